@@ -0,0 +1,253 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"pioneerwebworks.com/juniper/auth"
+	"pioneerwebworks.com/juniper/config"
+	"pioneerwebworks.com/juniper/models"
+)
+
+// runCommand handles the command line subcommands, e.g. `juniper config check`,
+// and returns the exit code.
+func runCommand(args []string) int {
+	switch {
+	case strings.Join(args, " ") == "config check":
+		return command_ConfigCheck()
+	case len(args) == 3 && args[0] == "users" && args[1] == "unlock":
+		return command_UsersUnlock(args[2])
+	case len(args) == 3 && args[0] == "users" && args[1] == "reset-2fa":
+		return command_UsersResetTwoFactor(args[2])
+	case strings.Join(args, " ") == "keys rotate":
+		return command_KeysRotate()
+	case len(args) >= 2 && args[0] == "clients" && args[1] == "add":
+		return command_ClientsAdd(args[2:])
+	case strings.Join(args, " ") == "clients list":
+		return command_ClientsList()
+	case len(args) == 3 && args[0] == "clients" && args[1] == "delete":
+		return command_ClientsDelete(args[2])
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\nCommands:\n"+
+			"  config check             validate the configuration and print the resolved settings\n"+
+			"  users unlock <username>     clear the failed logins and lockout of a user\n"+
+			"  users reset-2fa <username>  turn off two-factor authentication for a user who lost their authenticator\n"+
+			"  keys rotate                 start signing sessions with a new key, keeping the old ones for a grace period\n"+
+			"  clients add <name>          register an OAuth2 client for the API, see clients add -h for the options\n"+
+			"  clients list                list the OAuth2 clients\n"+
+			"  clients delete <client ID>  delete an OAuth2 client and its tokens\n",
+			strings.Join(args, " "))
+		return 2
+	}
+}
+
+func command_ConfigCheck() int {
+	cfg, err := config.Load()
+	var validationError *config.ValidationError
+	if err != nil && !errors.As(err, &validationError) {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	fmt.Printf("Profile: %s\n", cfg.Env)
+	if len(cfg.Sources) > 0 {
+		fmt.Printf("Loaded: %s\n", strings.Join(cfg.Sources, ", "))
+	}
+	fmt.Println()
+	for _, line := range cfg.Describe() {
+		fmt.Println("  " + line)
+	}
+	fmt.Println()
+
+	if validationError != nil {
+		fmt.Fprintln(os.Stderr, validationError)
+		return 1
+	}
+	fmt.Println("Configuration is valid.")
+	return 0
+}
+
+// command_UsersUnlock unlocks an account from the command line, for when the
+// only administrator is the one locked out.
+func command_UsersUnlock(username string) int {
+	userDB := models.ConnectToUserDB()
+	defer models.CloseUserDB()
+
+	user := userDB.FindByUsername(username)
+	if user.ID == 0 {
+		fmt.Fprintf(os.Stderr, "no user %q\n", username)
+		return 1
+	}
+	if _, err := userDB.Unlock(user.ID); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("Unlocked %s.\n", username)
+	return 0
+}
+
+// command_UsersResetTwoFactor turns off two-factor authentication for a
+// user who lost both their authenticator and their recovery codes. If their
+// role requires it, they set it up again on their next login.
+func command_UsersResetTwoFactor(username string) int {
+	userDB := models.ConnectToUserDB()
+	defer models.CloseUserDB()
+
+	user := userDB.FindByUsername(username)
+	if user.ID == 0 {
+		fmt.Fprintf(os.Stderr, "no user %q\n", username)
+		return 1
+	}
+	if err := userDB.DisableTOTP(&user); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("Turned off two-factor authentication for %s.\n", username)
+	return 0
+}
+
+// command_KeysRotate adds a new session key to the key file. Running
+// servers pick it up within a minute; cookies signed with the old key keep
+// working for SESSION_KEY_GRACE_PERIOD.
+func command_KeysRotate() int {
+	cfg, err := config.Load()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	keys := sessionKeyConfig(cfg)
+	now := time.Now()
+
+	if len(keys.Configured) > 0 {
+		key, err := auth.NewKey(now)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Printf("SESSION_KEYS is set, so the key file is not used. Put this key first in SESSION_KEYS\n"+
+			"and remove the old ones after %s:\n\n%s\n", keys.GracePeriod, key)
+		return 0
+	}
+
+	if _, err := os.Stat(keys.File); errors.Is(err, os.ErrNotExist) {
+		if _, err := auth.LoadOrCreateKeyRing(keys.File, now); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Printf("Created %s with a new session key.\n", keys.File)
+		return 0
+	}
+	ring, err := auth.LoadKeyRing(keys.File)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if _, err := ring.Rotate(now, keys.GracePeriod); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err := auth.SaveKeyRing(keys.File, ring); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("Rotated the session keys in %s. Old keys verify cookies until %s.\n",
+		keys.File, now.Add(keys.GracePeriod).Format(time.RFC1123))
+	return 0
+}
+
+// connectToOAuthDB opens the user database with the OAuth2 tables, which
+// the server may not have created yet.
+func connectToOAuthDB() (models.UserDB, error) {
+	userDB := models.ConnectToUserDB()
+	return userDB, userDB.DB.AutoMigrate(&models.OAuthClient{}, &models.OAuthCode{}, &models.OAuthToken{})
+}
+
+// command_ClientsAdd registers an OAuth2 client and prints its credentials.
+// The secret is only shown here, as just its hash is stored.
+func command_ClientsAdd(args []string) int {
+	flags := flag.NewFlagSet("clients add", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: juniper clients add [options] <name>")
+		flags.PrintDefaults()
+	}
+	var redirectURIs []string
+	flags.Func("redirect-uri", "where users are sent back to after allowing access, repeat for several", func(uri string) error {
+		redirectURIs = append(redirectURIs, uri)
+		return nil
+	})
+	scopes := flags.String("scopes", "", "comma-separated scopes the client may be granted, e.g. posts:read,posts:write")
+	public := flags.Bool("public", false, "for apps that cannot keep a secret, e.g. on phones, which then rely on PKCE alone")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 || *scopes == "" {
+		flags.Usage()
+		return 2
+	}
+
+	auth.OAuthScopes = oauthScopes()
+	userDB, err := connectToOAuthDB()
+	defer models.CloseUserDB()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	client, secret, err := auth.NewOAuthClient(userDB, flags.Arg(0), redirectURIs, strings.Split(*scopes, ","), *public)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("Registered %s.\n\nClient ID: %s\n", client.Name, client.ClientID)
+	if secret != "" {
+		fmt.Printf("Client secret: %s\n\nKeep the secret safe, it cannot be shown again.\n", secret)
+	}
+	return 0
+}
+
+func command_ClientsList() int {
+	userDB, err := connectToOAuthDB()
+	defer models.CloseUserDB()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	clients, err := userDB.OAuthClients()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	for _, client := range clients {
+		kind := "confidential"
+		if client.Public() {
+			kind = "public"
+		}
+		fmt.Printf("%s  %s (%s)\n  scopes: %s\n  redirect URIs: %s\n", client.ClientID, client.Name, kind, client.Scopes, client.RedirectURIs)
+	}
+	return 0
+}
+
+// command_ClientsDelete deletes an OAuth2 client. Its tokens stop working
+// at once.
+func command_ClientsDelete(clientID string) int {
+	userDB, err := connectToOAuthDB()
+	defer models.CloseUserDB()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	deleted, err := userDB.DeleteOAuthClient(clientID)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if !deleted {
+		fmt.Fprintf(os.Stderr, "no client %q\n", clientID)
+		return 1
+	}
+	fmt.Printf("Deleted client %s.\n", clientID)
+	return 0
+}
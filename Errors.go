@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+
+	"pioneerwebworks.com/juniper/apperr"
+	"pioneerwebworks.com/juniper/models"
+	"pioneerwebworks.com/juniper/requestid"
+	"pioneerwebworks.com/juniper/views/public"
+)
+
+// appHandler is a handler that can fail. Returned errors, usually an
+// *apperr.AppError, are rendered by renderError.
+type appHandler func(w http.ResponseWriter, r *http.Request) error
+
+func (h appHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := h(w, r); err != nil {
+		renderError(w, r, err)
+	}
+}
+
+// renderError writes err as the JSON error envelope for API callers and as
+// an error page for browsers.
+func renderError(w http.ResponseWriter, r *http.Request, err error) {
+	if apperr.IsAPIRequest(r) {
+		apperr.WriteJSON(w, r, err)
+		return
+	}
+
+	appErr := apperr.Report(r, err)
+	page := public.Page_Error(appErr.Status, appErr.Message, requestid.FromContext(r.Context()))
+	title := http.StatusText(appErr.Status) + " - Juniper"
+	if appErr.Status == http.StatusNotFound {
+		page = public.Page_404()
+		title = "Page not found - Juniper"
+	}
+
+	// Looking up the user may be what failed.
+	user := models.User{}
+	if appErr.Status < 500 {
+		user = getSessionUser(r)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(appErr.Status)
+	public.App(
+		page,
+		public.Header(user),
+		public.Footer(),
+		public.Head(privatePageMeta(r, title)),
+	).Render(r.Context(), w)
+}
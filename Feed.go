@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"pioneerwebworks.com/juniper/models"
+)
+
+const feedItemLimit = 50
+
+type FeedHandler struct {
+	Context context.Context
+}
+
+// A feed is the format independent view of a list of posts.
+type feed struct {
+	Title       string
+	Description string
+	HomeURL     string
+	FeedURL     string
+	Updated     time.Time
+	Posts       []models.Post
+}
+
+func siteURL() string {
+	return strings.TrimRight(APP_CONFIG.SiteURL, "/")
+}
+
+func postURL(post models.Post) string {
+	return siteURL() + "/blog/" + strconv.Itoa(int(post.ID))
+}
+
+func postUpdated(post models.Post) time.Time {
+	if post.UpdatedAt.After(post.PublishedAt) {
+		return post.UpdatedAt
+	}
+	return post.PublishedAt
+}
+
+func (fh *FeedHandler) loadFeed(r *http.Request) (feed, error) {
+	filter := models.PostFilter{
+		Tag:      r.PathValue("tag"),
+		Category: r.PathValue("category"),
+		Limit:    feedItemLimit,
+	}
+	posts, err := models.ListPublishedPosts(APP_DATA.PostHandler.DB(), filter)
+	if err != nil {
+		return feed{}, err
+	}
+
+	title := "Juniper"
+	switch {
+	case filter.Tag != "":
+		title += " - Tag: " + filter.Tag
+	case filter.Category != "":
+		title += " - Category: " + filter.Category
+	}
+
+	f := feed{
+		Title:       title,
+		Description: title + " blog",
+		HomeURL:     siteURL() + "/blog",
+		FeedURL:     siteURL() + r.URL.Path,
+		Posts:       posts,
+	}
+	for _, post := range posts {
+		if updated := postUpdated(post); updated.After(f.Updated) {
+			f.Updated = updated
+		}
+	}
+	return f, nil
+}
+
+// serveFeed writes the rendered feed, answering conditional requests with
+// 304 Not Modified based on the ETag and Last-Modified headers.
+func serveFeed(w http.ResponseWriter, r *http.Request, contentType string, updated time.Time, body []byte) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("ETag", fmt.Sprintf(`"%x"`, sha256.Sum256(body)))
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	http.ServeContent(w, r, "", updated, bytes.NewReader(body))
+}
+
+func (fh *FeedHandler) feed_RSS(w http.ResponseWriter, r *http.Request) {
+	f, err := fh.loadFeed(r)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	body, err := renderRSS(f)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	serveFeed(w, r, "application/rss+xml; charset=utf-8", f.Updated, body)
+}
+
+func (fh *FeedHandler) feed_Atom(w http.ResponseWriter, r *http.Request) {
+	f, err := fh.loadFeed(r)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	body, err := renderAtom(f)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	serveFeed(w, r, "application/atom+xml; charset=utf-8", f.Updated, body)
+}
+
+func (fh *FeedHandler) feed_JSON(w http.ResponseWriter, r *http.Request) {
+	f, err := fh.loadFeed(r)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	body, err := renderJSONFeed(f)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	serveFeed(w, r, "application/feed+json; charset=utf-8", f.Updated, body)
+}
+
+// RSS 2.0
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	AtomNS  string     `xml:"xmlns:atom,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string      `xml:"title"`
+	Link          string      `xml:"link"`
+	Description   string      `xml:"description"`
+	LastBuildDate string      `xml:"lastBuildDate,omitempty"`
+	AtomLink      rssAtomLink `xml:"atom:link"`
+	Items         []rssItem   `xml:"item"`
+}
+
+type rssAtomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr"`
+	Type string `xml:"type,attr"`
+}
+
+type rssItem struct {
+	Title       string   `xml:"title"`
+	Link        string   `xml:"link"`
+	Description string   `xml:"description"`
+	GUID        rssGUID  `xml:"guid"`
+	PubDate     string   `xml:"pubDate"`
+	Categories  []string `xml:"category"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+func renderRSS(f feed) ([]byte, error) {
+	channel := rssChannel{
+		Title:       f.Title,
+		Link:        f.HomeURL,
+		Description: f.Description,
+		AtomLink: rssAtomLink{
+			Href: f.FeedURL,
+			Rel:  "self",
+			Type: "application/rss+xml",
+		},
+	}
+	if !f.Updated.IsZero() {
+		channel.LastBuildDate = f.Updated.UTC().Format(time.RFC1123Z)
+	}
+	for _, post := range f.Posts {
+		categories := post.TagList()
+		if post.Category != "" {
+			categories = append([]string{post.Category}, categories...)
+		}
+		channel.Items = append(channel.Items, rssItem{
+			Title:       post.Title,
+			Link:        postURL(post),
+			Description: post.Content,
+			GUID:        rssGUID{IsPermaLink: true, Value: postURL(post)},
+			PubDate:     post.PublishedAt.UTC().Format(time.RFC1123Z),
+			Categories:  categories,
+		})
+	}
+
+	out, err := xml.MarshalIndent(rssFeed{
+		Version: "2.0",
+		AtomNS:  "http://www.w3.org/2005/Atom",
+		Channel: channel,
+	}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), out...), nil
+}
+
+// Atom
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Author  atomPerson  `xml:"author"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type atomText struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+type atomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+type atomEntry struct {
+	Title      string         `xml:"title"`
+	ID         string         `xml:"id"`
+	Updated    string         `xml:"updated"`
+	Published  string         `xml:"published"`
+	Links      []atomLink     `xml:"link"`
+	Content    atomText       `xml:"content"`
+	Categories []atomCategory `xml:"category"`
+}
+
+func renderAtom(f feed) ([]byte, error) {
+	updated := f.Updated
+	if updated.IsZero() {
+		updated = time.Unix(0, 0)
+	}
+	out := atomFeed{
+		Title:   f.Title,
+		ID:      f.FeedURL,
+		Updated: updated.UTC().Format(time.RFC3339),
+		Author:  atomPerson{Name: "Juniper"},
+		Links: []atomLink{
+			{Href: f.FeedURL, Rel: "self", Type: "application/atom+xml"},
+			{Href: f.HomeURL, Rel: "alternate", Type: "text/html"},
+		},
+	}
+	for _, post := range f.Posts {
+		entry := atomEntry{
+			Title:     post.Title,
+			ID:        postURL(post),
+			Updated:   postUpdated(post).UTC().Format(time.RFC3339),
+			Published: post.PublishedAt.UTC().Format(time.RFC3339),
+			Links:     []atomLink{{Href: postURL(post), Rel: "alternate", Type: "text/html"}},
+			Content:   atomText{Type: "text", Value: post.Content},
+		}
+		if post.Category != "" {
+			entry.Categories = append(entry.Categories, atomCategory{Term: post.Category})
+		}
+		for _, tag := range post.TagList() {
+			entry.Categories = append(entry.Categories, atomCategory{Term: tag})
+		}
+		out.Entries = append(out.Entries, entry)
+	}
+
+	body, err := xml.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), body...), nil
+}
+
+// JSON Feed 1.1
+
+type jsonFeed struct {
+	Version     string         `json:"version"`
+	Title       string         `json:"title"`
+	HomePageURL string         `json:"home_page_url"`
+	FeedURL     string         `json:"feed_url"`
+	Description string         `json:"description,omitempty"`
+	Items       []jsonFeedItem `json:"items"`
+}
+
+type jsonFeedItem struct {
+	ID            string   `json:"id"`
+	URL           string   `json:"url"`
+	Title         string   `json:"title"`
+	ContentText   string   `json:"content_text"`
+	DatePublished string   `json:"date_published"`
+	DateModified  string   `json:"date_modified,omitempty"`
+	Tags          []string `json:"tags,omitempty"`
+}
+
+func renderJSONFeed(f feed) ([]byte, error) {
+	out := jsonFeed{
+		Version:     "https://jsonfeed.org/version/1.1",
+		Title:       f.Title,
+		HomePageURL: f.HomeURL,
+		FeedURL:     f.FeedURL,
+		Description: f.Description,
+		Items:       []jsonFeedItem{},
+	}
+	for _, post := range f.Posts {
+		out.Items = append(out.Items, jsonFeedItem{
+			ID:            postURL(post),
+			URL:           postURL(post),
+			Title:         post.Title,
+			ContentText:   post.Content,
+			DatePublished: post.PublishedAt.UTC().Format(time.RFC3339),
+			DateModified:  postUpdated(post).UTC().Format(time.RFC3339),
+			Tags:          post.TagList(),
+		})
+	}
+	return json.MarshalIndent(out, "", "  ")
+}
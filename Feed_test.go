@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"pioneerwebworks.com/juniper/config"
+	"pioneerwebworks.com/juniper/models"
+)
+
+func testFeed(t *testing.T) feed {
+	saved := APP_CONFIG
+	APP_CONFIG = &config.Config{SiteURL: "https://example.com/"}
+	t.Cleanup(func() { APP_CONFIG = saved })
+
+	published := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	return feed{
+		Title:       "Juniper",
+		Description: "Juniper blog",
+		HomeURL:     siteURL() + "/blog",
+		FeedURL:     siteURL() + "/blog/feed.xml",
+		Updated:     published.Add(time.Hour),
+		Posts: []models.Post{{
+			ID:          7,
+			Title:       "Fish & Chips",
+			Content:     "Crispy <b>and</b> hot",
+			Published:   true,
+			PublishedAt: published,
+			UpdatedAt:   published.Add(time.Hour),
+			Category:    "Food",
+			Tags:        "fish, chips",
+		}},
+	}
+}
+
+func Test_RenderFeeds(t *testing.T) {
+	f := testFeed(t)
+
+	tests := []struct {
+		name   string
+		render func(feed) ([]byte, error)
+		valid  func([]byte) error
+		want   []string
+	}{
+		{
+			name:   "RSS",
+			render: renderRSS,
+			valid:  func(body []byte) error { return xml.Unmarshal(body, &rssFeed{}) },
+			want: []string{
+				`<rss version="2.0" xmlns:atom="http://www.w3.org/2005/Atom">`,
+				`<atom:link href="https://example.com/blog/feed.xml" rel="self" type="application/rss+xml"></atom:link>`,
+				`<title>Fish &amp; Chips</title>`,
+				`<guid isPermaLink="true">https://example.com/blog/7</guid>`,
+				`<pubDate>Wed, 01 May 2024 12:00:00 +0000</pubDate>`,
+				`<lastBuildDate>Wed, 01 May 2024 13:00:00 +0000</lastBuildDate>`,
+				`<category>Food</category>`,
+				`<category>chips</category>`,
+				`Crispy &lt;b&gt;and&lt;/b&gt; hot`,
+			},
+		},
+		{
+			name:   "Atom",
+			render: renderAtom,
+			valid:  func(body []byte) error { return xml.Unmarshal(body, &atomFeed{}) },
+			want: []string{
+				`<feed xmlns="http://www.w3.org/2005/Atom">`,
+				`<id>https://example.com/blog/feed.xml</id>`,
+				`<updated>2024-05-01T13:00:00Z</updated>`,
+				`<published>2024-05-01T12:00:00Z</published>`,
+				`<link href="https://example.com/blog/7" rel="alternate" type="text/html"></link>`,
+				`<category term="Food"></category>`,
+				`<category term="fish"></category>`,
+			},
+		},
+		{
+			name:   "JSON Feed",
+			render: renderJSONFeed,
+			valid:  func(body []byte) error { return json.Unmarshal(body, &jsonFeed{}) },
+			want: []string{
+				`"version": "https://jsonfeed.org/version/1.1"`,
+				`"feed_url": "https://example.com/blog/feed.xml"`,
+				`"id": "https://example.com/blog/7"`,
+				`"title": "Fish \u0026 Chips"`,
+				`"date_published": "2024-05-01T12:00:00Z"`,
+				`"date_modified": "2024-05-01T13:00:00Z"`,
+				`"fish",`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, err := tt.render(f)
+			if err != nil {
+				t.Fatalf("Failed to render: %v", err)
+			}
+			if err := tt.valid(body); err != nil {
+				t.Fatalf("Failed to parse the rendered feed: %v\n%s", err, body)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(string(body), want) {
+					t.Errorf("Expected %s in:\n%s", want, body)
+				}
+			}
+		})
+	}
+}
+
+func Test_RenderEmptyFeeds(t *testing.T) {
+	f := testFeed(t)
+	f.Posts, f.Updated = nil, time.Time{}
+
+	if body, _ := renderRSS(f); strings.Contains(string(body), "lastBuildDate") {
+		t.Errorf("Expected no lastBuildDate without posts:\n%s", body)
+	}
+	if body, _ := renderAtom(f); !strings.Contains(string(body), "<updated>1970-01-01T00:00:00Z</updated>") {
+		t.Errorf("Expected the epoch as the updated date without posts:\n%s", body)
+	}
+	if body, _ := renderJSONFeed(f); !strings.Contains(string(body), `"items": []`) {
+		t.Errorf("Expected an empty items list:\n%s", body)
+	}
+}
+
+func Test_ServeFeed(t *testing.T) {
+	updated := time.Date(2024, 5, 1, 13, 0, 0, 0, time.UTC)
+	body := []byte("<rss></rss>")
+	serve := func(headers map[string]string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/blog/feed.xml", nil)
+		for key, value := range headers {
+			r.Header.Set(key, value)
+		}
+		w := httptest.NewRecorder()
+		serveFeed(w, r, "application/rss+xml; charset=utf-8", updated, body)
+		return w
+	}
+
+	first := serve(nil)
+	etag := first.Header().Get("ETag")
+	if first.Code != http.StatusOK || first.Body.String() != string(body) || etag == "" {
+		t.Fatalf("Expected the feed with an ETag, got %d %q: %s", first.Code, etag, first.Body.String())
+	}
+	if got := first.Header().Get("Last-Modified"); got != "Wed, 01 May 2024 13:00:00 GMT" {
+		t.Errorf("Unexpected Last-Modified %q", got)
+	}
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		status  int
+	}{
+		{"matching ETag", map[string]string{"If-None-Match": etag}, http.StatusNotModified},
+		{"other ETag", map[string]string{"If-None-Match": `"other"`}, http.StatusOK},
+		{"not modified since", map[string]string{"If-Modified-Since": "Wed, 01 May 2024 13:00:00 GMT"}, http.StatusNotModified},
+		{"modified since", map[string]string{"If-Modified-Since": "Wed, 01 May 2024 12:00:00 GMT"}, http.StatusOK},
+		{"ETag wins over the date", map[string]string{"If-None-Match": `"other"`, "If-Modified-Since": "Wed, 01 May 2024 13:00:00 GMT"}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(tt.headers)
+			if w.Code != tt.status {
+				t.Errorf("Expected %d, got %d", tt.status, w.Code)
+			}
+			if tt.status == http.StatusNotModified && w.Body.Len() != 0 {
+				t.Errorf("Expected no body with 304, got %q", w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// Lifecycle owns the application context. Background jobs started with Go
+// run until Shutdown cancels it, after which the registered closers release
+// resources such as database handles.
+type Lifecycle struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	jobs    sync.WaitGroup
+	mu      sync.Mutex
+	closers []func() error
+}
+
+func NewLifecycle(parent context.Context) *Lifecycle {
+	ctx, cancel := context.WithCancel(parent)
+	return &Lifecycle{ctx: ctx, cancel: cancel}
+}
+
+func (l *Lifecycle) Context() context.Context {
+	return l.ctx
+}
+
+// Go runs job in the background. The job must return once ctx is done.
+func (l *Lifecycle) Go(job func(ctx context.Context)) {
+	l.jobs.Add(1)
+	go func() {
+		defer l.jobs.Done()
+		job(l.ctx)
+	}()
+}
+
+// OnClose registers fn to run during Shutdown. Closers run in reverse order
+// of registration, like defers.
+func (l *Lifecycle) OnClose(fn func() error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closers = append(l.closers, fn)
+}
+
+// Shutdown cancels the context, waits for background jobs and runs the
+// closers, returning all of their errors.
+func (l *Lifecycle) Shutdown() error {
+	l.cancel()
+	l.jobs.Wait()
+
+	l.mu.Lock()
+	closers := l.closers
+	l.closers = nil
+	l.mu.Unlock()
+
+	var errs []error
+	for i := len(closers) - 1; i >= 0; i-- {
+		errs = append(errs, closers[i]())
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"pioneerwebworks.com/juniper/apperr"
+	"pioneerwebworks.com/juniper/logging"
+	"pioneerwebworks.com/juniper/metrics"
+)
+
+// Middleware wraps a handler, e.g. to authenticate or log requests.
+// auth.WithAuth and auth.WithCSRF have this shape.
+type Middleware func(http.Handler) http.Handler
+
+// chain wraps handler so that the first middleware runs first.
+func chain(handler http.Handler, middleware []Middleware) http.Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	return handler
+}
+
+// RouteGroup is a set of routes under a common path prefix that share
+// middleware. Routes are registered with their full pattern, e.g.
+// "POST /api/auth/login" in the "/api" group.
+type RouteGroup struct {
+	Prefix string
+	// Mux holds the group's routes. Packages that register their own routes,
+	// like models.ModelHandler, can be given the Mux directly.
+	Mux        *http.ServeMux
+	middleware []Middleware
+}
+
+// Use adds middleware to every route of the group, including routes that
+// were registered before.
+func (group *RouteGroup) Use(middleware ...Middleware) {
+	group.middleware = append(group.middleware, middleware...)
+}
+
+// Handle registers handler with middleware that only applies to this route.
+func (group *RouteGroup) Handle(pattern string, handler http.Handler, middleware ...Middleware) {
+	if !strings.HasPrefix(patternPath(pattern), group.Prefix) {
+		panic("route " + pattern + " is outside of the " + group.Prefix + " group")
+	}
+	group.Mux.Handle(pattern, chain(handler, middleware))
+}
+
+func (group *RouteGroup) HandleFunc(pattern string, handler http.HandlerFunc, middleware ...Middleware) {
+	group.Handle(pattern, handler, middleware...)
+}
+
+func (group *RouteGroup) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	chain(group.Mux, group.middleware).ServeHTTP(w, r)
+}
+
+// patternPath strips the method from a ServeMux pattern.
+func patternPath(pattern string) string {
+	if _, path, found := strings.Cut(pattern, " "); found {
+		return strings.TrimLeft(path, " ")
+	}
+	return pattern
+}
+
+// accessLog logs every request once it has been served and records it in
+// the request metrics. The user ID is filled in by the auth code through
+// logging.SetUserID.
+func (router *Router) accessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ctx := logging.NewRequestContext(r.Context())
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r.WithContext(ctx))
+
+		status := sw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		latency := time.Since(start)
+		route := router.routePattern(r)
+		metrics.ObserveRequest(r.Method, route, status, latency)
+
+		level := slog.LevelInfo
+		if status >= 500 {
+			level = slog.LevelError
+		}
+		slog.LogAttrs(ctx, level, "request",
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.String("route", route),
+			slog.Int("status", status),
+			slog.Int64("bytes", sw.bytes),
+			slog.Duration("latency", latency),
+			slog.String("remote_addr", r.RemoteAddr),
+		)
+	})
+}
+
+// statusWriter records the status and size of the response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	if sw.status == 0 {
+		sw.status = status
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	n, err := sw.ResponseWriter.Write(b)
+	sw.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// recoverPanics turns a panicking handler into a 500 response and logs the
+// stack with the request ID.
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw := &statusWriter{ResponseWriter: w}
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			if recovered == http.ErrAbortHandler {
+				panic(recovered)
+			}
+			slog.ErrorContext(r.Context(), "panic serving request",
+				"method", r.Method,
+				"path", r.URL.Path,
+				"panic", fmt.Sprint(recovered),
+				"stack", string(debug.Stack()),
+			)
+			// Too late for an error page once the response has started.
+			if sw.status == 0 {
+				renderError(sw, r, apperr.New(http.StatusInternalServerError, "Internal Server Error"))
+			}
+		}()
+		next.ServeHTTP(sw, r)
+	})
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/url"
+	"time"
+
+	"pioneerwebworks.com/juniper/apperr"
+	"pioneerwebworks.com/juniper/auth"
+	"pioneerwebworks.com/juniper/models"
+	"pioneerwebworks.com/juniper/views/partials"
+	"pioneerwebworks.com/juniper/views/public"
+)
+
+// oauthScopes are the scopes of the model APIs, e.g. posts:read, which
+// clients are granted to call them with access tokens.
+func oauthScopes() map[string]string {
+	scopes := models.Scopes[models.User]()
+	maps.Copy(scopes, models.Scopes[models.Post]())
+	return scopes
+}
+
+// oauthRedirectError sends err back to the client of req, or shows it to the
+// user when the client or its redirect URI cannot be trusted.
+func oauthRedirectError(w http.ResponseWriter, r *http.Request, req auth.AuthorizationRequest, err error) error {
+	var oauthErr *auth.OAuthError
+	if !errors.As(err, &oauthErr) {
+		return apperr.Internal(err)
+	}
+	if req.RedirectURI == "" {
+		return apperr.BadRequest(oauthErr.Description).Wrap(err)
+	}
+	http.Redirect(w, r, req.RedirectWith(url.Values{
+		"error":             {oauthErr.Code},
+		"error_description": {oauthErr.Description},
+	}), http.StatusSeeOther)
+	return nil
+}
+
+// writeOAuth answers a call to the token, introspection or revocation
+// endpoint with v, or the error in the format of RFC 6749.
+func writeOAuth(w http.ResponseWriter, r *http.Request, v any, err error) error {
+	w.Header().Set("Cache-Control", "no-store")
+	var oauthErr *auth.OAuthError
+	switch {
+	case errors.As(err, &oauthErr):
+		slog.InfoContext(r.Context(), "oauth request refused", "path", r.URL.Path, "error", err)
+		if _, _, basic := r.BasicAuth(); basic && oauthErr.Status() == http.StatusUnauthorized {
+			w.Header().Set("WWW-Authenticate", `Basic realm="juniper"`)
+		}
+		writeJSON(w, oauthErr.Status(), oauthErr)
+	case err != nil:
+		apperr.WriteJSON(w, r, apperr.Internal(err))
+	case v == nil:
+		w.WriteHeader(http.StatusOK)
+	default:
+		writeJSON(w, http.StatusOK, v)
+	}
+	return nil
+}
+
+// oauth_authorize asks the logged in user whether to let a client call the
+// API for them.
+func (router *Router) oauth_authorize(w http.ResponseWriter, r *http.Request) error {
+	userDB := models.ConnectToUserDB().WithContext(r.Context())
+	user, err := userDB.GetUser(auth.UserIDFromContext(r.Context()))
+	if err != nil {
+		return apperr.Unauthorized("Unauthorized").Wrap(err)
+	}
+	req, err := auth.ParseAuthorizationRequest(userDB, r.URL.Query(), user)
+	if err != nil {
+		return oauthRedirectError(w, r, req, err)
+	}
+	csrf, err := auth.CSRFToken(w, r)
+	if err != nil {
+		return apperr.Internal(err)
+	}
+
+	public.App(
+		partials.Consent(req.Client.Name, req.Scopes, req.RedirectURI, r.URL.Query(), csrf),
+		public.Header(user),
+		public.Footer(),
+		public.Head(privatePageMeta(r, "Allow "+req.Client.Name+" - Juniper")),
+	).Render(router.Context, w)
+	return nil
+}
+
+// oauth_consent sends the user back to the client with an authorization
+// code, or with access_denied if they did not allow it.
+func (router *Router) oauth_consent(w http.ResponseWriter, r *http.Request) error {
+	userDB := models.ConnectToUserDB().WithContext(r.Context())
+	user, err := userDB.GetUser(auth.UserIDFromContext(r.Context()))
+	if err != nil {
+		return apperr.Unauthorized("Unauthorized").Wrap(err)
+	}
+	if err := r.ParseForm(); err != nil {
+		return apperr.BadRequest("Error parsing form").Wrap(err)
+	}
+	req, err := auth.ParseAuthorizationRequest(userDB, r.PostForm, user)
+	if err != nil {
+		return oauthRedirectError(w, r, req, err)
+	}
+	if r.PostForm.Get("consent") != "approve" {
+		slog.InfoContext(r.Context(), "oauth consent denied", "user_id", user.ID, "client_id", req.Client.ClientID)
+		return oauthRedirectError(w, r, req, &auth.OAuthError{Code: "access_denied", Description: "The user did not allow access"})
+	}
+
+	code, err := auth.IssueCode(userDB, req, user.ID, time.Now())
+	if err != nil {
+		return apperr.Internal(err)
+	}
+	slog.InfoContext(r.Context(), "oauth consent given", "user_id", user.ID, "client_id", req.Client.ClientID, "scopes", req.Scopes)
+	http.Redirect(w, r, req.RedirectWith(url.Values{"code": {code}}), http.StatusSeeOther)
+	return nil
+}
+
+// oauth_token issues tokens for an authorization code, a refresh token or
+// the client's own credentials.
+func (router *Router) oauth_token(w http.ResponseWriter, r *http.Request) error {
+	userDB := models.ConnectToUserDB().WithContext(r.Context())
+	client, err := auth.AuthenticateClient(userDB, r)
+	if err != nil {
+		return writeOAuth(w, r, nil, err)
+	}
+
+	now := time.Now()
+	var tokens auth.TokenResponse
+	switch grantType := r.PostFormValue("grant_type"); grantType {
+	case "authorization_code":
+		tokens, err = auth.ExchangeCode(userDB, client, r.PostFormValue("code"), r.PostFormValue("redirect_uri"), r.PostFormValue("code_verifier"), now)
+	case "refresh_token":
+		tokens, err = auth.RefreshTokens(userDB, client, r.PostFormValue("refresh_token"), r.PostFormValue("scope"), now)
+	case "client_credentials":
+		tokens, err = auth.ClientCredentials(userDB, client, r.PostFormValue("scope"), now)
+	default:
+		err = &auth.OAuthError{Code: "unsupported_grant_type", Description: "Unsupported grant type " + grantType}
+	}
+	if err != nil {
+		return writeOAuth(w, r, nil, err)
+	}
+	slog.InfoContext(r.Context(), "oauth tokens issued", "client_id", client.ClientID, "grant_type", r.PostFormValue("grant_type"), "scope", tokens.Scope)
+	return writeOAuth(w, r, tokens, nil)
+}
+
+// oauth_introspect tells a confidential client whether a token is active,
+// and what it grants.
+func (router *Router) oauth_introspect(w http.ResponseWriter, r *http.Request) error {
+	userDB := models.ConnectToUserDB().WithContext(r.Context())
+	client, err := auth.AuthenticateClient(userDB, r)
+	if err == nil && client.Public() {
+		err = &auth.OAuthError{Code: "invalid_client", Description: "Public clients cannot introspect tokens"}
+	}
+	if err != nil {
+		return writeOAuth(w, r, nil, err)
+	}
+	return writeOAuth(w, r, auth.Introspect(userDB, r.PostFormValue("token"), time.Now()), nil)
+}
+
+// oauth_revoke revokes a token of the calling client, e.g. when its user
+// logs out of it.
+func (router *Router) oauth_revoke(w http.ResponseWriter, r *http.Request) error {
+	userDB := models.ConnectToUserDB().WithContext(r.Context())
+	client, err := auth.AuthenticateClient(userDB, r)
+	if err != nil {
+		return writeOAuth(w, r, nil, err)
+	}
+	if err := auth.RevokeToken(userDB, client, r.PostFormValue("token"), time.Now()); err != nil {
+		return writeOAuth(w, r, nil, err)
+	}
+	slog.InfoContext(r.Context(), "oauth token revoked", "client_id", client.ClientID)
+	return writeOAuth(w, r, nil, nil)
+}
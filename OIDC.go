@@ -0,0 +1,242 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"pioneerwebworks.com/juniper/apperr"
+	"pioneerwebworks.com/juniper/auth"
+	"pioneerwebworks.com/juniper/config"
+	"pioneerwebworks.com/juniper/logging"
+	"pioneerwebworks.com/juniper/metrics"
+	"pioneerwebworks.com/juniper/models"
+	"pioneerwebworks.com/juniper/views/dashboard"
+	"pioneerwebworks.com/juniper/views/public"
+)
+
+// oidcProviders lists the sign-in providers cfg sets a client for. Their
+// callbacks are /auth/<name>/callback on SITE_URL.
+func oidcProviders(cfg *config.Config) []*auth.OIDCProvider {
+	callback := func(name string) string {
+		return publicURL(cfg).String() + "/auth/" + name + "/callback"
+	}
+	providers := []*auth.OIDCProvider{}
+	if cfg.OIDC.Google.ClientID != "" {
+		providers = append(providers, auth.NewOIDCProvider(auth.OIDCConfig{
+			Name:         "google",
+			DisplayName:  "Google",
+			Issuer:       "https://accounts.google.com",
+			ClientID:     cfg.OIDC.Google.ClientID,
+			ClientSecret: cfg.OIDC.Google.ClientSecret,
+			RedirectURL:  callback("google"),
+		}))
+	}
+	if cfg.OIDC.GitHub.ClientID != "" {
+		providers = append(providers, auth.NewGitHubProvider(auth.OIDCConfig{
+			Name:         "github",
+			DisplayName:  "GitHub",
+			ClientID:     cfg.OIDC.GitHub.ClientID,
+			ClientSecret: cfg.OIDC.GitHub.ClientSecret,
+			RedirectURL:  callback("github"),
+		}))
+	}
+	if cfg.OIDC.Issuer != "" {
+		providers = append(providers, auth.NewOIDCProvider(auth.OIDCConfig{
+			Name:         cfg.OIDC.Name,
+			DisplayName:  cfg.OIDC.DisplayName,
+			Issuer:       cfg.OIDC.Issuer,
+			ClientID:     cfg.OIDC.ClientID,
+			ClientSecret: cfg.OIDC.ClientSecret,
+			RedirectURL:  callback(cfg.OIDC.Name),
+			Scopes:       cfg.OIDC.Scopes,
+		}))
+	}
+	return providers
+}
+
+// oidcError turns a failed sign in into a 401 or 409 and anything else
+// into a 500.
+func oidcError(err error, provider *auth.OIDCProvider) error {
+	switch {
+	case errors.Is(err, auth.ErrOIDCRejected):
+		return apperr.Unauthorized("Sign-in with " + provider.DisplayName + " not accepted").Wrap(err)
+	case errors.Is(err, auth.ErrOIDCAccountExists):
+		return apperr.Conflict("An account with this email already exists. Log in to it and connect " + provider.DisplayName + " from the dashboard.").Wrap(err)
+	case errors.Is(err, auth.ErrOIDCIdentityTaken):
+		return apperr.Conflict("This " + provider.DisplayName + " account is connected to another user").Wrap(err)
+	}
+	return apperr.Internal(err)
+}
+
+// auth_oidc_begin sends the browser to the provider to sign in.
+func (router *Router) auth_oidc_begin(w http.ResponseWriter, r *http.Request) error {
+	provider, ok := auth.FindOIDCProvider(r.PathValue("provider"))
+	if !ok {
+		return apperr.NotFound("Sign-in provider not found")
+	}
+	target, err := auth.BeginOIDCLogin(w, r, provider, false)
+	if err != nil {
+		return apperr.New(http.StatusBadGateway, provider.DisplayName+" is not available, try again later").Wrap(err)
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+	return nil
+}
+
+// auth_oidc_callback is where the provider sends the browser back. It logs
+// in the user the identity is linked to, creating an account on the first
+// sign in, or links the identity to the logged in user if they asked to.
+func (router *Router) auth_oidc_callback(w http.ResponseWriter, r *http.Request) error {
+	provider, ok := auth.FindOIDCProvider(r.PathValue("provider"))
+	if !ok {
+		return apperr.NotFound("Sign-in provider not found")
+	}
+	identity, link, err := auth.FinishOIDCLogin(w, r, provider)
+	if err != nil {
+		slog.InfoContext(r.Context(), "oidc sign-in failed", "provider", provider.Name, "error", err)
+		return oidcError(err, provider)
+	}
+	userDB := models.ConnectToUserDB().WithContext(r.Context())
+	now := time.Now()
+
+	if link {
+		user := getSessionUser(r)
+		if user.ID == 0 {
+			return apperr.Unauthorized("Log in again to connect " + provider.DisplayName)
+		}
+		if err := auth.LinkOIDCIdentity(userDB, user.ID, identity, now); err != nil {
+			return oidcError(err, provider)
+		}
+		slog.InfoContext(r.Context(), "identity linked", "user_id", user.ID, "provider", provider.Name)
+		http.Redirect(w, r, "/dashboard/identities", http.StatusSeeOther)
+		return nil
+	}
+
+	user, created, err := auth.OIDCUser(userDB, identity, APP_CONFIG.OIDC.DefaultRole, now)
+	if err != nil {
+		metrics.ObserveLogin(false)
+		slog.InfoContext(r.Context(), "oidc sign-in failed", "provider", provider.Name, "error", err)
+		return oidcError(err, provider)
+	}
+	if created {
+		slog.InfoContext(r.Context(), "account created", "user_id", user.ID, "provider", provider.Name)
+	}
+	// The provider cannot vouch for the second factor
+	if user.TOTPEnabled {
+		metrics.ObserveLogin(false)
+		return apperr.Forbidden("This account uses two-factor authentication, log in with your password or a passkey")
+	}
+	if err := lockedOut(w, user, now); err != nil {
+		return err
+	}
+	metrics.ObserveLogin(true)
+
+	session, _ := auth.Store.Get(r, "juniper-session")
+	if err := auth.Store.Renew(r, session); err != nil {
+		return apperr.Internal(err)
+	}
+	session.Values["userID"] = user.ID
+	session.Values["authenticated"] = true
+	auth.MarkVerified(session, now)
+	if err := session.Save(r, w); err != nil {
+		return apperr.Internal(err)
+	}
+	logging.SetUserID(r.Context(), user.ID)
+
+	user.LastLoginAt = now
+	user.FailedLogins = 0
+	userDB.UpdateUser(user)
+
+	http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
+	return nil
+}
+
+// api_auth_identities lists the sign-in providers the logged in user has
+// connected.
+func (router *Router) api_auth_identities(w http.ResponseWriter, r *http.Request) error {
+	userDB := models.ConnectToUserDB().WithContext(r.Context())
+	identities, err := userDB.Identities(auth.UserIDFromContext(r.Context()))
+	if err != nil {
+		return apperr.Internal(err)
+	}
+	writeJSON(w, http.StatusOK, identities)
+	return nil
+}
+
+// api_auth_identity_link starts connecting a provider to the logged in
+// user. It returns the URL of the provider, as a fetch cannot follow the
+// redirect.
+func (router *Router) api_auth_identity_link(w http.ResponseWriter, r *http.Request) error {
+	provider, ok := auth.FindOIDCProvider(r.PathValue("provider"))
+	if !ok {
+		return apperr.NotFound("Sign-in provider not found")
+	}
+	target, err := auth.BeginOIDCLogin(w, r, provider, true)
+	if err != nil {
+		return apperr.New(http.StatusBadGateway, provider.DisplayName+" is not available, try again later").Wrap(err)
+	}
+	writeJSON(w, http.StatusOK, identityLinkResponse{URL: target})
+	return nil
+}
+
+// api_auth_identity_delete disconnects a provider from the logged in user,
+// unless it is the only way left to log in.
+func (router *Router) api_auth_identity_delete(w http.ResponseWriter, r *http.Request) error {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		return apperr.NotFound("Identity not found")
+	}
+	userDB := models.ConnectToUserDB().WithContext(r.Context())
+	user, err := userDB.GetUser(auth.UserIDFromContext(r.Context()))
+	if err != nil {
+		return apperr.Unauthorized("Unauthorized").Wrap(err)
+	}
+	identities, err := userDB.Identities(user.ID)
+	if err != nil {
+		return apperr.Internal(err)
+	}
+	if !slices.ContainsFunc(identities, func(i models.Identity) bool { return i.ID == uint(id) }) {
+		return apperr.NotFound("Identity not found")
+	}
+	passkeys, err := userDB.Passkeys(user.ID)
+	if err != nil {
+		return apperr.Internal(err)
+	}
+	if user.Password == "" && len(passkeys) == 0 && len(identities) == 1 {
+		return apperr.Conflict("Add a passkey first, this is the only way to log in to your account")
+	}
+	if _, err := userDB.DeleteIdentity(user.ID, uint(id)); err != nil {
+		return apperr.Internal(err)
+	}
+	slog.InfoContext(r.Context(), "identity unlinked", "user_id", user.ID, "identity_id", id)
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("{\"message\": \"Deleted\"}"))
+	return nil
+}
+
+// dashboard_Identities lists the sign-in providers of the logged in user,
+// with buttons to connect and disconnect them.
+func (dh *DashboardHandler) dashboard_Identities(w http.ResponseWriter, r *http.Request) {
+	userDB := models.ConnectToUserDB().WithContext(r.Context())
+	identities, err := userDB.Identities(auth.UserIDFromContext(r.Context()))
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
+	csrf, err := auth.CSRFToken(w, r)
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
+
+	public.App(
+		dashboard.Identities(identities, auth.OIDCProviders, csrf),
+		public.Header(getSessionUser(r)),
+		public.Footer(),
+		public.Head(privatePageMeta(r, "Sign-in providers - Juniper")),
+	).Render(dh.Context, w)
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"maps"
+	"net/http"
+	"strings"
+
+	"pioneerwebworks.com/juniper/auth"
+	"pioneerwebworks.com/juniper/models"
+	"pioneerwebworks.com/juniper/openapi"
+)
+
+// messageResponse is the body of successful /api/auth responses.
+type messageResponse struct {
+	Message string `json:"message"`
+}
+
+// csrfResponse is the body of GET /api/auth/csrf.
+type csrfResponse struct {
+	Token string `json:"token"`
+}
+
+// identityLinkResponse is the body of POST
+// /api/auth/identities/{provider}/link.
+type identityLinkResponse struct {
+	URL string `json:"url"` // Of the provider, to send the browser to
+}
+
+// apiDocument describes the JSON API: the /api/auth routes and the routes of
+// every model handler in APP_DATA.
+func apiDocument() *openapi.Document {
+	doc := openapi.New("Juniper API", "1.0.0")
+	doc.Info.Description = "Errors are returned as {\"error\": {...}} with the HTTP status repeated in the body. " +
+		"Requests other than GET, HEAD and OPTIONS must send the token from GET /api/auth/csrf in the X-CSRF-Token header, or are refused with 403. " +
+		"The model routes need a session, or an access token of a registered OAuth2 client granting the route's scope, sent as Authorization: Bearer. " +
+		"Clients check tokens at " + auth.OAuthIntrospectPath + " (RFC 7662) and revoke them at " + auth.OAuthRevokePath + " (RFC 7009)."
+
+	message := doc.Model("Message", messageResponse{})
+	authTags := []string{"auth"}
+
+	doc.Add("POST", "/api/auth/login", &openapi.Operation{
+		OperationID: "login",
+		Summary:     "Log in with a username and password and start a session",
+		Tags:        authTags,
+		RequestBody: openapi.Body(doc.Model("LoginForm", loginForm{})),
+		Responses: map[string]*openapi.Response{
+			"200": {Description: "Logged in. The session cookie is set.", Content: openapi.JSON(message)},
+			"400": openapi.Error(http.StatusBadRequest),
+			"401": {Description: "Wrong credentials, or code two_factor_required when the user has two-factor authentication on and no code or recoveryCode was sent", Content: openapi.JSON(openapi.Ref("Error"))},
+			"423": openapi.Error(http.StatusLocked),
+			"429": openapi.Error(http.StatusTooManyRequests),
+		},
+	})
+	doc.Add("POST", "/api/auth/logout", &openapi.Operation{
+		OperationID: "logout",
+		Summary:     "End the current session",
+		Tags:        authTags,
+		Security:    openapi.Session(),
+		Responses: map[string]*openapi.Response{
+			"200": {Description: "Logged out", Content: openapi.JSON(message)},
+		},
+	})
+	doc.Add("POST", "/api/auth/logout-all", &openapi.Operation{
+		OperationID: "logoutAll",
+		Summary:     "End every session of the user, on all devices",
+		Tags:        authTags,
+		Security:    openapi.Session(),
+		Responses: map[string]*openapi.Response{
+			"200": {Description: "Logged out everywhere", Content: openapi.JSON(message)},
+			"401": openapi.Error(http.StatusUnauthorized),
+		},
+	})
+	doc.Add("GET", "/api/auth/status", &openapi.Operation{
+		OperationID: "authStatus",
+		Summary:     "Check whether the session is logged in",
+		Tags:        authTags,
+		Security:    openapi.Session(),
+		Responses: map[string]*openapi.Response{
+			"200": {Description: "Logged in", Content: openapi.JSON(message)},
+			"401": openapi.Error(http.StatusUnauthorized),
+		},
+	})
+	doc.Add("GET", "/api/auth/csrf", &openapi.Operation{
+		OperationID: "csrfToken",
+		Summary:     "Get the CSRF token of the session",
+		Tags:        authTags,
+		Responses: map[string]*openapi.Response{
+			"200": {Description: "The token. The session cookie is set if there was none.", Content: openapi.JSON(doc.Model("CSRFToken", csrfResponse{}))},
+		},
+	})
+	creationOptions := &openapi.Schema{Type: "object", Description: "CredentialCreationOptions for navigator.credentials.create, with binary fields in base64url."}
+	requestOptions := &openapi.Schema{Type: "object", Description: "CredentialRequestOptions for navigator.credentials.get, with binary fields in base64url."}
+	credential := &openapi.Schema{Type: "object", Description: "The PublicKeyCredential from the browser, with binary fields in base64url."}
+	passkey := doc.Model("Passkey", models.Passkey{})
+	doc.Add("POST", "/api/auth/passkeys/login/begin", &openapi.Operation{
+		OperationID: "passkeyLoginBegin",
+		Summary:     "Start logging in with a passkey",
+		Tags:        authTags,
+		Responses: map[string]*openapi.Response{
+			"200": {Description: "Options for the browser", Content: openapi.JSON(requestOptions)},
+			"429": openapi.Error(http.StatusTooManyRequests),
+		},
+	})
+	doc.Add("POST", "/api/auth/passkeys/login/finish", &openapi.Operation{
+		OperationID: "passkeyLoginFinish",
+		Summary:     "Log in with the passkey the browser chose",
+		Tags:        authTags,
+		RequestBody: openapi.Body(credential),
+		Responses: map[string]*openapi.Response{
+			"200": {Description: "Logged in. The session cookie is set.", Content: openapi.JSON(message)},
+			"401": openapi.Error(http.StatusUnauthorized),
+			"423": openapi.Error(http.StatusLocked),
+			"429": openapi.Error(http.StatusTooManyRequests),
+		},
+	})
+	doc.Add("GET", "/api/auth/passkeys", &openapi.Operation{
+		OperationID: "listPasskeys",
+		Summary:     "List the passkeys of the user",
+		Tags:        authTags,
+		Security:    openapi.Session(),
+		Responses: map[string]*openapi.Response{
+			"200": {Description: "Passkeys, oldest first", Content: openapi.JSON(openapi.ArrayOf(passkey))},
+			"401": openapi.Error(http.StatusUnauthorized),
+		},
+	})
+	doc.Add("POST", "/api/auth/passkeys/register/begin", &openapi.Operation{
+		OperationID: "passkeyRegisterBegin",
+		Summary:     "Start adding a passkey",
+		Description: "Needs a login or passkey step-up in the last few minutes, otherwise fails with code step_up_required.",
+		Tags:        authTags,
+		Security:    openapi.Session(),
+		Responses: map[string]*openapi.Response{
+			"200": {Description: "Options for the browser", Content: openapi.JSON(creationOptions)},
+			"401": openapi.Error(http.StatusUnauthorized),
+			"403": openapi.Error(http.StatusForbidden),
+		},
+	})
+	doc.Add("POST", "/api/auth/passkeys/register/finish", &openapi.Operation{
+		OperationID: "passkeyRegisterFinish",
+		Summary:     "Store the passkey the browser created",
+		Tags:        authTags,
+		Security:    openapi.Session(),
+		Parameters: []openapi.Parameter{
+			{Name: "name", In: "query", Description: "Shown in the passkey list", Schema: &openapi.Schema{Type: "string"}},
+		},
+		RequestBody: openapi.Body(credential),
+		Responses: map[string]*openapi.Response{
+			"200": {Description: "Added", Content: openapi.JSON(passkey)},
+			"401": openapi.Error(http.StatusUnauthorized),
+			"403": openapi.Error(http.StatusForbidden),
+			"409": openapi.Error(http.StatusConflict),
+		},
+	})
+	doc.Add("DELETE", "/api/auth/passkeys/{id}", &openapi.Operation{
+		OperationID: "deletePasskey",
+		Summary:     "Remove a passkey",
+		Description: "Needs a recent login or passkey step-up, like adding one.",
+		Tags:        authTags,
+		Security:    openapi.Session(),
+		Responses: map[string]*openapi.Response{
+			"200": {Description: "Deleted", Content: openapi.JSON(message)},
+			"401": openapi.Error(http.StatusUnauthorized),
+			"403": openapi.Error(http.StatusForbidden),
+			"404": openapi.Error(http.StatusNotFound),
+		},
+	})
+	doc.Add("POST", "/api/auth/passkeys/step-up/begin", &openapi.Operation{
+		OperationID: "passkeyStepUpBegin",
+		Summary:     "Start confirming with a passkey before a sensitive change",
+		Tags:        authTags,
+		Security:    openapi.Session(),
+		Responses: map[string]*openapi.Response{
+			"200": {Description: "Options for the browser", Content: openapi.JSON(requestOptions)},
+			"400": openapi.Error(http.StatusBadRequest),
+			"401": openapi.Error(http.StatusUnauthorized),
+		},
+	})
+	doc.Add("POST", "/api/auth/passkeys/step-up/finish", &openapi.Operation{
+		OperationID: "passkeyStepUpFinish",
+		Summary:     "Confirm with a passkey",
+		Tags:        authTags,
+		Security:    openapi.Session(),
+		RequestBody: openapi.Body(credential),
+		Responses: map[string]*openapi.Response{
+			"200": {Description: "Confirmed", Content: openapi.JSON(message)},
+			"401": openapi.Error(http.StatusUnauthorized),
+		},
+	})
+	identity := doc.Model("Identity", models.Identity{})
+	doc.Add("GET", "/api/auth/identities", &openapi.Operation{
+		OperationID: "listIdentities",
+		Summary:     "List the sign-in providers the user has connected",
+		Tags:        authTags,
+		Security:    openapi.Session(),
+		Responses: map[string]*openapi.Response{
+			"200": {Description: "Identities, oldest first", Content: openapi.JSON(openapi.ArrayOf(identity))},
+			"401": openapi.Error(http.StatusUnauthorized),
+		},
+	})
+	doc.Add("POST", "/api/auth/identities/{provider}/link", &openapi.Operation{
+		OperationID: "linkIdentity",
+		Summary:     "Start connecting a sign-in provider",
+		Description: "Send the browser to the returned URL. The provider sends it back to /auth/{provider}/callback, which connects the account. " +
+			"Needs a recent login or passkey step-up, like adding a passkey.",
+		Tags:     authTags,
+		Security: openapi.Session(),
+		Responses: map[string]*openapi.Response{
+			"200": {Description: "The provider's login page", Content: openapi.JSON(doc.Model("IdentityLink", identityLinkResponse{}))},
+			"401": openapi.Error(http.StatusUnauthorized),
+			"403": openapi.Error(http.StatusForbidden),
+			"404": openapi.Error(http.StatusNotFound),
+			"502": {Description: "The provider could not be reached", Content: openapi.JSON(openapi.Ref("Error"))},
+		},
+	})
+	doc.Add("DELETE", "/api/auth/identities/{id}", &openapi.Operation{
+		OperationID: "deleteIdentity",
+		Summary:     "Disconnect a sign-in provider",
+		Description: "Needs a recent login or passkey step-up. Refused with 409 if it is the only way left to log in.",
+		Tags:        authTags,
+		Security:    openapi.Session(),
+		Responses: map[string]*openapi.Response{
+			"200": {Description: "Deleted", Content: openapi.JSON(message)},
+			"401": openapi.Error(http.StatusUnauthorized),
+			"403": openapi.Error(http.StatusForbidden),
+			"404": openapi.Error(http.StatusNotFound),
+			"409": openapi.Error(http.StatusConflict),
+		},
+	})
+	doc.Add("POST", "/api/auth/register", &openapi.Operation{
+		OperationID: "register",
+		Summary:     "Create an account, send the verification email and start a session",
+		Tags:        authTags,
+		RequestBody: openapi.Body(doc.Model("RegisterForm", registerForm{})),
+		Responses: map[string]*openapi.Response{
+			"200": {Description: "Registered. The session cookie is set.", Content: openapi.JSON(message)},
+			"400": openapi.Error(http.StatusBadRequest),
+			"409": openapi.Error(http.StatusConflict),
+			"422": openapi.Error(http.StatusUnprocessableEntity),
+			"429": openapi.Error(http.StatusTooManyRequests),
+			"500": openapi.Error(http.StatusInternalServerError),
+			"502": {Description: "The verification email could not be sent", Content: openapi.JSON(openapi.Ref("Error"))},
+		},
+	})
+	doc.Add("POST", "/api/auth/verify-email", &openapi.Operation{
+		OperationID: "verifyEmail",
+		Summary:     "Confirm an email address with the token from the verification email",
+		Tags:        authTags,
+		Parameters: []openapi.Parameter{
+			{Name: "username", In: "query", Required: true, Schema: &openapi.Schema{Type: "string"}},
+			{Name: "token", In: "query", Required: true, Schema: &openapi.Schema{Type: "string"}},
+		},
+		Responses: map[string]*openapi.Response{
+			"200": {Description: "Verified. The user still has to log in.", Content: openapi.JSON(message)},
+			"401": openapi.Error(http.StatusUnauthorized),
+		},
+	})
+
+	doc.Add("POST", "/api/admin/users/{id}/unlock", &openapi.Operation{
+		OperationID: "unlockUser",
+		Summary:     "Clear the failed logins and lockout of a user",
+		Tags:        []string{"admin"},
+		Security:    openapi.Session(),
+		Responses: map[string]*openapi.Response{
+			"200": {Description: "Unlocked", Content: openapi.JSON(message)},
+			"401": openapi.Error(http.StatusUnauthorized),
+			"403": openapi.Error(http.StatusForbidden),
+			"404": openapi.Error(http.StatusNotFound),
+		},
+	})
+
+	site := publicURL(APP_CONFIG).String()
+	scopes := maps.Clone(auth.OAuthScopes)
+	for scope, roles := range auth.ScopeRoles {
+		if _, ok := scopes[scope]; ok {
+			scopes[scope] += " (" + strings.Join(roles, ", ") + " only)"
+		}
+	}
+	doc.AddOAuth2(site+auth.OAuthAuthorizePath, site+auth.OAuthTokenPath, scopes)
+	APP_DATA.UserHandler.Describe(doc)
+	APP_DATA.PostHandler.Describe(doc)
+
+	return doc
+}
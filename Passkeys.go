@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"pioneerwebworks.com/juniper/apperr"
+	"pioneerwebworks.com/juniper/auth"
+	"pioneerwebworks.com/juniper/config"
+	"pioneerwebworks.com/juniper/logging"
+	"pioneerwebworks.com/juniper/metrics"
+	"pioneerwebworks.com/juniper/models"
+	"pioneerwebworks.com/juniper/views/dashboard"
+	"pioneerwebworks.com/juniper/views/public"
+)
+
+// publicURL is SITE_URL, or localhost on PORT in development.
+func publicURL(cfg *config.Config) *url.URL {
+	site, err := url.Parse(strings.TrimRight(cfg.SiteURL, "/"))
+	if cfg.SiteURL == "" || err != nil {
+		site = &url.URL{Scheme: "http", Host: "localhost:" + strconv.Itoa(cfg.Port)}
+	}
+	return site
+}
+
+// passkeyConfig binds passkeys to the host of SITE_URL unless cfg says
+// otherwise. Without SITE_URL, as in development, they work on localhost.
+func passkeyConfig(cfg *config.Config) auth.PasskeyConfig {
+	passkeys := auth.PasskeyConfig{
+		RPID:    cfg.Auth.PasskeyRPID,
+		RPName:  "Juniper",
+		Origins: cfg.Auth.PasskeyOrigins,
+		Timeout: cfg.Auth.PasskeyTimeout,
+	}
+	site := publicURL(cfg)
+	if passkeys.RPID == "" {
+		passkeys.RPID = site.Hostname()
+	}
+	if len(passkeys.Origins) == 0 {
+		passkeys.Origins = []string{site.Scheme + "://" + site.Host}
+	}
+	return passkeys
+}
+
+// passkeyError turns a failed ceremony into a 401 and anything else into a
+// 500.
+func passkeyError(err error) error {
+	if errors.Is(err, auth.ErrPasskeyRejected) {
+		return apperr.Unauthorized("Passkey not accepted").Wrap(err)
+	}
+	return apperr.Internal(err)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// api_auth_passkey_login_begin returns the options for
+// navigator.credentials.get on the login page.
+func (router *Router) api_auth_passkey_login_begin(w http.ResponseWriter, r *http.Request) error {
+	assertion, err := auth.BeginPasskeyLogin(w, r)
+	if err != nil {
+		return apperr.Internal(err)
+	}
+	writeJSON(w, http.StatusOK, assertion)
+	return nil
+}
+
+// api_auth_passkey_login_finish logs in the owner of the passkey the
+// browser answered with. A passkey verifies the user itself, so there is
+// no TOTP step.
+func (router *Router) api_auth_passkey_login_finish(w http.ResponseWriter, r *http.Request) error {
+	userDB := models.ConnectToUserDB().WithContext(r.Context())
+	now := time.Now()
+	user, err := auth.FinishPasskeyLogin(w, r, userDB, r.Body, now)
+	if err != nil {
+		metrics.ObserveLogin(false)
+		slog.InfoContext(r.Context(), "passkey login failed", "error", err)
+		return passkeyError(err)
+	}
+	if err := lockedOut(w, user, now); err != nil {
+		return err
+	}
+	metrics.ObserveLogin(true)
+
+	session, _ := auth.Store.Get(r, "juniper-session")
+	if err := auth.Store.Renew(r, session); err != nil {
+		return apperr.Internal(err)
+	}
+	session.Values["userID"] = user.ID
+	session.Values["authenticated"] = true
+	auth.MarkVerified(session, now)
+	if err := session.Save(r, w); err != nil {
+		return apperr.Internal(err)
+	}
+	logging.SetUserID(r.Context(), user.ID)
+
+	user.LastLoginAt = now
+	user.FailedLogins = 0
+	userDB.UpdateUser(user)
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("{\"message\": \"Success\"}"))
+	return nil
+}
+
+// api_auth_passkeys lists the passkeys of the logged in user.
+func (router *Router) api_auth_passkeys(w http.ResponseWriter, r *http.Request) error {
+	userDB := models.ConnectToUserDB().WithContext(r.Context())
+	passkeys, err := userDB.Passkeys(auth.UserIDFromContext(r.Context()))
+	if err != nil {
+		return apperr.Internal(err)
+	}
+	writeJSON(w, http.StatusOK, passkeys)
+	return nil
+}
+
+// api_auth_passkey_register_begin returns the options for
+// navigator.credentials.create to add a passkey.
+func (router *Router) api_auth_passkey_register_begin(w http.ResponseWriter, r *http.Request) error {
+	userDB := models.ConnectToUserDB().WithContext(r.Context())
+	user, err := userDB.GetUser(auth.UserIDFromContext(r.Context()))
+	if err != nil {
+		return apperr.Unauthorized("Unauthorized").Wrap(err)
+	}
+	if err := userDB.EnsurePasskeyHandle(&user); err != nil {
+		return apperr.Internal(err)
+	}
+	passkeys, err := userDB.Passkeys(user.ID)
+	if err != nil {
+		return apperr.Internal(err)
+	}
+	creation, err := auth.BeginPasskeyRegistration(w, r, user, passkeys)
+	if err != nil {
+		return apperr.Internal(err)
+	}
+	writeJSON(w, http.StatusOK, creation)
+	return nil
+}
+
+// api_auth_passkey_register_finish stores the passkey the browser created,
+// under the name in the "name" query parameter.
+func (router *Router) api_auth_passkey_register_finish(w http.ResponseWriter, r *http.Request) error {
+	userDB := models.ConnectToUserDB().WithContext(r.Context())
+	user, err := userDB.GetUser(auth.UserIDFromContext(r.Context()))
+	if err != nil {
+		return apperr.Unauthorized("Unauthorized").Wrap(err)
+	}
+	passkeys, err := userDB.Passkeys(user.ID)
+	if err != nil {
+		return apperr.Internal(err)
+	}
+	passkey, err := auth.FinishPasskeyRegistration(w, r, user, passkeys, r.Body)
+	if err != nil {
+		return passkeyError(err)
+	}
+	passkey.Name = r.URL.Query().Get("name")
+	if passkey.Name == "" {
+		passkey.Name = "Passkey " + strconv.Itoa(len(passkeys)+1)
+	}
+	if err := userDB.AddPasskey(&passkey); err != nil {
+		return apperr.Conflict("Passkey already registered").Wrap(err)
+	}
+	slog.InfoContext(r.Context(), "passkey added", "user_id", user.ID, "passkey_id", passkey.ID)
+	writeJSON(w, http.StatusOK, passkey)
+	return nil
+}
+
+// api_auth_passkey_delete removes a passkey of the logged in user.
+func (router *Router) api_auth_passkey_delete(w http.ResponseWriter, r *http.Request) error {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		return apperr.NotFound("Passkey not found")
+	}
+	userID := auth.UserIDFromContext(r.Context())
+	userDB := models.ConnectToUserDB().WithContext(r.Context())
+	found, err := userDB.DeletePasskey(userID, uint(id))
+	if err != nil {
+		return apperr.Internal(err)
+	}
+	if !found {
+		return apperr.NotFound("Passkey not found")
+	}
+	slog.InfoContext(r.Context(), "passkey deleted", "user_id", userID, "passkey_id", id)
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("{\"message\": \"Deleted\"}"))
+	return nil
+}
+
+// api_auth_passkey_step_up_begin asks the logged in user to confirm with a
+// passkey before a change that needs a recent login.
+func (router *Router) api_auth_passkey_step_up_begin(w http.ResponseWriter, r *http.Request) error {
+	userDB := models.ConnectToUserDB().WithContext(r.Context())
+	user, err := userDB.GetUser(auth.UserIDFromContext(r.Context()))
+	if err != nil {
+		return apperr.Unauthorized("Unauthorized").Wrap(err)
+	}
+	passkeys, err := userDB.Passkeys(user.ID)
+	if err != nil {
+		return apperr.Internal(err)
+	}
+	if len(passkeys) == 0 {
+		return apperr.BadRequest("No passkeys, log in again instead")
+	}
+	assertion, err := auth.BeginPasskeyStepUp(w, r, user, passkeys)
+	if err != nil {
+		return passkeyError(err)
+	}
+	writeJSON(w, http.StatusOK, assertion)
+	return nil
+}
+
+// api_auth_passkey_step_up_finish records a fresh passkey assertion as the
+// step-up for the logged in user.
+func (router *Router) api_auth_passkey_step_up_finish(w http.ResponseWriter, r *http.Request) error {
+	userDB := models.ConnectToUserDB().WithContext(r.Context())
+	user, err := userDB.GetUser(auth.UserIDFromContext(r.Context()))
+	if err != nil {
+		return apperr.Unauthorized("Unauthorized").Wrap(err)
+	}
+	if err := auth.FinishPasskeyStepUp(w, r, userDB, user, r.Body, time.Now()); err != nil {
+		return passkeyError(err)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("{\"message\": \"Success\"}"))
+	return nil
+}
+
+// dashboard_Passkeys lists the passkeys of the logged in user, with
+// buttons to add and remove them.
+func (dh *DashboardHandler) dashboard_Passkeys(w http.ResponseWriter, r *http.Request) {
+	userDB := models.ConnectToUserDB().WithContext(r.Context())
+	passkeys, err := userDB.Passkeys(auth.UserIDFromContext(r.Context()))
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
+	csrf, err := auth.CSRFToken(w, r)
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
+
+	public.App(
+		dashboard.Passkeys(passkeys, csrf),
+		public.Header(getSessionUser(r)),
+		public.Footer(),
+		public.Head(privatePageMeta(r, "Passkeys - Juniper")),
+	).Render(dh.Context, w)
+}
@@ -3,19 +3,24 @@ package main
 import (
 	"context"
 	"encoding/json"
-	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"math"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
-	"github.com/gorilla/sessions"
-	"gorm.io/driver/sqlite"
-	"gorm.io/gorm"
+	"pioneerwebworks.com/juniper/apperr"
 	"pioneerwebworks.com/juniper/auth"
+	"pioneerwebworks.com/juniper/logging"
+	"pioneerwebworks.com/juniper/metrics"
 	"pioneerwebworks.com/juniper/models"
+	"pioneerwebworks.com/juniper/ratelimit"
+	"pioneerwebworks.com/juniper/requestid"
+	"pioneerwebworks.com/juniper/tracing"
 	"pioneerwebworks.com/juniper/views/dashboard"
 	"pioneerwebworks.com/juniper/views/partials"
 	"pioneerwebworks.com/juniper/views/public"
@@ -24,33 +29,106 @@ import (
 type Router struct {
 	Mux             *http.ServeMux
 	Context         context.Context
-	APIRouter       http.Handler
-	DashboardRouter http.Handler
-	PublicRouter    http.Handler
+	APIRouter       *RouteGroup
+	DashboardRouter *RouteGroup
+	middleware      []Middleware
+	rateLimits      ratelimit.Store
 }
 
 func NewRouter(context context.Context) *Router {
 	r := &Router{
-		Mux:     http.NewServeMux(),
-		Context: context,
+		Mux:        http.NewServeMux(),
+		Context:    context,
+		rateLimits: ratelimit.NewMemoryStore(),
 	}
+	r.Use(requestid.Middleware, tracing.Middleware(r.routePattern), r.accessLog, recoverPanics, auth.WithCSRF)
+	r.APIRouter = r.Group("/api")
+	r.DashboardRouter = r.Group("/dashboard", auth.WithAuth)
 	r.routes()
 
 	return r
 }
 
+// Use adds middleware that runs for every request.
+func (router *Router) Use(middleware ...Middleware) {
+	router.middleware = append(router.middleware, middleware...)
+}
+
+// routePattern returns the pattern of the route serving r, looking inside
+// groups, or "unmatched".
+func (router *Router) routePattern(r *http.Request) string {
+	_, pattern := router.Mux.Handler(r)
+	for _, group := range []*RouteGroup{router.APIRouter, router.DashboardRouter} {
+		if pattern == group.Prefix || pattern == group.Prefix+"/" {
+			_, pattern = group.Mux.Handler(r)
+		}
+	}
+	if pattern == "" {
+		return "unmatched"
+	}
+	return pattern
+}
+
+// Group mounts a new route group at prefix, serving both prefix itself and
+// everything below it.
+func (router *Router) Group(prefix string, middleware ...Middleware) *RouteGroup {
+	group := &RouteGroup{
+		Prefix:     prefix,
+		Mux:        http.NewServeMux(),
+		middleware: middleware,
+	}
+	router.Mux.Handle(prefix, group)
+	router.Mux.Handle(prefix+"/", group)
+	return group
+}
+
+// Handle registers a route outside of any group, with middleware that only
+// applies to this route.
+func (router *Router) Handle(pattern string, handler http.Handler, middleware ...Middleware) {
+	router.Mux.Handle(pattern, chain(handler, middleware))
+}
+
+func (router *Router) HandleFunc(pattern string, handler http.HandlerFunc, middleware ...Middleware) {
+	router.Handle(pattern, handler, middleware...)
+}
+
 func (router *Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	fmt.Println("Router.ServeHTTP" + req.URL.Path)
-	router.Mux.ServeHTTP(w, req)
+	chain(router.Mux, router.middleware).ServeHTTP(w, req)
 }
 
 func (router *Router) routes() {
 	// API routes
-	router.Mux.HandleFunc("POST /api/auth/login", router.api_auth_login)
-	router.Mux.HandleFunc("POST /api/auth/logout", router.api_auth_logout)
-	router.Mux.HandleFunc("GET /api/auth/status", router.api_auth_status)
-	router.Mux.HandleFunc("POST /api/auth/register", router.api_auth_register)
-	router.Mux.HandleFunc("GET /api/auth/verify-email", router.api_auth_verify_email)
+	api := router.APIRouter
+	api.Handle("POST /api/auth/login", appHandler(router.api_auth_login),
+		router.limitPerIP("login", APP_CONFIG.Auth.LoginLimitPerIP),
+	)
+	api.Handle("POST /api/auth/logout", appHandler(router.api_auth_logout))
+	api.Handle("POST /api/auth/logout-all", appHandler(router.api_auth_logout_all), auth.WithAuth)
+	api.Handle("GET /api/auth/status", appHandler(router.api_auth_status))
+	api.Handle("GET /api/auth/csrf", appHandler(router.api_auth_csrf))
+	api.Handle("POST /api/auth/passkeys/login/begin", appHandler(router.api_auth_passkey_login_begin),
+		router.limitPerIP("login", APP_CONFIG.Auth.LoginLimitPerIP),
+	)
+	api.Handle("POST /api/auth/passkeys/login/finish", appHandler(router.api_auth_passkey_login_finish),
+		router.limitPerIP("login", APP_CONFIG.Auth.LoginLimitPerIP),
+	)
+	api.Handle("GET /api/auth/passkeys", appHandler(router.api_auth_passkeys), auth.WithAuth)
+	api.Handle("POST /api/auth/passkeys/register/begin", appHandler(router.api_auth_passkey_register_begin), auth.WithAuth, auth.WithStepUp)
+	api.Handle("POST /api/auth/passkeys/register/finish", appHandler(router.api_auth_passkey_register_finish), auth.WithAuth, auth.WithStepUp)
+	api.Handle("DELETE /api/auth/passkeys/{id}", appHandler(router.api_auth_passkey_delete), auth.WithAuth, auth.WithStepUp)
+	api.Handle("POST /api/auth/passkeys/step-up/begin", appHandler(router.api_auth_passkey_step_up_begin), auth.WithAuth)
+	api.Handle("POST /api/auth/passkeys/step-up/finish", appHandler(router.api_auth_passkey_step_up_finish), auth.WithAuth)
+	api.Handle("GET /api/auth/identities", appHandler(router.api_auth_identities), auth.WithAuth)
+	api.Handle("POST /api/auth/identities/{provider}/link", appHandler(router.api_auth_identity_link), auth.WithAuth, auth.WithStepUp)
+	api.Handle("DELETE /api/auth/identities/{id}", appHandler(router.api_auth_identity_delete), auth.WithAuth, auth.WithStepUp)
+	api.Handle("POST /api/auth/register", appHandler(router.api_auth_register),
+		router.limitPerIP("register", APP_CONFIG.Auth.RegisterLimitPerIP),
+	)
+	api.Handle("POST /api/auth/verify-email", appHandler(router.api_auth_verify_email))
+	api.Handle("POST /api/admin/users/{id}/unlock", appHandler(router.api_admin_unlock_user),
+		auth.WithAuth,
+		auth.RequireRole("administrator"),
+	)
 	/**
 	 * @todo
 	 * - auth forgot password
@@ -63,118 +141,161 @@ func (router *Router) routes() {
 	 * - auth get account
 	 */
 
-	router.Mux.Handle(
+	api.Handle("/api/", appHandler(func(w http.ResponseWriter, r *http.Request) error {
+		return apperr.NotFound("Endpoint not found")
+	}))
+
+	dashboardHandler := &DashboardHandler{Context: router.Context}
+	router.DashboardRouter.Handle(
 		"/dashboard",
-		auth.WithAuth(&DashboardHandler{Context: router.Context}),
+		dashboardHandler,
+	)
+	router.DashboardRouter.HandleFunc("GET /dashboard/sessions", dashboardHandler.dashboard_Sessions)
+	router.DashboardRouter.Handle("POST /dashboard/sessions/{id}/revoke", appHandler(dashboardHandler.dashboard_RevokeSession))
+	router.DashboardRouter.Handle("POST /dashboard/sessions/revoke-others", appHandler(dashboardHandler.dashboard_RevokeOtherSessions))
+	router.DashboardRouter.HandleFunc("GET /dashboard/passkeys", dashboardHandler.dashboard_Passkeys)
+	router.DashboardRouter.HandleFunc("GET /dashboard/identities", dashboardHandler.dashboard_Identities)
+	router.DashboardRouter.HandleFunc("GET /dashboard/two-factor", dashboardHandler.dashboard_TwoFactor)
+	router.DashboardRouter.Handle("POST /dashboard/two-factor/enable", appHandler(dashboardHandler.dashboard_TwoFactorEnable))
+	router.DashboardRouter.Handle("POST /dashboard/two-factor/recovery-codes", appHandler(dashboardHandler.dashboard_TwoFactorRecoveryCodes))
+	router.DashboardRouter.Handle("POST /dashboard/two-factor/disable", appHandler(dashboardHandler.dashboard_TwoFactorDisable))
+
+	// Sign in with Google, GitHub and other providers
+	router.Handle("GET /auth/{provider}", appHandler(router.auth_oidc_begin),
+		router.limitPerIP("login", APP_CONFIG.Auth.LoginLimitPerIP),
+	)
+	router.Handle("GET /auth/{provider}/callback", appHandler(router.auth_oidc_callback),
+		router.limitPerIP("login", APP_CONFIG.Auth.LoginLimitPerIP),
 	)
-	router.Mux.Handle(
+
+	// OAuth2 server for third-party tools calling the model APIs
+	router.Handle("GET "+auth.OAuthAuthorizePath, appHandler(router.oauth_authorize), auth.WithAuth)
+	router.Handle("POST "+auth.OAuthAuthorizePath, appHandler(router.oauth_consent), auth.WithAuth)
+	router.Handle("POST "+auth.OAuthTokenPath, appHandler(router.oauth_token))
+	router.Handle("POST "+auth.OAuthIntrospectPath, appHandler(router.oauth_introspect))
+	router.Handle("POST "+auth.OAuthRevokePath, appHandler(router.oauth_revoke))
+
+	// Blog feeds
+	feedHandler := &FeedHandler{Context: router.Context}
+	router.HandleFunc("GET /blog/feed.xml", feedHandler.feed_RSS)
+	router.HandleFunc("GET /blog/atom.xml", feedHandler.feed_Atom)
+	router.HandleFunc("GET /blog/feed.json", feedHandler.feed_JSON)
+	router.HandleFunc("GET /blog/tag/{tag}/feed.xml", feedHandler.feed_RSS)
+	router.HandleFunc("GET /blog/tag/{tag}/atom.xml", feedHandler.feed_Atom)
+	router.HandleFunc("GET /blog/tag/{tag}/feed.json", feedHandler.feed_JSON)
+	router.HandleFunc("GET /blog/category/{category}/feed.xml", feedHandler.feed_RSS)
+	router.HandleFunc("GET /blog/category/{category}/atom.xml", feedHandler.feed_Atom)
+	router.HandleFunc("GET /blog/category/{category}/feed.json", feedHandler.feed_JSON)
+
+	// SEO
+	router.HandleFunc("GET /sitemap.xml", seo_Sitemap)
+	router.HandleFunc("GET /sitemaps/{page}", seo_SitemapPage)
+	router.HandleFunc("GET /robots.txt", seo_Robots)
+
+	publicHandler := &PublicHandler{Context: router.Context}
+	router.HandleFunc("GET /blog/{id}", publicHandler.public_Post)
+	router.Handle(
 		"/",
-		&PublicHandler{Context: router.Context},
+		publicHandler,
 	)
 }
 
-func (router *Router) api_auth_verify_email(w http.ResponseWriter, r *http.Request) {
-	session, _ := auth.Store.Get(r, "juniper-session")
-
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
-		return
-	}
+// limitPerIP allows burst requests per client IP every
+// APP_CONFIG.Auth.RateLimitWindow, counted under name.
+func (router *Router) limitPerIP(name string, burst int) Middleware {
+	limit := ratelimit.Limit{Burst: burst, Period: APP_CONFIG.Auth.RateLimitWindow}
+	return ratelimit.Middleware(ratelimit.New(router.rateLimits, name+":ip", limit), ratelimit.ClientIP)
+}
 
+// api_auth_verify_email confirms an email address with the token from the
+// verification email. It does not log the user in.
+func (router *Router) api_auth_verify_email(w http.ResponseWriter, r *http.Request) error {
 	// Get the token from the URL query parameter
 	username := r.URL.Query().Get("username")
 	token := r.URL.Query().Get("token")
 
-	// Authenticate user
-	userDB := models.ConnectToUserDB()
+	userDB := models.ConnectToUserDB().WithContext(r.Context())
 
 	user := userDB.FindByUsername(username)
 
-	tokenIsValid := user.CheckEmailToken(token)
-
-	if !tokenIsValid {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
+	verified, err := userDB.VerifyEmail(&user, token)
+	if err != nil {
+		return apperr.Internal(err)
+	}
+	if !verified {
+		return apperr.Unauthorized("Invalid verification token")
 	}
-
-	// Set user as authenticated
-	session.Values["userID"] = user.ID
-	session.Values["authenticated"] = true
-	log.Println(session.Values)
-	session.Save(r, w)
-
-	// Update user's last login time
-	user.LastLoginAt = time.Now()
-	user.EmailVerified = true
-	userDB.UpdateUser(user)
 
 	// return success
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("{\"message\": \"Success\"}"))
+	return nil
 }
 
-func (router *Router) api_auth_register(w http.ResponseWriter, r *http.Request) {
-	userDB := models.ConnectToUserDB()
+type registerForm struct {
+	Username  string `json:"username"`
+	Password  string `json:"password"`
+	Email     string `json:"email"`
+	Forename  string `json:"forename"`
+	Surname   string `json:"surname"`
+	Phone     string `json:"phone"`
+	Birthdate string `json:"birthdate"` // YYYY-MM-DD
+}
 
-	type registerForm struct {
-		Username  string `json:"username"`
-		Password  string `json:"password"`
-		Email     string `json:"email"`
-		Forename  string `json:"forename"`
-		Surname   string `json:"surname"`
-		Phone     string `json:"phone"`
-		Birthdate string `json:"birthdate"`
-	}
+func (router *Router) api_auth_register(w http.ResponseWriter, r *http.Request) error {
+	userDB := models.ConnectToUserDB().WithContext(r.Context())
 
 	// Read the body
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		http.Error(w, "Error reading request body", http.StatusInternalServerError)
-		return
+		return apperr.BadRequest("Error reading request body").Wrap(err)
 	}
 	defer r.Body.Close()
 
 	// Unmarshal the JSON data into the struct
 	var data registerForm
 	if err := json.Unmarshal(body, &data); err != nil {
-		http.Error(w, "Error parsing JSON body", http.StatusBadRequest)
-		log.Println(err)
-		return
+		return apperr.BadRequest("Error parsing JSON body").Wrap(err)
 	}
 
-	// Use the data
-	log.Printf("Received: %+v", data)
+	problems := map[string]string{}
+	if data.Username == "" {
+		problems["username"] = "Username is required"
+	}
+	if data.Password == "" {
+		problems["password"] = "Password is required"
+	}
+	if data.Email == "" {
+		problems["email"] = "Email is required"
+	}
+	parsedBirthdate, err := time.Parse("2006-01-02", data.Birthdate)
+	if err != nil {
+		problems["birthdate"] = "Birthdate must be formatted as YYYY-MM-DD"
+	}
+	if len(problems) > 0 {
+		return apperr.Validation(problems)
+	}
 
 	// Check if user already exists
 	var user models.User
 	userDB.DB.First(&user, "username = ?", data.Username)
 	if user.Username != "" {
-		http.Error(w, "User already exists", http.StatusBadRequest)
-		return
+		return apperr.Conflict("User already exists")
 	}
 
 	hashedPassword, err := models.HashPassword(data.Password)
 	if err != nil {
-		http.Error(w, "Error hashing password", http.StatusInternalServerError)
-		return
+		return apperr.Internal(err)
 	}
 
 	token, err := auth.GenerateToken(data.Email)
 	if err != nil {
-		http.Error(w, "Error generating token", http.StatusInternalServerError)
-		return
+		return apperr.Internal(err)
 	}
 
-	hashedEmailToken, err := models.HashEmailToken(data.Email)
+	hashedEmailToken, err := models.HashEmailToken(token)
 	if err != nil {
-		http.Error(w, "Error hashing email token", http.StatusInternalServerError)
-		return
-	}
-
-	parsedBirthdate, err := time.Parse("2006-01-02", data.Birthdate)
-	if err != nil {
-		http.Error(w, "Error parsing birthdate", http.StatusInternalServerError)
-		return
+		return apperr.Internal(err)
 	}
 
 	user = models.User{
@@ -192,8 +313,7 @@ func (router *Router) api_auth_register(w http.ResponseWriter, r *http.Request)
 	}
 	user.ID, err = userDB.CreateUser(&user)
 	if err != nil {
-		http.Error(w, "Error creating user", http.StatusInternalServerError)
-		return
+		return apperr.Internal(err)
 	}
 
 	// URL encode the token
@@ -202,24 +322,28 @@ func (router *Router) api_auth_register(w http.ResponseWriter, r *http.Request)
 	// Send verification email
 	email := Email{
 		To:      []string{user.Email},
-		From:    APP_CONFIG["SMTP_USERNAME"],
+		From:    APP_CONFIG.SMTP.Username,
 		Subject: "Verify your email address",
-		Body:    "Please verify your email address by clicking the link below:\n\n" + APP_CONFIG["SITE_URL"] + "/verify?token=" + token + "&username=" + user.Username,
+		Body:    "Please verify your email address by clicking the link below:\n\n" + APP_CONFIG.SiteURL + "/verify?token=" + token + "&username=" + user.Username,
 	}
 
-	err = GlobalMailer.Send(email)
+	err = GlobalMailer.Send(r.Context(), email)
 	if err != nil {
-		http.Error(w, "Error sending email", http.StatusInternalServerError)
-		return
+		return apperr.New(http.StatusBadGateway, "Error sending email").Wrap(err)
 	}
 
 	session, _ := auth.Store.Get(r, "juniper-session")
 
-	// Set user as authenticated
+	// Set user as authenticated, under a new session ID
+	if err := auth.Store.Renew(r, session); err != nil {
+		return apperr.Internal(err)
+	}
 	session.Values["userID"] = user.ID
 	session.Values["authenticated"] = true
-	log.Println(session.Values)
-	session.Save(r, w)
+	if err := session.Save(r, w); err != nil {
+		return apperr.Internal(err)
+	}
+	logging.SetUserID(r.Context(), user.ID)
 
 	// Update user's last login time
 	user.LastLoginAt = time.Now()
@@ -228,62 +352,147 @@ func (router *Router) api_auth_register(w http.ResponseWriter, r *http.Request)
 	// return success
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("{\"message\": \"Success\"}"))
+	return nil
 }
 
-func (router *Router) api_auth_login(w http.ResponseWriter, r *http.Request) {
-	session, _ := auth.Store.Get(r, "juniper-session")
+type loginForm struct {
+	Username     string `json:"username"`
+	Password     string `json:"password"`
+	Code         string `json:"code,omitempty"`         // From the authenticator app, when two-factor authentication is on
+	RecoveryCode string `json:"recoveryCode,omitempty"` // Instead of Code, when the authenticator is lost
+}
 
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
-		return
+// lockedOut refuses to log in user while failed logins have locked the
+// account, telling the client when to try again.
+func lockedOut(w http.ResponseWriter, user models.User, now time.Time) error {
+	if !user.IsLocked(now) {
+		return nil
 	}
+	metrics.ObserveLogin(false)
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(user.LockedUntil.Sub(now).Seconds()))))
+	return apperr.New(http.StatusLocked, "Account temporarily locked after too many failed logins")
+}
+
+func (router *Router) api_auth_login(w http.ResponseWriter, r *http.Request) error {
+	session, _ := auth.Store.Get(r, "juniper-session")
 
 	// Authenticate user
-	userDB := models.ConnectToUserDB()
+	userDB := models.ConnectToUserDB().WithContext(r.Context())
 
 	// Read the body
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		http.Error(w, "Error reading request body", http.StatusInternalServerError)
-		return
+		return apperr.BadRequest("Error reading request body").Wrap(err)
 	}
 	defer r.Body.Close()
 
-	var data map[string]interface{}
+	var data loginForm
 	// Unmarshal the JSON data into the struct
 	if err := json.Unmarshal(body, &data); err != nil {
-		http.Error(w, "Error parsing JSON body", http.StatusBadRequest)
-		return
+		return apperr.BadRequest("Error parsing JSON body").Wrap(err)
 	}
 
-	// Use the data
-	log.Printf("Received: %+v", data)
-	log.Println(data["username"])
-	log.Println(data["password"])
+	if data.Username == "" || data.Password == "" {
+		return apperr.BadRequest("Username and password are required")
+	}
 
-	//csrf := data["csrf"].(string)
-	//nonce := data["nonce"].(string)
-	user := userDB.FindByUsername(data["username"].(string))
-	passwordVerified := user.CheckPassword(data["password"].(string))
+	// Limit guesses per account, whichever addresses they come from
+	perUser := ratelimit.New(router.rateLimits, "login:user", ratelimit.Limit{
+		Burst:  APP_CONFIG.Auth.LoginLimitPerUser,
+		Period: APP_CONFIG.Auth.RateLimitWindow,
+	})
+	if result := perUser.Allow(r.Context(), strings.ToLower(data.Username)); !result.Allowed {
+		return ratelimit.Error(w, result)
+	}
 
-	if !passwordVerified {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
+	user := userDB.FindByUsername(data.Username)
+	now := time.Now()
+	if err := lockedOut(w, user, now); err != nil {
+		return err
+	}
+
+	fail := func(message string) error {
+		metrics.ObserveLogin(false)
+		failures := 1
+		if user.ID != 0 {
+			policy := models.LockoutPolicy{
+				Threshold: APP_CONFIG.Auth.LockoutThreshold,
+				Duration:  APP_CONFIG.Auth.LockoutDuration,
+			}
+			if err := userDB.RecordFailedLogin(&user, policy, now); err != nil {
+				return apperr.Internal(err)
+			}
+			failures = user.FailedLogins
+		}
+		// Slow down guessing, the same way for unknown usernames
+		select {
+		case <-time.After(models.LoginDelay(failures)):
+		case <-r.Context().Done():
+		}
+		return apperr.Unauthorized(message)
+	}
+
+	if !user.CheckPassword(data.Password) {
+		return fail("Invalid username or password")
+	}
+
+	// The password is right, ask for the second factor before going on
+	if user.TOTPEnabled {
+		if data.Code == "" && data.RecoveryCode == "" {
+			err := apperr.Unauthorized("Enter the code from your authenticator app")
+			err.Code = "two_factor_required"
+			return err
+		}
+		verified, err := auth.VerifySecondFactor(userDB, &user, data.Code, data.RecoveryCode, now)
+		if err != nil {
+			return apperr.Internal(err)
+		}
+		if !verified {
+			return fail("Invalid two-factor code")
+		}
 	}
+	metrics.ObserveLogin(true)
 
-	// Set user as authenticated
+	// Set user as authenticated, under a new session ID
+	if err := auth.Store.Renew(r, session); err != nil {
+		return apperr.Internal(err)
+	}
 	session.Values["userID"] = user.ID
 	session.Values["authenticated"] = true
-	log.Println(session.Values)
-	session.Save(r, w)
+	auth.MarkVerified(session, now)
+	if err := session.Save(r, w); err != nil {
+		return apperr.Internal(err)
+	}
+	logging.SetUserID(r.Context(), user.ID)
 
 	// Update user's last login time
-	user.LastLoginAt = time.Now()
+	user.LastLoginAt = now
+	user.FailedLogins = 0
 	userDB.UpdateUser(user)
 
 	// return success
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("{\"message\": \"Success\"}"))
+	return nil
+}
+
+// api_admin_unlock_user clears the lockout of a user who failed to log in
+// too often.
+func (router *Router) api_admin_unlock_user(w http.ResponseWriter, r *http.Request) error {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		return apperr.NotFound("User not found")
+	}
+	userDB := models.ConnectToUserDB().WithContext(r.Context())
+	user, err := userDB.Unlock(uint(id))
+	if err != nil {
+		return apperr.NotFound("User not found").Wrap(err)
+	}
+	slog.InfoContext(r.Context(), "user unlocked", "unlocked_user_id", user.ID, "by_user_id", auth.UserIDFromContext(r.Context()))
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("{\"message\": \"Unlocked\"}"))
+	return nil
 }
 
 func getSessionUser(r *http.Request) models.User {
@@ -297,7 +506,7 @@ func getSessionUser(r *http.Request) models.User {
 
 	userID, _ := session.Values["userID"].(uint)
 
-	userDB := models.ConnectToUserDB()
+	userDB := models.ConnectToUserDB().WithContext(r.Context())
 	user := models.User{}
 	user, err := userDB.GetUser(userID)
 	if err != nil {
@@ -307,29 +516,51 @@ func getSessionUser(r *http.Request) models.User {
 	return user
 }
 
-func (router *Router) api_auth_logout(w http.ResponseWriter, r *http.Request) {
+func (router *Router) api_auth_logout(w http.ResponseWriter, r *http.Request) error {
 	session, _ := auth.Store.Get(r, "juniper-session")
 
-	// Revoke users authentication
-	session.Values["authenticated"] = false
+	// Delete the session, so the cookie is worthless even if it was copied
+	session.Options.MaxAge = -1
+	if err := session.Save(r, w); err != nil {
+		return apperr.Internal(err)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("{\"message\": \"Success\"}"))
+	return nil
+}
+
+// api_auth_logout_all ends every session of the user, on every device,
+// including this one.
+func (router *Router) api_auth_logout_all(w http.ResponseWriter, r *http.Request) error {
+	userID := auth.UserIDFromContext(r.Context())
+	userDB := models.ConnectToUserDB().WithContext(r.Context())
+	revoked, err := userDB.RevokeSessions(userID, "")
+	if err != nil {
+		return apperr.Internal(err)
+	}
+	slog.InfoContext(r.Context(), "sessions revoked", "user_id", userID, "count", revoked)
+
+	session, _ := auth.Store.Get(r, "juniper-session")
+	session.Options.MaxAge = -1
 	session.Save(r, w)
 
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("{\"message\": \"Success\"}"))
+	return nil
 }
 
-func (router *Router) api_auth_status(w http.ResponseWriter, r *http.Request) {
+func (router *Router) api_auth_status(w http.ResponseWriter, r *http.Request) error {
 	session, _ := auth.Store.Get(r, "juniper-session")
 
 	// Check if user is authenticated
 	if auth, ok := session.Values["authenticated"].(bool); !ok || !auth {
-		w.WriteHeader(http.StatusUnauthorized)
-		w.Write([]byte("{\"message\": \"Unauthorized\"}"))
-		return
+		return apperr.Unauthorized("Unauthorized")
 	}
 
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("{\"message\": \"Authenticated\"}"))
+	return nil
 }
 
 type DashboardHandler struct {
@@ -339,7 +570,13 @@ type DashboardHandler struct {
 func (dh *DashboardHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	posts, err := APP_DATA.PostHandler.List()
 	if err != nil {
-		panic(err)
+		renderError(w, r, err)
+		return
+	}
+	csrf, err := auth.CSRFToken(w, r)
+	if err != nil {
+		renderError(w, r, err)
+		return
 	}
 	user := getSessionUser(r)
 	public.App(
@@ -347,10 +584,12 @@ func (dh *DashboardHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			APP_DATA,
 			APP_DATA.ListHandlerfields(),
 			posts,
+			user.ID,
+			csrf,
 		),
 		public.Header(user),
 		public.Footer(),
-		public.Head("Juniper"),
+		public.Head(privatePageMeta(r, "Juniper")),
 	).Render(dh.Context, w)
 }
 
@@ -386,23 +625,40 @@ func (ph *PublicHandler) public_Home(w http.ResponseWriter, r *http.Request) {
 		c,
 		public.Header(user),
 		public.Footer(),
-		public.Head("Juniper"),
+		public.Head(pageMeta(r, "Juniper")),
 	).Render(ph.Context, w)
 }
 
+// api_auth_csrf hands the CSRF token to API clients, which must send it in
+// the X-CSRF-Token header on every request that changes something.
+func (router *Router) api_auth_csrf(w http.ResponseWriter, r *http.Request) error {
+	token, err := auth.CSRFToken(w, r)
+	if err != nil {
+		return apperr.Internal(err)
+	}
+	out, err := json.Marshal(csrfResponse{Token: token})
+	if err != nil {
+		return apperr.Internal(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(out)
+	return nil
+}
+
 func (ph *PublicHandler) public_About(w http.ResponseWriter, r *http.Request) {
 	user := getSessionUser(r)
 	public.App(
 		public.Page_About(),
 		public.Header(user),
 		public.Footer(),
-		public.Head("Juniper"),
+		public.Head(pageMeta(r, "About - Juniper")),
 	).Render(ph.Context, w)
 }
 
 func (ph *PublicHandler) public_Verify(w http.ResponseWriter, r *http.Request) {
 	session, _ := auth.Store.Get(r, "juniper-session")
-	userDB := models.ConnectToUserDB()
+	userDB := models.ConnectToUserDB().WithContext(r.Context())
 
 	// Get the token from the URL query parameter
 	username := r.URL.Query().Get("username")
@@ -417,8 +673,6 @@ func (ph *PublicHandler) public_Verify(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
-	log.Println("auth", auth)
-	log.Println("ok", ok)
 
 	user := userDB.FindByUsername(username)
 
@@ -431,80 +685,107 @@ func (ph *PublicHandler) public_Verify(w http.ResponseWriter, r *http.Request) {
 	// 	return
 	// }
 
-	tokenIsValid := user.CheckEmailToken(token)
+	tokenIsValid, err := userDB.VerifyEmail(&user, token)
+	if err != nil {
+		renderError(w, r, apperr.Internal(err))
+		return
+	}
 
-	log.Println("tokenIsValid", tokenIsValid)
-
-	// Update user's last login time
-	user.LastLoginAt = time.Now()
-	user.EmailVerified = true
-	userDB.UpdateUser(user)
+	slog.DebugContext(r.Context(), "email verification", "username", username, "valid", tokenIsValid)
 
 	public.App(
 		partials.Verify(tokenIsValid),
 		public.Header(user),
 		public.Footer(),
-		public.Head("Juniper"),
+		public.Head(privatePageMeta(r, "Juniper")),
 	).Render(ph.Context, w)
 }
 
 func (ph *PublicHandler) public_Register(w http.ResponseWriter, r *http.Request) {
+	csrf, err := auth.CSRFToken(w, r)
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
 	user := getSessionUser(r)
 	public.App(
-		partials.Register(),
+		partials.Register(csrf),
 		public.Header(user),
 		public.Footer(),
-		public.Head("Juniper"),
+		public.Head(privatePageMeta(r, "Juniper")),
 	).Render(ph.Context, w)
 }
 
 func (ph *PublicHandler) public_Login(w http.ResponseWriter, r *http.Request) {
+	csrf, err := auth.CSRFToken(w, r)
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
 	user := getSessionUser(r)
 	public.App(
-		partials.Login(uuid.NewString()),
+		partials.Login(uuid.NewString(), csrf, loginNext(r), auth.OIDCProviders),
 		public.Header(user),
 		public.Footer(),
-		public.Head("Juniper"),
+		public.Head(privatePageMeta(r, "Juniper")),
 	).Render(ph.Context, w)
 }
 
+// loginNext is where the login page sends the user: the local path in the
+// next parameter, e.g. the page WithAuth sent them away from, or else the
+// dashboard.
+func loginNext(r *http.Request) string {
+	next := r.URL.Query().Get("next")
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/dashboard"
+	}
+	return next
+}
+
 func (ph *PublicHandler) public_Logout(w http.ResponseWriter, r *http.Request) {
 	session, _ := auth.Store.Get(r, "juniper-session")
-	session.Options = &sessions.Options{MaxAge: -1}
-	session.Values["authenticated"] = false
-	session.Values["userID"] = 0
+	session.Options.MaxAge = -1
 	session.Save(r, w)
 
 	public.App(
 		public.Paragraph("You have been logged out."),
 		public.Header(models.User{}),
 		public.Footer(),
-		public.Head("Juniper"),
+		public.Head(privatePageMeta(r, "Juniper")),
 	).Render(ph.Context, w)
 }
 
 func (ph *PublicHandler) public_Blog(w http.ResponseWriter, r *http.Request) {
-	post_db, err := gorm.Open(sqlite.Open("database/post.db"), &gorm.Config{})
+	user := getSessionUser(r)
+	posts, err := models.ListPublishedPosts(APP_DATA.PostHandler.DB(), models.PostFilter{})
 	if err != nil {
-		panic("failed to connect database")
+		renderError(w, r, err)
+		return
 	}
-	user := getSessionUser(r)
-	posts := []models.Post{}
-	post_db.Find(&posts)
 	public.App(
 		public.Blog(posts),
 		public.Header(user),
 		public.Footer(),
-		public.Head("Juniper"),
+		public.Head(pageMeta(r, "Blog - Juniper")),
 	).Render(ph.Context, w)
 }
 
-func (ph *PublicHandler) public_404(w http.ResponseWriter, r *http.Request) {
+func (ph *PublicHandler) public_Post(w http.ResponseWriter, r *http.Request) {
+	var post models.Post
+	tx := APP_DATA.PostHandler.DB().First(&post, "id = ? AND published = ?", r.PathValue("id"), true)
+	if tx.Error != nil {
+		ph.public_404(w, r)
+		return
+	}
 	user := getSessionUser(r)
 	public.App(
-		public.Page_404(),
+		public.Post(post),
 		public.Header(user),
 		public.Footer(),
-		public.Head("Juniper"),
+		public.Head(postMeta(post)),
 	).Render(ph.Context, w)
 }
+
+func (ph *PublicHandler) public_404(w http.ResponseWriter, r *http.Request) {
+	renderError(w, r, apperr.NotFound("Page not found"))
+}
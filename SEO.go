@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"pioneerwebworks.com/juniper/models"
+	"pioneerwebworks.com/juniper/views/public"
+)
+
+// The sitemap protocol allows at most 50,000 URLs per file.
+var sitemapURLLimit = 50000
+
+// Public routes listed in the sitemap alongside the blog posts.
+var sitemapStaticPaths = []string{"/", "/about", "/blog"}
+
+const defaultDescription = "Juniper is a simple web framework and CMS built in Go."
+
+// pageMeta builds the head metadata for a regular page.
+func pageMeta(r *http.Request, title string) public.PageMeta {
+	return public.PageMeta{
+		Title:        title,
+		Description:  defaultDescription,
+		CanonicalURL: siteURL() + r.URL.Path,
+		Type:         "website",
+	}
+}
+
+// privatePageMeta builds the head metadata for pages that should stay out of
+// search results.
+func privatePageMeta(r *http.Request, title string) public.PageMeta {
+	meta := pageMeta(r, title)
+	meta.Robots = "noindex, nofollow"
+	return meta
+}
+
+type blogPostingAuthor struct {
+	Type string `json:"@type"`
+	Name string `json:"name"`
+}
+
+type blogPosting struct {
+	Context          string            `json:"@context"`
+	Type             string            `json:"@type"`
+	Headline         string            `json:"headline"`
+	Description      string            `json:"description,omitempty"`
+	URL              string            `json:"url"`
+	MainEntityOfPage string            `json:"mainEntityOfPage"`
+	DatePublished    string            `json:"datePublished"`
+	DateModified     string            `json:"dateModified"`
+	Author           blogPostingAuthor `json:"author"`
+	Keywords         string            `json:"keywords,omitempty"`
+	ArticleSection   string            `json:"articleSection,omitempty"`
+}
+
+// postMeta builds the head metadata for a blog post, including a JSON-LD
+// BlogPosting document.
+func postMeta(post models.Post) public.PageMeta {
+	author := "Juniper"
+	userDB := models.ConnectToUserDB()
+	if user, err := userDB.GetUser(post.UserID); err == nil {
+		if name := strings.TrimSpace(user.Forename + " " + user.Surname); name != "" {
+			author = name
+		}
+	}
+
+	description := post.Excerpt(160)
+	jsonLD, err := json.Marshal(blogPosting{
+		Context:          "https://schema.org",
+		Type:             "BlogPosting",
+		Headline:         post.Title,
+		Description:      description,
+		URL:              postURL(post),
+		MainEntityOfPage: postURL(post),
+		DatePublished:    post.PublishedAt.UTC().Format(time.RFC3339),
+		DateModified:     postUpdated(post).UTC().Format(time.RFC3339),
+		Author:           blogPostingAuthor{Type: "Person", Name: author},
+		Keywords:         strings.Join(post.TagList(), ", "),
+		ArticleSection:   post.Category,
+	})
+	if err != nil {
+		jsonLD = nil
+	}
+
+	return public.PageMeta{
+		Title:        post.Title,
+		Description:  description,
+		CanonicalURL: postURL(post),
+		Type:         "article",
+		JSONLD:       string(jsonLD),
+	}
+}
+
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 urlset"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+type sitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+type sitemapIndex struct {
+	XMLName  xml.Name     `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 sitemapindex"`
+	Sitemaps []sitemapURL `xml:"sitemap"`
+}
+
+func sitemapURLs() ([]sitemapURL, error) {
+	posts, err := models.ListPublishedPosts(APP_DATA.PostHandler.DB(), models.PostFilter{})
+	if err != nil {
+		return nil, err
+	}
+
+	urls := []sitemapURL{}
+	for _, path := range sitemapStaticPaths {
+		urls = append(urls, sitemapURL{Loc: siteURL() + path})
+	}
+	for _, post := range posts {
+		urls = append(urls, sitemapURL{
+			Loc:     postURL(post),
+			LastMod: postUpdated(post).UTC().Format("2006-01-02"),
+		})
+	}
+	return urls, nil
+}
+
+func writeXML(w http.ResponseWriter, v any) {
+	out, err := xml.MarshalIndent(v, "", "  ")
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	w.Write(out)
+}
+
+// seo_Sitemap serves the sitemap, or a sitemap index pointing at the numbered
+// pages once there are more URLs than fit in a single file.
+func seo_Sitemap(w http.ResponseWriter, r *http.Request) {
+	urls, err := sitemapURLs()
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	if len(urls) <= sitemapURLLimit {
+		writeXML(w, sitemapURLSet{URLs: urls})
+		return
+	}
+
+	index := sitemapIndex{}
+	pages := (len(urls) + sitemapURLLimit - 1) / sitemapURLLimit
+	for page := 1; page <= pages; page++ {
+		index.Sitemaps = append(index.Sitemaps, sitemapURL{
+			Loc: siteURL() + "/sitemaps/" + strconv.Itoa(page) + ".xml",
+		})
+	}
+	writeXML(w, index)
+}
+
+func seo_SitemapPage(w http.ResponseWriter, r *http.Request) {
+	page, err := strconv.Atoi(strings.TrimSuffix(r.PathValue("page"), ".xml"))
+	if err != nil || page < 1 {
+		http.NotFound(w, r)
+		return
+	}
+
+	urls, err := sitemapURLs()
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	start := (page - 1) * sitemapURLLimit
+	if start >= len(urls) {
+		http.NotFound(w, r)
+		return
+	}
+	end := min(start+sitemapURLLimit, len(urls))
+	writeXML(w, sitemapURLSet{URLs: urls[start:end]})
+}
+
+// seo_Robots serves the file at Robots.TxtPath when configured, otherwise a
+// generated robots.txt disallowing Robots.Disallow.
+func seo_Robots(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	if path := APP_CONFIG.Robots.TxtPath; path != "" {
+		if content, err := os.ReadFile(path); err == nil {
+			w.Write(content)
+			return
+		}
+	}
+
+	disallow := APP_CONFIG.Robots.Disallow
+
+	var b strings.Builder
+	b.WriteString("User-agent: *\n")
+	if len(disallow) == 0 {
+		b.WriteString("Disallow:\n")
+	}
+	for _, path := range disallow {
+		b.WriteString("Disallow: " + path + "\n")
+	}
+	b.WriteString("\nSitemap: " + siteURL() + "/sitemap.xml\n")
+	w.Write([]byte(b.String()))
+}
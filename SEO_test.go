@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+	"pioneerwebworks.com/juniper/config"
+	"pioneerwebworks.com/juniper/cors"
+	"pioneerwebworks.com/juniper/models"
+)
+
+// withTestPosts points APP_CONFIG at example.com and APP_DATA at a post
+// database holding a draft and two published posts.
+func withTestPosts(t *testing.T) {
+	savedConfig, savedData := APP_CONFIG, APP_DATA
+	APP_CONFIG = &config.Config{SiteURL: "https://example.com"}
+	APP_DATA = models.AppData{PostHandler: models.NewModelHandler[models.Post](
+		&models.Post{},
+		models.PostJSONMapper,
+		filepath.Join(t.TempDir(), "post.db"),
+		&gorm.Config{},
+		http.NewServeMux(),
+		context.Background(),
+		cors.Options{},
+	)}
+	t.Cleanup(func() {
+		APP_DATA.PostHandler.Close()
+		APP_CONFIG, APP_DATA = savedConfig, savedData
+	})
+
+	published := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	db := APP_DATA.PostHandler.DB()
+	db.Create(&models.Post{Title: "Draft", Slug: "draft", Content: "d", UserID: 1})
+	db.Create(&models.Post{Title: "First", Slug: "first", Content: "f", UserID: 1, Published: true, PublishedAt: published})
+	db.Create(&models.Post{Title: "Second", Slug: "second", Content: "s", UserID: 1, Published: true, PublishedAt: published.Add(time.Hour)})
+}
+
+func serveSEO(handler http.HandlerFunc, path string, pattern string) *httptest.ResponseRecorder {
+	mux := http.NewServeMux()
+	mux.HandleFunc(pattern, handler)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	return w
+}
+
+func Test_Sitemap(t *testing.T) {
+	withTestPosts(t)
+
+	w := serveSEO(seo_Sitemap, "/sitemap.xml", "GET /sitemap.xml")
+	var set sitemapURLSet
+	if err := xml.Unmarshal(w.Body.Bytes(), &set); err != nil {
+		t.Fatalf("Failed to parse the sitemap: %v\n%s", err, w.Body.String())
+	}
+	locs := []string{}
+	for _, url := range set.URLs {
+		locs = append(locs, url.Loc)
+	}
+	want := "https://example.com/ https://example.com/about https://example.com/blog https://example.com/blog/3 https://example.com/blog/2"
+	if strings.Join(locs, " ") != want {
+		t.Errorf("Expected the static pages and published posts, newest first, got %v", locs)
+	}
+	if strings.Contains(w.Body.String(), "/blog/1<") {
+		t.Errorf("Expected the draft to be left out:\n%s", w.Body.String())
+	}
+	if set.URLs[0].LastMod != "" || set.URLs[4].LastMod == "" {
+		t.Errorf("Expected lastmod only on posts, got %+v", set.URLs)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/xml; charset=utf-8" {
+		t.Errorf("Unexpected Content-Type %q", ct)
+	}
+}
+
+func Test_SitemapIndex(t *testing.T) {
+	withTestPosts(t)
+	saved := sitemapURLLimit
+	sitemapURLLimit = 2
+	t.Cleanup(func() { sitemapURLLimit = saved })
+
+	w := serveSEO(seo_Sitemap, "/sitemap.xml", "GET /sitemap.xml")
+	var index sitemapIndex
+	if err := xml.Unmarshal(w.Body.Bytes(), &index); err != nil {
+		t.Fatalf("Failed to parse the sitemap index: %v\n%s", err, w.Body.String())
+	}
+	if len(index.Sitemaps) != 3 || index.Sitemaps[2].Loc != "https://example.com/sitemaps/3.xml" {
+		t.Fatalf("Expected 3 pages for 5 URLs, got %+v", index.Sitemaps)
+	}
+
+	tests := []struct {
+		path   string
+		status int
+		urls   int
+	}{
+		{"/sitemaps/1.xml", http.StatusOK, 2},
+		{"/sitemaps/3.xml", http.StatusOK, 1},
+		{"/sitemaps/4.xml", http.StatusNotFound, 0},
+		{"/sitemaps/0.xml", http.StatusNotFound, 0},
+		{"/sitemaps/first.xml", http.StatusNotFound, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			w := serveSEO(seo_SitemapPage, tt.path, "GET /sitemaps/{page}")
+			if w.Code != tt.status {
+				t.Fatalf("Expected %d, got %d", tt.status, w.Code)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			var set sitemapURLSet
+			if err := xml.Unmarshal(w.Body.Bytes(), &set); err != nil || len(set.URLs) != tt.urls {
+				t.Errorf("Expected %d URLs, got %+v: %v", tt.urls, set.URLs, err)
+			}
+		})
+	}
+}
+
+func Test_Robots(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "robots.txt")
+	os.WriteFile(file, []byte("User-agent: *\nDisallow: /private\n"), 0600)
+
+	tests := []struct {
+		name   string
+		robots config.RobotsConfig
+		want   string
+	}{
+		{
+			name:   "allow everything",
+			robots: config.RobotsConfig{},
+			want:   "User-agent: *\nDisallow:\n\nSitemap: https://example.com/sitemap.xml\n",
+		},
+		{
+			name:   "disallowed paths",
+			robots: config.RobotsConfig{Disallow: []string{"/dashboard", "/api/"}},
+			want:   "User-agent: *\nDisallow: /dashboard\nDisallow: /api/\n\nSitemap: https://example.com/sitemap.xml\n",
+		},
+		{
+			name:   "file",
+			robots: config.RobotsConfig{TxtPath: file, Disallow: []string{"/dashboard"}},
+			want:   "User-agent: *\nDisallow: /private\n",
+		},
+		{
+			name:   "missing file",
+			robots: config.RobotsConfig{TxtPath: file + ".missing"},
+			want:   "User-agent: *\nDisallow:\n\nSitemap: https://example.com/sitemap.xml\n",
+		},
+	}
+	saved := APP_CONFIG
+	t.Cleanup(func() { APP_CONFIG = saved })
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			APP_CONFIG = &config.Config{SiteURL: "https://example.com/", Robots: tt.robots}
+			w := serveSEO(seo_Robots, "/robots.txt", "GET /robots.txt")
+			if w.Body.String() != tt.want {
+				t.Errorf("Expected:\n%s\ngot:\n%s", tt.want, w.Body.String())
+			}
+		})
+	}
+}
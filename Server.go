@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"pioneerwebworks.com/juniper/certs"
+	"pioneerwebworks.com/juniper/config"
+)
+
+func newServer(cfg *config.Config, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port)),
+		Handler:           handler,
+		ReadTimeout:       cfg.HTTP.ReadTimeout,
+		ReadHeaderTimeout: cfg.HTTP.ReadHeaderTimeout,
+		WriteTimeout:      cfg.HTTP.WriteTimeout,
+		IdleTimeout:       cfg.HTTP.IdleTimeout,
+	}
+}
+
+// newTLSServers returns the HTTPS server, whose certificate is reloaded in
+// the background when the files change, and the plain HTTP server that
+// redirects to it. The redirect server is nil when TLS_REDIRECT_PORT is 0.
+func newTLSServers(cfg *config.Config, handler http.Handler, lifecycle *Lifecycle) (*http.Server, *http.Server, error) {
+	reloader, err := certs.NewReloader(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	lifecycle.Go(func(ctx context.Context) {
+		reloader.Watch(ctx, cfg.TLS.ReloadInterval)
+	})
+
+	server := newServer(cfg, hstsHandler(cfg.TLS, handler))
+	server.TLSConfig = reloader.TLSConfig()
+
+	if cfg.TLS.RedirectPort == 0 {
+		return server, nil, nil
+	}
+	redirect := newServer(cfg, httpsRedirectHandler(cfg.Port))
+	redirect.Addr = net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.TLS.RedirectPort))
+	return server, redirect, nil
+}
+
+// hstsHandler tells browsers to only use HTTPS for the site from now on.
+func hstsHandler(tlsConfig config.TLSConfig, next http.Handler) http.Handler {
+	if tlsConfig.HSTSMaxAge <= 0 {
+		return next
+	}
+	value := "max-age=" + strconv.Itoa(int(tlsConfig.HSTSMaxAge.Seconds()))
+	if tlsConfig.HSTSIncludeSubdomains {
+		value += "; includeSubDomains"
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Strict-Transport-Security", value)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func httpsRedirectHandler(httpsPort int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if host == "" {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		if httpsPort != 443 {
+			host = net.JoinHostPort(strings.Trim(host, "[]"), strconv.Itoa(httpsPort))
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// serve runs the servers until one fails or SIGINT or SIGTERM arrives, then
+// stops accepting connections, waits up to the shutdown timeout for in-flight
+// requests, and shuts the lifecycle down. A second signal exits immediately.
+// Servers with a TLSConfig serve HTTPS.
+func serve(cfg *config.Config, lifecycle *Lifecycle, servers ...*http.Server) error {
+	signals, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	serverErr := make(chan error, len(servers))
+	for _, server := range servers {
+		go func() {
+			if server.TLSConfig != nil {
+				slog.Info("server listening", "addr", "https://"+server.Addr)
+				serverErr <- server.ListenAndServeTLS("", "")
+			} else {
+				slog.Info("server listening", "addr", "http://"+server.Addr)
+				serverErr <- server.ListenAndServe()
+			}
+		}()
+	}
+
+	var runErr error
+	select {
+	case runErr = <-serverErr:
+	case <-signals.Done():
+	}
+	stop()
+
+	slog.Info("shutting down, draining requests", "timeout", cfg.HTTP.ShutdownTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.HTTP.ShutdownTimeout)
+	defer cancel()
+
+	errs := []error{runErr}
+	for _, server := range servers {
+		err := server.Shutdown(ctx)
+		if errors.Is(err, context.DeadlineExceeded) {
+			slog.Warn("shutdown timeout reached, closing remaining connections", "addr", server.Addr)
+			server.Close()
+		}
+		errs = append(errs, err)
+	}
+	errs = append(errs, lifecycle.Shutdown())
+	return errors.Join(errs...)
+}
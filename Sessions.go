@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"pioneerwebworks.com/juniper/apperr"
+	"pioneerwebworks.com/juniper/auth"
+	"pioneerwebworks.com/juniper/config"
+	"pioneerwebworks.com/juniper/models"
+	"pioneerwebworks.com/juniper/views/dashboard"
+	"pioneerwebworks.com/juniper/views/public"
+)
+
+// sessionKeyConfig says where cfg takes the session keys from.
+func sessionKeyConfig(cfg *config.Config) auth.KeyConfig {
+	return auth.KeyConfig{
+		Configured:  cfg.Auth.SessionKeys,
+		File:        cfg.Auth.SessionKeyFile,
+		GracePeriod: cfg.Auth.SessionKeyGracePeriod,
+	}
+}
+
+// sessionsUser returns the user whose sessions the request is about: the
+// logged in user, or for administrators the user in the "user" query
+// parameter.
+func sessionsUser(r *http.Request) (models.User, error) {
+	userDB := models.ConnectToUserDB().WithContext(r.Context())
+	user, err := userDB.GetUser(auth.UserIDFromContext(r.Context()))
+	if err != nil {
+		return user, apperr.Unauthorized("Unauthorized").Wrap(err)
+	}
+	query := r.URL.Query().Get("user")
+	if query == "" || query == strconv.FormatUint(uint64(user.ID), 10) {
+		return user, nil
+	}
+	if user.UserRole != "administrator" {
+		return models.User{}, apperr.Forbidden("Forbidden")
+	}
+	id, err := strconv.ParseUint(query, 10, 64)
+	if err != nil {
+		return models.User{}, apperr.NotFound("User not found")
+	}
+	other, err := userDB.GetUser(uint(id))
+	if err != nil {
+		return other, apperr.NotFound("User not found").Wrap(err)
+	}
+	return other, nil
+}
+
+// dashboard_Sessions lists the devices a user is logged in on.
+func (dh *DashboardHandler) dashboard_Sessions(w http.ResponseWriter, r *http.Request) {
+	user, err := sessionsUser(r)
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
+	userDB := models.ConnectToUserDB().WithContext(r.Context())
+	sessions, err := userDB.ActiveSessions(user.ID, time.Now(), auth.Store.IdleTimeout)
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
+	csrf, err := auth.CSRFToken(w, r)
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
+	session, _ := auth.Store.Get(r, "juniper-session")
+
+	public.App(
+		dashboard.Sessions(user, sessions, session.ID, sessionsQuery(user), csrf),
+		public.Header(getSessionUser(r)),
+		public.Footer(),
+		public.Head(privatePageMeta(r, "Sessions - Juniper")),
+	).Render(dh.Context, w)
+}
+
+// dashboard_RevokeSession logs one device out.
+func (dh *DashboardHandler) dashboard_RevokeSession(w http.ResponseWriter, r *http.Request) error {
+	user, err := sessionsUser(r)
+	if err != nil {
+		return err
+	}
+	userDB := models.ConnectToUserDB().WithContext(r.Context())
+	found, err := userDB.RevokeSession(user.ID, r.PathValue("id"))
+	if err != nil {
+		return apperr.Internal(err)
+	}
+	if !found {
+		return apperr.NotFound("Session not found")
+	}
+	http.Redirect(w, r, "/dashboard/sessions"+sessionsQuery(user), http.StatusSeeOther)
+	return nil
+}
+
+// dashboard_RevokeOtherSessions logs out every device but the one making
+// the request.
+func (dh *DashboardHandler) dashboard_RevokeOtherSessions(w http.ResponseWriter, r *http.Request) error {
+	user, err := sessionsUser(r)
+	if err != nil {
+		return err
+	}
+	session, _ := auth.Store.Get(r, "juniper-session")
+	userDB := models.ConnectToUserDB().WithContext(r.Context())
+	if _, err := userDB.RevokeSessions(user.ID, session.ID); err != nil {
+		return apperr.Internal(err)
+	}
+	http.Redirect(w, r, "/dashboard/sessions"+sessionsQuery(user), http.StatusSeeOther)
+	return nil
+}
+
+// sessionsQuery keeps an administrator on the sessions of the user they are
+// looking at.
+func sessionsQuery(user models.User) string {
+	return "?user=" + strconv.FormatUint(uint64(user.ID), 10)
+}
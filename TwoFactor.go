@@ -0,0 +1,183 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/a-h/templ"
+	"pioneerwebworks.com/juniper/apperr"
+	"pioneerwebworks.com/juniper/auth"
+	"pioneerwebworks.com/juniper/models"
+	"pioneerwebworks.com/juniper/totp"
+	"pioneerwebworks.com/juniper/views/dashboard"
+	"pioneerwebworks.com/juniper/views/public"
+)
+
+// recoveryCodeCount is how many recovery codes a user gets at a time.
+const recoveryCodeCount = 10
+
+// totpPendingKey keeps the secret shown on the setup page in the session
+// until the user confirms it with a code.
+const totpPendingKey = "totpPending"
+
+// dashboard_TwoFactor shows the setup page, or the recovery codes and
+// settings once two-factor authentication is on.
+func (dh *DashboardHandler) dashboard_TwoFactor(w http.ResponseWriter, r *http.Request) {
+	userDB := models.ConnectToUserDB().WithContext(r.Context())
+	user, err := userDB.GetUser(auth.UserIDFromContext(r.Context()))
+	if err != nil {
+		renderError(w, r, apperr.Unauthorized("Unauthorized").Wrap(err))
+		return
+	}
+	if err := dh.renderTwoFactor(w, r, user, nil, ""); err != nil {
+		renderError(w, r, err)
+	}
+}
+
+// dashboard_TwoFactorEnable turns two-factor authentication on once the
+// user enters a code for the secret from the setup page.
+func (dh *DashboardHandler) dashboard_TwoFactorEnable(w http.ResponseWriter, r *http.Request) error {
+	userDB := models.ConnectToUserDB().WithContext(r.Context())
+	user, err := userDB.GetUser(auth.UserIDFromContext(r.Context()))
+	if err != nil {
+		return apperr.Unauthorized("Unauthorized").Wrap(err)
+	}
+	if user.TOTPEnabled {
+		http.Redirect(w, r, auth.TwoFactorSetupPath, http.StatusSeeOther)
+		return nil
+	}
+
+	session, _ := auth.Store.Get(r, "juniper-session")
+	secret, _ := session.Values[totpPendingKey].(string)
+	if secret == "" {
+		http.Redirect(w, r, auth.TwoFactorSetupPath, http.StatusSeeOther)
+		return nil
+	}
+	step, ok := totp.Validate(secret, r.PostFormValue("code"), time.Now(), 0)
+	if !ok {
+		return dh.renderTwoFactor(w, r, user, nil, "The code is not right, check the time on your device and try again.")
+	}
+
+	codes, err := auth.GenerateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		return apperr.Internal(err)
+	}
+	if err := userDB.EnableTOTP(&user, secret, step, codes); err != nil {
+		return apperr.Internal(err)
+	}
+	delete(session.Values, totpPendingKey)
+	if err := session.Save(r, w); err != nil {
+		return apperr.Internal(err)
+	}
+	return dh.renderTwoFactor(w, r, user, codes, "")
+}
+
+// dashboard_TwoFactorRecoveryCodes replaces the recovery codes of the user
+// with new ones.
+func (dh *DashboardHandler) dashboard_TwoFactorRecoveryCodes(w http.ResponseWriter, r *http.Request) error {
+	user, ok, err := twoFactorConfirmed(r)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return dh.renderTwoFactor(w, r, user, nil, "The code is not right.")
+	}
+
+	codes, err := auth.GenerateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		return apperr.Internal(err)
+	}
+	userDB := models.ConnectToUserDB().WithContext(r.Context())
+	if err := userDB.ReplaceRecoveryCodes(user.ID, codes); err != nil {
+		return apperr.Internal(err)
+	}
+	return dh.renderTwoFactor(w, r, user, codes, "")
+}
+
+// dashboard_TwoFactorDisable turns two-factor authentication off, unless
+// the role of the user requires it.
+func (dh *DashboardHandler) dashboard_TwoFactorDisable(w http.ResponseWriter, r *http.Request) error {
+	user, ok, err := twoFactorConfirmed(r)
+	if err != nil {
+		return err
+	}
+	if auth.TwoFactorRequired(user) {
+		return apperr.Forbidden("Two-factor authentication is required for your role")
+	}
+	if !ok {
+		return dh.renderTwoFactor(w, r, user, nil, "The code is not right.")
+	}
+
+	userDB := models.ConnectToUserDB().WithContext(r.Context())
+	if err := userDB.DisableTOTP(&user); err != nil {
+		return apperr.Internal(err)
+	}
+	http.Redirect(w, r, auth.TwoFactorSetupPath, http.StatusSeeOther)
+	return nil
+}
+
+// twoFactorConfirmed loads the logged in user and checks the code or
+// recovery code they posted, so a forgotten open session is not enough to
+// change their two-factor settings.
+func twoFactorConfirmed(r *http.Request) (models.User, bool, error) {
+	userDB := models.ConnectToUserDB().WithContext(r.Context())
+	user, err := userDB.GetUser(auth.UserIDFromContext(r.Context()))
+	if err != nil {
+		return user, false, apperr.Unauthorized("Unauthorized").Wrap(err)
+	}
+	if !user.TOTPEnabled {
+		return user, false, apperr.BadRequest("Two-factor authentication is not enabled")
+	}
+	ok, err := auth.VerifySecondFactor(userDB, &user, r.PostFormValue("code"), r.PostFormValue("recoveryCode"), time.Now())
+	if err != nil {
+		return user, false, apperr.Internal(err)
+	}
+	return user, ok, nil
+}
+
+// renderTwoFactor renders the two-factor page for user. codes are the new
+// recovery codes, shown only this once.
+func (dh *DashboardHandler) renderTwoFactor(w http.ResponseWriter, r *http.Request, user models.User, codes []string, message string) error {
+	csrf, err := auth.CSRFToken(w, r)
+	if err != nil {
+		return apperr.Internal(err)
+	}
+
+	var page templ.Component
+	if user.TOTPEnabled {
+		userDB := models.ConnectToUserDB().WithContext(r.Context())
+		remaining, err := userDB.RemainingRecoveryCodes(user.ID)
+		if err != nil {
+			return apperr.Internal(err)
+		}
+		page = dashboard.TwoFactor(user, codes, remaining, auth.TwoFactorRequired(user), message, csrf)
+	} else {
+		// Keep showing the same secret until it is confirmed, so a reload
+		// does not invalidate what the user already scanned.
+		session, _ := auth.Store.Get(r, "juniper-session")
+		secret, _ := session.Values[totpPendingKey].(string)
+		if secret == "" {
+			if secret, err = totp.GenerateSecret(); err != nil {
+				return apperr.Internal(err)
+			}
+			session.Values[totpPendingKey] = secret
+			if err := session.Save(r, w); err != nil {
+				return apperr.Internal(err)
+			}
+		}
+		uri := totp.URI(APP_CONFIG.Auth.TOTPIssuer, user.Username, secret)
+		qrCode, err := totp.QRCode(uri)
+		if err != nil {
+			return apperr.Internal(err)
+		}
+		page = dashboard.TwoFactorSetup(secret, qrCode, auth.TwoFactorRequired(user), message, csrf)
+	}
+
+	public.App(
+		page,
+		public.Header(getSessionUser(r)),
+		public.Footer(),
+		public.Head(privatePageMeta(r, "Two-factor authentication - Juniper")),
+	).Render(dh.Context, w)
+	return nil
+}
@@ -0,0 +1,137 @@
+package apperr
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"pioneerwebworks.com/juniper/requestid"
+)
+
+// AppError is an error with an HTTP status and a message that is safe to
+// show to users. The cause in Err is logged but never sent to the client.
+type AppError struct {
+	Status  int
+	Code    string            // Machine readable, e.g. "not_found"
+	Message string            // Human readable
+	Details map[string]string // Per-field problems for validation errors
+	Err     error
+}
+
+func (e *AppError) Error() string {
+	if e.Err != nil {
+		return e.Message + ": " + e.Err.Error()
+	}
+	return e.Message
+}
+
+func (e *AppError) Unwrap() error {
+	return e.Err
+}
+
+// Wrap returns a copy of the error with err as its cause.
+func (e *AppError) Wrap(err error) *AppError {
+	wrapped := *e
+	wrapped.Err = err
+	return &wrapped
+}
+
+// New creates an error for status, with the code derived from the status
+// text, e.g. 404 becomes "not_found".
+func New(status int, message string) *AppError {
+	code := strings.ToLower(strings.ReplaceAll(http.StatusText(status), " ", "_"))
+	return &AppError{Status: status, Code: code, Message: message}
+}
+
+func BadRequest(message string) *AppError {
+	return New(http.StatusBadRequest, message)
+}
+
+func Unauthorized(message string) *AppError {
+	return New(http.StatusUnauthorized, message)
+}
+
+func Forbidden(message string) *AppError {
+	return New(http.StatusForbidden, message)
+}
+
+func NotFound(message string) *AppError {
+	return New(http.StatusNotFound, message)
+}
+
+func Conflict(message string) *AppError {
+	return New(http.StatusConflict, message)
+}
+
+func Unprocessable(message string) *AppError {
+	return New(http.StatusUnprocessableEntity, message)
+}
+
+// Validation reports problems with individual fields, keyed by field name.
+func Validation(details map[string]string) *AppError {
+	err := Unprocessable("Validation failed")
+	err.Details = details
+	return err
+}
+
+func Internal(err error) *AppError {
+	return New(http.StatusInternalServerError, "Internal Server Error").Wrap(err)
+}
+
+// From returns err as an *AppError. Any other error is internal.
+func From(err error) *AppError {
+	var appErr *AppError
+	if errors.As(err, &appErr) {
+		return appErr
+	}
+	return Internal(err)
+}
+
+// Report converts err with From and logs server errors with their cause.
+func Report(r *http.Request, err error) *AppError {
+	appErr := From(err)
+	if appErr.Status >= 500 && appErr.Err != nil {
+		slog.ErrorContext(r.Context(), "request failed",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", appErr.Status,
+			"error", appErr.Error(),
+		)
+	}
+	return appErr
+}
+
+// IsAPIRequest reports whether the caller expects JSON rather than a page.
+func IsAPIRequest(r *http.Request) bool {
+	return r.URL.Path == "/api" || strings.HasPrefix(r.URL.Path, "/api/")
+}
+
+type envelope struct {
+	Error envelopeError `json:"error"`
+}
+
+type envelopeError struct {
+	Status    int               `json:"status"`
+	Code      string            `json:"code"`
+	Message   string            `json:"message"`
+	Details   map[string]string `json:"details,omitempty"`
+	RequestID string            `json:"requestId,omitempty"`
+}
+
+// WriteJSON writes err as
+//
+//	{"error": {"status": 404, "code": "not_found", "message": "...", "requestId": "..."}}
+func WriteJSON(w http.ResponseWriter, r *http.Request, err error) {
+	appErr := Report(r, err)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(appErr.Status)
+	json.NewEncoder(w).Encode(envelope{Error: envelopeError{
+		Status:    appErr.Status,
+		Code:      appErr.Code,
+		Message:   appErr.Message,
+		Details:   appErr.Details,
+		RequestID: requestid.FromContext(r.Context()),
+	}})
+}
@@ -0,0 +1,58 @@
+package apperr
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"pioneerwebworks.com/juniper/requestid"
+)
+
+func Test_WriteJSON(t *testing.T) {
+	r := httptest.NewRequest("GET", "/api/posts/1", nil)
+	r = r.WithContext(requestid.NewContext(r.Context(), "abc"))
+
+	tests := []struct {
+		err     error
+		status  int
+		code    string
+		message string
+	}{
+		{NotFound("Post not found"), http.StatusNotFound, "not_found", "Post not found"},
+		{Conflict("User already exists"), http.StatusConflict, "conflict", "User already exists"},
+		{Validation(map[string]string{"title": "required"}), http.StatusUnprocessableEntity, "unprocessable_entity", "Validation failed"},
+		// Causes of internal errors are not sent to the client.
+		{errors.New("database is locked"), http.StatusInternalServerError, "internal_server_error", "Internal Server Error"},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		WriteJSON(w, r, test.err)
+
+		var body envelope
+		if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		if w.Code != test.status || body.Error.Status != test.status {
+			t.Errorf("Expected status %d, got %d / %d", test.status, w.Code, body.Error.Status)
+		}
+		if body.Error.Code != test.code || body.Error.Message != test.message {
+			t.Errorf("Unexpected error %+v", body.Error)
+		}
+		if body.Error.RequestID != "abc" {
+			t.Errorf("Expected request ID abc, got %q", body.Error.RequestID)
+		}
+	}
+}
+
+func Test_From(t *testing.T) {
+	cause := errors.New("duplicate key")
+	wrapped := Conflict("Already exists").Wrap(cause)
+	if !errors.Is(From(wrapped), cause) {
+		t.Errorf("Failed to unwrap the cause")
+	}
+	if From(wrapped).Status != http.StatusConflict {
+		t.Errorf("Expected the status to be kept, got %d", From(wrapped).Status)
+	}
+}
@@ -0,0 +1,235 @@
+package assets
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/andybalholm/brotli"
+)
+
+const (
+	immutableCacheControl  = "public, max-age=31536000, immutable"
+	revalidateCacheControl = "public, no-cache"
+)
+
+// Content types worth compressing. Images and archives already are.
+var compressibleTypes = []string{
+	"text/",
+	"application/javascript",
+	"application/json",
+	"image/svg+xml",
+	"font/ttf",
+	"font/otf",
+}
+
+type asset struct {
+	data        []byte
+	gzip        []byte
+	brotli      []byte
+	etag        string
+	contentType string
+}
+
+// Assets serves a tree of static files. Outside of dev mode every file is
+// loaded into memory on startup, fingerprinted, and precompressed so it can
+// be served under a content hashed URL with far-future caching.
+type Assets struct {
+	dev     bool
+	loaded  time.Time
+	files   map[string]*asset // Keyed by path, e.g. "styles/app.css"
+	urls    map[string]string // Path to hashed path
+	hashed  map[string]string // Hashed path to path
+	devFile http.Handler
+}
+
+// Default is used by URL. Until it is replaced URL returns paths unchanged.
+var Default = &Assets{}
+
+// URL returns the cache-busted URL for an asset of the Default set.
+func URL(assetPath string) string {
+	return Default.URL(assetPath)
+}
+
+// New prepares the files in fsys. In dev mode files are read from fsys on
+// every request, so edits show up without a restart, and URLs are not hashed.
+func New(fsys fs.FS, dev bool) (*Assets, error) {
+	a := &Assets{
+		dev:     dev,
+		loaded:  time.Now(),
+		files:   map[string]*asset{},
+		urls:    map[string]string{},
+		hashed:  map[string]string{},
+		devFile: http.FileServerFS(fsys),
+	}
+	if dev {
+		return a, nil
+	}
+
+	err := fs.WalkDir(fsys, ".", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		return a.add(name, data)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *Assets) add(name string, data []byte) error {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])[:12]
+
+	ext := path.Ext(name)
+	contentType := mime.TypeByExtension(ext)
+	if contentType == "" {
+		contentType = http.DetectContentType(data)
+	}
+
+	file := &asset{
+		data:        data,
+		etag:        `"` + hash + `"`,
+		contentType: contentType,
+	}
+	if isCompressible(contentType) {
+		var err error
+		if file.gzip, err = gzipBytes(data); err != nil {
+			return err
+		}
+		if file.brotli, err = brotliBytes(data); err != nil {
+			return err
+		}
+	}
+
+	hashedName := strings.TrimSuffix(name, ext) + "." + hash + ext
+	a.files[name] = file
+	a.urls[name] = hashedName
+	a.hashed[hashedName] = name
+	return nil
+}
+
+// URL maps "/styles/app.css" to "/styles/app.<hash>.css". Unknown paths and
+// dev mode return the path unchanged.
+func (a *Assets) URL(assetPath string) string {
+	if hashedName, ok := a.urls[strings.TrimPrefix(assetPath, "/")]; ok {
+		return "/" + hashedName
+	}
+	return assetPath
+}
+
+func (a *Assets) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if a.dev {
+		w.Header().Set("Cache-Control", "no-store")
+		a.devFile.ServeHTTP(w, r)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	cacheControl := revalidateCacheControl
+	if original, ok := a.hashed[name]; ok {
+		name = original
+		cacheControl = immutableCacheControl
+	}
+	file, ok := a.files[name]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	body := file.data
+	header := w.Header()
+	header.Set("Cache-Control", cacheControl)
+	header.Set("Content-Type", file.contentType)
+	etag := file.etag
+	if file.gzip != nil {
+		header.Add("Vary", "Accept-Encoding")
+		// Each encoding is a different representation and needs its own ETag.
+		switch acceptedEncoding(r.Header.Get("Accept-Encoding")) {
+		case "br":
+			body = file.brotli
+			etag = strings.TrimSuffix(etag, `"`) + `-br"`
+			header.Set("Content-Encoding", "br")
+		case "gzip":
+			body = file.gzip
+			etag = strings.TrimSuffix(etag, `"`) + `-gz"`
+			header.Set("Content-Encoding", "gzip")
+		}
+	}
+	header.Set("ETag", etag)
+
+	http.ServeContent(w, r, name, a.loaded, bytes.NewReader(body))
+}
+
+// acceptedEncoding picks brotli over gzip when the client accepts it.
+func acceptedEncoding(acceptEncoding string) string {
+	accepted := map[string]bool{}
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		fields := strings.Split(part, ";")
+		encoding := strings.TrimSpace(fields[0])
+		refused := false
+		for _, param := range fields[1:] {
+			param = strings.ReplaceAll(param, " ", "")
+			if param == "q=0" || param == "q=0.0" || param == "q=0.00" || param == "q=0.000" {
+				refused = true
+			}
+		}
+		accepted[encoding] = !refused
+	}
+	switch {
+	case accepted["br"]:
+		return "br"
+	case accepted["gzip"]:
+		return "gzip"
+	}
+	return ""
+}
+
+func isCompressible(contentType string) bool {
+	for _, prefix := range compressibleTypes {
+		if strings.HasPrefix(contentType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func gzipBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	writer, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func brotliBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	// BestCompression takes seconds on the fonts, which delays startup.
+	writer := brotli.NewWriterLevel(&buf, brotli.DefaultCompression)
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
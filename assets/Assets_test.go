@@ -0,0 +1,74 @@
+package assets
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func Test_AssetsHashedURL(t *testing.T) {
+	css := strings.Repeat("body { color: red; }\n", 50)
+	a, err := New(fstest.MapFS{
+		"styles/app.css": {Data: []byte(css)},
+	}, false)
+	if err != nil {
+		t.Fatalf("Failed to load assets: %v", err)
+	}
+
+	url := a.URL("/styles/app.css")
+	if url == "/styles/app.css" || !strings.HasPrefix(url, "/styles/app.") || !strings.HasSuffix(url, ".css") {
+		t.Fatalf("Expected hashed URL, got %s", url)
+	}
+	if a.URL("/styles/missing.css") != "/styles/missing.css" {
+		t.Errorf("Expected unknown paths to be returned unchanged")
+	}
+
+	request := httptest.NewRequest(http.MethodGet, url, nil)
+	request.Header.Set("Accept-Encoding", "gzip, br;q=0")
+	recorder := httptest.NewRecorder()
+	a.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", recorder.Code)
+	}
+	if recorder.Header().Get("Cache-Control") != immutableCacheControl {
+		t.Errorf("Expected immutable caching, got %q", recorder.Header().Get("Cache-Control"))
+	}
+	if recorder.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Expected gzip encoding, got %q", recorder.Header().Get("Content-Encoding"))
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(recorder.Body.Bytes()))
+	if err != nil {
+		t.Fatalf("Invalid gzip body: %v", err)
+	}
+	body, _ := io.ReadAll(reader)
+	if string(body) != css {
+		t.Errorf("Decompressed body does not match")
+	}
+
+	// Conditional requests are answered from the ETag.
+	etag := recorder.Header().Get("ETag")
+	request = httptest.NewRequest(http.MethodGet, url, nil)
+	request.Header.Set("Accept-Encoding", "gzip, br;q=0")
+	request.Header.Set("If-None-Match", etag)
+	recorder = httptest.NewRecorder()
+	a.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusNotModified {
+		t.Errorf("Expected 304, got %d", recorder.Code)
+	}
+
+	// The unhashed path still works but must be revalidated.
+	recorder = httptest.NewRecorder()
+	a.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/styles/app.css", nil))
+	if recorder.Header().Get("Cache-Control") != revalidateCacheControl {
+		t.Errorf("Expected revalidation for unhashed path, got %q", recorder.Header().Get("Cache-Control"))
+	}
+	if recorder.Body.String() != css {
+		t.Errorf("Expected identity body without Accept-Encoding")
+	}
+}
@@ -5,36 +5,57 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
-	"strconv"
+	"time"
 
 	"github.com/google/uuid"
-	"github.com/gorilla/sessions"
+	"pioneerwebworks.com/juniper/apperr"
+	"pioneerwebworks.com/juniper/logging"
+	"pioneerwebworks.com/juniper/metrics"
 	"pioneerwebworks.com/juniper/models"
 )
 
 var (
-	Store *sessions.CookieStore
+	Store *DBStore
 )
 
-func Init() {
-	key, err := LoadSessionKey()
+// Init sets up Store on the user database with the session keys from keys.
+// Sessions end lifetime after login or after idleTimeout without a request.
+// Cookies are HttpOnly and SameSite=Lax, and with secure set they are only
+// sent over HTTPS.
+func Init(secure bool, lifetime, idleTimeout time.Duration, keys KeyConfig) {
+	ring, err := keys.Load(time.Now())
 	if err != nil {
-		key, err = GenerateRandomKey(32)
-		if err != nil {
-			log.Fatal(err)
-		}
-		err = SaveSessionKey(key)
-		if err != nil {
-			log.Fatal(err)
-		}
+		log.Fatal(err)
 	}
 
-	Store = sessions.NewCookieStore([]byte(key))
+	Store = NewDBStore(models.ConnectToUserDB(), ring, lifetime, idleTimeout)
+	Store.Options.Secure = secure
+}
+
+// CheckSessionKey reports whether Init set up Store with a usable key.
+func CheckSessionKey(ctx context.Context) error {
+	if Store == nil {
+		return errors.New("session store not initialized")
+	}
+	codecs := Store.Codecs()
+	if len(codecs) == 0 {
+		return errors.New("no session keys")
+	}
+	// Round trip a value to prove the key works.
+	encoded, err := codecs[0].Encode("juniper-health", "ok")
+	if err != nil {
+		return err
+	}
+	var decoded string
+	return codecs[0].Decode("juniper-health", encoded, &decoded)
 }
 
 type contextKey string
@@ -55,14 +76,7 @@ func GenerateRandomKey(length int) ([]byte, error) {
 	return key, nil
 }
 
-func SaveSessionKey(key []byte) error {
-	err := os.WriteFile("session.key", key, 0600)
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
+// LoadSessionKey reads the signing key older versions kept in session.key.
 func LoadSessionKey() ([]byte, error) {
 	key, err := os.ReadFile("session.key")
 	if err != nil {
@@ -75,46 +89,70 @@ type AuthMiddleware struct {
 	Next http.Handler
 }
 
-func (am *AuthMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	session, err := Store.Get(r, "juniper-session")
-	userDB := models.ConnectToUserDB()
+// Outcomes of checkSession, counted by metrics.ObserveSessionCheck.
+const (
+	sessionOK              = "ok"
+	sessionUnknownUser     = "unknown_user"
+	sessionUnauthenticated = "unauthenticated"
+	sessionUnverified      = "unverified"
+	sessionTwoFactorSetup  = "two_factor_setup"
+)
 
+// checkSession returns the user logged in with the session of r, and
+// sessionOK if they may use the app, or else what stops them.
+func checkSession(r *http.Request) (models.User, string, error) {
+	session, err := Store.Get(r, "juniper-session")
 	if err != nil {
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return
+		return models.User{}, "", err
 	}
-
-	auth, authOK := session.Values["authenticated"].(bool)
+	authenticated, _ := session.Values["authenticated"].(bool)
 	userID, _ := session.Values["userID"].(uint)
+	if userID == 0 {
+		slog.DebugContext(r.Context(), "auth: no session")
+		return models.User{}, sessionUnknownUser, nil
+	}
 
-	user, err := userDB.GetUser(uint(userID))
-
-	log.Println("user", user)
+	userDB := models.ConnectToUserDB().WithContext(r.Context())
+	user, err := userDB.GetUser(userID)
+	switch {
+	case err != nil:
+		slog.DebugContext(r.Context(), "auth: unknown user", "user_id", userID, "error", err)
+		return models.User{ID: userID}, sessionUnknownUser, nil
+	case !authenticated:
+		slog.DebugContext(r.Context(), "auth: not authenticated", "user_id", userID)
+		return user, sessionUnauthenticated, nil
+	case !user.EmailVerified:
+		slog.DebugContext(r.Context(), "auth: email not verified", "user_id", userID)
+		return user, sessionUnverified, nil
+	case needsTwoFactorSetup(user, r.URL.Path):
+		slog.DebugContext(r.Context(), "auth: two-factor setup required", "user_id", userID)
+		return user, sessionTwoFactorSetup, nil
+	}
+	return user, sessionOK, nil
+}
 
+func (am *AuthMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, check, err := checkSession(r)
 	if err != nil {
-		log.Println("AUTH: Error getting user: " + err.Error())
-		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
+	metrics.ObserveSessionCheck(check)
 
-	log.Println("AUTH: Auth: " + strconv.FormatBool(auth))
-	log.Println("AUTH: Auth OK: " + strconv.FormatBool(authOK))
-	log.Println("AUTH: User ID: " + strconv.Itoa(int(userID)))
-
-	if !auth {
-		log.Println("AUTH: Not authenticated")
+	switch check {
+	case sessionUnknownUser:
+		http.Redirect(w, r, loginURL(r), http.StatusSeeOther)
+		return
+	case sessionUnauthenticated:
 		if r.Method == "GET" {
-			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			http.Redirect(w, r, loginURL(r), http.StatusSeeOther)
 			return
 		}
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusUnauthorized)
 		w.Write([]byte(`{"error": "Unauthorized"}`))
 		return
-	}
-
-	if !user.EmailVerified {
-		log.Println("AUTH: Email not verified")
+	case sessionUnverified:
 		if r.Method == "GET" {
 			http.Redirect(w, r, "/verify", http.StatusSeeOther)
 			return
@@ -123,18 +161,62 @@ func (am *AuthMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusUnauthorized)
 		w.Write([]byte(`{"error": "Unauthorized. Please verify your email address."}`))
 		return
+	case sessionTwoFactorSetup:
+		if r.Method == "GET" && !apperr.IsAPIRequest(r) {
+			http.Redirect(w, r, TwoFactorSetupPath, http.StatusSeeOther)
+			return
+		}
+		apperr.WriteJSON(w, r, twoFactorSetupRequired())
+		return
 	}
 
-	ctx := context.WithValue(r.Context(), userIDKey, userID)
+	logging.SetUserID(r.Context(), user.ID)
+	ctx := context.WithValue(r.Context(), userIDKey, user.ID)
 	r = r.WithContext(ctx)
 
 	am.Next.ServeHTTP(w, r)
 }
 
+func twoFactorSetupRequired() *apperr.AppError {
+	err := apperr.Forbidden("Set up two-factor authentication first")
+	err.Code = "two_factor_setup_required"
+	return err
+}
+
+// loginURL is the login page, which sends the user back to the page of a
+// GET request once they are logged in.
+func loginURL(r *http.Request) string {
+	if r.Method != "GET" {
+		return "/login"
+	}
+	return "/login?next=" + url.QueryEscape(r.URL.RequestURI())
+}
+
 func WithAuth(next http.Handler) http.Handler {
 	return &AuthMiddleware{Next: next}
 }
 
+// RequireRole only lets users with role through. It goes after WithAuth,
+// which puts the user in the request context.
+func RequireRole(role string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			userDB := models.ConnectToUserDB().WithContext(r.Context())
+			user, err := userDB.GetUser(UserIDFromContext(r.Context()))
+			if err != nil || user.UserRole != role {
+				slog.DebugContext(r.Context(), "auth: missing role", "user_id", user.ID, "role", role)
+				if apperr.IsAPIRequest(r) {
+					apperr.WriteJSON(w, r, apperr.Forbidden("Forbidden"))
+					return
+				}
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
 // GenerateToken generates a secure, unique token for email verification.
 func GenerateToken(email string) (string, error) {
 	// Generate a UUID.
@@ -173,3 +255,10 @@ func GenerateSecureRandomToken() (string, error) {
 
 	return token, nil
 }
+
+// UserIDFromContext returns the ID of the user authenticated by WithAuth,
+// or 0 when the request did not pass through it.
+func UserIDFromContext(ctx context.Context) uint {
+	userID, _ := ctx.Value(userIDKey).(uint)
+	return userID
+}
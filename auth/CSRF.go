@@ -1,17 +1,31 @@
 package auth
 
 import (
-	"bytes"
-	"context"
 	"crypto/rand"
+	"crypto/subtle"
 	"encoding/base64"
-	"encoding/json"
-	"io"
+	"log/slog"
+	"mime"
 	"net/http"
+
+	"pioneerwebworks.com/juniper/apperr"
+)
+
+// CSRFHeader carries the token on fetch calls. Forms send it in the
+// CSRFField field instead.
+const (
+	CSRFHeader = "X-CSRF-Token"
+	CSRFField  = "csrf"
 )
 
-const csrfKey contextKey = "csrf_token"
+// csrfSessionKey is where the token is kept in the session.
+const csrfSessionKey = "csrf"
 
+// CSRFMiddleware refuses state-changing requests that do not send back the
+// token of their session, so other sites cannot make a logged in browser
+// submit forms or call the API. Safe methods pass without touching the
+// session; pages get the token with CSRFToken. Requests that do not rely on
+// cookies pass too, see csrfExempt.
 type CSRFMiddleware struct {
 	Next http.Handler
 }
@@ -21,65 +35,51 @@ func WithCSRF(next http.Handler) http.Handler {
 }
 
 func (c *CSRFMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	session, _ := Store.Get(r, "juniper-session")
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		c.Next.ServeHTTP(w, r)
+		return
+	}
+	if csrfExempt(r) {
+		c.Next.ServeHTTP(w, r)
+		return
+	}
 
-	if r.Method == "GET" {
-		// Check if the CSRF token is present in the session.
-		// If it is not present, generate a new CSRF token and store it in the session.
-		if _, ok := session.Values[csrfKey].(string); !ok {
-			csrfToken, err := GenerateCSRFToken(32)
-			if err != nil {
-				http.Error(w, "Server error", http.StatusInternalServerError)
-				return
-			}
-			ctx := context.WithValue(r.Context(), csrfKey, csrfToken)
-			r = r.WithContext(ctx)
-			session.Values[csrfKey] = csrfToken
-			session.Save(r, w)
-			c.Next.ServeHTTP(w, r)
+	expected := GetCSRFToken(r)
+	sent := r.Header.Get(CSRFHeader)
+	if sent == "" && isURLEncodedForm(r) {
+		// Multipart bodies are left for the handler to parse with its own
+		// size limit, so uploads must use the header.
+		sent = r.PostFormValue(CSRFField)
+	}
+	if expected == "" || subtle.ConstantTimeCompare([]byte(sent), []byte(expected)) != 1 {
+		slog.DebugContext(r.Context(), "csrf: token mismatch", "sent", sent != "", "session", expected != "")
+		if apperr.IsAPIRequest(r) {
+			apperr.WriteJSON(w, r, apperr.Forbidden("Invalid CSRF token"))
 			return
 		}
+		http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+		return
 	}
 
-	if r.Method == "POST" || r.Method == "PUT" || r.Method == "DELETE" {
-		// Check if the CSRF token is present in the session.
-		// If it is present, validate the CSRF token.
-		// If it is not present, deny the request.
-		csrfToken, ok := session.Values[csrfKey].(string)
-		var csrfTokenInRequest string
-		if ok {
-			// If the request is a JSON request, validate the CSRF token.
-			if r.Header.Get("Content-Type") == "application/json" {
-				bodyBytes, err := io.ReadAll(r.Body)
-				if err != nil {
-					http.Error(w, "Server error", http.StatusInternalServerError)
-					return
-				}
-
-				// Ensure the body reader is replaced so it can be consumed again
-				r.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
-
-				var data map[string]interface{}
-				err = json.Unmarshal(bodyBytes, &data)
-				if err != nil {
-					http.Error(w, "Server error", http.StatusInternalServerError)
-					return
-				}
-
-				csrfTokenInRequest = data["csrf"].(string)
-			} else {
-				csrfTokenInRequest = r.FormValue("csrf")
-			}
-			if csrfTokenInRequest != csrfToken {
-				http.Error(w, "CSRF token mismatch", http.StatusUnauthorized)
-				return
-			}
-		} else {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
+	c.Next.ServeHTTP(w, r)
+}
 
+// csrfExempt reports whether r is authenticated by something a browser
+// does not send on its own: a bearer token, as long as no session cookie
+// comes with it, or the client credentials of the OAuth2 endpoints.
+func csrfExempt(r *http.Request) bool {
+	switch r.URL.Path {
+	case OAuthTokenPath, OAuthIntrospectPath, OAuthRevokePath:
+		return true
 	}
+	_, err := r.Cookie("juniper-session")
+	return err != nil && BearerToken(r) != ""
+}
+
+func isURLEncodedForm(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType == "application/x-www-form-urlencoded"
 }
 
 func GenerateCSRFToken(length int) (string, error) {
@@ -92,11 +92,27 @@ func GenerateCSRFToken(length int) (string, error) {
 	return token, nil
 }
 
+// GetCSRFToken returns the token of the session, or "" if it has none yet.
 func GetCSRFToken(r *http.Request) string {
 	session, _ := Store.Get(r, "juniper-session")
-	csrfToken, ok := session.Values[csrfKey].(string)
+	csrfToken, ok := session.Values[csrfSessionKey].(string)
 	if !ok {
 		return ""
 	}
 	return csrfToken
 }
+
+// CSRFToken returns the token of the session, creating it on first use.
+// Call it before writing the response, as it may set the session cookie.
+func CSRFToken(w http.ResponseWriter, r *http.Request) (string, error) {
+	if token := GetCSRFToken(r); token != "" {
+		return token, nil
+	}
+	token, err := GenerateCSRFToken(32)
+	if err != nil {
+		return "", err
+	}
+	session, _ := Store.Get(r, "juniper-session")
+	session.Values[csrfSessionKey] = token
+	return token, session.Save(r, w)
+}
@@ -0,0 +1,87 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func Test_CSRF(t *testing.T) {
+	Store, _ = newTestStore(t)
+	t.Cleanup(func() { Store = nil })
+
+	called := false
+	handler := WithCSRF(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+
+	// The login page hands out the token along with the session cookie.
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/login", nil)
+	token, err := CSRFToken(w, r)
+	if err != nil || token == "" {
+		t.Fatalf("Failed to create a CSRF token: %v", err)
+	}
+	cookies := w.Result().Cookies()
+
+	serve := func(r *http.Request) *httptest.ResponseRecorder {
+		called = false
+		for _, cookie := range cookies {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	jsonRequest := func(header string) *http.Request {
+		r := httptest.NewRequest("POST", "/api/auth/login", strings.NewReader(`{"username":"alice"}`))
+		r.Header.Set("Content-Type", "application/json")
+		if header != "" {
+			r.Header.Set(CSRFHeader, header)
+		}
+		return r
+	}
+
+	if w := serve(httptest.NewRequest("GET", "/dashboard", nil)); !called || w.Code != http.StatusOK {
+		t.Errorf("Expected GET requests to pass without a token, got %d", w.Code)
+	}
+	if w := serve(jsonRequest(token)); !called || w.Code != http.StatusOK {
+		t.Errorf("Expected a request with the header to reach the handler, got %d", w.Code)
+	}
+	if w := serve(jsonRequest("")); called || w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for JSON without a token, got %d", w.Code)
+	}
+	if w := serve(jsonRequest("forged")); called || w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for a wrong token, got %d", w.Code)
+	}
+
+	form := httptest.NewRequest("POST", "/dashboard/sessions/revoke-others", strings.NewReader(url.Values{"csrf": {token}}.Encode()))
+	form.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if w := serve(form); !called || w.Code != http.StatusOK {
+		t.Errorf("Expected a form with the token field to reach the handler, got %d", w.Code)
+	}
+
+	// Another browser has no session, so even a stolen token is useless.
+	cookies = nil
+	if w := serve(jsonRequest(token)); called || w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 without the session, got %d", w.Code)
+	}
+
+	// Clients with a bearer token or their own credentials send no cookies.
+	bearer := jsonRequest("")
+	bearer.Header.Set("Authorization", "Bearer token")
+	if w := serve(bearer); !called || w.Code != http.StatusOK {
+		t.Errorf("Expected a bearer token without a session to reach the handler, got %d", w.Code)
+	}
+	if w := serve(httptest.NewRequest("POST", OAuthTokenPath, nil)); !called || w.Code != http.StatusOK {
+		t.Errorf("Expected the token endpoint to be exempt, got %d", w.Code)
+	}
+	cookies = w.Result().Cookies()
+	bearer = jsonRequest("")
+	bearer.Header.Set("Authorization", "Bearer token")
+	if w := serve(bearer); called || w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for a bearer token sent with the session cookie, got %d", w.Code)
+	}
+}
@@ -0,0 +1,224 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gorilla/securecookie"
+)
+
+// Key signs and encrypts session cookies: HMAC-SHA256 with Hash, then
+// AES-256 with Block, which securecookie checks before decrypting.
+type Key struct {
+	Hash      []byte    `json:"hash"`
+	Block     []byte    `json:"block"` // Empty for the key of session.key, which only signed
+	CreatedAt time.Time `json:"createdAt"`
+	RetiredAt time.Time `json:"retiredAt"` // Zero while the key is current
+}
+
+func NewKey(now time.Time) (Key, error) {
+	key := Key{
+		Hash:      make([]byte, 64),
+		Block:     make([]byte, 32),
+		CreatedAt: now,
+	}
+	if _, err := rand.Read(key.Hash); err != nil {
+		return Key{}, err
+	}
+	if _, err := rand.Read(key.Block); err != nil {
+		return Key{}, err
+	}
+	return key, nil
+}
+
+// ParseKey reads a key written by Key.String, as used in SESSION_KEYS.
+func ParseKey(s string) (Key, error) {
+	hash, block, found := strings.Cut(strings.TrimSpace(s), ":")
+	if !found {
+		return Key{}, errors.New(`session key must be "<hash key>:<block key>" in base64`)
+	}
+	var key Key
+	var err error
+	if key.Hash, err = base64.StdEncoding.DecodeString(hash); err != nil || len(key.Hash) < 32 {
+		return Key{}, errors.New("session hash key must be at least 32 bytes of base64")
+	}
+	if key.Block, err = base64.StdEncoding.DecodeString(block); err != nil || len(key.Block) != 32 {
+		return Key{}, errors.New("session block key must be 32 bytes of base64")
+	}
+	return key, nil
+}
+
+func (k Key) String() string {
+	return base64.StdEncoding.EncodeToString(k.Hash) + ":" + base64.StdEncoding.EncodeToString(k.Block)
+}
+
+// KeyRing holds the current key first, followed by retired keys that still
+// verify cookies until their grace period is over.
+type KeyRing struct {
+	Keys []Key `json:"keys"`
+}
+
+// Rotate makes a new current key, retires the old one and drops keys whose
+// grace period is over. It returns the new key.
+func (ring *KeyRing) Rotate(now time.Time, grace time.Duration) (Key, error) {
+	key, err := NewKey(now)
+	if err != nil {
+		return Key{}, err
+	}
+	if len(ring.Keys) > 0 && ring.Keys[0].RetiredAt.IsZero() {
+		ring.Keys[0].RetiredAt = now
+	}
+	ring.Keys = append([]Key{key}, ring.Active(now, grace).Keys...)
+	return key, nil
+}
+
+// Active returns the ring without the keys retired more than grace ago.
+func (ring KeyRing) Active(now time.Time, grace time.Duration) KeyRing {
+	active := KeyRing{}
+	for _, key := range ring.Keys {
+		if key.RetiredAt.IsZero() || now.Sub(key.RetiredAt) < grace {
+			active.Keys = append(active.Keys, key)
+		}
+	}
+	return active
+}
+
+// Codecs returns a codec per key in ring order, so the current key encodes
+// and every key decodes. maxAge is how long an encoded value stays valid.
+func (ring KeyRing) Codecs(maxAge time.Duration) []securecookie.Codec {
+	codecs := []securecookie.Codec{}
+	for _, key := range ring.Keys {
+		var block []byte
+		if len(key.Block) > 0 {
+			block = key.Block
+		}
+		codec := securecookie.New(key.Hash, block)
+		codec.MaxAge(int(maxAge.Seconds()))
+		codecs = append(codecs, codec)
+	}
+	return codecs
+}
+
+// LoadKeyRing reads a key file written by SaveKeyRing.
+func LoadKeyRing(path string) (KeyRing, error) {
+	var ring KeyRing
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ring, err
+	}
+	if err := json.Unmarshal(data, &ring); err != nil {
+		return ring, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(ring.Keys) == 0 {
+		return ring, fmt.Errorf("%s: no keys", path)
+	}
+	return ring, nil
+}
+
+// SaveKeyRing writes ring to path, readable by the owner only. The file is
+// replaced in one step, so a running server never reads half of it.
+func SaveKeyRing(path string, ring KeyRing) error {
+	data, err := json.MarshalIndent(ring, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".session-keys-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// LoadOrCreateKeyRing reads the key file at path, creating it with a fresh
+// key when it does not exist yet. The signing key of older versions in
+// session.key is kept as a retired key, so existing sessions survive.
+func LoadOrCreateKeyRing(path string, now time.Time) (KeyRing, error) {
+	ring, err := LoadKeyRing(path)
+	if !errors.Is(err, os.ErrNotExist) {
+		return ring, err
+	}
+
+	ring = KeyRing{}
+	if legacy, err := LoadSessionKey(); err == nil {
+		ring.Keys = append(ring.Keys, Key{Hash: legacy, CreatedAt: now})
+	}
+	if _, err := ring.Rotate(now, math.MaxInt64); err != nil {
+		return ring, err
+	}
+	return ring, SaveKeyRing(path, ring)
+}
+
+// KeyConfig says where the session keys come from.
+type KeyConfig struct {
+	Configured  []string      // Keys from the configuration, current first. The file is not used when set.
+	File        string        // Key file, created on first start
+	GracePeriod time.Duration // How long retired keys in File still verify cookies
+}
+
+// Load returns the keys in use at now.
+func (c KeyConfig) Load(now time.Time) (KeyRing, error) {
+	if len(c.Configured) > 0 {
+		ring := KeyRing{}
+		for _, configured := range c.Configured {
+			key, err := ParseKey(configured)
+			if err != nil {
+				return ring, err
+			}
+			ring.Keys = append(ring.Keys, key)
+		}
+		return ring, nil
+	}
+	ring, err := LoadOrCreateKeyRing(c.File, now)
+	if err != nil {
+		return ring, err
+	}
+	return ring.Active(now, c.GracePeriod), nil
+}
+
+// WatchKeys reloads the key file into Store every interval until ctx is
+// done, so `juniper keys rotate` takes effect without a restart and retired
+// keys stop working once their grace period is over.
+func WatchKeys(ctx context.Context, keys KeyConfig, interval time.Duration) {
+	if len(keys.Configured) > 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			ring, err := LoadKeyRing(keys.File)
+			if err != nil {
+				slog.ErrorContext(ctx, "failed to reload session keys, keeping the current ones", "error", err)
+				continue
+			}
+			if Store.SetKeys(ring.Active(time.Now(), keys.GracePeriod)) {
+				slog.InfoContext(ctx, "reloaded session keys", "file", keys.File, "keys", len(ring.Keys))
+			}
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package auth
+
+import (
+	"encoding/base64"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/securecookie"
+)
+
+func Test_KeyRotation(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	path := filepath.Join(t.TempDir(), "session.keys")
+	ring, err := LoadOrCreateKeyRing(path, now)
+	if err != nil || len(ring.Keys) != 1 {
+		t.Fatalf("Failed to create the key file: %v", err)
+	}
+
+	sessionID := "0123456789abcdef"
+	old, err := securecookie.EncodeMulti("juniper-session", sessionID, ring.Codecs(time.Hour)...)
+	if err != nil {
+		t.Fatalf("Failed to encode: %v", err)
+	}
+	raw, _ := base64.URLEncoding.DecodeString(old)
+	if strings.Contains(string(raw), sessionID) {
+		t.Errorf("Expected the session ID to be encrypted")
+	}
+
+	grace := 24 * time.Hour
+	ring.Rotate(now.Add(time.Hour), grace)
+	if err := SaveKeyRing(path, ring); err != nil {
+		t.Fatalf("Failed to save keys: %v", err)
+	}
+	ring, err = LoadKeyRing(path)
+	if err != nil || len(ring.Keys) != 2 || !ring.Keys[1].RetiredAt.Equal(now.Add(time.Hour)) {
+		t.Fatalf("Expected the old key to be retired, got %+v %v", ring, err)
+	}
+
+	decode := func(ring KeyRing, value string) (string, error) {
+		var decoded string
+		err := securecookie.DecodeMulti("juniper-session", value, &decoded, ring.Codecs(time.Hour)...)
+		return decoded, err
+	}
+	if decoded, err := decode(ring.Active(now.Add(2*time.Hour), grace), old); err != nil || decoded != sessionID {
+		t.Errorf("Expected the retired key to verify during the grace period, got %q %v", decoded, err)
+	}
+	if _, err := decode(ring.Active(now.Add(26*time.Hour), grace), old); err == nil {
+		t.Errorf("Expected the retired key to stop working after the grace period")
+	}
+
+	current, err := securecookie.EncodeMulti("juniper-session", sessionID, ring.Codecs(time.Hour)...)
+	if err != nil {
+		t.Fatalf("Failed to encode: %v", err)
+	}
+	if _, err := decode(KeyRing{Keys: ring.Keys[1:]}, current); err == nil {
+		t.Errorf("Expected new cookies to be encoded with the new key")
+	}
+
+	parsed, err := ParseKey(ring.Keys[0].String())
+	if err != nil || parsed.String() != ring.Keys[0].String() {
+		t.Errorf("Failed to parse a key back from its string: %v", err)
+	}
+	if _, err := ParseKey("not-a-key"); err == nil {
+		t.Errorf("Expected an invalid key to be rejected")
+	}
+}
@@ -0,0 +1,525 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"pioneerwebworks.com/juniper/apperr"
+	"pioneerwebworks.com/juniper/logging"
+	"pioneerwebworks.com/juniper/metrics"
+	"pioneerwebworks.com/juniper/models"
+)
+
+// OAuthScopes are the scopes clients may ask for, with the description
+// shown on the consent page, e.g. "posts:read": "Read Posts".
+var OAuthScopes = map[string]string{}
+
+// ScopeRoles limits who may grant a scope: a scope listed here only users
+// with one of its roles, the others any user.
+var ScopeRoles = map[string][]string{}
+
+// Lifetimes of what the OAuth2 server issues. A refresh token is replaced,
+// with a new lifetime, every time it is used.
+var (
+	OAuthCodeLifetime         = time.Minute
+	OAuthAccessTokenLifetime  = time.Hour
+	OAuthRefreshTokenLifetime = 30 * 24 * time.Hour
+)
+
+// Paths of the OAuth2 endpoints. Clients call the token, introspection and
+// revocation endpoints with their own credentials rather than the cookies
+// of a browser, so WithCSRF lets them through.
+const (
+	OAuthAuthorizePath  = "/oauth/authorize"
+	OAuthTokenPath      = "/oauth/token"
+	OAuthIntrospectPath = "/oauth/introspect"
+	OAuthRevokePath     = "/oauth/revoke"
+)
+
+// OAuthError is an error response of RFC 6749, e.g. invalid_grant, sent to
+// the client as is.
+type OAuthError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+func (e *OAuthError) Error() string {
+	return "oauth: " + e.Code + ": " + e.Description
+}
+
+// Status is the HTTP status of e at the token endpoint.
+func (e *OAuthError) Status() int {
+	if e.Code == "invalid_client" {
+		return http.StatusUnauthorized
+	}
+	return http.StatusBadRequest
+}
+
+func oauthError(code, description string) *OAuthError {
+	return &OAuthError{Code: code, Description: description}
+}
+
+// TokenResponse is what the token endpoint returns, per RFC 6749.
+type TokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	Scope        string `json:"scope"`
+}
+
+// Introspection is what the introspection endpoint returns, per RFC 7662.
+// Only Active is set for tokens that are unknown, expired or revoked.
+type Introspection struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	Username  string `json:"username,omitempty"`
+	Subject   string `json:"sub,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+}
+
+// CanGrant reports whether user may give clients scope.
+func CanGrant(user models.User, scope string) bool {
+	roles, limited := ScopeRoles[scope]
+	return !limited || slices.Contains(roles, user.UserRole)
+}
+
+// NewOAuthClient registers a client called name, which may be granted
+// scopes and is sent back to redirectURIs after the consent. It returns the
+// client and, unless it is public, its secret, which is not stored.
+func NewOAuthClient(userDB models.UserDB, name string, redirectURIs []string, scopes []string, public bool) (models.OAuthClient, string, error) {
+	for _, scope := range scopes {
+		if _, ok := OAuthScopes[scope]; !ok {
+			return models.OAuthClient{}, "", fmt.Errorf("unknown scope %q", scope)
+		}
+	}
+	for _, redirectURI := range redirectURIs {
+		parsed, err := url.Parse(redirectURI)
+		if err != nil || !parsed.IsAbs() || parsed.Fragment != "" {
+			return models.OAuthClient{}, "", fmt.Errorf("redirect URI %q must be an absolute URL without a fragment", redirectURI)
+		}
+	}
+	client := models.OAuthClient{
+		ClientID:     uuid.NewString(),
+		Name:         name,
+		RedirectURIs: strings.Join(redirectURIs, " "),
+		Scopes:       strings.Join(scopes, " "),
+	}
+	secret := ""
+	if !public {
+		var err error
+		if secret, err = GenerateSecureRandomToken(); err != nil {
+			return client, "", err
+		}
+		client.SecretHash = models.HashOAuthToken(secret)
+	}
+	return client, secret, userDB.AddOAuthClient(&client)
+}
+
+// AuthenticateClient identifies the client calling the token,
+// introspection or revocation endpoint, by HTTP Basic authentication or
+// the client_id and client_secret form fields. Public clients send only
+// their client_id.
+func AuthenticateClient(userDB models.UserDB, r *http.Request) (models.OAuthClient, error) {
+	clientID, secret, basic := r.BasicAuth()
+	if basic {
+		// RFC 6749 form-encodes both before the Basic encoding
+		clientID, _ = url.QueryUnescape(clientID)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		clientID, secret = r.PostFormValue("client_id"), r.PostFormValue("client_secret")
+	}
+	client := userDB.FindOAuthClient(clientID)
+	switch {
+	case client.ID == 0:
+		return client, oauthError("invalid_client", "Unknown client")
+	case client.Public() && secret == "":
+		return client, nil
+	case client.Public() || subtle.ConstantTimeCompare([]byte(models.HashOAuthToken(secret)), []byte(client.SecretHash)) != 1:
+		return models.OAuthClient{}, oauthError("invalid_client", "Wrong client credentials")
+	}
+	return client, nil
+}
+
+// AuthorizationRequest is a client asking the logged in user for access,
+// as checked by ParseAuthorizationRequest.
+type AuthorizationRequest struct {
+	Client      models.OAuthClient
+	RedirectURI string
+	Scopes      []string
+	State       string
+	Challenge   string
+}
+
+// ParseAuthorizationRequest checks the query of an authorization request
+// by the client for user. PKCE with S256 is required of every client.
+// Scopes the user may not grant are left out. When the error comes with a
+// RedirectURI it is sent to the client there; without one the client or
+// redirect URI are wrong, and the error is shown to the user instead.
+func ParseAuthorizationRequest(userDB models.UserDB, query url.Values, user models.User) (AuthorizationRequest, error) {
+	req := AuthorizationRequest{State: query.Get("state")}
+	req.Client = userDB.FindOAuthClient(query.Get("client_id"))
+	if req.Client.ID == 0 {
+		return req, oauthError("invalid_request", "Unknown client")
+	}
+	registered := strings.Fields(req.Client.RedirectURIs)
+	switch redirectURI := query.Get("redirect_uri"); {
+	case redirectURI == "" && len(registered) == 1:
+		req.RedirectURI = registered[0]
+	case redirectURI == "" || !slices.Contains(registered, redirectURI):
+		return req, oauthError("invalid_request", "The redirect URI is not registered for "+req.Client.Name)
+	default:
+		req.RedirectURI = redirectURI
+	}
+
+	if query.Get("response_type") != "code" {
+		return req, oauthError("unsupported_response_type", "Only the code response type is supported")
+	}
+	req.Challenge = query.Get("code_challenge")
+	if query.Get("code_challenge_method") != "S256" || len(req.Challenge) < 43 || len(req.Challenge) > 128 {
+		return req, oauthError("invalid_request", "PKCE with code_challenge_method S256 is required")
+	}
+	requested, err := clientScopes(req.Client, query.Get("scope"))
+	if err != nil {
+		return req, err
+	}
+	for _, scope := range requested {
+		if CanGrant(user, scope) {
+			req.Scopes = append(req.Scopes, scope)
+		}
+	}
+	if len(req.Scopes) == 0 {
+		return req, oauthError("invalid_scope", "You may not grant any of the requested scopes")
+	}
+	return req, nil
+}
+
+// clientScopes returns the scopes in the space-separated scope, which
+// must all be allowed for client, or all of them if it is empty.
+func clientScopes(client models.OAuthClient, scope string) ([]string, error) {
+	allowed := strings.Fields(client.Scopes)
+	requested := strings.Fields(scope)
+	if len(requested) == 0 {
+		return allowed, nil
+	}
+	for _, s := range requested {
+		if !slices.Contains(allowed, s) {
+			return nil, oauthError("invalid_scope", fmt.Sprintf("Scope %q is not allowed for this client", s))
+		}
+	}
+	return requested, nil
+}
+
+// RedirectWith returns the redirect URI of req with params and the state
+// added to its query.
+func (req AuthorizationRequest) RedirectWith(params url.Values) string {
+	target, _ := url.Parse(req.RedirectURI)
+	query := target.Query()
+	for key, values := range params {
+		query[key] = values
+	}
+	if req.State != "" {
+		query.Set("state", req.State)
+	}
+	target.RawQuery = query.Encode()
+	return target.String()
+}
+
+// IssueCode stores an authorization code for req, approved by the user
+// with userID, and returns it.
+func IssueCode(userDB models.UserDB, req AuthorizationRequest, userID uint, now time.Time) (string, error) {
+	code, err := GenerateSecureRandomToken()
+	if err != nil {
+		return "", err
+	}
+	err = userDB.AddOAuthCode(&models.OAuthCode{
+		Hash:        models.HashOAuthToken(code),
+		GrantID:     uuid.NewString(),
+		ClientID:    req.Client.ClientID,
+		UserID:      userID,
+		RedirectURI: req.RedirectURI,
+		Scopes:      strings.Join(req.Scopes, " "),
+		Challenge:   req.Challenge,
+		ExpiresAt:   now.Add(OAuthCodeLifetime),
+	})
+	return code, err
+}
+
+// ExchangeCode redeems an authorization code of client for tokens, if
+// verifier matches the challenge it was issued with. A code redeemed twice
+// was stolen by one of the parties, so the tokens of the first exchange are
+// revoked too.
+func ExchangeCode(userDB models.UserDB, client models.OAuthClient, code, redirectURI, verifier string, now time.Time) (TokenResponse, error) {
+	stored := userDB.FindOAuthCode(models.HashOAuthToken(code))
+	if stored.ID == 0 || stored.ClientID != client.ClientID || !now.Before(stored.ExpiresAt) {
+		return TokenResponse{}, oauthError("invalid_grant", "Unknown or expired code")
+	}
+	fresh, err := userDB.UseOAuthCode(&stored, now)
+	if err != nil {
+		return TokenResponse{}, err
+	}
+	if !fresh {
+		if err := userDB.RevokeOAuthGrant(stored.GrantID, now); err != nil {
+			return TokenResponse{}, err
+		}
+		return TokenResponse{}, oauthError("invalid_grant", "The code was already used")
+	}
+	if redirectURI != "" && redirectURI != stored.RedirectURI {
+		return TokenResponse{}, oauthError("invalid_grant", "The redirect URI does not match the authorization request")
+	}
+	challenge := sha256.Sum256([]byte(verifier))
+	if len(verifier) < 43 || subtle.ConstantTimeCompare([]byte(base64.RawURLEncoding.EncodeToString(challenge[:])), []byte(stored.Challenge)) != 1 {
+		return TokenResponse{}, oauthError("invalid_grant", "The code verifier does not match the code challenge")
+	}
+	return issueTokens(userDB, client, stored.UserID, strings.Fields(stored.Scopes), stored.GrantID, true, now)
+}
+
+// RefreshTokens replaces a refresh token of client, and its access token,
+// with new ones for scope, which may narrow the original scopes. A refresh
+// token used twice was stolen by one of the parties, so every token of its
+// grant is revoked.
+func RefreshTokens(userDB models.UserDB, client models.OAuthClient, refreshToken, scope string, now time.Time) (TokenResponse, error) {
+	stored := userDB.FindOAuthToken(models.HashOAuthToken(refreshToken))
+	if stored.ID == 0 || stored.Kind != models.OAuthRefreshToken || stored.ClientID != client.ClientID || !now.Before(stored.ExpiresAt) {
+		return TokenResponse{}, oauthError("invalid_grant", "Unknown or expired refresh token")
+	}
+	fresh, err := userDB.RevokeOAuthToken(&stored, now)
+	if err != nil {
+		return TokenResponse{}, err
+	}
+	if !fresh {
+		if err := userDB.RevokeOAuthGrant(stored.GrantID, now); err != nil {
+			return TokenResponse{}, err
+		}
+		return TokenResponse{}, oauthError("invalid_grant", "The refresh token was already used")
+	}
+
+	granted := strings.Fields(stored.Scopes)
+	scopes := granted
+	if requested := strings.Fields(scope); len(requested) > 0 {
+		for _, s := range requested {
+			if !slices.Contains(granted, s) {
+				return TokenResponse{}, oauthError("invalid_scope", fmt.Sprintf("Scope %q was not granted", s))
+			}
+		}
+		scopes = requested
+	}
+	return issueTokens(userDB, client, stored.UserID, scopes, stored.GrantID, true, now)
+}
+
+// ClientCredentials issues an access token for client itself, not on
+// behalf of a user, which only confidential clients can get.
+func ClientCredentials(userDB models.UserDB, client models.OAuthClient, scope string, now time.Time) (TokenResponse, error) {
+	if client.Public() {
+		return TokenResponse{}, oauthError("unauthorized_client", "Public clients cannot use client credentials")
+	}
+	scopes, err := clientScopes(client, scope)
+	if err != nil {
+		return TokenResponse{}, err
+	}
+	return issueTokens(userDB, client, 0, scopes, uuid.NewString(), false, now)
+}
+
+// issueTokens stores a new access token, and refresh token if asked for,
+// of grantID.
+func issueTokens(userDB models.UserDB, client models.OAuthClient, userID uint, scopes []string, grantID string, refresh bool, now time.Time) (TokenResponse, error) {
+	accessToken, err := GenerateSecureRandomToken()
+	if err != nil {
+		return TokenResponse{}, err
+	}
+	response := TokenResponse{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(OAuthAccessTokenLifetime / time.Second),
+		Scope:       strings.Join(scopes, " "),
+	}
+	tokens := []*models.OAuthToken{{
+		Hash:      models.HashOAuthToken(accessToken),
+		Kind:      models.OAuthAccessToken,
+		GrantID:   grantID,
+		ClientID:  client.ClientID,
+		UserID:    userID,
+		Scopes:    response.Scope,
+		ExpiresAt: now.Add(OAuthAccessTokenLifetime),
+	}}
+	if refresh {
+		if response.RefreshToken, err = GenerateSecureRandomToken(); err != nil {
+			return TokenResponse{}, err
+		}
+		tokens = append(tokens, &models.OAuthToken{
+			Hash:      models.HashOAuthToken(response.RefreshToken),
+			Kind:      models.OAuthRefreshToken,
+			GrantID:   grantID,
+			ClientID:  client.ClientID,
+			UserID:    userID,
+			Scopes:    response.Scope,
+			ExpiresAt: now.Add(OAuthRefreshTokenLifetime),
+		})
+	}
+	if err := userDB.AddOAuthTokens(tokens...); err != nil {
+		return TokenResponse{}, err
+	}
+	return response, nil
+}
+
+// Introspect describes token, an access or refresh token of any client.
+func Introspect(userDB models.UserDB, token string, now time.Time) Introspection {
+	stored := userDB.FindOAuthToken(models.HashOAuthToken(token))
+	if !stored.Active(now) {
+		return Introspection{}
+	}
+	info := Introspection{
+		Active:    true,
+		Scope:     stored.Scopes,
+		ClientID:  stored.ClientID,
+		Subject:   stored.ClientID,
+		ExpiresAt: stored.ExpiresAt.Unix(),
+		IssuedAt:  stored.CreatedAt.Unix(),
+	}
+	if stored.Kind == models.OAuthAccessToken {
+		info.TokenType = "Bearer"
+	}
+	if stored.UserID != 0 {
+		user, err := userDB.GetUser(stored.UserID)
+		if err != nil {
+			return Introspection{}
+		}
+		info.Username = user.Username
+		info.Subject = fmt.Sprint(user.ID)
+	}
+	return info
+}
+
+// RevokeToken revokes token if it was issued to client. Revoking a refresh
+// token revokes the access tokens of its grant too. As RFC 7009 asks,
+// unknown tokens are not an error.
+func RevokeToken(userDB models.UserDB, client models.OAuthClient, token string, now time.Time) error {
+	stored := userDB.FindOAuthToken(models.HashOAuthToken(token))
+	if stored.ID == 0 || stored.ClientID != client.ClientID {
+		return nil
+	}
+	if stored.Kind == models.OAuthRefreshToken {
+		return userDB.RevokeOAuthGrant(stored.GrantID, now)
+	}
+	_, err := userDB.RevokeOAuthToken(&stored, now)
+	return err
+}
+
+// BearerToken returns the token in the Authorization header of r, or "".
+func BearerToken(r *http.Request) string {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// CheckAccessToken returns the stored access token, if it is active and
+// grants scope. A token of a user needs the user to still exist and be
+// allowed to grant scope.
+func CheckAccessToken(userDB models.UserDB, token, scope string, now time.Time) (models.OAuthToken, error) {
+	stored := userDB.FindOAuthToken(models.HashOAuthToken(token))
+	if stored.Kind != models.OAuthAccessToken || !stored.Active(now) {
+		return stored, oauthError("invalid_token", "The access token is unknown, expired or revoked")
+	}
+	if !slices.Contains(strings.Fields(stored.Scopes), scope) {
+		return stored, oauthError("insufficient_scope", "The access token does not grant "+scope)
+	}
+	if stored.UserID != 0 {
+		user, err := userDB.GetUser(stored.UserID)
+		if err != nil {
+			return stored, oauthError("invalid_token", "The user of the access token no longer exists")
+		}
+		if !CanGrant(user, scope) {
+			return stored, oauthError("insufficient_scope", "The user of the access token may no longer grant "+scope)
+		}
+	}
+	return stored, nil
+}
+
+// AuthorizeScope is the models.Authorizer of the model APIs. A request
+// with an Authorization header needs an access token granting scope; one
+// without needs a logged in session, whose user may grant scope, so e.g.
+// only administrators use the users scopes either way.
+func AuthorizeScope(w http.ResponseWriter, r *http.Request, scope string) error {
+	if r.Header.Get("Authorization") == "" {
+		return authorizeSession(w, r, scope)
+	}
+	userDB := models.ConnectToUserDB().WithContext(r.Context())
+	token, err := CheckAccessToken(userDB, BearerToken(r), scope, time.Now())
+	var oauthErr *OAuthError
+	if errors.As(err, &oauthErr) {
+		slog.DebugContext(r.Context(), "auth: bearer token refused", "error", err)
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error=%q, error_description=%q, scope=%q`, oauthErr.Code, oauthErr.Description, scope))
+		if oauthErr.Code == "insufficient_scope" {
+			appErr := apperr.Forbidden(oauthErr.Description)
+			appErr.Code = oauthErr.Code
+			return appErr
+		}
+		appErr := apperr.Unauthorized(oauthErr.Description)
+		appErr.Code = oauthErr.Code
+		return appErr
+	}
+	if token.UserID != 0 {
+		logging.SetUserID(r.Context(), token.UserID)
+	}
+	return nil
+}
+
+// authorizeSession checks the session of a request to a model API without a
+// bearer token, as WithAuth does, and that its user may grant scope.
+func authorizeSession(w http.ResponseWriter, r *http.Request, scope string) error {
+	user, check, err := checkSession(r)
+	if err != nil {
+		return apperr.Internal(err)
+	}
+	metrics.ObserveSessionCheck(check)
+	switch check {
+	case sessionOK:
+	case sessionTwoFactorSetup:
+		return twoFactorSetupRequired()
+	case sessionUnverified:
+		return apperr.Unauthorized("Unauthorized. Please verify your email address.")
+	default:
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer scope=%q`, scope))
+		return apperr.Unauthorized("Unauthorized")
+	}
+	if !CanGrant(user, scope) {
+		slog.DebugContext(r.Context(), "auth: missing role for scope", "user_id", user.ID, "scope", scope)
+		return apperr.Forbidden("Forbidden")
+	}
+	logging.SetUserID(r.Context(), user.ID)
+	return nil
+}
+
+// CleanupOAuth deletes expired codes and tokens every interval until ctx
+// is done.
+func CleanupOAuth(ctx context.Context, userDB models.UserDB, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			db := userDB.WithContext(ctx)
+			if err := db.DeleteExpiredOAuth(time.Now()); err != nil {
+				slog.ErrorContext(ctx, "oauth cleanup failed", "error", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"pioneerwebworks.com/juniper/apperr"
+	"pioneerwebworks.com/juniper/models"
+)
+
+func Test_OAuth(t *testing.T) {
+	_, gormDB := newTestStore(t)
+	gormDB.AutoMigrate(&models.User{}, &models.OAuthClient{}, &models.OAuthCode{}, &models.OAuthToken{})
+	db := models.UserDB{DB: gormDB}
+	OAuthScopes = map[string]string{"posts:read": "Read Posts", "posts:write": "Change Posts", "users:read": "Read Users"}
+	ScopeRoles = map[string][]string{"users:read": {"administrator"}}
+	t.Cleanup(func() { OAuthScopes, ScopeRoles = map[string]string{}, map[string][]string{} })
+
+	alice := models.User{Username: "alice", UserRole: "user"}
+	db.CreateUser(&alice)
+	app, secret, err := NewOAuthClient(db, "Tool", []string{"https://tool.example.com/callback"}, []string{"posts:read", "posts:write", "users:read"}, false)
+	if err != nil || secret == "" {
+		t.Fatalf("Failed to register a client: %v", err)
+	}
+	if _, _, err := NewOAuthClient(db, "Bad", nil, []string{"comments:read"}, false); err == nil {
+		t.Errorf("Expected an unknown scope to be refused")
+	}
+
+	// Clients authenticate with Basic authentication or form fields
+	r := httptest.NewRequest("POST", OAuthTokenPath, nil)
+	r.SetBasicAuth(app.ClientID, secret)
+	if client, err := AuthenticateClient(db, r); err != nil || client.ID != app.ID {
+		t.Errorf("Failed to authenticate with Basic authentication: %v", err)
+	}
+	r = httptest.NewRequest("POST", OAuthTokenPath, strings.NewReader(url.Values{"client_id": {app.ClientID}, "client_secret": {"wrong"}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if _, err := AuthenticateClient(db, r); err == nil {
+		t.Errorf("Expected a wrong secret to be refused")
+	}
+
+	verifier := strings.Repeat("v", 43)
+	sum := sha256.Sum256([]byte(verifier))
+	query := url.Values{
+		"client_id":             {app.ClientID},
+		"response_type":         {"code"},
+		"state":                 {"xyz"},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(sum[:])},
+		"code_challenge_method": {"S256"},
+	}
+	with := func(key, value string) url.Values {
+		q := url.Values{}
+		for k, v := range query {
+			q[k] = v
+		}
+		q.Set(key, value)
+		return q
+	}
+
+	// Errors before the redirect URI is known are shown to the user
+	if req, err := ParseAuthorizationRequest(db, with("redirect_uri", "https://evil.example.com/"), alice); err == nil || req.RedirectURI != "" {
+		t.Errorf("Expected an unregistered redirect URI to be refused without a redirect, got %q: %v", req.RedirectURI, err)
+	}
+	if req, err := ParseAuthorizationRequest(db, with("code_challenge_method", "plain"), alice); err == nil || req.RedirectURI == "" {
+		t.Errorf("Expected a request without S256 PKCE to be sent back to the client: %v", err)
+	}
+	req, err := ParseAuthorizationRequest(db, query, alice)
+	if err != nil {
+		t.Fatalf("Failed to parse the authorization request: %v", err)
+	}
+	if strings.Join(req.Scopes, " ") != "posts:read posts:write" {
+		t.Errorf("Expected the scopes a user may grant, got %v", req.Scopes)
+	}
+	if got := req.RedirectWith(url.Values{"code": {"c"}}); got != "https://tool.example.com/callback?code=c&state=xyz" {
+		t.Errorf("Unexpected redirect %q", got)
+	}
+
+	now := time.Now()
+	code, err := IssueCode(db, req, alice.ID, now)
+	if err != nil {
+		t.Fatalf("Failed to issue a code: %v", err)
+	}
+	if _, err := ExchangeCode(db, app, code, "", "wrong"+verifier, now); err == nil {
+		t.Errorf("Expected a wrong code verifier to be refused")
+	}
+	code, _ = IssueCode(db, req, alice.ID, now)
+	tokens, err := ExchangeCode(db, app, code, "https://tool.example.com/callback", verifier, now)
+	if err != nil || tokens.AccessToken == "" || tokens.RefreshToken == "" {
+		t.Fatalf("Failed to exchange the code: %v", err)
+	}
+
+	if _, err := CheckAccessToken(db, tokens.AccessToken, "posts:write", now); err != nil {
+		t.Errorf("Expected the access token to grant posts:write: %v", err)
+	}
+	var oauthErr *OAuthError
+	if _, err := CheckAccessToken(db, tokens.AccessToken, "users:read", now); !errors.As(err, &oauthErr) || oauthErr.Code != "insufficient_scope" {
+		t.Errorf("Expected insufficient_scope for users:read, got %v", err)
+	}
+	if _, err := CheckAccessToken(db, tokens.AccessToken, "posts:read", now.Add(OAuthAccessTokenLifetime)); err == nil {
+		t.Errorf("Expected an expired access token to be refused")
+	}
+	if info := Introspect(db, tokens.AccessToken, now); !info.Active || info.Username != "alice" || info.Scope != "posts:read posts:write" {
+		t.Errorf("Unexpected introspection %+v", info)
+	}
+
+	// A code used twice revokes the tokens of the first exchange
+	if _, err := ExchangeCode(db, app, code, "", verifier, now); err == nil {
+		t.Errorf("Expected a used code to be refused")
+	}
+	if Introspect(db, tokens.AccessToken, now).Active {
+		t.Errorf("Expected a replayed code to revoke its tokens")
+	}
+
+	// Refresh tokens are replaced on use, and a used one revokes its grant
+	code, _ = IssueCode(db, req, alice.ID, now)
+	tokens, _ = ExchangeCode(db, app, code, "", verifier, now)
+	refreshed, err := RefreshTokens(db, app, tokens.RefreshToken, "posts:read", now)
+	if err != nil || refreshed.Scope != "posts:read" {
+		t.Fatalf("Failed to refresh with a narrower scope: %v", err)
+	}
+	if _, err := RefreshTokens(db, app, refreshed.RefreshToken, "posts:read posts:write", now); err == nil {
+		t.Errorf("Expected a refresh to be refused a scope that was not granted")
+	}
+	if _, err := RefreshTokens(db, app, tokens.RefreshToken, "", now); err == nil {
+		t.Errorf("Expected a used refresh token to be refused")
+	}
+	if Introspect(db, refreshed.AccessToken, now).Active {
+		t.Errorf("Expected a reused refresh token to revoke its grant")
+	}
+
+	// Client credentials act as the client itself
+	machine, err := ClientCredentials(db, app, "users:read", now)
+	if err != nil || machine.RefreshToken != "" {
+		t.Fatalf("Failed to get a token with client credentials: %v", err)
+	}
+	if _, err := CheckAccessToken(db, machine.AccessToken, "users:read", now); err != nil {
+		t.Errorf("Expected the client's token to grant users:read: %v", err)
+	}
+	mobile, _, _ := NewOAuthClient(db, "Mobile", []string{"app://callback"}, []string{"posts:read"}, true)
+	if _, err := ClientCredentials(db, mobile, "", now); err == nil {
+		t.Errorf("Expected a public client to be refused client credentials")
+	}
+
+	// Only the client a token was issued to can revoke it
+	if err := RevokeToken(db, mobile, machine.AccessToken, now); err != nil || !Introspect(db, machine.AccessToken, now).Active {
+		t.Errorf("Expected another client's revocation to be ignored: %v", err)
+	}
+	if err := RevokeToken(db, app, machine.AccessToken, now); err != nil || Introspect(db, machine.AccessToken, now).Active {
+		t.Errorf("Failed to revoke the token: %v", err)
+	}
+
+	// Requests without a token need a session
+	Store, _ = newTestStore(t)
+	t.Cleanup(func() { Store = nil })
+	r = httptest.NewRequest("GET", "/api/v1/Posts/", nil)
+	w := httptest.NewRecorder()
+	var appErr *apperr.AppError
+	if err := AuthorizeScope(w, r, "posts:read"); !errors.As(err, &appErr) || appErr.Status != http.StatusUnauthorized {
+		t.Errorf("Expected a request without a token or session to be refused with 401, got %v", err)
+	}
+	if w.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("Expected a WWW-Authenticate challenge")
+	}
+	r.Header.Set("Authorization", "bearer "+machine.AccessToken)
+	if BearerToken(r) != machine.AccessToken {
+		t.Errorf("Expected the token from the Authorization header, got %q", BearerToken(r))
+	}
+}
@@ -0,0 +1,405 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/endpoints"
+	"gorm.io/gorm"
+	"pioneerwebworks.com/juniper/models"
+)
+
+// OIDCProviders are the providers users can sign in with, in the order the
+// login page shows them.
+var OIDCProviders []*OIDCProvider
+
+// ErrOIDCRejected is returned when the answer from a provider does not
+// check out: wrong state or nonce, a refused code or a bad ID token.
+var ErrOIDCRejected = errors.New("sign-in rejected")
+
+// ErrOIDCAccountExists is returned on a first sign in with an email that
+// already has an account. Its owner logs in as before and links the
+// provider from the dashboard, as the provider cannot vouch for the account.
+var ErrOIDCAccountExists = errors.New("an account with this email already exists")
+
+// ErrOIDCIdentityTaken is returned when linking an identity that belongs to
+// another user.
+var ErrOIDCIdentityTaken = errors.New("identity linked to another account")
+
+// oidcLoginKey holds the sign in in progress in the session. It is used once.
+const oidcLoginKey = "oidcLogin"
+
+// oidcClient makes the requests to providers.
+var oidcClient = &http.Client{Timeout: 10 * time.Second}
+
+// githubAPI is where GitHub users are looked up. Tests point it elsewhere.
+var githubAPI = "https://api.github.com"
+
+// OIDCConfig describes a provider and how Juniper is registered with it.
+type OIDCConfig struct {
+	Name         string // In URLs, e.g. "google"
+	DisplayName  string // On the login page, e.g. "Google"
+	Issuer       string // Where /.well-known/openid-configuration is found
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string   // The callback, as registered with the provider
+	Scopes       []string // Besides openid, defaults to email and profile
+}
+
+// OIDCProvider signs users in with an OpenID Connect provider, using the
+// authorization code flow with PKCE. The provider is discovered on first
+// use, so one that is down does not stop Juniper from starting.
+type OIDCProvider struct {
+	Name        string
+	DisplayName string
+
+	config   OIDCConfig
+	github   bool
+	mu       sync.Mutex
+	oauth2   *oauth2.Config        // Set by discover
+	verifier *oidc.IDTokenVerifier // Set by discover, nil for GitHub
+}
+
+// NewOIDCProvider returns a provider speaking OpenID Connect, such as
+// Google or a company's single sign-on.
+func NewOIDCProvider(config OIDCConfig) *OIDCProvider {
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{"email", "profile"}
+	}
+	return &OIDCProvider{Name: config.Name, DisplayName: config.DisplayName, config: config}
+}
+
+// NewGitHubProvider returns a provider for GitHub. GitHub only speaks plain
+// OAuth2, without ID tokens, so the user is looked up in its API instead
+// and there is no nonce to check.
+func NewGitHubProvider(config OIDCConfig) *OIDCProvider {
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{"read:user", "user:email"}
+	}
+	return &OIDCProvider{
+		Name:        config.Name,
+		DisplayName: config.DisplayName,
+		config:      config,
+		github:      true,
+		oauth2: &oauth2.Config{
+			ClientID:     config.ClientID,
+			ClientSecret: config.ClientSecret,
+			RedirectURL:  config.RedirectURL,
+			Endpoint:     endpoints.GitHub,
+			Scopes:       config.Scopes,
+		},
+	}
+}
+
+// FindOIDCProvider returns the provider of OIDCProviders called name.
+func FindOIDCProvider(name string) (*OIDCProvider, bool) {
+	for _, p := range OIDCProviders {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+// discover fetches the endpoints and keys of the provider, once it works.
+func (p *OIDCProvider) discover(ctx context.Context) (*oauth2.Config, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.oauth2 != nil {
+		return p.oauth2, nil
+	}
+	provider, err := oidc.NewProvider(oidc.ClientContext(ctx, oidcClient), p.config.Issuer)
+	if err != nil {
+		return nil, fmt.Errorf("oidc: discovering %s: %w", p.Name, err)
+	}
+	p.verifier = provider.Verifier(&oidc.Config{ClientID: p.config.ClientID})
+	p.oauth2 = &oauth2.Config{
+		ClientID:     p.config.ClientID,
+		ClientSecret: p.config.ClientSecret,
+		RedirectURL:  p.config.RedirectURL,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       append([]string{oidc.ScopeOpenID}, p.config.Scopes...),
+	}
+	return p.oauth2, nil
+}
+
+// OIDCIdentity is who the provider says the user is.
+type OIDCIdentity struct {
+	Provider      string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Username      string // Preferred, Juniper may have to pick another
+	Forename      string
+	Surname       string
+}
+
+// oidcLogin is what a sign in keeps in the session until the provider
+// sends the user back.
+type oidcLogin struct {
+	Provider string
+	State    string
+	Nonce    string
+	Verifier string
+	Link     bool // Add the identity to the logged in user instead of logging in
+}
+
+// BeginOIDCLogin starts signing in with p and returns the URL of the
+// provider to send the browser to. With link set the identity is added to
+// the logged in user instead.
+func BeginOIDCLogin(w http.ResponseWriter, r *http.Request, p *OIDCProvider, link bool) (string, error) {
+	config, err := p.discover(r.Context())
+	if err != nil {
+		return "", err
+	}
+	state, err := GenerateSecureRandomToken()
+	if err != nil {
+		return "", err
+	}
+	nonce, err := GenerateSecureRandomToken()
+	if err != nil {
+		return "", err
+	}
+	login := oidcLogin{Provider: p.Name, State: state, Nonce: nonce, Verifier: oauth2.GenerateVerifier(), Link: link}
+	encoded, err := json.Marshal(login)
+	if err != nil {
+		return "", err
+	}
+	session, _ := Store.Get(r, "juniper-session")
+	session.Values[oidcLoginKey] = encoded
+	if err := session.Save(r, w); err != nil {
+		return "", err
+	}
+
+	options := []oauth2.AuthCodeOption{oauth2.S256ChallengeOption(login.Verifier)}
+	if !p.github {
+		options = append(options, oidc.Nonce(nonce))
+	}
+	return config.AuthCodeURL(state, options...), nil
+}
+
+// FinishOIDCLogin handles the provider sending the browser back to the
+// callback. It checks the state, redeems the code with the PKCE verifier
+// and checks the ID token and its nonce. It also reports whether the
+// sign in was started to link the identity.
+func FinishOIDCLogin(w http.ResponseWriter, r *http.Request, p *OIDCProvider) (OIDCIdentity, bool, error) {
+	session, _ := Store.Get(r, "juniper-session")
+	encoded, ok := session.Values[oidcLoginKey].([]byte)
+	if !ok {
+		return OIDCIdentity{}, false, fmt.Errorf("%w: no sign in in progress", ErrOIDCRejected)
+	}
+	delete(session.Values, oidcLoginKey)
+	if err := session.Save(r, w); err != nil {
+		return OIDCIdentity{}, false, err
+	}
+	var login oidcLogin
+	if err := json.Unmarshal(encoded, &login); err != nil {
+		return OIDCIdentity{}, false, err
+	}
+
+	query := r.URL.Query()
+	if login.Provider != p.Name {
+		return OIDCIdentity{}, false, fmt.Errorf("%w: started with %s", ErrOIDCRejected, login.Provider)
+	}
+	if subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(login.State)) != 1 {
+		return OIDCIdentity{}, false, fmt.Errorf("%w: state does not match", ErrOIDCRejected)
+	}
+	if reason := query.Get("error"); reason != "" {
+		return OIDCIdentity{}, false, fmt.Errorf("%w: %s: %s", ErrOIDCRejected, reason, query.Get("error_description"))
+	}
+
+	config, err := p.discover(r.Context())
+	if err != nil {
+		return OIDCIdentity{}, false, err
+	}
+	ctx := oidc.ClientContext(r.Context(), oidcClient)
+	token, err := config.Exchange(ctx, query.Get("code"), oauth2.VerifierOption(login.Verifier))
+	if err != nil {
+		return OIDCIdentity{}, false, fmt.Errorf("%w: %v", ErrOIDCRejected, err)
+	}
+	if p.github {
+		identity, err := githubIdentity(ctx, p.Name, config, token)
+		return identity, login.Link, err
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return OIDCIdentity{}, false, fmt.Errorf("%w: no ID token", ErrOIDCRejected)
+	}
+	idToken, err := p.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return OIDCIdentity{}, false, fmt.Errorf("%w: %v", ErrOIDCRejected, err)
+	}
+	if subtle.ConstantTimeCompare([]byte(idToken.Nonce), []byte(login.Nonce)) != 1 {
+		return OIDCIdentity{}, false, fmt.Errorf("%w: nonce does not match", ErrOIDCRejected)
+	}
+	var claims struct {
+		Email             string `json:"email"`
+		EmailVerified     bool   `json:"email_verified"`
+		PreferredUsername string `json:"preferred_username"`
+		GivenName         string `json:"given_name"`
+		FamilyName        string `json:"family_name"`
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		return OIDCIdentity{}, false, fmt.Errorf("%w: %v", ErrOIDCRejected, err)
+	}
+	return OIDCIdentity{
+		Provider:      p.Name,
+		Subject:       idToken.Subject,
+		Email:         claims.Email,
+		EmailVerified: claims.EmailVerified,
+		Username:      claims.PreferredUsername,
+		Forename:      claims.GivenName,
+		Surname:       claims.FamilyName,
+	}, login.Link, nil
+}
+
+// githubIdentity looks up the GitHub user token belongs to, with their
+// primary email if it is verified.
+func githubIdentity(ctx context.Context, provider string, config *oauth2.Config, token *oauth2.Token) (OIDCIdentity, error) {
+	client := config.Client(ctx, token)
+	var user struct {
+		ID    int64  `json:"id"`
+		Login string `json:"login"`
+		Name  string `json:"name"`
+	}
+	if err := githubGet(client, "/user", &user); err != nil {
+		return OIDCIdentity{}, err
+	}
+	var emails []struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}
+	if err := githubGet(client, "/user/emails", &emails); err != nil {
+		return OIDCIdentity{}, err
+	}
+
+	identity := OIDCIdentity{Provider: provider, Subject: strconv.FormatInt(user.ID, 10), Username: user.Login}
+	identity.Forename, identity.Surname, _ = strings.Cut(user.Name, " ")
+	for _, email := range emails {
+		if email.Primary && email.Verified {
+			identity.Email, identity.EmailVerified = email.Email, true
+		}
+	}
+	return identity, nil
+}
+
+func githubGet(client *http.Client, path string, v any) error {
+	req, err := http.NewRequest("GET", githubAPI+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("github: %s: %s", path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// OIDCUser returns the user identity signs in, creating an account with
+// role on their first sign in. It also reports whether it did.
+func OIDCUser(userDB models.UserDB, identity OIDCIdentity, role string, now time.Time) (models.User, bool, error) {
+	linked := userDB.FindIdentity(identity.Provider, identity.Subject)
+	if linked.ID != 0 {
+		user, err := userDB.GetUser(linked.UserID)
+		if err != nil {
+			return user, false, err
+		}
+		return user, false, userDB.UseIdentity(&linked, identity.Email, now)
+	}
+
+	if identity.Email == "" || !identity.EmailVerified {
+		return models.User{}, false, fmt.Errorf("%w: the provider did not share a verified email", ErrOIDCRejected)
+	}
+	var existing int64
+	if err := userDB.DB.Model(&models.User{}).Where("email = ?", identity.Email).Count(&existing).Error; err != nil {
+		return models.User{}, false, err
+	}
+	if existing > 0 {
+		return models.User{}, false, ErrOIDCAccountExists
+	}
+
+	// No password, the account logs in through the provider or a passkey
+	user := models.User{
+		Email:         identity.Email,
+		EmailVerified: true,
+		Forename:      identity.Forename,
+		Surname:       identity.Surname,
+		UserRole:      role,
+		LastLoginAt:   now,
+	}
+	err := userDB.DB.Transaction(func(tx *gorm.DB) error {
+		udb := models.UserDB{DB: tx}
+		user.Username = freeUsername(udb, identity)
+		if _, err := udb.CreateUser(&user); err != nil {
+			return err
+		}
+		return udb.AddIdentity(&models.Identity{
+			UserID:     user.ID,
+			Provider:   identity.Provider,
+			Subject:    identity.Subject,
+			Email:      identity.Email,
+			LastUsedAt: now,
+		})
+	})
+	if err != nil {
+		return models.User{}, false, err
+	}
+	return user, true, nil
+}
+
+// LinkOIDCIdentity adds identity to the user with userID, so they can sign
+// in with it too.
+func LinkOIDCIdentity(userDB models.UserDB, userID uint, identity OIDCIdentity, now time.Time) error {
+	linked := userDB.FindIdentity(identity.Provider, identity.Subject)
+	if linked.ID != 0 {
+		if linked.UserID != userID {
+			return ErrOIDCIdentityTaken
+		}
+		return userDB.UseIdentity(&linked, identity.Email, now)
+	}
+	return userDB.AddIdentity(&models.Identity{
+		UserID:     userID,
+		Provider:   identity.Provider,
+		Subject:    identity.Subject,
+		Email:      identity.Email,
+		LastUsedAt: now,
+	})
+}
+
+var usernameUnsafe = regexp.MustCompile(`[^a-zA-Z0-9._-]+`)
+
+// freeUsername picks a username for a new account from the preferred one,
+// or the email, adding a number if it is taken.
+func freeUsername(userDB models.UserDB, identity OIDCIdentity) string {
+	base := identity.Username
+	if base == "" {
+		base, _, _ = strings.Cut(identity.Email, "@")
+	}
+	base = usernameUnsafe.ReplaceAllString(base, "")
+	if base == "" {
+		base = "user"
+	}
+	username := base
+	for n := 2; userDB.FindByUsername(username).ID != 0; n++ {
+		username = base + strconv.Itoa(n)
+	}
+	return username
+}
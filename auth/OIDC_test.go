@@ -0,0 +1,227 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"pioneerwebworks.com/juniper/models"
+)
+
+// mockOIDC is an OpenID Connect provider with one user, which checks the
+// PKCE verifier and signs ID tokens with the nonce of the last
+// authorization request.
+type mockOIDC struct {
+	*httptest.Server
+	t         *testing.T
+	key       *rsa.PrivateKey
+	challenge string
+	nonce     string
+}
+
+func newMockOIDC(t *testing.T) *mockOIDC {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate a key: %v", err)
+	}
+	m := &mockOIDC{t: t, key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                m.URL,
+			"authorization_endpoint":                m.URL + "/authorize",
+			"token_endpoint":                        m.URL + "/token",
+			"jwks_uri":                              m.URL + "/jwks",
+			"response_types_supported":              []string{"code"},
+			"subject_types_supported":               []string{"public"},
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "test",
+				"alg": "RS256",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		verifier := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		if r.PostFormValue("code") != "code" || base64.RawURLEncoding.EncodeToString(verifier[:]) != m.challenge {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error": "invalid_grant"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     m.idToken(),
+		})
+	})
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+	return m
+}
+
+// authorize plays the user logging in at the provider and returns the state
+// to send back.
+func (m *mockOIDC) authorize(authURL string) string {
+	parsed, err := url.Parse(authURL)
+	if err != nil {
+		m.t.Fatalf("Failed to parse %q: %v", authURL, err)
+	}
+	query := parsed.Query()
+	if query.Get("client_id") != "juniper" || query.Get("code_challenge_method") != "S256" || query.Get("nonce") == "" {
+		m.t.Fatalf("Expected an authorization request with PKCE and a nonce, got %q", authURL)
+	}
+	m.challenge = query.Get("code_challenge")
+	m.nonce = query.Get("nonce")
+	return query.Get("state")
+}
+
+func (m *mockOIDC) idToken() string {
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":            m.URL,
+		"sub":            "248289761001",
+		"aud":            "juniper",
+		"iat":            now.Unix(),
+		"exp":            now.Add(time.Hour).Unix(),
+		"nonce":          m.nonce,
+		"email":          "alice@example.com",
+		"email_verified": true,
+		"given_name":     "Alice",
+		"family_name":    "Liddell",
+	})
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, m.key, crypto.SHA256, digest[:])
+	if err != nil {
+		m.t.Fatalf("Failed to sign: %v", err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func Test_OIDC(t *testing.T) {
+	var db = func() models.UserDB {
+		store, db := newTestStore(t)
+		Store = store
+		db.AutoMigrate(&models.User{}, &models.Identity{})
+		return models.UserDB{DB: db}
+	}()
+	t.Cleanup(func() { Store = nil })
+	mock := newMockOIDC(t)
+	provider := NewOIDCProvider(OIDCConfig{
+		Name:         "mock",
+		Issuer:       mock.URL,
+		ClientID:     "juniper",
+		ClientSecret: "secret",
+		RedirectURL:  "https://example.com/auth/mock/callback",
+	})
+
+	// request sends the cookies of earlier responses, like a browser.
+	var cookies []*http.Cookie
+	request := func(target string) (*httptest.ResponseRecorder, *http.Request) {
+		r := httptest.NewRequest("GET", target, nil)
+		for _, cookie := range cookies {
+			r.AddCookie(cookie)
+		}
+		return httptest.NewRecorder(), r
+	}
+	keep := func(w *httptest.ResponseRecorder) {
+		if c := w.Result().Cookies(); len(c) > 0 {
+			cookies = c
+		}
+	}
+	begin := func() string {
+		w, r := request("/auth/mock")
+		authURL, err := BeginOIDCLogin(w, r, provider, false)
+		if err != nil {
+			t.Fatalf("Failed to begin signing in: %v", err)
+		}
+		keep(w)
+		return mock.authorize(authURL)
+	}
+	callback := func(state string) (OIDCIdentity, error) {
+		w, r := request("/auth/mock/callback?code=code&state=" + url.QueryEscape(state))
+		identity, _, err := FinishOIDCLogin(w, r, provider)
+		keep(w)
+		return identity, err
+	}
+
+	state := begin()
+	identity, err := callback(state)
+	if err != nil {
+		t.Fatalf("Failed to sign in: %v", err)
+	}
+	if identity.Subject != "248289761001" || identity.Email != "alice@example.com" || !identity.EmailVerified {
+		t.Errorf("Expected the identity from the ID token, got %+v", identity)
+	}
+	if _, err := callback(state); !errors.Is(err, ErrOIDCRejected) {
+		t.Errorf("Expected a replayed callback to be rejected, got %v", err)
+	}
+
+	begin()
+	if _, err := callback("forged"); !errors.Is(err, ErrOIDCRejected) {
+		t.Errorf("Expected a callback with another state to be rejected, got %v", err)
+	}
+	state = begin()
+	mock.nonce = "replayed"
+	if _, err := callback(state); !errors.Is(err, ErrOIDCRejected) {
+		t.Errorf("Expected an ID token with another nonce to be rejected, got %v", err)
+	}
+	state = begin()
+	mock.challenge = "intercepted"
+	if _, err := callback(state); !errors.Is(err, ErrOIDCRejected) {
+		t.Errorf("Expected a code redeemed without the PKCE verifier to be rejected, got %v", err)
+	}
+
+	// The first sign in creates the account, taking a free username
+	taken := models.User{Username: "alice", Email: "alice@example.org"}
+	db.CreateUser(&taken)
+	now := time.Now()
+	user, created, err := OIDCUser(db, identity, "editor", now)
+	if err != nil || !created {
+		t.Fatalf("Failed to create an account: %v", err)
+	}
+	if user.Username != "alice2" || user.UserRole != "editor" || user.Email != "alice@example.com" || !user.EmailVerified {
+		t.Errorf("Expected a verified editor alice2, got %+v", user)
+	}
+	again, created, err := OIDCUser(db, identity, "editor", now)
+	if err != nil || created || again.ID != user.ID {
+		t.Errorf("Expected the next sign in to find user %d, got %d: %v", user.ID, again.ID, err)
+	}
+
+	// An account with the email is linked by its owner, not taken over
+	other := OIDCIdentity{Provider: "mock", Subject: "42", Email: "alice@example.org", EmailVerified: true}
+	if _, _, err := OIDCUser(db, other, "editor", now); !errors.Is(err, ErrOIDCAccountExists) {
+		t.Errorf("Expected a sign in with a taken email to be refused, got %v", err)
+	}
+	if err := LinkOIDCIdentity(db, taken.ID, other, now); err != nil {
+		t.Fatalf("Failed to link an identity: %v", err)
+	}
+	if found, _, err := OIDCUser(db, other, "editor", now); err != nil || found.ID != taken.ID {
+		t.Errorf("Expected the linked identity to sign in user %d, got %d: %v", taken.ID, found.ID, err)
+	}
+	if err := LinkOIDCIdentity(db, user.ID, other, now); !errors.Is(err, ErrOIDCIdentityTaken) {
+		t.Errorf("Expected an identity of another user not to be linked, got %v", err)
+	}
+}
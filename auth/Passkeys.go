@@ -0,0 +1,289 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"pioneerwebworks.com/juniper/models"
+)
+
+// WebAuthn runs the passkey ceremonies. It is nil until InitPasskeys.
+var WebAuthn *webauthn.WebAuthn
+
+// ErrPasskeyRejected is returned when the browser's answer to a ceremony
+// does not check out: wrong challenge, origin, signature or credential.
+var ErrPasskeyRejected = errors.New("passkey rejected")
+
+// Session keys of the ceremony in progress. Each is used once.
+const (
+	passkeyRegistrationKey = "passkeyRegistration"
+	passkeyLoginKey        = "passkeyLogin"
+	passkeyStepUpKey       = "passkeyStepUp"
+)
+
+// PasskeyConfig identifies the site to authenticators. Passkeys are bound
+// to RPID, the domain, and only work on pages served from Origins.
+type PasskeyConfig struct {
+	RPID    string
+	RPName  string
+	Origins []string
+	Timeout time.Duration // How long the browser and the server wait for the user
+}
+
+// InitPasskeys sets up WebAuthn. Passkeys must verify the user, with a PIN
+// or biometrics, as they replace both the password and the second factor.
+func InitPasskeys(config PasskeyConfig) error {
+	timeout := webauthn.TimeoutConfig{Enforce: true, Timeout: config.Timeout, TimeoutUVD: config.Timeout}
+	w, err := webauthn.New(&webauthn.Config{
+		RPID:          config.RPID,
+		RPDisplayName: config.RPName,
+		RPOrigins:     config.Origins,
+		AuthenticatorSelection: protocol.AuthenticatorSelection{
+			ResidentKey:        protocol.ResidentKeyRequirementRequired,
+			RequireResidentKey: protocol.ResidentKeyRequired(),
+			UserVerification:   protocol.VerificationRequired,
+		},
+		Timeouts: webauthn.TimeoutsConfig{Login: timeout, Registration: timeout},
+	})
+	if err != nil {
+		return err
+	}
+	WebAuthn = w
+	return nil
+}
+
+// passkeyUser adapts a user and their passkeys to webauthn.User.
+type passkeyUser struct {
+	user     models.User
+	passkeys []models.Passkey
+}
+
+func (u passkeyUser) WebAuthnID() []byte          { return u.user.PasskeyHandle }
+func (u passkeyUser) WebAuthnName() string        { return u.user.Username }
+func (u passkeyUser) WebAuthnDisplayName() string { return u.user.Username }
+func (u passkeyUser) WebAuthnIcon() string        { return "" }
+
+func (u passkeyUser) WebAuthnCredentials() []webauthn.Credential {
+	credentials := make([]webauthn.Credential, len(u.passkeys))
+	for i, p := range u.passkeys {
+		transports := []protocol.AuthenticatorTransport{}
+		for _, transport := range p.TransportList() {
+			transports = append(transports, protocol.AuthenticatorTransport(transport))
+		}
+		credentials[i] = webauthn.Credential{
+			ID:              p.CredentialID,
+			PublicKey:       p.PublicKey,
+			AttestationType: p.AttestationType,
+			Transport:       transports,
+			Flags: webauthn.CredentialFlags{
+				BackupEligible: p.BackupEligible,
+				BackupState:    p.BackupState,
+			},
+			Authenticator: webauthn.Authenticator{
+				AAGUID:    p.AAGUID,
+				SignCount: p.SignCount,
+			},
+		}
+	}
+	return credentials
+}
+
+// passkey returns the passkey of u with credentialID.
+func (u passkeyUser) passkey(credentialID []byte) (*models.Passkey, bool) {
+	for i := range u.passkeys {
+		if bytes.Equal(u.passkeys[i].CredentialID, credentialID) {
+			return &u.passkeys[i], true
+		}
+	}
+	return nil, false
+}
+
+// BeginPasskeyRegistration starts adding a passkey for user, who must have
+// a passkey handle (see models.UserDB.EnsurePasskeyHandle). The result goes
+// to navigator.credentials.create in the browser.
+func BeginPasskeyRegistration(w http.ResponseWriter, r *http.Request, user models.User, passkeys []models.Passkey) (*protocol.CredentialCreation, error) {
+	u := passkeyUser{user: user, passkeys: passkeys}
+	exclusions := []protocol.CredentialDescriptor{}
+	for _, credential := range u.WebAuthnCredentials() {
+		exclusions = append(exclusions, credential.Descriptor())
+	}
+	creation, data, err := WebAuthn.BeginRegistration(u, webauthn.WithExclusions(exclusions))
+	if err != nil {
+		return nil, err
+	}
+	return creation, saveCeremony(w, r, passkeyRegistrationKey, data)
+}
+
+// FinishPasskeyRegistration checks the new credential in body, the JSON of
+// the PublicKeyCredential the browser created, and returns the passkey to
+// store. It is not saved yet.
+func FinishPasskeyRegistration(w http.ResponseWriter, r *http.Request, user models.User, passkeys []models.Passkey, body io.Reader) (models.Passkey, error) {
+	data, err := takeCeremony(w, r, passkeyRegistrationKey)
+	if err != nil {
+		return models.Passkey{}, err
+	}
+	parsed, err := protocol.ParseCredentialCreationResponseBody(body)
+	if err != nil {
+		return models.Passkey{}, rejected(err)
+	}
+	credential, err := WebAuthn.CreateCredential(passkeyUser{user: user, passkeys: passkeys}, data, parsed)
+	if err != nil {
+		return models.Passkey{}, rejected(err)
+	}
+
+	transports := []string{}
+	for _, transport := range credential.Transport {
+		transports = append(transports, string(transport))
+	}
+	return models.Passkey{
+		UserID:          user.ID,
+		CredentialID:    credential.ID,
+		PublicKey:       credential.PublicKey,
+		AttestationType: credential.AttestationType,
+		Transports:      strings.Join(transports, ","),
+		AAGUID:          credential.Authenticator.AAGUID,
+		SignCount:       credential.Authenticator.SignCount,
+		BackupEligible:  credential.Flags.BackupEligible,
+		BackupState:     credential.Flags.BackupState,
+	}, nil
+}
+
+// BeginPasskeyLogin starts a login without a username: the browser offers
+// the passkeys it has for the site and the chosen one names the user.
+func BeginPasskeyLogin(w http.ResponseWriter, r *http.Request) (*protocol.CredentialAssertion, error) {
+	assertion, data, err := WebAuthn.BeginDiscoverableLogin()
+	if err != nil {
+		return nil, err
+	}
+	return assertion, saveCeremony(w, r, passkeyLoginKey, data)
+}
+
+// FinishPasskeyLogin checks the assertion in body and returns the user it
+// logs in. The caller marks the session as authenticated.
+func FinishPasskeyLogin(w http.ResponseWriter, r *http.Request, userDB models.UserDB, body io.Reader, now time.Time) (models.User, error) {
+	data, err := takeCeremony(w, r, passkeyLoginKey)
+	if err != nil {
+		return models.User{}, err
+	}
+	parsed, err := protocol.ParseCredentialRequestResponseBody(body)
+	if err != nil {
+		return models.User{}, rejected(err)
+	}
+
+	var found passkeyUser
+	credential, err := WebAuthn.ValidateDiscoverableLogin(func(rawID, userHandle []byte) (webauthn.User, error) {
+		user := userDB.FindByPasskeyHandle(userHandle)
+		if user.ID == 0 {
+			return nil, errors.New("unknown user handle")
+		}
+		passkeys, err := userDB.Passkeys(user.ID)
+		if err != nil {
+			return nil, err
+		}
+		found = passkeyUser{user: user, passkeys: passkeys}
+		return found, nil
+	}, data, parsed)
+	if err != nil {
+		return models.User{}, rejected(err)
+	}
+	return found.user, usePasskey(userDB, found, credential, now)
+}
+
+// BeginPasskeyStepUp asks user to confirm with one of their passkeys that
+// they are still at the keyboard, before a sensitive change.
+func BeginPasskeyStepUp(w http.ResponseWriter, r *http.Request, user models.User, passkeys []models.Passkey) (*protocol.CredentialAssertion, error) {
+	assertion, data, err := WebAuthn.BeginLogin(passkeyUser{user: user, passkeys: passkeys})
+	if err != nil {
+		return nil, rejected(err)
+	}
+	return assertion, saveCeremony(w, r, passkeyStepUpKey, data)
+}
+
+// FinishPasskeyStepUp checks the assertion in body for user and marks the
+// session as recently verified.
+func FinishPasskeyStepUp(w http.ResponseWriter, r *http.Request, userDB models.UserDB, user models.User, body io.Reader, now time.Time) error {
+	data, err := takeCeremony(w, r, passkeyStepUpKey)
+	if err != nil {
+		return err
+	}
+	parsed, err := protocol.ParseCredentialRequestResponseBody(body)
+	if err != nil {
+		return rejected(err)
+	}
+	passkeys, err := userDB.Passkeys(user.ID)
+	if err != nil {
+		return err
+	}
+	u := passkeyUser{user: user, passkeys: passkeys}
+	credential, err := WebAuthn.ValidateLogin(u, data, parsed)
+	if err != nil {
+		return rejected(err)
+	}
+	if err := usePasskey(userDB, u, credential, now); err != nil {
+		return err
+	}
+
+	session, _ := Store.Get(r, "juniper-session")
+	MarkVerified(session, now)
+	return session.Save(r, w)
+}
+
+// usePasskey stores the signature counter of a login with credential. A
+// counter that went backwards means the key was copied, so the login is
+// refused.
+func usePasskey(userDB models.UserDB, u passkeyUser, credential *webauthn.Credential, now time.Time) error {
+	if credential.Authenticator.CloneWarning {
+		return fmt.Errorf("%w: signature counter went backwards, the authenticator may be cloned", ErrPasskeyRejected)
+	}
+	passkey, ok := u.passkey(credential.ID)
+	if !ok {
+		return fmt.Errorf("%w: unknown credential", ErrPasskeyRejected)
+	}
+	return userDB.UsePasskey(passkey, credential.Authenticator.SignCount, credential.Flags.BackupState, now)
+}
+
+// saveCeremony keeps data in the session until the browser answers.
+func saveCeremony(w http.ResponseWriter, r *http.Request, key string, data *webauthn.SessionData) error {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	session, _ := Store.Get(r, "juniper-session")
+	session.Values[key] = encoded
+	return session.Save(r, w)
+}
+
+// takeCeremony returns the data saveCeremony kept under key and removes it,
+// so each challenge is answered at most once.
+func takeCeremony(w http.ResponseWriter, r *http.Request, key string) (webauthn.SessionData, error) {
+	var data webauthn.SessionData
+	session, _ := Store.Get(r, "juniper-session")
+	encoded, ok := session.Values[key].([]byte)
+	if !ok {
+		return data, fmt.Errorf("%w: no ceremony in progress", ErrPasskeyRejected)
+	}
+	delete(session.Values, key)
+	if err := session.Save(r, w); err != nil {
+		return data, err
+	}
+	if err := json.Unmarshal(encoded, &data); err != nil {
+		return data, err
+	}
+	return data, nil
+}
+
+func rejected(err error) error {
+	var protocolErr *protocol.Error
+	if errors.As(err, &protocolErr) && protocolErr.DevInfo != "" {
+		return fmt.Errorf("%w: %s: %s", ErrPasskeyRejected, protocolErr.Details, protocolErr.DevInfo)
+	}
+	return fmt.Errorf("%w: %v", ErrPasskeyRejected, err)
+}
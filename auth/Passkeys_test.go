@@ -0,0 +1,249 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"pioneerwebworks.com/juniper/models"
+)
+
+// softAuthenticator is a passkey authenticator in software, answering the
+// ceremonies like a browser with a platform authenticator would.
+type softAuthenticator struct {
+	t            *testing.T
+	origin       string
+	rpID         string
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	userHandle   []byte
+	signCount    uint32
+}
+
+func newSoftAuthenticator(t *testing.T, origin, rpID string) *softAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate a key: %v", err)
+	}
+	credentialID := make([]byte, 16)
+	rand.Read(credentialID)
+	return &softAuthenticator{t: t, origin: origin, rpID: rpID, key: key, credentialID: credentialID}
+}
+
+func (a *softAuthenticator) clientData(kind string, challenge []byte) []byte {
+	data, _ := json.Marshal(map[string]string{
+		"type":      kind,
+		"challenge": base64.RawURLEncoding.EncodeToString(challenge),
+		"origin":    a.origin,
+	})
+	return data
+}
+
+// authData builds the authenticator data with user presence and user
+// verification, plus attested credential data when attested is set.
+func (a *softAuthenticator) authData(attested bool) []byte {
+	rpIDHash := sha256.Sum256([]byte(a.rpID))
+	data := append([]byte{}, rpIDHash[:]...)
+	flags := byte(0x01 | 0x04)
+	if attested {
+		flags |= 0x40
+	}
+	data = append(data, flags)
+	data = binary.BigEndian.AppendUint32(data, a.signCount)
+	if attested {
+		data = append(data, make([]byte, 16)...) // AAGUID
+		data = binary.BigEndian.AppendUint16(data, uint16(len(a.credentialID)))
+		data = append(data, a.credentialID...)
+		publicKey, err := webauthncbor.Marshal(map[int]interface{}{
+			1:  2,  // EC2
+			3:  -7, // ES256
+			-1: 1,  // P-256
+			-2: a.key.X.FillBytes(make([]byte, 32)),
+			-3: a.key.Y.FillBytes(make([]byte, 32)),
+		})
+		if err != nil {
+			a.t.Fatalf("Failed to encode the public key: %v", err)
+		}
+		data = append(data, publicKey...)
+	}
+	return data
+}
+
+// create answers navigator.credentials.create.
+func (a *softAuthenticator) create(challenge, userHandle []byte) []byte {
+	a.userHandle = userHandle
+	attestation, err := webauthncbor.Marshal(map[string]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[string]interface{}{},
+		"authData": a.authData(true),
+	})
+	if err != nil {
+		a.t.Fatalf("Failed to encode the attestation: %v", err)
+	}
+	id := base64.RawURLEncoding.EncodeToString(a.credentialID)
+	body, _ := json.Marshal(map[string]interface{}{
+		"id":    id,
+		"rawId": id,
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    base64.RawURLEncoding.EncodeToString(a.clientData("webauthn.create", challenge)),
+			"attestationObject": base64.RawURLEncoding.EncodeToString(attestation),
+		},
+	})
+	return body
+}
+
+// get answers navigator.credentials.get.
+func (a *softAuthenticator) get(challenge []byte) []byte {
+	a.signCount++
+	authData := a.authData(false)
+	clientData := a.clientData("webauthn.get", challenge)
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		a.t.Fatalf("Failed to sign: %v", err)
+	}
+	id := base64.RawURLEncoding.EncodeToString(a.credentialID)
+	body, _ := json.Marshal(map[string]interface{}{
+		"id":    id,
+		"rawId": id,
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    base64.RawURLEncoding.EncodeToString(clientData),
+			"authenticatorData": base64.RawURLEncoding.EncodeToString(authData),
+			"signature":         base64.RawURLEncoding.EncodeToString(signature),
+			"userHandle":        base64.RawURLEncoding.EncodeToString(a.userHandle),
+		},
+	})
+	return body
+}
+
+func Test_Passkeys(t *testing.T) {
+	var db = func() models.UserDB {
+		store, db := newTestStore(t)
+		Store = store
+		db.AutoMigrate(&models.User{}, &models.Passkey{})
+		return models.UserDB{DB: db}
+	}()
+	t.Cleanup(func() { Store = nil })
+	if err := InitPasskeys(PasskeyConfig{RPID: "example.com", RPName: "Juniper", Origins: []string{"https://example.com"}, Timeout: time.Minute}); err != nil {
+		t.Fatalf("Failed to set up WebAuthn: %v", err)
+	}
+	user := models.User{Username: "alice", Email: "alice@example.com"}
+	db.CreateUser(&user)
+	if err := db.EnsurePasskeyHandle(&user); err != nil || len(user.PasskeyHandle) != 32 {
+		t.Fatalf("Failed to give the user a passkey handle: %v", err)
+	}
+
+	// request sends the cookies of earlier responses, like a browser.
+	var cookies []*http.Cookie
+	request := func(body []byte) (*httptest.ResponseRecorder, *http.Request) {
+		r := httptest.NewRequest("POST", "/api/auth/passkeys", bytes.NewReader(body))
+		for _, cookie := range cookies {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		return w, r
+	}
+	keep := func(w *httptest.ResponseRecorder) {
+		if c := w.Result().Cookies(); len(c) > 0 {
+			cookies = c
+		}
+	}
+	now := time.Now()
+	authenticator := newSoftAuthenticator(t, "https://example.com", "example.com")
+
+	w, r := request(nil)
+	creation, err := BeginPasskeyRegistration(w, r, user, nil)
+	if err != nil {
+		t.Fatalf("Failed to begin registration: %v", err)
+	}
+	keep(w)
+	w, r = request(nil)
+	body := authenticator.create(creation.Response.Challenge, user.PasskeyHandle)
+	passkey, err := FinishPasskeyRegistration(w, r, user, nil, bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to register a passkey: %v", err)
+	}
+	keep(w)
+	if err := db.AddPasskey(&passkey); err != nil {
+		t.Fatalf("Failed to save the passkey: %v", err)
+	}
+
+	w, r = request(nil)
+	assertion, err := BeginPasskeyLogin(w, r)
+	if err != nil {
+		t.Fatalf("Failed to begin login: %v", err)
+	}
+	keep(w)
+	answer := authenticator.get(assertion.Response.Challenge)
+	w, r = request(nil)
+	loggedIn, err := FinishPasskeyLogin(w, r, db, bytes.NewReader(answer), now)
+	if err != nil || loggedIn.ID != user.ID {
+		t.Fatalf("Expected the passkey to log in %d, got %d: %v", user.ID, loggedIn.ID, err)
+	}
+	keep(w)
+	passkeys, _ := db.Passkeys(user.ID)
+	if len(passkeys) != 1 || passkeys[0].SignCount != 1 {
+		t.Errorf("Expected the signature counter to be stored, got %+v", passkeys)
+	}
+
+	w, r = request(nil)
+	if _, err := FinishPasskeyLogin(w, r, db, bytes.NewReader(answer), now); !errors.Is(err, ErrPasskeyRejected) {
+		t.Errorf("Expected a replayed answer to be rejected, got %v", err)
+	}
+
+	// A counter going backwards means the key was copied.
+	w, r = request(nil)
+	assertion, _ = BeginPasskeyLogin(w, r)
+	keep(w)
+	authenticator.signCount = 0
+	w, r = request(nil)
+	if _, err := FinishPasskeyLogin(w, r, db, bytes.NewReader(authenticator.get(assertion.Response.Challenge)), now); !errors.Is(err, ErrPasskeyRejected) {
+		t.Errorf("Expected a cloned authenticator to be rejected, got %v", err)
+	}
+	authenticator.signCount = 5
+
+	// Another site's page cannot use the passkey.
+	w, r = request(nil)
+	assertion, _ = BeginPasskeyLogin(w, r)
+	keep(w)
+	phishing := *authenticator
+	phishing.origin = "https://example.com.evil.test"
+	w, r = request(nil)
+	if _, err := FinishPasskeyLogin(w, r, db, bytes.NewReader(phishing.get(assertion.Response.Challenge)), now); !errors.Is(err, ErrPasskeyRejected) {
+		t.Errorf("Expected an answer from another origin to be rejected, got %v", err)
+	}
+
+	w, r = request(nil)
+	if VerifiedRecently(r, now) {
+		t.Errorf("Expected the session not to be verified yet")
+	}
+	passkeys, _ = db.Passkeys(user.ID)
+	assertion, err = BeginPasskeyStepUp(w, r, user, passkeys)
+	if err != nil {
+		t.Fatalf("Failed to begin step-up: %v", err)
+	}
+	keep(w)
+	w, r = request(nil)
+	if err := FinishPasskeyStepUp(w, r, db, user, bytes.NewReader(authenticator.get(assertion.Response.Challenge)), now); err != nil {
+		t.Fatalf("Failed to step up: %v", err)
+	}
+	keep(w)
+	_, r = request(nil)
+	if !VerifiedRecently(r, now) || VerifiedRecently(r, now.Add(StepUpMaxAge)) {
+		t.Errorf("Expected the session to be verified for StepUpMaxAge")
+	}
+}
@@ -0,0 +1,262 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"pioneerwebworks.com/juniper/models"
+	"pioneerwebworks.com/juniper/ratelimit"
+)
+
+// ErrSessionRevoked is returned by Save when the session was deleted, for
+// example by "log out all devices", while the request was being served.
+var ErrSessionRevoked = errors.New("session revoked")
+
+// lastSeenInterval limits how often a session's LastSeenAt is written, so
+// every request does not turn into a database write.
+const lastSeenInterval = time.Minute
+
+// DBStore is a sessions.Store keeping sessions in the user database. The
+// cookie only carries the signed session ID, so a session can be revoked by
+// deleting its row.
+type DBStore struct {
+	Options     *sessions.Options // Defaults for new sessions
+	Lifetime    time.Duration     // From login, however active the session is
+	IdleTimeout time.Duration     // Without a request
+
+	db  models.UserDB
+	now func() time.Time
+
+	mu      sync.RWMutex
+	codecs  []securecookie.Codec
+	keysSum [sha256.Size]byte // Of the keys behind codecs
+}
+
+func NewDBStore(db models.UserDB, keys KeyRing, lifetime, idleTimeout time.Duration) *DBStore {
+	s := &DBStore{
+		Options: &sessions.Options{
+			Path:     "/",
+			MaxAge:   int(lifetime.Seconds()),
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		},
+		Lifetime:    lifetime,
+		IdleTimeout: idleTimeout,
+		db:          db,
+		now:         time.Now,
+	}
+	s.SetKeys(keys)
+	return s
+}
+
+// SetKeys replaces the keys cookies are encoded and decoded with, and
+// reports whether they changed.
+func (s *DBStore) SetKeys(keys KeyRing) bool {
+	hash := sha256.New()
+	for _, key := range keys.Keys {
+		hash.Write(key.Hash)
+		hash.Write(key.Block)
+	}
+	var sum [sha256.Size]byte
+	copy(sum[:], hash.Sum(nil))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sum == s.keysSum {
+		return false
+	}
+	s.codecs = keys.Codecs(s.Lifetime)
+	s.keysSum = sum
+	return true
+}
+
+// Codecs returns the codecs for the current keys, the first one encoding.
+func (s *DBStore) Codecs() []securecookie.Codec {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.codecs
+}
+
+// Get returns the session for name, cached for the rest of the request.
+func (s *DBStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New loads the session named by the cookie. A missing, forged, expired or
+// revoked session gives a new empty one rather than an error, which is what
+// a logged out visitor has.
+func (s *DBStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	options := *s.Options
+	session.Options = &options
+	session.IsNew = true
+
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+	var id string
+	if err := securecookie.DecodeMulti(name, cookie.Value, &id, s.Codecs()...); err != nil {
+		slog.DebugContext(r.Context(), "session: invalid cookie", "error", err)
+		return session, nil
+	}
+
+	db := s.db.WithContext(r.Context())
+	var row models.Session
+	if err := db.DB.Limit(1).Find(&row, "id = ?", id).Error; err != nil {
+		return session, err
+	}
+	now := s.now()
+	switch {
+	case row.ID == "":
+		return session, nil
+	case !now.Before(row.ExpiresAt), now.Sub(row.LastSeenAt) >= s.IdleTimeout:
+		slog.DebugContext(r.Context(), "session: expired", "user_id", row.UserID)
+		return session, db.DB.Delete(&row).Error
+	}
+
+	if err := (securecookie.GobEncoder{}).Deserialize(row.Data, &session.Values); err != nil {
+		slog.WarnContext(r.Context(), "session: undecodable data", "error", err)
+		return session, nil
+	}
+	session.ID = row.ID
+	session.IsNew = false
+
+	if now.Sub(row.LastSeenAt) >= lastSeenInterval {
+		err = db.DB.Model(&row).Updates(map[string]interface{}{
+			"last_seen_at": now,
+			"ip_address":   ratelimit.ClientIP(r),
+		}).Error
+	}
+	return session, err
+}
+
+// Save writes the session and sets the cookie. A negative MaxAge deletes
+// the session, which is how a single device logs out.
+func (s *DBStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	db := s.db.WithContext(r.Context())
+
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			if err := db.DB.Delete(&models.Session{}, "id = ?", session.ID).Error; err != nil {
+				return err
+			}
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	data, err := securecookie.GobEncoder{}.Serialize(session.Values)
+	if err != nil {
+		return err
+	}
+	var userID uint
+	if authenticated, _ := session.Values["authenticated"].(bool); authenticated {
+		userID, _ = session.Values["userID"].(uint)
+	}
+	now := s.now()
+
+	if session.ID == "" {
+		id, err := newSessionID()
+		if err != nil {
+			return err
+		}
+		row := models.Session{
+			ID:         id,
+			UserID:     userID,
+			Data:       data,
+			IPAddress:  ratelimit.ClientIP(r),
+			UserAgent:  truncate(r.UserAgent(), 512),
+			CreatedAt:  now,
+			LastSeenAt: now,
+			ExpiresAt:  now.Add(s.Lifetime),
+		}
+		if err := db.DB.Create(&row).Error; err != nil {
+			return err
+		}
+		session.ID = id
+	} else {
+		tx := db.DB.Model(&models.Session{ID: session.ID}).Updates(map[string]interface{}{
+			"user_id":      userID,
+			"data":         data,
+			"last_seen_at": now,
+		})
+		if tx.Error != nil {
+			return tx.Error
+		}
+		if tx.RowsAffected == 0 {
+			// Writing it back would undo the revocation.
+			options := *session.Options
+			options.MaxAge = -1
+			http.SetCookie(w, sessions.NewCookie(session.Name(), "", &options))
+			return ErrSessionRevoked
+		}
+	}
+
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.Codecs()...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+// Renew deletes the stored session so the next Save gives it a new ID, and
+// drops its CSRF token. Call it when a user logs in, so an ID or token
+// planted before login is worthless after.
+func (s *DBStore) Renew(r *http.Request, session *sessions.Session) error {
+	delete(session.Values, csrfSessionKey)
+	if session.ID == "" {
+		return nil
+	}
+	err := s.db.WithContext(r.Context()).DB.Delete(&models.Session{}, "id = ?", session.ID).Error
+	session.ID = ""
+	session.IsNew = true
+	return err
+}
+
+// Cleanup deletes expired and idle sessions every interval until ctx is done.
+func (s *DBStore) Cleanup(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			db := s.db.WithContext(ctx)
+			deleted, err := db.DeleteExpiredSessions(s.now(), s.IdleTimeout)
+			if err != nil {
+				slog.ErrorContext(ctx, "session cleanup failed", "error", err)
+				continue
+			}
+			if deleted > 0 {
+				slog.InfoContext(ctx, "expired sessions deleted", "count", deleted)
+			}
+		}
+	}
+}
+
+func newSessionID() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
@@ -0,0 +1,127 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"pioneerwebworks.com/juniper/models"
+)
+
+// newTestStore returns a store on a fresh database, with sessions lasting a
+// day and an idle timeout of an hour.
+func newTestStore(t *testing.T) (*DBStore, *gorm.DB) {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "user.db")), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	db.AutoMigrate(&models.Session{})
+	keys := KeyRing{}
+	keys.Rotate(time.Now(), time.Hour)
+	return NewDBStore(models.UserDB{DB: db}, keys, 24*time.Hour, time.Hour), db
+}
+
+func Test_DBStore(t *testing.T) {
+	store, db := newTestStore(t)
+	userDB := models.UserDB{DB: db}
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	store.now = func() time.Time { return now }
+
+	// request sends cookies like a browser would and returns the session
+	// the store loads for them.
+	var cookies []*http.Cookie
+	request := func() *http.Request {
+		r := httptest.NewRequest("GET", "/dashboard", nil)
+		r.RemoteAddr = "192.0.2.1:1234"
+		r.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64; rv:125.0) Gecko/20100101 Firefox/125.0")
+		for _, cookie := range cookies {
+			r.AddCookie(cookie)
+		}
+		return r
+	}
+	save := func(r *http.Request, session *sessions.Session) error {
+		w := httptest.NewRecorder()
+		err := session.Save(r, w)
+		if set := w.Result().Cookies(); len(set) > 0 {
+			cookies = set
+		}
+		return err
+	}
+
+	r := request()
+	session, err := store.Get(r, "juniper-session")
+	if err != nil || !session.IsNew {
+		t.Fatalf("Expected a new session without a cookie, got %v", err)
+	}
+	session.Values["userID"] = uint(7)
+	session.Values["authenticated"] = true
+	if err := save(r, session); err != nil {
+		t.Fatalf("Failed to save session: %v", err)
+	}
+	firstID := session.ID
+
+	sessions, _ := userDB.ActiveSessions(7, now, time.Hour)
+	if len(sessions) != 1 || sessions[0].IPAddress != "192.0.2.1" || sessions[0].Device() != "Firefox on Linux" {
+		t.Errorf("Expected one session with device metadata, got %+v", sessions)
+	}
+
+	now = now.Add(30 * time.Minute)
+	session, _ = store.Get(request(), "juniper-session")
+	if session.IsNew || session.ID != firstID || session.Values["userID"] != uint(7) {
+		t.Errorf("Expected the saved session to load from the cookie, got %+v", session)
+	}
+
+	// Logging in again gets a new ID and drops the old one.
+	r = request()
+	session, _ = store.Get(r, "juniper-session")
+	store.Renew(r, session)
+	save(r, session)
+	if session.ID == firstID {
+		t.Errorf("Expected Renew to change the session ID")
+	}
+	var count int64
+	db.Model(&models.Session{}).Where("id = ?", firstID).Count(&count)
+	if count != 0 {
+		t.Errorf("Expected the renewed session to be deleted")
+	}
+
+	// Revoked elsewhere: the cookie stops working and a stale save does not
+	// bring the session back.
+	r = request()
+	stale, _ := store.Get(r, "juniper-session")
+	userDB.RevokeSessions(7, "")
+	if err := save(r, stale); !errors.Is(err, ErrSessionRevoked) {
+		t.Errorf("Expected saving a revoked session to fail, got %v", err)
+	}
+	session, _ = store.Get(request(), "juniper-session")
+	if !session.IsNew {
+		t.Errorf("Expected a revoked session to be gone")
+	}
+
+	// Idle sessions expire.
+	r = request()
+	session, _ = store.Get(r, "juniper-session")
+	save(r, session)
+	now = now.Add(2 * time.Hour)
+	session, _ = store.Get(request(), "juniper-session")
+	if !session.IsNew {
+		t.Errorf("Expected an idle session to expire")
+	}
+
+	// Logging out deletes the session.
+	r = request()
+	session, _ = store.Get(r, "juniper-session")
+	save(r, session)
+	session.Options.MaxAge = -1
+	save(r, session)
+	db.Model(&models.Session{}).Count(&count)
+	if count != 0 {
+		t.Errorf("Expected logging out to delete the session, %d left", count)
+	}
+}
@@ -0,0 +1,52 @@
+package auth
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"pioneerwebworks.com/juniper/apperr"
+)
+
+// StepUpMaxAge is how long after logging in or confirming with a passkey
+// sensitive changes are allowed without asking again.
+var StepUpMaxAge = 10 * time.Minute
+
+// verifiedAtKey holds the Unix time the user last proved who they are.
+const verifiedAtKey = "verifiedAt"
+
+// MarkVerified records in session that the user just logged in or
+// confirmed with a passkey. The caller saves the session.
+func MarkVerified(session *sessions.Session, now time.Time) {
+	session.Values[verifiedAtKey] = now.Unix()
+}
+
+// VerifiedRecently reports whether the user of r proved who they are less
+// than StepUpMaxAge before now.
+func VerifiedRecently(r *http.Request, now time.Time) bool {
+	session, _ := Store.Get(r, "juniper-session")
+	verifiedAt, ok := session.Values[verifiedAtKey].(int64)
+	return ok && now.Sub(time.Unix(verifiedAt, 0)) < StepUpMaxAge
+}
+
+// WithStepUp refuses requests from sessions that were not verified
+// recently, so an unattended logged in browser cannot change how its user
+// logs in. It goes after WithAuth. The client confirms with a passkey, or
+// logs in again, and retries.
+func WithStepUp(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !VerifiedRecently(r, time.Now()) {
+			slog.DebugContext(r.Context(), "auth: step-up required", "user_id", UserIDFromContext(r.Context()))
+			err := apperr.Forbidden("Confirm it is you with a passkey or log in again")
+			err.Code = "step_up_required"
+			if apperr.IsAPIRequest(r) {
+				apperr.WriteJSON(w, r, err)
+				return
+			}
+			http.Error(w, err.Message, http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
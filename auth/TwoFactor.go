@@ -0,0 +1,64 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"slices"
+	"strings"
+	"time"
+
+	"pioneerwebworks.com/juniper/models"
+	"pioneerwebworks.com/juniper/totp"
+)
+
+// TwoFactorRoles lists the roles that must log in with a second factor.
+// Users with one of them are sent to TwoFactorSetupPath until they set it
+// up.
+var TwoFactorRoles = []string{"administrator"}
+
+// TwoFactorSetupPath is where users set up two-factor authentication. It
+// and the routes below it stay open to users who still have to.
+const TwoFactorSetupPath = "/dashboard/two-factor"
+
+// TwoFactorRequired reports whether user must use two-factor authentication.
+func TwoFactorRequired(user models.User) bool {
+	return slices.Contains(TwoFactorRoles, user.UserRole)
+}
+
+// needsTwoFactorSetup reports whether user may only reach the setup page.
+func needsTwoFactorSetup(user models.User, path string) bool {
+	return TwoFactorRequired(user) && !user.TOTPEnabled &&
+		path != TwoFactorSetupPath && !strings.HasPrefix(path, TwoFactorSetupPath+"/")
+}
+
+// GenerateRecoveryCodes returns n codes like "k3j5h-a9x2m", 50 random bits
+// each.
+func GenerateRecoveryCodes(n int) ([]string, error) {
+	encoding := base32.StdEncoding.WithPadding(base32.NoPadding)
+	codes := make([]string, n)
+	for i := range codes {
+		b := make([]byte, 7)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(encoding.EncodeToString(b))[:10]
+		codes[i] = code[:5] + "-" + code[5:]
+	}
+	return codes, nil
+}
+
+// VerifySecondFactor checks a TOTP code, or failing that a recovery code,
+// for user. Either can only be used once.
+func VerifySecondFactor(userDB models.UserDB, user *models.User, code, recoveryCode string, now time.Time) (bool, error) {
+	if code != "" {
+		step, ok := totp.Validate(user.TOTPSecret, code, now, user.TOTPLastStep)
+		if !ok {
+			return false, nil
+		}
+		return userDB.UseTOTPStep(user, step)
+	}
+	if recoveryCode != "" {
+		return userDB.UseRecoveryCode(user.ID, recoveryCode, now)
+	}
+	return false, nil
+}
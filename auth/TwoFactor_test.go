@@ -0,0 +1,40 @@
+package auth
+
+import (
+	"regexp"
+	"testing"
+
+	"pioneerwebworks.com/juniper/models"
+)
+
+func Test_TwoFactorSetup(t *testing.T) {
+	admin := models.User{UserRole: "administrator"}
+	if !needsTwoFactorSetup(admin, "/dashboard") {
+		t.Errorf("Expected an administrator without TOTP to be sent to setup")
+	}
+	if needsTwoFactorSetup(admin, TwoFactorSetupPath) || needsTwoFactorSetup(admin, TwoFactorSetupPath+"/enable") {
+		t.Errorf("Expected the setup pages to stay open")
+	}
+	if !needsTwoFactorSetup(admin, "/dashboard/two-factorx") {
+		t.Errorf("Expected only the setup pages to stay open")
+	}
+	admin.TOTPEnabled = true
+	if needsTwoFactorSetup(admin, "/dashboard") {
+		t.Errorf("Expected an administrator with TOTP to pass")
+	}
+	if needsTwoFactorSetup(models.User{UserRole: "user"}, "/dashboard") {
+		t.Errorf("Expected other roles not to need two-factor authentication")
+	}
+
+	codes, err := GenerateRecoveryCodes(10)
+	if err != nil || len(codes) != 10 {
+		t.Fatalf("Failed to generate recovery codes: %v", err)
+	}
+	seen := map[string]bool{}
+	for _, code := range codes {
+		if !regexp.MustCompile(`^[a-z2-7]{5}-[a-z2-7]{5}$`).MatchString(code) || seen[code] {
+			t.Errorf("Expected unique codes like xxxxx-xxxxx, got %q", code)
+		}
+		seen[code] = true
+	}
+}
@@ -0,0 +1,113 @@
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Reloader serves a certificate and key pair from disk and picks up new
+// files, e.g. after a certbot renewal, without a restart.
+type Reloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	version string // Modification times and sizes of the loaded files
+}
+
+func NewReloader(certFile string, keyFile string) (*Reloader, error) {
+	reloader := &Reloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := reloader.Reload(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// Reload reads the files again. On error the previous certificate is kept.
+func (r *Reloader) Reload() error {
+	version, err := r.fileVersion()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert = &cert
+	r.version = version
+	return nil
+}
+
+// fileVersion identifies the current contents of the files. Stat follows
+// symlinks, so swapping the link target counts as a change.
+func (r *Reloader) fileVersion() (string, error) {
+	version := ""
+	for _, name := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return "", err
+		}
+		version += info.ModTime().String() + "/" + strconv.FormatInt(info.Size(), 10) + ";"
+	}
+	return version, nil
+}
+
+// reloadIfChanged reloads when either file changed since the last load.
+func (r *Reloader) reloadIfChanged() (bool, error) {
+	version, err := r.fileVersion()
+	if err != nil {
+		return false, err
+	}
+	r.mu.RLock()
+	unchanged := version == r.version
+	r.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+	return true, r.Reload()
+}
+
+// Watch checks the files every interval until ctx is done.
+func (r *Reloader) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reloaded, err := r.reloadIfChanged()
+			if err != nil {
+				slog.Error("failed to reload TLS certificate, keeping the current one", "error", err)
+			} else if reloaded {
+				slog.Info("reloaded TLS certificate", "file", r.certFile)
+			}
+		}
+	}
+}
+
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// TLSConfig returns a server configuration using the reloaded certificate.
+func (r *Reloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: r.GetCertificate,
+	}
+}
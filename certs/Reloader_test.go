@@ -0,0 +1,96 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeCert(t *testing.T, certFile string, keyFile string, serial int64, modTime time.Time) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(certFile, modTime, modTime)
+	os.Chtimes(keyFile, modTime, modTime)
+}
+
+func serialOf(t *testing.T, r *Reloader) int64 {
+	t.Helper()
+	cert, _ := r.GetCertificate(nil)
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("Failed to parse certificate: %v", err)
+	}
+	return parsed.SerialNumber.Int64()
+}
+
+func Test_Reloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	start := time.Now().Add(-time.Minute)
+	writeCert(t, certFile, keyFile, 1, start)
+
+	reloader, err := NewReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("Failed to load certificate: %v", err)
+	}
+	if serial := serialOf(t, reloader); serial != 1 {
+		t.Errorf("Expected serial 1, got %d", serial)
+	}
+
+	if reloaded, err := reloader.reloadIfChanged(); reloaded || err != nil {
+		t.Errorf("Expected no reload for unchanged files, got %v, %v", reloaded, err)
+	}
+
+	writeCert(t, certFile, keyFile, 2, start.Add(time.Second))
+	if reloaded, err := reloader.reloadIfChanged(); !reloaded || err != nil {
+		t.Fatalf("Failed to reload changed files: %v, %v", reloaded, err)
+	}
+	if serial := serialOf(t, reloader); serial != 2 {
+		t.Errorf("Expected serial 2, got %d", serial)
+	}
+
+	// A broken renewal keeps the certificate that is being served.
+	os.WriteFile(keyFile, []byte("not a key"), 0600)
+	if _, err := reloader.reloadIfChanged(); err == nil {
+		t.Errorf("Expected an error for an invalid key")
+	}
+	if serial := serialOf(t, reloader); serial != 2 {
+		t.Errorf("Expected serial 2 to be kept, got %d", serial)
+	}
+}
@@ -0,0 +1,638 @@
+package config
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	ProfileDev  = "dev"
+	ProfileTest = "test"
+	ProfileProd = "prod"
+)
+
+var Profiles = []string{ProfileDev, ProfileTest, ProfileProd}
+
+var apiVersionPattern = regexp.MustCompile(`^v[0-9]+$`)
+
+var oidcNamePattern = regexp.MustCompile(`^[a-z0-9-]+$`)
+
+// Config is the application configuration. Every setting can come from the
+// config file (by its yaml/toml key) or from an environment variable (by its
+// env tag), see Load for the precedence.
+//
+// Tags:
+//   - default: value used when no source sets the field
+//   - required: "true" or a comma separated list of profiles it is required in
+//   - secret: "true" to mask the value in Describe
+type Config struct {
+	Env     string        `env:"APP_ENV" yaml:"env" toml:"env" default:"dev"`
+	SiteURL string        `env:"SITE_URL" yaml:"site_url" toml:"site_url" required:"prod"`
+	Host    string        `env:"HOST" yaml:"host" toml:"host" default:"127.0.0.1"`
+	Port    int           `env:"PORT" yaml:"port" toml:"port" default:"8080"`
+	Log     LogConfig     `yaml:"log" toml:"log"`
+	HTTP    HTTPConfig    `yaml:"http" toml:"http"`
+	TLS     TLSConfig     `yaml:"tls" toml:"tls"`
+	SMTP    SMTPConfig    `yaml:"smtp" toml:"smtp"`
+	Media   MediaConfig   `yaml:"media" toml:"media"`
+	Robots  RobotsConfig  `yaml:"robots" toml:"robots"`
+	Metrics MetricsConfig `yaml:"metrics" toml:"metrics"`
+	Health  HealthConfig  `yaml:"health" toml:"health"`
+	Tracing TracingConfig `yaml:"tracing" toml:"tracing"`
+	API     APIConfig     `yaml:"api" toml:"api"`
+	CORS    CORSConfig    `yaml:"cors" toml:"cors"`
+	Auth    AuthConfig    `yaml:"auth" toml:"auth"`
+	OIDC    OIDCConfig    `yaml:"oidc" toml:"oidc"`
+	OAuth   OAuthConfig   `yaml:"oauth" toml:"oauth"`
+	Sources []string      `yaml:"-" toml:"-"` // Files that were loaded, for diagnostics
+}
+
+type LogConfig struct {
+	Level  string `env:"LOG_LEVEL" yaml:"level" toml:"level" default:"info"`
+	Format string `env:"LOG_FORMAT" yaml:"format" toml:"format"` // text or json, defaults to json in prod
+}
+
+// JSON reports whether logs should be written as JSON lines.
+func (l LogConfig) JSON(profile string) bool {
+	if l.Format == "" {
+		return profile == ProfileProd
+	}
+	return l.Format == "json"
+}
+
+type HTTPConfig struct {
+	ReadTimeout       time.Duration `env:"HTTP_READ_TIMEOUT" yaml:"read_timeout" toml:"read_timeout" default:"15s"`
+	ReadHeaderTimeout time.Duration `env:"HTTP_READ_HEADER_TIMEOUT" yaml:"read_header_timeout" toml:"read_header_timeout" default:"5s"`
+	WriteTimeout      time.Duration `env:"HTTP_WRITE_TIMEOUT" yaml:"write_timeout" toml:"write_timeout" default:"30s"`
+	IdleTimeout       time.Duration `env:"HTTP_IDLE_TIMEOUT" yaml:"idle_timeout" toml:"idle_timeout" default:"120s"`
+	ShutdownTimeout   time.Duration `env:"HTTP_SHUTDOWN_TIMEOUT" yaml:"shutdown_timeout" toml:"shutdown_timeout" default:"30s"`
+}
+
+// TLSConfig turns on HTTPS when both CertFile and KeyFile are set. PORT is
+// then the HTTPS port and plain HTTP on RedirectPort is redirected to it.
+type TLSConfig struct {
+	CertFile              string        `env:"TLS_CERT_FILE" yaml:"cert_file" toml:"cert_file"`
+	KeyFile               string        `env:"TLS_KEY_FILE" yaml:"key_file" toml:"key_file"`
+	ReloadInterval        time.Duration `env:"TLS_RELOAD_INTERVAL" yaml:"reload_interval" toml:"reload_interval" default:"30s"`
+	RedirectPort          int           `env:"TLS_REDIRECT_PORT" yaml:"redirect_port" toml:"redirect_port" default:"80"` // 0 disables the redirect listener
+	HSTSMaxAge            time.Duration `env:"TLS_HSTS_MAX_AGE" yaml:"hsts_max_age" toml:"hsts_max_age" default:"8760h"` // 0 disables HSTS
+	HSTSIncludeSubdomains bool          `env:"TLS_HSTS_INCLUDE_SUBDOMAINS" yaml:"hsts_include_subdomains" toml:"hsts_include_subdomains"`
+}
+
+func (t TLSConfig) Enabled() bool {
+	return t.CertFile != "" && t.KeyFile != ""
+}
+
+type SMTPConfig struct {
+	Host     string `env:"SMTP_HOST" yaml:"host" toml:"host" required:"prod"`
+	Port     int    `env:"SMTP_PORT" yaml:"port" toml:"port" default:"587"`
+	Username string `env:"SMTP_USERNAME" yaml:"username" toml:"username" required:"prod"`
+	Password string `env:"SMTP_PASSWORD" yaml:"password" toml:"password" secret:"true"`
+}
+
+type MediaConfig struct {
+	Storage    string   `env:"MEDIA_STORAGE" yaml:"storage" toml:"storage" default:"local"`
+	MaxBytes   int64    `env:"MEDIA_MAX_BYTES" yaml:"max_bytes" toml:"max_bytes" default:"10485760"`
+	SigningKey string   `env:"MEDIA_SIGNING_KEY" yaml:"signing_key" toml:"signing_key" required:"prod" secret:"true"`
+	S3         S3Config `yaml:"s3" toml:"s3"`
+}
+
+type S3Config struct {
+	Endpoint  string `env:"MEDIA_S3_ENDPOINT" yaml:"endpoint" toml:"endpoint"`
+	Bucket    string `env:"MEDIA_S3_BUCKET" yaml:"bucket" toml:"bucket"`
+	Region    string `env:"MEDIA_S3_REGION" yaml:"region" toml:"region"`
+	AccessKey string `env:"MEDIA_S3_ACCESS_KEY" yaml:"access_key" toml:"access_key"`
+	SecretKey string `env:"MEDIA_S3_SECRET_KEY" yaml:"secret_key" toml:"secret_key" secret:"true"`
+}
+
+type RobotsConfig struct {
+	TxtPath  string   `env:"ROBOTS_TXT" yaml:"txt_path" toml:"txt_path"`
+	Disallow []string `env:"ROBOTS_DISALLOW" yaml:"disallow" toml:"disallow" default:"/api/,/dashboard,/login,/logout,/register,/verify"`
+}
+
+// MetricsConfig controls /metrics, which is off by default. Scrapers need
+// the bearer Token or an address in AllowedNetworks. Behind a reverse proxy
+// every request comes from the proxy's address, so use the Token there.
+type MetricsConfig struct {
+	Enabled         bool     `env:"METRICS_ENABLED" yaml:"enabled" toml:"enabled"`
+	Token           string   `env:"METRICS_TOKEN" yaml:"token" toml:"token" secret:"true"`
+	AllowedNetworks []string `env:"METRICS_ALLOWED_NETWORKS" yaml:"allowed_networks" toml:"allowed_networks" default:"127.0.0.1,::1"`
+}
+
+type HealthConfig struct {
+	Timeout   time.Duration `env:"HEALTH_TIMEOUT" yaml:"timeout" toml:"timeout" default:"2s"` // Per check in /readyz
+	CheckSMTP bool          `env:"HEALTH_CHECK_SMTP" yaml:"check_smtp" toml:"check_smtp"`
+}
+
+type APIConfig struct {
+	Alias string `env:"API_ALIAS" yaml:"alias" toml:"alias" default:"v1"` // Version served at /api/{Model}/ too, empty for versioned paths only
+}
+
+// CORSConfig applies to the model APIs. With no allowed origins only
+// same-origin requests work.
+type CORSConfig struct {
+	AllowedOrigins   []string      `env:"CORS_ALLOWED_ORIGINS" yaml:"allowed_origins" toml:"allowed_origins"` // e.g. https://example.com,https://*.example.com
+	AllowedMethods   []string      `env:"CORS_ALLOWED_METHODS" yaml:"allowed_methods" toml:"allowed_methods" default:"GET,POST,PUT,DELETE"`
+	AllowedHeaders   []string      `env:"CORS_ALLOWED_HEADERS" yaml:"allowed_headers" toml:"allowed_headers" default:"Authorization,Content-Type,X-Request-ID,X-CSRF-Token"`
+	ExposedHeaders   []string      `env:"CORS_EXPOSED_HEADERS" yaml:"exposed_headers" toml:"exposed_headers" default:"X-Request-ID,Deprecation,Sunset,Link"`
+	AllowCredentials bool          `env:"CORS_ALLOW_CREDENTIALS" yaml:"allow_credentials" toml:"allow_credentials"`
+	MaxAge           time.Duration `env:"CORS_MAX_AGE" yaml:"max_age" toml:"max_age" default:"10m"`
+}
+
+// AuthConfig limits attempts on the /api/auth endpoints and sets how long
+// sessions last. Limits are token buckets refilled over RateLimitWindow; 0
+// disables a limit.
+type AuthConfig struct {
+	LoginLimitPerIP       int           `env:"AUTH_LOGIN_LIMIT_PER_IP" yaml:"login_limit_per_ip" toml:"login_limit_per_ip" default:"20"`
+	LoginLimitPerUser     int           `env:"AUTH_LOGIN_LIMIT_PER_USER" yaml:"login_limit_per_user" toml:"login_limit_per_user" default:"5"`
+	RegisterLimitPerIP    int           `env:"AUTH_REGISTER_LIMIT_PER_IP" yaml:"register_limit_per_ip" toml:"register_limit_per_ip" default:"5"`
+	RateLimitWindow       time.Duration `env:"AUTH_RATE_LIMIT_WINDOW" yaml:"rate_limit_window" toml:"rate_limit_window" default:"1m"`
+	LockoutThreshold      int           `env:"AUTH_LOCKOUT_THRESHOLD" yaml:"lockout_threshold" toml:"lockout_threshold" default:"10"` // Failed logins in a row
+	LockoutDuration       time.Duration `env:"AUTH_LOCKOUT_DURATION" yaml:"lockout_duration" toml:"lockout_duration" default:"15m"`   // Doubles with every further lock
+	SessionLifetime       time.Duration `env:"SESSION_LIFETIME" yaml:"session_lifetime" toml:"session_lifetime" default:"720h"`
+	SessionIdleTimeout    time.Duration `env:"SESSION_IDLE_TIMEOUT" yaml:"session_idle_timeout" toml:"session_idle_timeout" default:"168h"`
+	SessionKeys           []string      `env:"SESSION_KEYS" yaml:"session_keys" toml:"session_keys" secret:"true"`                                      // "<hash>:<block>" in base64, current first; replaces SessionKeyFile
+	SessionKeyFile        string        `env:"SESSION_KEY_FILE" yaml:"session_key_file" toml:"session_key_file" default:"session.keys"`                 // Written by `juniper keys rotate`
+	SessionKeyGracePeriod time.Duration `env:"SESSION_KEY_GRACE_PERIOD" yaml:"session_key_grace_period" toml:"session_key_grace_period" default:"720h"` // How long rotated out keys still verify cookies
+	TwoFactorRoles        []string      `env:"AUTH_TWO_FACTOR_ROLES" yaml:"two_factor_roles" toml:"two_factor_roles" default:"administrator"`           // Roles that must log in with a TOTP code
+	TOTPIssuer            string        `env:"AUTH_TOTP_ISSUER" yaml:"totp_issuer" toml:"totp_issuer" default:"Juniper"`                                // Shown in authenticator apps
+	PasskeyRPID           string        `env:"AUTH_PASSKEY_RP_ID" yaml:"passkey_rp_id" toml:"passkey_rp_id"`                                            // Domain passkeys are bound to, defaults to the host of SITE_URL
+	PasskeyOrigins        []string      `env:"AUTH_PASSKEY_ORIGINS" yaml:"passkey_origins" toml:"passkey_origins"`                                      // Origins passkeys work on, defaults to SITE_URL
+	PasskeyTimeout        time.Duration `env:"AUTH_PASSKEY_TIMEOUT" yaml:"passkey_timeout" toml:"passkey_timeout" default:"5m"`                         // How long a passkey prompt waits for the user
+	StepUpMaxAge          time.Duration `env:"AUTH_STEP_UP_MAX_AGE" yaml:"step_up_max_age" toml:"step_up_max_age" default:"10m"`                        // How long after a login changes to passkeys are allowed without confirming again
+}
+
+// OIDCConfig turns on signing in with Google, GitHub or a provider of your
+// own, e.g. a company's single sign-on, each once its client is set. Register
+// SITE_URL/auth/<name>/callback with the provider, e.g. /auth/google/callback.
+type OIDCConfig struct {
+	DefaultRole  string       `env:"OIDC_DEFAULT_ROLE" yaml:"default_role" toml:"default_role" default:"user"` // Of accounts created by a first sign in
+	Google       GoogleConfig `yaml:"google" toml:"google"`
+	GitHub       GitHubConfig `yaml:"github" toml:"github"`
+	Name         string       `env:"OIDC_NAME" yaml:"name" toml:"name" default:"sso"`                                    // Of your own provider, in URLs
+	DisplayName  string       `env:"OIDC_DISPLAY_NAME" yaml:"display_name" toml:"display_name" default:"Single sign-on"` // On the login page
+	Issuer       string       `env:"OIDC_ISSUER" yaml:"issuer" toml:"issuer"`                                            // Where /.well-known/openid-configuration is found
+	ClientID     string       `env:"OIDC_CLIENT_ID" yaml:"client_id" toml:"client_id"`
+	ClientSecret string       `env:"OIDC_CLIENT_SECRET" yaml:"client_secret" toml:"client_secret" secret:"true"`
+	Scopes       []string     `env:"OIDC_SCOPES" yaml:"scopes" toml:"scopes" default:"email,profile"` // Besides openid
+}
+
+type GoogleConfig struct {
+	ClientID     string `env:"OIDC_GOOGLE_CLIENT_ID" yaml:"client_id" toml:"client_id"`
+	ClientSecret string `env:"OIDC_GOOGLE_CLIENT_SECRET" yaml:"client_secret" toml:"client_secret" secret:"true"`
+}
+
+type GitHubConfig struct {
+	ClientID     string `env:"OIDC_GITHUB_CLIENT_ID" yaml:"client_id" toml:"client_id"`
+	ClientSecret string `env:"OIDC_GITHUB_CLIENT_SECRET" yaml:"client_secret" toml:"client_secret" secret:"true"`
+}
+
+// OAuthConfig sets the lifetimes of what the OAuth2 server issues to the
+// clients registered with `juniper clients add`.
+type OAuthConfig struct {
+	CodeLifetime         time.Duration `env:"OAUTH_CODE_LIFETIME" yaml:"code_lifetime" toml:"code_lifetime" default:"1m"` // Between the consent and the exchange for tokens
+	AccessTokenLifetime  time.Duration `env:"OAUTH_ACCESS_TOKEN_LIFETIME" yaml:"access_token_lifetime" toml:"access_token_lifetime" default:"1h"`
+	RefreshTokenLifetime time.Duration `env:"OAUTH_REFRESH_TOKEN_LIFETIME" yaml:"refresh_token_lifetime" toml:"refresh_token_lifetime" default:"720h"` // Starts again on every refresh
+}
+
+// TracingConfig uses the standard OpenTelemetry variable names. Tracing is
+// off unless Endpoint is set.
+type TracingConfig struct {
+	Endpoint    string `env:"OTEL_EXPORTER_OTLP_ENDPOINT" yaml:"endpoint" toml:"endpoint"` // OTLP/HTTP, e.g. http://collector:4318
+	ServiceName string `env:"OTEL_SERVICE_NAME" yaml:"service_name" toml:"service_name" default:"juniper"`
+}
+
+// Options control where Load looks for settings. The zero value reads the
+// process environment and the files in the working directory.
+type Options struct {
+	File      string                          // Config file, defaults to CONFIG_FILE or juniper.{yaml,yml,toml}
+	EnvFiles  []string                        // Defaults to .env and .env.<profile>
+	LookupEnv func(key string) (string, bool) // Defaults to os.LookupEnv
+}
+
+// ValidationError lists every problem found in the configuration.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid configuration:\n  - " + strings.Join(e.Problems, "\n  - ")
+}
+
+// Load builds the configuration. Later sources win:
+//
+//  1. defaults
+//  2. the YAML or TOML config file
+//  3. .env, then .env.<profile>
+//  4. environment variables
+//
+// The profile is read from APP_ENV (environment, then .env, then the config
+// file) and defaults to dev.
+func Load() (*Config, error) {
+	return LoadWith(Options{})
+}
+
+func LoadWith(options Options) (*Config, error) {
+	if options.LookupEnv == nil {
+		options.LookupEnv = os.LookupEnv
+	}
+	problems := []string{}
+
+	cfg := &Config{}
+	setDefaults(reflect.ValueOf(cfg).Elem())
+
+	// Config file
+	file := options.File
+	if file == "" {
+		file, _ = options.LookupEnv("CONFIG_FILE")
+	}
+	if file == "" {
+		for _, candidate := range []string{"juniper.yaml", "juniper.yml", "juniper.toml"} {
+			if _, err := os.Stat(candidate); err == nil {
+				file = candidate
+				break
+			}
+		}
+	}
+	if file != "" {
+		if err := decodeFile(file, cfg); err != nil {
+			return nil, err
+		}
+		cfg.Sources = append(cfg.Sources, file)
+	}
+
+	// .env files, which may pick the profile for the profile specific one
+	envFiles := options.EnvFiles
+	dotEnv := map[string]string{}
+	if envFiles == nil {
+		envFiles = []string{".env"}
+		values, _ := godotenv.Read(".env")
+		profile := cfg.Env
+		if value, ok := values["APP_ENV"]; ok {
+			profile = value
+		}
+		if value, ok := options.LookupEnv("APP_ENV"); ok {
+			profile = value
+		}
+		envFiles = append(envFiles, ".env."+profile)
+	}
+	for _, envFile := range envFiles {
+		values, err := godotenv.Read(envFile)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("config: reading %s: %w", envFile, err)
+		}
+		for key, value := range values {
+			dotEnv[key] = value
+		}
+		cfg.Sources = append(cfg.Sources, envFile)
+	}
+
+	lookup := func(key string) (string, bool) {
+		if value, ok := options.LookupEnv(key); ok {
+			return value, true
+		}
+		value, ok := dotEnv[key]
+		return value, ok
+	}
+	applyEnv(reflect.ValueOf(cfg).Elem(), lookup, &problems)
+
+	problems = append(problems, cfg.validate()...)
+	if len(problems) > 0 {
+		return cfg, &ValidationError{Problems: problems}
+	}
+	return cfg, nil
+}
+
+func decodeFile(file string, cfg *Config) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("config: reading %s: %w", file, err)
+	}
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, cfg)
+	case ".toml":
+		err = toml.Unmarshal(data, cfg)
+	default:
+		return fmt.Errorf("config: %s: unsupported format, use .yaml or .toml", file)
+	}
+	if err != nil {
+		return fmt.Errorf("config: parsing %s: %w", file, err)
+	}
+	return nil
+}
+
+// fields calls fn for every settable leaf field of v, recursing into nested
+// config structs.
+func fields(v reflect.Value, fn func(field reflect.StructField, value reflect.Value)) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		value := v.Field(i)
+		if field.Type.Kind() == reflect.Struct {
+			fields(value, fn)
+			continue
+		}
+		if field.Tag.Get("env") == "" {
+			continue
+		}
+		fn(field, value)
+	}
+}
+
+func setDefaults(v reflect.Value) {
+	fields(v, func(field reflect.StructField, value reflect.Value) {
+		if def, ok := field.Tag.Lookup("default"); ok {
+			// Defaults are part of the source code, a bad one is a bug.
+			if err := setValue(value, def); err != nil {
+				panic(fmt.Sprintf("config: bad default for %s: %v", field.Name, err))
+			}
+		}
+	})
+}
+
+func applyEnv(v reflect.Value, lookup func(string) (string, bool), problems *[]string) {
+	fields(v, func(field reflect.StructField, value reflect.Value) {
+		key := field.Tag.Get("env")
+		raw, ok := lookup(key)
+		if !ok {
+			return
+		}
+		if err := setValue(value, raw); err != nil {
+			*problems = append(*problems, fmt.Sprintf("%s: %v", key, err))
+		}
+	})
+}
+
+func setValue(value reflect.Value, raw string) error {
+	raw = strings.TrimSpace(raw)
+	switch value.Interface().(type) {
+	case string:
+		value.SetString(raw)
+	case int, int64:
+		if raw == "" {
+			value.SetInt(0)
+			return nil
+		}
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return fmt.Errorf("expected an integer, got %q", raw)
+		}
+		value.SetInt(n)
+	case bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("expected true or false, got %q", raw)
+		}
+		value.SetBool(b)
+	case time.Duration:
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return fmt.Errorf("expected a duration such as 30s, got %q", raw)
+		}
+		value.SetInt(int64(d))
+	case []string:
+		list := []string{}
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		value.Set(reflect.ValueOf(list))
+	default:
+		return fmt.Errorf("unsupported setting type %s", value.Type())
+	}
+	return nil
+}
+
+func (cfg *Config) validate() []string {
+	problems := []string{}
+
+	if !slices.Contains(Profiles, cfg.Env) {
+		problems = append(problems, fmt.Sprintf("APP_ENV: must be one of %s, got %q", strings.Join(Profiles, ", "), cfg.Env))
+	}
+
+	fields(reflect.ValueOf(cfg).Elem(), func(field reflect.StructField, value reflect.Value) {
+		required := field.Tag.Get("required")
+		if required == "" || !value.IsZero() {
+			return
+		}
+		if required == "true" || slices.Contains(strings.Split(required, ","), cfg.Env) {
+			problems = append(problems, fmt.Sprintf("%s: required in the %s profile", field.Tag.Get("env"), cfg.Env))
+		}
+	})
+
+	if cfg.SiteURL != "" {
+		parsed, err := url.Parse(cfg.SiteURL)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			problems = append(problems, fmt.Sprintf("SITE_URL: must be an absolute http(s) URL, got %q", cfg.SiteURL))
+		}
+	}
+	if !slices.Contains([]string{"debug", "info", "warn", "error"}, strings.ToLower(cfg.Log.Level)) {
+		problems = append(problems, fmt.Sprintf("LOG_LEVEL: must be one of debug, info, warn, error, got %q", cfg.Log.Level))
+	}
+	if !slices.Contains([]string{"", "text", "json"}, cfg.Log.Format) {
+		problems = append(problems, fmt.Sprintf("LOG_FORMAT: must be text or json, got %q", cfg.Log.Format))
+	}
+	if cfg.Port < 1 || cfg.Port > 65535 {
+		problems = append(problems, fmt.Sprintf("PORT: must be between 1 and 65535, got %d", cfg.Port))
+	}
+	for _, limit := range []struct {
+		key   string
+		value int
+	}{
+		{"AUTH_LOGIN_LIMIT_PER_IP", cfg.Auth.LoginLimitPerIP},
+		{"AUTH_LOGIN_LIMIT_PER_USER", cfg.Auth.LoginLimitPerUser},
+		{"AUTH_REGISTER_LIMIT_PER_IP", cfg.Auth.RegisterLimitPerIP},
+		{"AUTH_LOCKOUT_THRESHOLD", cfg.Auth.LockoutThreshold},
+	} {
+		if limit.value < 0 {
+			problems = append(problems, limit.key+": must not be negative")
+		}
+	}
+	for _, timeout := range []struct {
+		key   string
+		value time.Duration
+	}{
+		{"HTTP_READ_TIMEOUT", cfg.HTTP.ReadTimeout},
+		{"HTTP_READ_HEADER_TIMEOUT", cfg.HTTP.ReadHeaderTimeout},
+		{"HTTP_WRITE_TIMEOUT", cfg.HTTP.WriteTimeout},
+		{"HTTP_IDLE_TIMEOUT", cfg.HTTP.IdleTimeout},
+		{"HTTP_SHUTDOWN_TIMEOUT", cfg.HTTP.ShutdownTimeout},
+		{"HEALTH_TIMEOUT", cfg.Health.Timeout},
+		{"AUTH_RATE_LIMIT_WINDOW", cfg.Auth.RateLimitWindow},
+		{"AUTH_LOCKOUT_DURATION", cfg.Auth.LockoutDuration},
+		{"SESSION_LIFETIME", cfg.Auth.SessionLifetime},
+		{"SESSION_IDLE_TIMEOUT", cfg.Auth.SessionIdleTimeout},
+		{"AUTH_PASSKEY_TIMEOUT", cfg.Auth.PasskeyTimeout},
+		{"AUTH_STEP_UP_MAX_AGE", cfg.Auth.StepUpMaxAge},
+		{"OAUTH_CODE_LIFETIME", cfg.OAuth.CodeLifetime},
+		{"OAUTH_ACCESS_TOKEN_LIFETIME", cfg.OAuth.AccessTokenLifetime},
+		{"OAUTH_REFRESH_TOKEN_LIFETIME", cfg.OAuth.RefreshTokenLifetime},
+	} {
+		if timeout.value <= 0 {
+			problems = append(problems, timeout.key+": must be positive")
+		}
+	}
+	if cfg.Auth.SessionKeyGracePeriod < 0 {
+		problems = append(problems, "SESSION_KEY_GRACE_PERIOD: must not be negative")
+	}
+	for _, origin := range cfg.Auth.PasskeyOrigins {
+		parsed, err := url.Parse(origin)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" || parsed.Path != "" {
+			problems = append(problems, fmt.Sprintf("AUTH_PASSKEY_ORIGINS: must be origins like https://example.com, got %q", origin))
+			break
+		}
+	}
+	for _, key := range cfg.Auth.SessionKeys {
+		if !validSessionKey(key) {
+			problems = append(problems, `SESSION_KEYS: every key must be "<hash key>:<block key>" in base64, with a hash key of at least 32 bytes and a block key of 32 bytes`)
+			break
+		}
+	}
+	if cfg.OIDC.DefaultRole == "" {
+		problems = append(problems, "OIDC_DEFAULT_ROLE: must not be empty")
+	}
+	if (cfg.OIDC.Google.ClientID == "") != (cfg.OIDC.Google.ClientSecret == "") {
+		problems = append(problems, "OIDC_GOOGLE_CLIENT_ID, OIDC_GOOGLE_CLIENT_SECRET: must be set together")
+	}
+	if (cfg.OIDC.GitHub.ClientID == "") != (cfg.OIDC.GitHub.ClientSecret == "") {
+		problems = append(problems, "OIDC_GITHUB_CLIENT_ID, OIDC_GITHUB_CLIENT_SECRET: must be set together")
+	}
+	if cfg.OIDC.Issuer != "" || cfg.OIDC.ClientID != "" || cfg.OIDC.ClientSecret != "" {
+		if cfg.OIDC.Issuer == "" || cfg.OIDC.ClientID == "" || cfg.OIDC.ClientSecret == "" {
+			problems = append(problems, "OIDC_ISSUER, OIDC_CLIENT_ID, OIDC_CLIENT_SECRET: must be set together")
+		}
+		parsed, err := url.Parse(cfg.OIDC.Issuer)
+		if cfg.OIDC.Issuer != "" && (err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "") {
+			problems = append(problems, fmt.Sprintf("OIDC_ISSUER: must be an absolute http(s) URL, got %q", cfg.OIDC.Issuer))
+		}
+		if !oidcNamePattern.MatchString(cfg.OIDC.Name) || cfg.OIDC.Name == "google" || cfg.OIDC.Name == "github" {
+			problems = append(problems, fmt.Sprintf("OIDC_NAME: must be lowercase letters, digits and dashes, other than google and github, got %q", cfg.OIDC.Name))
+		}
+	}
+	if (cfg.TLS.CertFile == "") != (cfg.TLS.KeyFile == "") {
+		problems = append(problems, "TLS_CERT_FILE, TLS_KEY_FILE: must be set together")
+	}
+	if cfg.TLS.Enabled() {
+		if cfg.TLS.ReloadInterval <= 0 {
+			problems = append(problems, "TLS_RELOAD_INTERVAL: must be positive")
+		}
+		if cfg.TLS.RedirectPort < 0 || cfg.TLS.RedirectPort > 65535 {
+			problems = append(problems, fmt.Sprintf("TLS_REDIRECT_PORT: must be between 0 and 65535, got %d", cfg.TLS.RedirectPort))
+		}
+		if cfg.TLS.RedirectPort == cfg.Port {
+			problems = append(problems, "TLS_REDIRECT_PORT: must differ from PORT")
+		}
+		if cfg.TLS.HSTSMaxAge < 0 {
+			problems = append(problems, "TLS_HSTS_MAX_AGE: must not be negative")
+		}
+	}
+	if cfg.SMTP.Port < 1 || cfg.SMTP.Port > 65535 {
+		problems = append(problems, fmt.Sprintf("SMTP_PORT: must be between 1 and 65535, got %d", cfg.SMTP.Port))
+	}
+	if cfg.Media.MaxBytes <= 0 {
+		problems = append(problems, "MEDIA_MAX_BYTES: must be positive")
+	}
+	if cfg.API.Alias != "" && !apiVersionPattern.MatchString(cfg.API.Alias) {
+		problems = append(problems, fmt.Sprintf("API_ALIAS: must be a version like v1, got %q", cfg.API.Alias))
+	}
+	for _, origin := range cfg.CORS.AllowedOrigins {
+		if origin == "*" {
+			if cfg.CORS.AllowCredentials {
+				problems = append(problems, "CORS_ALLOWED_ORIGINS: * cannot be combined with CORS_ALLOW_CREDENTIALS")
+			}
+			continue
+		}
+		parsed, err := url.Parse(strings.Replace(origin, "*", "wildcard", 1))
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" || parsed.Path != "" || strings.Count(origin, "*") > 1 {
+			problems = append(problems, fmt.Sprintf("CORS_ALLOWED_ORIGINS: must be origins like https://example.com or https://*.example.com, got %q", origin))
+		}
+	}
+	if cfg.CORS.MaxAge < 0 {
+		problems = append(problems, "CORS_MAX_AGE: must not be negative")
+	}
+	for _, network := range cfg.Metrics.AllowedNetworks {
+		_, _, cidrErr := net.ParseCIDR(network)
+		if cidrErr != nil && net.ParseIP(network) == nil {
+			problems = append(problems, fmt.Sprintf("METRICS_ALLOWED_NETWORKS: invalid IP address or CIDR %q", network))
+		}
+	}
+	if cfg.Tracing.Endpoint != "" {
+		parsed, err := url.Parse(cfg.Tracing.Endpoint)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			problems = append(problems, fmt.Sprintf("OTEL_EXPORTER_OTLP_ENDPOINT: must be an absolute http(s) URL, got %q", cfg.Tracing.Endpoint))
+		}
+	}
+	switch cfg.Media.Storage {
+	case "local":
+	case "s3":
+		for key, value := range map[string]string{
+			"MEDIA_S3_ENDPOINT":   cfg.Media.S3.Endpoint,
+			"MEDIA_S3_BUCKET":     cfg.Media.S3.Bucket,
+			"MEDIA_S3_ACCESS_KEY": cfg.Media.S3.AccessKey,
+			"MEDIA_S3_SECRET_KEY": cfg.Media.S3.SecretKey,
+		} {
+			if value == "" {
+				problems = append(problems, key+": required when MEDIA_STORAGE is s3")
+			}
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("MEDIA_STORAGE: must be local or s3, got %q", cfg.Media.Storage))
+	}
+
+	slices.Sort(problems)
+	return problems
+}
+
+// validSessionKey checks the format auth.ParseKey reads.
+func validSessionKey(key string) bool {
+	hash, block, found := strings.Cut(strings.TrimSpace(key), ":")
+	hashKey, hashErr := base64.StdEncoding.DecodeString(hash)
+	blockKey, blockErr := base64.StdEncoding.DecodeString(block)
+	return found && hashErr == nil && blockErr == nil && len(hashKey) >= 32 && len(blockKey) == 32
+}
+
+// Describe lists every setting as "ENV_NAME=value" with secrets masked.
+func (cfg *Config) Describe() []string {
+	lines := []string{}
+	fields(reflect.ValueOf(cfg).Elem(), func(field reflect.StructField, value reflect.Value) {
+		var shown string
+		switch v := value.Interface().(type) {
+		case []string:
+			shown = strings.Join(v, ",")
+		default:
+			shown = fmt.Sprint(v)
+		}
+		if field.Tag.Get("secret") == "true" && shown != "" {
+			shown = "********"
+		}
+		lines = append(lines, field.Tag.Get("env")+"="+shown)
+	})
+	return lines
+}
+
+func (cfg *Config) IsProd() bool {
+	return cfg.Env == ProfileProd
+}
@@ -0,0 +1,117 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func env(values map[string]string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		value, ok := values[key]
+		return value, ok
+	}
+}
+
+func Test_LoadPrecedence(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "juniper.yaml")
+	os.WriteFile(file, []byte("site_url: http://file.example\nport: 9000\nsmtp:\n  host: smtp.file.example\n"), 0600)
+	dotEnv := filepath.Join(dir, ".env")
+	os.WriteFile(dotEnv, []byte("PORT=9100\nSMTP_HOST=smtp.env-file.example\n"), 0600)
+
+	cfg, err := LoadWith(Options{
+		File:      file,
+		EnvFiles:  []string{dotEnv},
+		LookupEnv: env(map[string]string{"PORT": "9200", "ROBOTS_DISALLOW": ""}),
+	})
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	if cfg.SiteURL != "http://file.example" {
+		t.Errorf("Expected SiteURL from the config file, got %q", cfg.SiteURL)
+	}
+	if cfg.SMTP.Host != "smtp.env-file.example" {
+		t.Errorf("Expected .env to override the config file, got %q", cfg.SMTP.Host)
+	}
+	if cfg.Port != 9200 {
+		t.Errorf("Expected the environment to override .env, got %d", cfg.Port)
+	}
+	if cfg.SMTP.Port != 587 || cfg.Env != ProfileDev {
+		t.Errorf("Expected defaults, got SMTP port %d and profile %q", cfg.SMTP.Port, cfg.Env)
+	}
+	if !slices.Contains(cfg.CORS.AllowedHeaders, "Authorization") {
+		t.Errorf("Expected bearer tokens to be allowed by default, got %v", cfg.CORS.AllowedHeaders)
+	}
+	if cfg.Metrics.Enabled {
+		t.Errorf("Expected /metrics to be off by default")
+	}
+	if len(cfg.Robots.Disallow) != 0 {
+		t.Errorf("Expected an explicitly empty list, got %v", cfg.Robots.Disallow)
+	}
+}
+
+func Test_LoadTOML(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "juniper.toml")
+	os.WriteFile(file, []byte("site_url = \"https://toml.example\"\n[media]\nmax_bytes = 1024\n"), 0600)
+
+	cfg, err := LoadWith(Options{File: file, EnvFiles: []string{}, LookupEnv: env(nil)})
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if cfg.SiteURL != "https://toml.example" || cfg.Media.MaxBytes != 1024 {
+		t.Errorf("Unexpected config %+v", cfg)
+	}
+}
+
+func Test_LoadValidation(t *testing.T) {
+	_, err := LoadWith(Options{
+		EnvFiles: []string{},
+		LookupEnv: env(map[string]string{
+			"APP_ENV":              "prod",
+			"SITE_URL":             "example.com",
+			"PORT":                 "eighty",
+			"MEDIA_STORAGE":        "s3",
+			"TLS_CERT_FILE":        "cert.pem",
+			"CORS_ALLOWED_ORIGINS": "https://*.example.com,example.com/app",
+			"SESSION_KEYS":         "c2hvcnQ=:c2hvcnQ=",
+			"AUTH_PASSKEY_ORIGINS": "https://example.com/login",
+			"OIDC_ISSUER":          "accounts.example.com",
+		}),
+	})
+
+	var validationError *ValidationError
+	if !errors.As(err, &validationError) {
+		t.Fatalf("Expected a ValidationError, got %v", err)
+	}
+	for _, expected := range []string{
+		"PORT: expected an integer",
+		"SITE_URL: must be an absolute http(s) URL",
+		"SMTP_HOST: required in the prod profile",
+		"MEDIA_SIGNING_KEY: required in the prod profile",
+		"MEDIA_S3_BUCKET: required when MEDIA_STORAGE is s3",
+		"TLS_CERT_FILE, TLS_KEY_FILE: must be set together",
+		`CORS_ALLOWED_ORIGINS: must be origins like https://example.com or https://*.example.com, got "example.com/app"`,
+		`SESSION_KEYS: every key must be "<hash key>:<block key>" in base64`,
+		`AUTH_PASSKEY_ORIGINS: must be origins like https://example.com, got "https://example.com/login"`,
+		"OIDC_ISSUER, OIDC_CLIENT_ID, OIDC_CLIENT_SECRET: must be set together",
+		`OIDC_ISSUER: must be an absolute http(s) URL, got "accounts.example.com"`,
+	} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected %q in:\n%v", expected, err)
+		}
+	}
+
+	if strings.Contains(err.Error(), `"https://*.example.com"`) {
+		t.Errorf("Expected wildcard origins to be valid, got:\n%v", err)
+	}
+
+	// The dev profile does not require production settings.
+	if _, err := LoadWith(Options{EnvFiles: []string{}, LookupEnv: env(nil)}); err != nil {
+		t.Errorf("Expected defaults to be valid in dev, got %v", err)
+	}
+}
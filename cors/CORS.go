@@ -0,0 +1,149 @@
+package cors
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Options configures which cross-origin requests are allowed.
+type Options struct {
+	// AllowedOrigins are exact origins like "https://example.com", patterns
+	// with one wildcard like "https://*.example.com", or "*" for any origin.
+	// Empty allows no cross-origin requests.
+	AllowedOrigins   []string
+	AllowedMethods   []string
+	AllowedHeaders   []string
+	ExposedHeaders   []string
+	AllowCredentials bool
+	MaxAge           time.Duration // How long browsers may cache a preflight
+}
+
+// CORS answers preflight requests and adds the CORS headers to responses
+// for allowed origins. Requests from other origins are served without the
+// headers, so browsers hide the response from the calling page.
+type CORS struct {
+	options Options
+	methods string
+	headers []string
+}
+
+func New(options Options) *CORS {
+	methods := make([]string, len(options.AllowedMethods))
+	for i, method := range options.AllowedMethods {
+		methods[i] = strings.ToUpper(method)
+	}
+	headers := make([]string, len(options.AllowedHeaders))
+	for i, header := range options.AllowedHeaders {
+		headers[i] = http.CanonicalHeaderKey(header)
+	}
+	options.AllowedMethods = methods
+	return &CORS{
+		options: options,
+		methods: strings.Join(methods, ", "),
+		headers: headers,
+	}
+}
+
+// Handler applies the policy to next. Preflight requests are answered
+// without calling next.
+func (c *CORS) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			c.preflight(w, r, origin)
+			return
+		}
+
+		w.Header().Add("Vary", "Origin")
+		if c.AllowsOrigin(origin) {
+			c.allowOrigin(w, origin)
+			if len(c.options.ExposedHeaders) > 0 {
+				w.Header().Set("Access-Control-Expose-Headers", strings.Join(c.options.ExposedHeaders, ", "))
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (c *CORS) preflight(w http.ResponseWriter, r *http.Request, origin string) {
+	w.Header().Add("Vary", "Origin")
+	w.Header().Add("Vary", "Access-Control-Request-Method")
+	w.Header().Add("Vary", "Access-Control-Request-Headers")
+	defer w.WriteHeader(http.StatusNoContent)
+
+	method := strings.ToUpper(r.Header.Get("Access-Control-Request-Method"))
+	if !c.AllowsOrigin(origin) || !slices.Contains(c.options.AllowedMethods, method) {
+		return
+	}
+	requested := []string{}
+	for _, header := range strings.Split(r.Header.Get("Access-Control-Request-Headers"), ",") {
+		header = http.CanonicalHeaderKey(strings.TrimSpace(header))
+		if header == "" {
+			continue
+		}
+		if !slices.Contains(c.headers, header) {
+			return
+		}
+		requested = append(requested, header)
+	}
+
+	c.allowOrigin(w, origin)
+	w.Header().Set("Access-Control-Allow-Methods", c.methods)
+	if len(requested) > 0 {
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join(requested, ", "))
+	}
+	if c.options.MaxAge > 0 {
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(c.options.MaxAge.Seconds())))
+	}
+}
+
+func (c *CORS) allowOrigin(w http.ResponseWriter, origin string) {
+	if c.options.AllowCredentials {
+		// Credentialed requests need the exact origin, never "*".
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+		return
+	}
+	if slices.Contains(c.options.AllowedOrigins, "*") {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+}
+
+// AllowsOrigin reports whether origin matches one of the allowed origins.
+func (c *CORS) AllowsOrigin(origin string) bool {
+	origin = strings.ToLower(origin)
+	for _, allowed := range c.options.AllowedOrigins {
+		if MatchOrigin(strings.ToLower(allowed), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchOrigin matches origin against pattern, which may contain a single "*"
+// standing for one or more subdomain labels.
+func MatchOrigin(pattern, origin string) bool {
+	if pattern == "*" {
+		return true
+	}
+	prefix, suffix, wildcard := strings.Cut(pattern, "*")
+	if !wildcard {
+		return pattern == origin
+	}
+	if len(origin) <= len(prefix)+len(suffix) || !strings.HasPrefix(origin, prefix) || !strings.HasSuffix(origin, suffix) {
+		return false
+	}
+	// The wildcard stays within the host, so "https://*.example.com" does not
+	// match "https://evil.com/.example.com" or a different port.
+	return !strings.ContainsAny(origin[len(prefix):len(origin)-len(suffix)], "/:@")
+}
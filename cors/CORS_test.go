@@ -0,0 +1,104 @@
+package cors
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_MatchOrigin(t *testing.T) {
+	for _, test := range []struct {
+		pattern, origin string
+		expected        bool
+	}{
+		{"*", "https://anything.test", true},
+		{"https://example.com", "https://example.com", true},
+		{"https://example.com", "http://example.com", false},
+		{"https://*.example.com", "https://app.example.com", true},
+		{"https://*.example.com", "https://a.b.example.com", true},
+		{"https://*.example.com", "https://example.com", false},
+		{"https://*.example.com", "https://evil.com/.example.com", false},
+		{"https://*.example.com", "https://evil.com:.example.com", false},
+	} {
+		if got := MatchOrigin(test.pattern, test.origin); got != test.expected {
+			t.Errorf("MatchOrigin(%q, %q) = %v, expected %v", test.pattern, test.origin, got, test.expected)
+		}
+	}
+}
+
+func Test_CORS(t *testing.T) {
+	c := New(Options{
+		AllowedOrigins:   []string{"https://*.example.com"},
+		AllowedMethods:   []string{"GET", "post"},
+		AllowedHeaders:   []string{"content-type"},
+		ExposedHeaders:   []string{"X-Request-ID"},
+		AllowCredentials: true,
+		MaxAge:           10 * time.Minute,
+	})
+	called := false
+	handler := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+
+	serve := func(method, origin string, headers map[string]string) *httptest.ResponseRecorder {
+		called = false
+		r := httptest.NewRequest(method, "/api/v1/Posts/", nil)
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		for key, value := range headers {
+			r.Header.Set(key, value)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	w := serve("OPTIONS", "https://app.example.com", map[string]string{
+		"Access-Control-Request-Method":  "POST",
+		"Access-Control-Request-Headers": "Content-Type",
+	})
+	if called {
+		t.Errorf("Expected the preflight to be answered without calling the handler")
+	}
+	if w.Code != http.StatusNoContent {
+		t.Errorf("Expected 204 for the preflight, got %d", w.Code)
+	}
+	for header, expected := range map[string]string{
+		"Access-Control-Allow-Origin":      "https://app.example.com",
+		"Access-Control-Allow-Credentials": "true",
+		"Access-Control-Allow-Methods":     "GET, POST",
+		"Access-Control-Allow-Headers":     "Content-Type",
+		"Access-Control-Max-Age":           "600",
+	} {
+		if got := w.Header().Get(header); got != expected {
+			t.Errorf("Expected %s %q, got %q", header, expected, got)
+		}
+	}
+
+	for name, headers := range map[string]map[string]string{
+		"method": {"Access-Control-Request-Method": "DELETE"},
+		"header": {"Access-Control-Request-Method": "GET", "Access-Control-Request-Headers": "Authorization"},
+	} {
+		w = serve("OPTIONS", "https://app.example.com", headers)
+		if w.Header().Get("Access-Control-Allow-Origin") != "" {
+			t.Errorf("Expected the preflight with a disallowed %s to be refused", name)
+		}
+	}
+
+	w = serve("GET", "https://app.example.com", nil)
+	if !called || w.Header().Get("Access-Control-Allow-Origin") != "https://app.example.com" || w.Header().Get("Access-Control-Expose-Headers") != "X-Request-ID" {
+		t.Errorf("Expected CORS headers on the allowed request, got %v", w.Header())
+	}
+
+	w = serve("GET", "https://evil.test", nil)
+	if !called || w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("Expected no CORS headers for another origin, got %v", w.Header())
+	}
+
+	w = serve("GET", "", nil)
+	if !called || w.Header().Get("Vary") != "" {
+		t.Errorf("Expected same-origin requests to pass through untouched, got %v", w.Header())
+	}
+}
@@ -0,0 +1,56 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func Test_Checker(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+
+	checker := NewChecker(50 * time.Millisecond)
+	checker.Add("database", DB(db))
+	checker.Add("ok", func(ctx context.Context) error { return nil })
+
+	w := httptest.NewRecorder()
+	checker.ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	checker.Add("broken", func(ctx context.Context) error { return errors.New("connection refused") })
+	checker.Add("slow", func(ctx context.Context) error {
+		time.Sleep(time.Second)
+		return nil
+	})
+
+	w = httptest.NewRecorder()
+	checker.ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503, got %d", w.Code)
+	}
+	var report Report
+	if err := json.NewDecoder(w.Body).Decode(&report); err != nil {
+		t.Fatalf("Failed to decode report: %v", err)
+	}
+	if report.Components["database"].Status != StatusOK {
+		t.Errorf("Expected the database to be ok, got %+v", report.Components["database"])
+	}
+	if broken := report.Components["broken"]; broken.Status != StatusFail || broken.Error != "connection refused" {
+		t.Errorf("Unexpected status for broken: %+v", broken)
+	}
+	if slow := report.Components["slow"]; slow.Status != StatusFail || slow.Error != "timed out" {
+		t.Errorf("Unexpected status for slow: %+v", slow)
+	}
+}
@@ -0,0 +1,196 @@
+package logging
+
+import (
+	"context"
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"reflect"
+	"strings"
+	"sync/atomic"
+
+	"go.opentelemetry.io/otel/trace"
+	"pioneerwebworks.com/juniper/requestid"
+)
+
+const redacted = "[REDACTED]"
+
+// Keys whose values never end up in the logs. Matching is case insensitive
+// and on substrings, so "newPassword" and "X-Csrf-Token" are covered.
+var sensitiveKeys = []string{
+	"password",
+	"secret",
+	"token",
+	"csrf",
+	"nonce",
+	"authorization",
+	"cookie",
+	"session",
+	"apikey",
+	"api_key",
+	"private_key",
+	"privatekey",
+}
+
+type Options struct {
+	Level slog.Leveler
+	JSON  bool // JSON lines instead of logfmt style text
+}
+
+// New returns a logger that redacts sensitive fields and adds the request ID
+// and user ID of the request a record is logged for.
+func New(w io.Writer, options Options) *slog.Logger {
+	handlerOptions := &slog.HandlerOptions{
+		Level:       options.Level,
+		ReplaceAttr: redactAttr,
+	}
+	var handler slog.Handler = slog.NewTextHandler(w, handlerOptions)
+	if options.JSON {
+		handler = slog.NewJSONHandler(w, handlerOptions)
+	}
+	return slog.New(&contextHandler{handler})
+}
+
+// ParseLevel parses "debug", "info", "warn" or "error", defaulting to info.
+func ParseLevel(level string) slog.Level {
+	var parsed slog.Level
+	if err := parsed.UnmarshalText([]byte(level)); err != nil {
+		return slog.LevelInfo
+	}
+	return parsed
+}
+
+func IsSensitive(key string) bool {
+	key = strings.ToLower(key)
+	for _, sensitive := range sensitiveKeys {
+		if strings.Contains(key, sensitive) {
+			return true
+		}
+	}
+	return false
+}
+
+func redactAttr(groups []string, attr slog.Attr) slog.Attr {
+	if IsSensitive(attr.Key) {
+		return slog.String(attr.Key, redacted)
+	}
+	if attr.Value.Kind() == slog.KindAny {
+		attr.Value = slog.AnyValue(Redact(attr.Value.Any()))
+	}
+	return attr
+}
+
+// Redact returns a copy of maps and structs with sensitive fields replaced.
+// Struct fields are keyed by their json name. Other values are returned
+// unchanged.
+func Redact(v any) any {
+	value := reflect.ValueOf(v)
+	for value.Kind() == reflect.Pointer && !value.IsNil() {
+		value = value.Elem()
+	}
+
+	switch value.Kind() {
+	case reflect.Map:
+		if value.Type().Key().Kind() != reflect.String {
+			return v
+		}
+		out := make(map[string]any, value.Len())
+		iter := value.MapRange()
+		for iter.Next() {
+			key := iter.Key().String()
+			if IsSensitive(key) {
+				out[key] = redacted
+			} else {
+				out[key] = Redact(iter.Value().Interface())
+			}
+		}
+		return out
+	case reflect.Struct:
+		// Types like time.Time and errors know how to print themselves.
+		switch v.(type) {
+		case error, fmt.Stringer, json.Marshaler, encoding.TextMarshaler:
+			return v
+		}
+		out := map[string]any{}
+		for i := 0; i < value.NumField(); i++ {
+			field := value.Type().Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			key, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if key == "-" {
+				continue
+			}
+			if key == "" {
+				key = field.Name
+			}
+			if IsSensitive(key) || IsSensitive(field.Name) {
+				out[key] = redacted
+			} else {
+				out[key] = Redact(value.Field(i).Interface())
+			}
+		}
+		return out
+	}
+	return v
+}
+
+type requestState struct {
+	userID atomic.Uint64
+}
+
+type stateKey struct{}
+
+// NewRequestContext prepares ctx to carry the ID of the authenticated user,
+// once the request gets that far, see SetUserID.
+func NewRequestContext(ctx context.Context) context.Context {
+	return context.WithValue(ctx, stateKey{}, &requestState{})
+}
+
+// SetUserID records the authenticated user for the access log and for every
+// record logged afterwards in the request.
+func SetUserID(ctx context.Context, userID uint) {
+	if state, ok := ctx.Value(stateKey{}).(*requestState); ok {
+		state.userID.Store(uint64(userID))
+	}
+}
+
+// UserID returns the user recorded with SetUserID, or 0.
+func UserID(ctx context.Context) uint {
+	if state, ok := ctx.Value(stateKey{}).(*requestState); ok {
+		return uint(state.userID.Load())
+	}
+	return 0
+}
+
+// contextHandler adds request_id, user_id and the trace and span IDs to
+// records logged with a request context.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h *contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id := requestid.FromContext(ctx); id != "" {
+		record.AddAttrs(slog.String("request_id", id))
+	}
+	if userID := UserID(ctx); userID != 0 {
+		record.AddAttrs(slog.Uint64("user_id", uint64(userID)))
+	}
+	if span := trace.SpanContextFromContext(ctx); span.IsValid() {
+		record.AddAttrs(
+			slog.String("trace_id", span.TraceID().String()),
+			slog.String("span_id", span.SpanID().String()),
+		)
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h *contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h *contextHandler) WithGroup(name string) slog.Handler {
+	return &contextHandler{h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,62 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel/trace"
+	"pioneerwebworks.com/juniper/requestid"
+)
+
+func Test_Redaction(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf, Options{Level: slog.LevelDebug, JSON: true})
+
+	type loginForm struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	logger.Info("login",
+		"password", "hunter2",
+		"form", loginForm{Username: "admin", Password: "hunter2"},
+		"data", map[string]interface{}{"username": "admin", "newPassword": "hunter2"},
+		slog.Group("headers", "Authorization", "Bearer hunter2"),
+	)
+
+	if strings.Contains(buf.String(), "hunter2") {
+		t.Errorf("Expected the password to be redacted:\n%s", buf.String())
+	}
+	if !strings.Contains(buf.String(), `"username":"admin"`) {
+		t.Errorf("Expected other fields to be kept:\n%s", buf.String())
+	}
+}
+
+func Test_RequestContext(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf, Options{JSON: true})
+
+	ctx := NewRequestContext(requestid.NewContext(context.Background(), "abc"))
+	SetUserID(ctx, 42)
+	traceID, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	spanID, _ := trace.SpanIDFromHex("00f067aa0ba902b7")
+	ctx = trace.ContextWithSpanContext(ctx, trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID: traceID,
+		SpanID:  spanID,
+	}))
+	logger.InfoContext(ctx, "hello")
+
+	var record map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("Failed to parse log record: %v", err)
+	}
+	if record["request_id"] != "abc" || record["user_id"] != float64(42) {
+		t.Errorf("Expected request and user IDs, got %v", record)
+	}
+	if record["trace_id"] != traceID.String() || record["span_id"] != spanID.String() {
+		t.Errorf("Expected trace and span IDs, got %v", record)
+	}
+}
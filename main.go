@@ -2,51 +2,85 @@ package main
 
 import (
 	"context"
+	"embed"
+	"errors"
+	"flag"
+	"io/fs"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
-	"strconv"
+	"time"
 
+	"pioneerwebworks.com/juniper/assets"
 	"pioneerwebworks.com/juniper/auth"
+	"pioneerwebworks.com/juniper/config"
+	"pioneerwebworks.com/juniper/cors"
+	"pioneerwebworks.com/juniper/health"
+	"pioneerwebworks.com/juniper/logging"
+	"pioneerwebworks.com/juniper/media"
+	"pioneerwebworks.com/juniper/metrics"
 	"pioneerwebworks.com/juniper/models"
+	"pioneerwebworks.com/juniper/openapi"
+	"pioneerwebworks.com/juniper/tracing"
 
-	"github.com/joho/godotenv"
-	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
 
-var APP_CONFIG map[string]string
+var APP_CONFIG *config.Config
 var GlobalMailer Mailer
 
 var APP_DATA models.AppData
 
+//go:embed public/styles public/fonts public/media/*.png
+var embeddedPublic embed.FS
+
 func main() {
-	envFile, _ := godotenv.Read(".env")
-
-	// get the values from the environment variables from .env file
-	APP_CONFIG = envFile
-	smtpUsername := envFile["SMTP_USERNAME"]
-	smtpPassword := envFile["SMTP_PASSWORD"]
-	smtpHost := envFile["SMTP_HOST"]
-	smtpPortRaw := envFile["SMTP_PORT"]
-	smtpPort, err := strconv.Atoi(smtpPortRaw)
+	dev := flag.Bool("dev", false, "serve static assets from ./public instead of the embedded copy")
+	flag.Parse()
+
+	if flag.NArg() > 0 {
+		os.Exit(runCommand(flag.Args()))
+	}
+
+	var err error
+	APP_CONFIG, err = config.Load()
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	// Structured logs; the standard log package writes through them too.
+	slog.SetDefault(logging.New(os.Stderr, logging.Options{
+		Level: logging.ParseLevel(APP_CONFIG.Log.Level),
+		JSON:  APP_CONFIG.Log.JSON(APP_CONFIG.Env),
+	}))
+
 	GlobalMailer = Mailer{
-		Host:     smtpHost,
-		Port:     int(smtpPort),
-		Username: smtpUsername,
-		Password: smtpPassword,
+		Host:     APP_CONFIG.SMTP.Host,
+		Port:     APP_CONFIG.SMTP.Port,
+		Username: APP_CONFIG.SMTP.Username,
+		Password: APP_CONFIG.SMTP.Password,
 	}
-	GlobalMailer.Initialize(smtpUsername, smtpPassword, smtpHost)
+	GlobalMailer.Initialize(GlobalMailer.Username, GlobalMailer.Password, GlobalMailer.Host)
 
-	user_db, err := gorm.Open(sqlite.Open("database/user.db"), &gorm.Config{})
-	if err != nil {
-		panic("failed to connect database")
+	lifecycle := NewLifecycle(context.Background())
+
+	if APP_CONFIG.Tracing.Endpoint != "" {
+		shutdownTracing, err := tracing.Setup(lifecycle.Context(), APP_CONFIG.Tracing.Endpoint, APP_CONFIG.Tracing.ServiceName)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// Registered first so it runs last and flushes every span.
+		lifecycle.OnClose(func() error {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			return shutdownTracing(ctx)
+		})
 	}
-	user_db.AutoMigrate(&models.User{})
+	lifecycle.OnClose(models.CloseUserDB)
+
+	user_db := models.ConnectToUserDB().DB
+	user_db.AutoMigrate(&models.User{}, &models.Session{}, &models.RecoveryCode{}, &models.Passkey{}, &models.Identity{}, &models.OAuthClient{}, &models.OAuthCode{}, &models.OAuthToken{})
 
 	// Initialize the user database with a default admin user
 	var adminUser models.User
@@ -65,53 +99,169 @@ func main() {
 		user_db.Create(&adminUser)
 	}
 
-	// Initialize the session store
-	auth.Init()
+	// Initialize the session store, with Secure cookies when serving HTTPS
+	auth.TwoFactorRoles = APP_CONFIG.Auth.TwoFactorRoles
+	sessionKeys := sessionKeyConfig(APP_CONFIG)
+	auth.Init(APP_CONFIG.TLS.Enabled(), APP_CONFIG.Auth.SessionLifetime, APP_CONFIG.Auth.SessionIdleTimeout, sessionKeys)
+	lifecycle.Go(func(ctx context.Context) {
+		auth.Store.Cleanup(ctx, time.Hour)
+	})
+	lifecycle.Go(func(ctx context.Context) {
+		auth.WatchKeys(ctx, sessionKeys, time.Minute)
+	})
+	auth.StepUpMaxAge = APP_CONFIG.Auth.StepUpMaxAge
+	if err := auth.InitPasskeys(passkeyConfig(APP_CONFIG)); err != nil {
+		log.Fatal(err)
+	}
+	auth.OIDCProviders = oidcProviders(APP_CONFIG)
+	auth.OAuthCodeLifetime = APP_CONFIG.OAuth.CodeLifetime
+	auth.OAuthAccessTokenLifetime = APP_CONFIG.OAuth.AccessTokenLifetime
+	auth.OAuthRefreshTokenLifetime = APP_CONFIG.OAuth.RefreshTokenLifetime
+	lifecycle.Go(func(ctx context.Context) {
+		auth.CleanupOAuth(ctx, models.ConnectToUserDB(), time.Hour)
+	})
 
-	// Serve static files from public/media under the /media URL path
-	mediaFs := http.FileServer(http.Dir("public/media"))
-	http.Handle("/media/", http.StripPrefix("/media/", mediaFs))
-	stylesFs := http.FileServer(http.Dir("public/styles"))
-	http.Handle("/styles/", http.StripPrefix("/styles/", stylesFs))
-	scriptsFs := http.FileServer(http.Dir("public/scripts"))
-	http.Handle("/scripts/", http.StripPrefix("/scripts/", scriptsFs))
-	fontsFs := http.FileServer(http.Dir("public/fonts"))
-	http.Handle("/fonts/", http.StripPrefix("/fonts/", fontsFs))
+	// Serve static files embedded in the binary, or from disk with -dev
+	var publicFs fs.FS = os.DirFS("public")
+	if !*dev {
+		publicFs, err = fs.Sub(embeddedPublic, "public")
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	staticAssets, err := assets.New(publicFs, *dev)
+	if err != nil {
+		log.Fatal(err)
+	}
+	assets.Default = staticAssets
 
 	router := NewRouter(
-		context.Background(),
+		lifecycle.Context(),
 	)
+	router.Handle("/media/", staticAssets)
+	router.Handle("/styles/", staticAssets)
+	router.Handle("/fonts/", staticAssets)
 
+	// Cross-origin access to the model APIs
+	corsOptions := cors.Options{
+		AllowedOrigins:   APP_CONFIG.CORS.AllowedOrigins,
+		AllowedMethods:   APP_CONFIG.CORS.AllowedMethods,
+		AllowedHeaders:   APP_CONFIG.CORS.AllowedHeaders,
+		ExposedHeaders:   APP_CONFIG.CORS.ExposedHeaders,
+		AllowCredentials: APP_CONFIG.CORS.AllowCredentials,
+		MaxAge:           APP_CONFIG.CORS.MaxAge,
+	}
 	APP_DATA = models.AppData{
 		UserHandler: models.NewModelHandler[models.User](
 			&models.User{},
 			models.UserJSONMapper,
 			"database/user.db",
 			&gorm.Config{},
-			router.Mux,
+			router.APIRouter.Mux,
 			router.Context,
-			[]string{APP_CONFIG["SITE_URL"]},
-			[]string{"GET", "POST", "PUT", "DELETE"},
+			corsOptions,
 		),
 		PostHandler: models.NewModelHandler[models.Post](
 			&models.Post{},
 			models.PostJSONMapper,
 			"database/post.db",
 			&gorm.Config{},
-			router.Mux,
+			router.APIRouter.Mux,
 			router.Context,
-			[]string{APP_CONFIG["SITE_URL"]},
-			[]string{"GET", "POST", "PUT", "DELETE"},
+			corsOptions,
 		),
 	}
+	lifecycle.OnClose(APP_DATA.UserHandler.Close)
+	lifecycle.OnClose(APP_DATA.PostHandler.Close)
+	if alias := APP_CONFIG.API.Alias; alias != "" {
+		err = errors.Join(
+			APP_DATA.UserHandler.Alias(alias),
+			APP_DATA.PostHandler.Alias(alias),
+		)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// The model APIs need a session or an access token granting their scope.
+	// Only administrators use the users scopes, either way.
+	auth.OAuthScopes = oauthScopes()
+	auth.ScopeRoles = map[string][]string{
+		APP_DATA.UserHandler.Scope(false): {"administrator"},
+		APP_DATA.UserHandler.Scope(true):  {"administrator"},
+	}
+	APP_DATA.UserHandler.Authorize(auth.AuthorizeScope)
+	APP_DATA.PostHandler.Authorize(auth.AuthorizeScope)
+
+	// API description, generated from the registered models
+	router.APIRouter.Handle("GET /api/openapi.json", apiDocument())
+	router.APIRouter.Handle("GET /api/docs", openapi.Docs("Juniper API", "/api/openapi.json"))
+
+	// Uploaded media, on local disk unless an S3 compatible bucket is configured
+	var mediaStorage media.Storage = media.NewLocalStorage("public/media/uploads")
+	if APP_CONFIG.Media.Storage == "s3" {
+		mediaStorage = media.NewS3Storage(
+			APP_CONFIG.Media.S3.Endpoint,
+			APP_CONFIG.Media.S3.Bucket,
+			APP_CONFIG.Media.S3.Region,
+			APP_CONFIG.Media.S3.AccessKey,
+			APP_CONFIG.Media.S3.SecretKey,
+		)
+	}
+	mediaSigningKey := []byte(APP_CONFIG.Media.SigningKey)
+	if len(mediaSigningKey) == 0 {
+		// Signed URLs will not survive a restart without a configured key.
+		mediaSigningKey, err = auth.GenerateRandomKey(32)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	mediaLibrary := media.NewLibrary(
+		"database/media.db",
+		&gorm.Config{},
+		mediaStorage,
+		"/media/uploads",
+		APP_CONFIG.Media.MaxBytes,
+		mediaSigningKey,
+	)
+	lifecycle.OnClose(mediaLibrary.Close)
+	mediaLibrary.RegisterHandlers(router.APIRouter.Mux)
+	router.Handle("/media/uploads/", mediaLibrary)
 
-	http.Handle("/", router)
+	// Probes for the orchestrator
+	readiness := health.NewChecker(APP_CONFIG.Health.Timeout)
+	readiness.Add("database:user", health.DB(models.ConnectToUserDB().DB))
+	readiness.Add("database:users", health.DB(APP_DATA.UserHandler.DB()))
+	readiness.Add("database:posts", health.DB(APP_DATA.PostHandler.DB()))
+	readiness.Add("database:media", health.DB(mediaLibrary.DB()))
+	readiness.Add("session_key", auth.CheckSessionKey)
+	if APP_CONFIG.Health.CheckSMTP {
+		readiness.Add("smtp", GlobalMailer.Ping)
+	}
+	router.HandleFunc("GET /healthz", health.Live)
+	router.Handle("GET /readyz", readiness)
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	if APP_CONFIG.Metrics.Enabled {
+		metricsHandler, err := metrics.Handler(APP_CONFIG.Metrics.Token, APP_CONFIG.Metrics.AllowedNetworks)
+		if err != nil {
+			log.Fatal(err)
+		}
+		router.Handle("GET /metrics", metricsHandler)
 	}
 
-	log.Printf("Server listening on port %s", port)
-	log.Fatal(http.ListenAndServe("127.0.0.1:"+port, nil))
+	servers := []*http.Server{newServer(APP_CONFIG, router)}
+	if APP_CONFIG.TLS.Enabled() {
+		server, redirect, err := newTLSServers(APP_CONFIG, router, lifecycle)
+		if err != nil {
+			log.Fatal(err)
+		}
+		servers = []*http.Server{server}
+		if redirect != nil {
+			servers = append(servers, redirect)
+		}
+	}
+	if err := serve(APP_CONFIG, lifecycle, servers...); err != nil {
+		log.Fatal(err)
+	}
+	slog.Info("server stopped")
 }
@@ -0,0 +1,204 @@
+package media
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"pioneerwebworks.com/juniper/apperr"
+	"pioneerwebworks.com/juniper/auth"
+	"pioneerwebworks.com/juniper/models"
+)
+
+type mediaResponse struct {
+	models.Media
+	URL         string            `json:"url"`
+	VariantURLs map[string]string `json:"variantURLs"`
+}
+
+func (lib *Library) response(item models.Media) mediaResponse {
+	variantURLs := map[string]string{}
+	for _, variant := range item.Variants {
+		variantURLs[variant.Name] = lib.URL(variant.Path)
+	}
+	return mediaResponse{
+		Media:       item,
+		URL:         lib.URL(item.Path),
+		VariantURLs: variantURLs,
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	apperr.WriteJSON(w, r, apperr.New(status, message))
+}
+
+// RegisterHandlers mounts the authenticated media API on the mux.
+func (lib *Library) RegisterHandlers(mux *http.ServeMux) {
+	mux.Handle("GET /api/media", auth.WithAuth(http.HandlerFunc(lib.Handle_Get_List)))
+	mux.Handle("POST /api/media", auth.WithAuth(http.HandlerFunc(lib.Handle_Upload)))
+	mux.Handle("GET /api/media/{id}", auth.WithAuth(http.HandlerFunc(lib.Handle_Get_One)))
+	mux.Handle("PUT /api/media/{id}", auth.WithAuth(http.HandlerFunc(lib.Handle_Put)))
+	mux.Handle("DELETE /api/media/{id}", auth.WithAuth(http.HandlerFunc(lib.Handle_Delete)))
+}
+
+func pathID(r *http.Request) (uint, bool) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	return uint(id), err == nil
+}
+
+// mediaUser returns the logged in user, whose uploads the request may manage.
+func mediaUser(r *http.Request) (models.User, error) {
+	userDB := models.ConnectToUserDB().WithContext(r.Context())
+	user, err := userDB.GetUser(auth.UserIDFromContext(r.Context()))
+	if err != nil {
+		return user, apperr.Unauthorized("Unauthorized").Wrap(err)
+	}
+	return user, nil
+}
+
+// canManage reports whether user may see and change item: their own
+// uploads, or any upload for administrators.
+func canManage(user models.User, item models.Media) bool {
+	return item.UserID == user.ID || user.UserRole == "administrator"
+}
+
+// owned looks up the upload in the path, answering 404 for uploads of
+// other users so their IDs are not given away.
+func (lib *Library) owned(w http.ResponseWriter, r *http.Request) (models.Media, bool) {
+	user, err := mediaUser(r)
+	if err != nil {
+		apperr.WriteJSON(w, r, err)
+		return models.Media{}, false
+	}
+	id, ok := pathID(r)
+	if !ok {
+		writeError(w, r, http.StatusNotFound, "Media not found")
+		return models.Media{}, false
+	}
+	item, err := lib.Get(id)
+	if err != nil || !canManage(user, item) {
+		writeError(w, r, http.StatusNotFound, "Media not found")
+		return models.Media{}, false
+	}
+	return item, true
+}
+
+// Handle_Get_List lists the user's uploads, or all uploads for administrators.
+func (lib *Library) Handle_Get_List(w http.ResponseWriter, r *http.Request) {
+	user, err := mediaUser(r)
+	if err != nil {
+		apperr.WriteJSON(w, r, err)
+		return
+	}
+	var items []models.Media
+	if user.UserRole == "administrator" {
+		items, err = lib.List()
+	} else {
+		items, err = lib.ListByUser(user.ID)
+	}
+	if err != nil {
+		apperr.WriteJSON(w, r, apperr.New(http.StatusInternalServerError, "Error listing media").Wrap(err))
+		return
+	}
+	responses := make([]mediaResponse, 0, len(items))
+	for _, item := range items {
+		responses = append(responses, lib.response(item))
+	}
+	writeJSON(w, http.StatusOK, responses)
+}
+
+func (lib *Library) Handle_Get_One(w http.ResponseWriter, r *http.Request) {
+	item, ok := lib.owned(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, lib.response(item))
+}
+
+// Handle_Upload accepts a multipart form with a "file" part and optional
+// "alt" and "private" fields.
+func (lib *Library) Handle_Upload(w http.ResponseWriter, r *http.Request) {
+	// Leave some room for the multipart framing and the other fields.
+	r.Body = http.MaxBytesReader(w, r.Body, lib.MaxBytes+1<<20)
+	if err := r.ParseMultipartForm(1 << 20); err != nil {
+		var maxBytesError *http.MaxBytesError
+		if errors.As(err, &maxBytesError) {
+			writeError(w, r, http.StatusRequestEntityTooLarge, ErrTooLarge.Error())
+			return
+		}
+		writeError(w, r, http.StatusBadRequest, "Error parsing upload")
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "Missing file")
+		return
+	}
+	defer file.Close()
+
+	item, err := lib.Save(
+		r.Context(),
+		file,
+		header.Filename,
+		r.FormValue("alt"),
+		r.FormValue("private") == "true",
+		auth.UserIDFromContext(r.Context()),
+	)
+	switch {
+	case errors.Is(err, ErrTooLarge):
+		writeError(w, r, http.StatusRequestEntityTooLarge, err.Error())
+		return
+	case errors.Is(err, ErrUnsupportedType), errors.Is(err, ErrEmptyFile), errors.Is(err, ErrImageTooLarge):
+		writeError(w, r, http.StatusUnsupportedMediaType, err.Error())
+		return
+	case err != nil:
+		apperr.WriteJSON(w, r, apperr.New(http.StatusInternalServerError, "Error saving upload").Wrap(err))
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, lib.response(item))
+}
+
+// Handle_Put updates the editable metadata, currently only the alt text.
+func (lib *Library) Handle_Put(w http.ResponseWriter, r *http.Request) {
+	item, ok := lib.owned(w, r)
+	if !ok {
+		return
+	}
+
+	var data struct {
+		AltText string `json:"altText"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		writeError(w, r, http.StatusBadRequest, "Error parsing JSON body")
+		return
+	}
+
+	item, err := lib.UpdateAltText(item.ID, data.AltText)
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, "Media not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, lib.response(item))
+}
+
+func (lib *Library) Handle_Delete(w http.ResponseWriter, r *http.Request) {
+	item, ok := lib.owned(w, r)
+	if !ok {
+		return
+	}
+	if err := lib.Delete(r.Context(), item.ID); err != nil {
+		writeError(w, r, http.StatusNotFound, "Media not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"message": "Success"})
+}
@@ -0,0 +1,139 @@
+package media
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"mime"
+	"path"
+	"strconv"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+	"pioneerwebworks.com/juniper/models"
+)
+
+const (
+	thumbnailSize = 150
+	maxPixels     = 40_000_000 // Refuse to decode anything larger to avoid decompression bombs
+	jpegQuality   = 82
+)
+
+// Widths of the responsive variants. Only widths smaller than the original
+// are generated.
+var responsiveWidths = []int{320, 640, 1280}
+
+var ErrImageTooLarge = errors.New("image dimensions are too large")
+
+// processImage decodes the upload, writes its variants to disk and returns
+// them with the original dimensions.
+func (lib *Library) processImage(ctx context.Context, data []byte, dir, name string) ([]models.MediaVariant, int, int, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	if config.Width*config.Height > maxPixels {
+		return nil, 0, 0, ErrImageTooLarge
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	// Keep lossless formats lossless, everything else becomes a JPEG.
+	ext := ".jpg"
+	if format == "png" || format == "gif" {
+		ext = ".png"
+	}
+
+	variants := []models.MediaVariant{}
+
+	thumbnail := Thumbnail(src, thumbnailSize)
+	variant, err := lib.writeVariant(ctx, thumbnail, path.Join(dir, name+"-thumbnail"+ext), "thumbnail")
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	variants = append(variants, variant)
+
+	for _, width := range responsiveWidths {
+		if width >= config.Width {
+			continue
+		}
+		label := strconv.Itoa(width) + "w"
+		resized := Resize(src, width)
+		variant, err := lib.writeVariant(ctx, resized, path.Join(dir, name+"-"+label+ext), label)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		variants = append(variants, variant)
+	}
+
+	return variants, config.Width, config.Height, nil
+}
+
+func (lib *Library) writeVariant(ctx context.Context, img image.Image, key, name string) (models.MediaVariant, error) {
+	ext := path.Ext(key)
+	data, err := encodeImage(img, ext)
+	if err != nil {
+		return models.MediaVariant{}, err
+	}
+	err = lib.Storage.Put(ctx, key, bytes.NewReader(data), int64(len(data)), mime.TypeByExtension(ext))
+	if err != nil {
+		return models.MediaVariant{}, err
+	}
+	bounds := img.Bounds()
+	return models.MediaVariant{
+		Name:   name,
+		Path:   key,
+		Width:  bounds.Dx(),
+		Height: bounds.Dy(),
+	}, nil
+}
+
+func encodeImage(img image.Image, ext string) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+	switch ext {
+	case ".png":
+		err = png.Encode(&buf, img)
+	case ".gif":
+		err = gif.Encode(&buf, img, nil)
+	default:
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: jpegQuality})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Resize scales img to the given width, keeping the aspect ratio.
+func Resize(img image.Image, width int) image.Image {
+	bounds := img.Bounds()
+	height := bounds.Dy() * width / bounds.Dx()
+	if height < 1 {
+		height = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, draw.Src, nil)
+	return dst
+}
+
+// Thumbnail center crops img to a square and scales it to size x size.
+func Thumbnail(img image.Image, size int) image.Image {
+	bounds := img.Bounds()
+	side := min(bounds.Dx(), bounds.Dy())
+	crop := image.Rect(0, 0, side, side).Add(image.Pt(
+		bounds.Min.X+(bounds.Dx()-side)/2,
+		bounds.Min.Y+(bounds.Dy()-side)/2,
+	))
+	size = min(size, side)
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, crop, draw.Src, nil)
+	return dst
+}
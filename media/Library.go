@@ -0,0 +1,272 @@
+package media
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"pioneerwebworks.com/juniper/metrics"
+	"pioneerwebworks.com/juniper/models"
+	"pioneerwebworks.com/juniper/tracing"
+)
+
+const (
+	DefaultMaxBytes int64 = 10 << 20
+	DefaultURLTTL         = 15 * time.Minute
+	privatePrefix         = "private/"
+)
+
+var (
+	ErrTooLarge        = errors.New("file is too large")
+	ErrUnsupportedType = errors.New("unsupported file type")
+	ErrEmptyFile       = errors.New("file is empty")
+)
+
+// Sniffed content types accepted for upload and the extension they are stored with.
+var allowedTypes = map[string]string{
+	"image/jpeg":      ".jpg",
+	"image/png":       ".png",
+	"image/gif":       ".gif",
+	"image/webp":      ".webp",
+	"application/pdf": ".pdf",
+}
+
+// Library stores uploaded files in a Storage backend and keeps their
+// metadata in its own database.
+type Library struct {
+	db         *gorm.DB
+	Storage    Storage
+	URLPrefix  string // Public URL the library is served under, see ServeHTTP
+	MaxBytes   int64
+	SigningKey []byte        // Signs URLs of private files
+	URLTTL     time.Duration // How long signed URLs stay valid
+}
+
+func NewLibrary(
+	databaseLocation string,
+	databaseConnectionConfig *gorm.Config,
+	storage Storage,
+	urlPrefix string,
+	maxBytes int64,
+	signingKey []byte,
+) *Library {
+	media_db, err := gorm.Open(
+		sqlite.Open(databaseLocation),
+		databaseConnectionConfig,
+	)
+	if err != nil {
+		panic("failed to connect database")
+	}
+	err = errors.Join(
+		metrics.InstrumentDB(media_db, "media"),
+		tracing.InstrumentDB(media_db, "media"),
+	)
+	if err != nil {
+		panic("failed to instrument database")
+	}
+	media_db.AutoMigrate(&models.Media{})
+
+	if maxBytes <= 0 {
+		maxBytes = DefaultMaxBytes
+	}
+
+	return &Library{
+		db:         media_db,
+		Storage:    storage,
+		URLPrefix:  strings.TrimRight(urlPrefix, "/") + "/",
+		MaxBytes:   maxBytes,
+		SigningKey: signingKey,
+		URLTTL:     DefaultURLTTL,
+	}
+}
+
+// DB exposes the underlying connection, e.g. for health checks.
+func (lib *Library) DB() *gorm.DB {
+	return lib.db
+}
+
+// Close closes the database connection.
+func (lib *Library) Close() error {
+	sqlDB, err := lib.db.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.Close()
+}
+
+// URL returns the URL a stored file is served at. Private files get a
+// signed URL that expires after URLTTL.
+func (lib *Library) URL(key string) string {
+	if isPrivateKey(key) {
+		return lib.SignedURL(key, time.Now().Add(lib.URLTTL))
+	}
+	return lib.URLPrefix + key
+}
+
+func (lib *Library) List() ([]models.Media, error) {
+	items := []models.Media{}
+	tx := lib.db.Order("created_at DESC").Find(&items)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	return items, nil
+}
+
+// ListByUser lists the uploads of one user.
+func (lib *Library) ListByUser(userID uint) ([]models.Media, error) {
+	items := []models.Media{}
+	tx := lib.db.Where("user_id = ?", userID).Order("created_at DESC").Find(&items)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	return items, nil
+}
+
+func (lib *Library) Get(id uint) (models.Media, error) {
+	var item models.Media
+	tx := lib.db.First(&item, id)
+	if tx.Error != nil {
+		return item, tx.Error
+	}
+	return item, nil
+}
+
+func (lib *Library) UpdateAltText(id uint, altText string) (models.Media, error) {
+	item, err := lib.Get(id)
+	if err != nil {
+		return item, err
+	}
+	item.AltText = altText
+	tx := lib.db.Save(&item)
+	if tx.Error != nil {
+		return item, tx.Error
+	}
+	return item, nil
+}
+
+// Delete removes the record along with the original file and its variants.
+func (lib *Library) Delete(ctx context.Context, id uint) error {
+	item, err := lib.Get(id)
+	if err != nil {
+		return err
+	}
+	for _, variant := range item.Variants {
+		if err := lib.Storage.Delete(ctx, variant.Path); err != nil {
+			return err
+		}
+	}
+	if err := lib.Storage.Delete(ctx, item.Path); err != nil {
+		return err
+	}
+
+	tx := lib.db.WithContext(ctx).Delete(&item)
+	if tx.Error != nil {
+		return tx.Error
+	}
+	return nil
+}
+
+// Save validates and stores an upload. The content type is sniffed from the
+// data itself, the stored name is derived from originalName but made safe
+// and unique, and images get a thumbnail and responsive width variants.
+// Private files are only reachable through signed URLs.
+func (lib *Library) Save(ctx context.Context, file io.Reader, originalName, altText string, private bool, userID uint) (models.Media, error) {
+	data, err := io.ReadAll(io.LimitReader(file, lib.MaxBytes+1))
+	if err != nil {
+		return models.Media{}, err
+	}
+	if int64(len(data)) > lib.MaxBytes {
+		return models.Media{}, ErrTooLarge
+	}
+	if len(data) == 0 {
+		return models.Media{}, ErrEmptyFile
+	}
+
+	contentType := http.DetectContentType(data)
+	ext, ok := allowedTypes[contentType]
+	if !ok {
+		return models.Media{}, ErrUnsupportedType
+	}
+
+	name, err := SafeName(originalName)
+	if err != nil {
+		return models.Media{}, err
+	}
+	dir := time.Now().Format("2006/01")
+	if private {
+		dir = privatePrefix + dir
+	}
+
+	item := models.Media{
+		Path:         path.Join(dir, name+ext),
+		OriginalName: filepath.Base(originalName),
+		ContentType:  contentType,
+		Size:         int64(len(data)),
+		AltText:      altText,
+		UserID:       userID,
+	}
+
+	if strings.HasPrefix(contentType, "image/") {
+		variants, width, height, err := lib.processImage(ctx, data, dir, name)
+		if err != nil {
+			return models.Media{}, err
+		}
+		item.Width = width
+		item.Height = height
+		item.Variants = variants
+	}
+
+	err = lib.Storage.Put(ctx, item.Path, bytes.NewReader(data), item.Size, contentType)
+	if err != nil {
+		return models.Media{}, err
+	}
+
+	tx := lib.db.WithContext(ctx).Create(&item)
+	if tx.Error != nil {
+		return models.Media{}, tx.Error
+	}
+	return item, nil
+}
+
+// SafeName turns an uploaded file name into a lowercase, URL safe slug with a
+// random suffix so uploads never overwrite each other. The extension is
+// dropped; callers pick one from the sniffed content type.
+func SafeName(originalName string) (string, error) {
+	base := filepath.Base(strings.ReplaceAll(originalName, "\\", "/"))
+	base = strings.TrimSuffix(base, filepath.Ext(base))
+
+	var b strings.Builder
+	dash := false
+	for _, c := range strings.ToLower(base) {
+		if (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') {
+			b.WriteRune(c)
+			dash = false
+		} else if !dash && b.Len() > 0 {
+			b.WriteByte('-')
+			dash = true
+		}
+		if b.Len() >= 64 {
+			break
+		}
+	}
+	slug := strings.Trim(b.String(), "-")
+	if slug == "" {
+		slug = "file"
+	}
+
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	return slug + "-" + hex.EncodeToString(suffix), nil
+}
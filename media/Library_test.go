@@ -0,0 +1,144 @@
+package media
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gorm.io/gorm"
+	"pioneerwebworks.com/juniper/models"
+)
+
+func newTestLibrary(t *testing.T) *Library {
+	dir := t.TempDir()
+	return NewLibrary(
+		filepath.Join(dir, "media.db"),
+		&gorm.Config{},
+		NewLocalStorage(filepath.Join(dir, "uploads")),
+		"/media/uploads",
+		1<<20,
+		[]byte("test-signing-key"),
+	)
+}
+
+func testPNG(t *testing.T, width, height int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		img.Set(x, 0, color.RGBA{R: 255, A: 255})
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("Failed to encode png: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func Test_SafeName(t *testing.T) {
+	name, err := SafeName(`..\..\My Holiday Photo!!.PHP.jpg`)
+	if err != nil {
+		t.Fatalf("Failed to generate name: %v", err)
+	}
+	if !strings.HasPrefix(name, "my-holiday-photo-php-") {
+		t.Errorf("Unexpected safe name: %s", name)
+	}
+	if strings.ContainsAny(name, `/\. `) {
+		t.Errorf("Safe name contains unsafe characters: %s", name)
+	}
+}
+
+func Test_SaveImage(t *testing.T) {
+	lib := newTestLibrary(t)
+
+	ctx := context.Background()
+
+	item, err := lib.Save(ctx, bytes.NewReader(testPNG(t, 800, 400)), "banner.gif", "A banner", false, 1)
+	if err != nil {
+		t.Fatalf("Failed to save image: %v", err)
+	}
+	if item.ContentType != "image/png" || !strings.HasSuffix(item.Path, ".png") {
+		t.Errorf("Expected sniffed png, got %s at %s", item.ContentType, item.Path)
+	}
+	if item.Width != 800 || item.Height != 400 {
+		t.Errorf("Unexpected dimensions %dx%d", item.Width, item.Height)
+	}
+
+	thumbnail := item.Variant("thumbnail")
+	if thumbnail.Width != thumbnailSize || thumbnail.Height != thumbnailSize {
+		t.Errorf("Unexpected thumbnail %+v", thumbnail)
+	}
+	if variant := item.Variant("640w"); variant.Width != 640 || variant.Height != 320 {
+		t.Errorf("Unexpected 640w variant %+v", variant)
+	}
+	if variant := item.Variant("1280w"); variant.Name != "original" {
+		t.Errorf("Did not expect a variant wider than the original, got %+v", variant)
+	}
+	for _, variant := range append(item.Variants, item.Variant("original")) {
+		if _, err := os.Stat(filepath.Join(lib.Storage.(*LocalStorage).Root, variant.Path)); err != nil {
+			t.Errorf("Missing file for %s: %v", variant.Name, err)
+		}
+	}
+
+	if err := lib.Delete(ctx, item.ID); err != nil {
+		t.Fatalf("Failed to delete: %v", err)
+	}
+	if _, err := lib.Storage.Open(ctx, item.Path, ""); err != ErrNotFound {
+		t.Errorf("Expected original to be removed, got %v", err)
+	}
+}
+
+func Test_SaveRejects(t *testing.T) {
+	lib := newTestLibrary(t)
+
+	ctx := context.Background()
+
+	if _, err := lib.Save(ctx, strings.NewReader("<?php echo 'hi'; ?>"), "image.png", "", false, 1); err != ErrUnsupportedType {
+		t.Errorf("Expected ErrUnsupportedType, got %v", err)
+	}
+	if _, err := lib.Save(ctx, bytes.NewReader(make([]byte, 2<<20)), "big.png", "", false, 1); err != ErrTooLarge {
+		t.Errorf("Expected ErrTooLarge, got %v", err)
+	}
+}
+
+func Test_ListByUser(t *testing.T) {
+	lib := newTestLibrary(t)
+
+	ctx := context.Background()
+
+	own, err := lib.Save(ctx, bytes.NewReader(testPNG(t, 10, 10)), "own.png", "", true, 1)
+	if err != nil {
+		t.Fatalf("Failed to save image: %v", err)
+	}
+	other, err := lib.Save(ctx, bytes.NewReader(testPNG(t, 10, 10)), "other.png", "", true, 2)
+	if err != nil {
+		t.Fatalf("Failed to save image: %v", err)
+	}
+
+	items, err := lib.ListByUser(1)
+	if err != nil || len(items) != 1 || items[0].ID != own.ID {
+		t.Errorf("Expected only the user's own upload, got %+v: %v", items, err)
+	}
+
+	tests := []struct {
+		name string
+		user models.User
+		item models.Media
+		want bool
+	}{
+		{"owner", models.User{ID: 1, UserRole: "user"}, own, true},
+		{"other user", models.User{ID: 1, UserRole: "user"}, other, false},
+		{"administrator", models.User{ID: 1, UserRole: "administrator"}, other, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := canManage(tt.user, tt.item); got != tt.want {
+				t.Errorf("Expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package media
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SignedURL returns a URL for key that is valid until expires.
+func (lib *Library) SignedURL(key string, expires time.Time) string {
+	expiresValue := strconv.FormatInt(expires.Unix(), 10)
+	query := url.Values{}
+	query.Set("expires", expiresValue)
+	query.Set("signature", lib.signature(key, expiresValue))
+	return lib.URLPrefix + key + "?" + query.Encode()
+}
+
+func (lib *Library) signature(key, expires string) string {
+	mac := hmac.New(sha256.New, lib.SigningKey)
+	mac.Write([]byte(key + "\n" + expires))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (lib *Library) verifySignature(key string, query url.Values) bool {
+	if len(lib.SigningKey) == 0 {
+		return false
+	}
+	expires := query.Get("expires")
+	expiresAt, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > expiresAt {
+		return false
+	}
+	expected := lib.signature(key, expires)
+	return hmac.Equal([]byte(expected), []byte(query.Get("signature")))
+}
+
+// ServeHTTP streams stored files from the storage backend, honouring Range
+// requests. Private files require a valid, unexpired signature.
+func (lib *Library) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	key := strings.TrimPrefix(r.URL.Path, lib.URLPrefix)
+	if key == "" || key == r.URL.Path {
+		http.NotFound(w, r)
+		return
+	}
+
+	private := isPrivateKey(key)
+	if private && !lib.verifySignature(key, r.URL.Query()) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	object, err := lib.Storage.Open(r.Context(), key, r.Header.Get("Range"))
+	if errors.Is(err, ErrNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	defer object.Body.Close()
+
+	if private {
+		w.Header().Set("Cache-Control", "private, no-store")
+	} else {
+		w.Header().Set("Cache-Control", "public, max-age=86400")
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if object.ContentType != "" {
+		w.Header().Set("Content-Type", object.ContentType)
+	}
+	if object.ETag != "" {
+		w.Header().Set("ETag", object.ETag)
+	}
+
+	// Seekable objects get ranges and conditional requests from net/http.
+	if seeker, ok := object.Body.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, key, object.ModTime, seeker)
+		return
+	}
+
+	// Otherwise the backend has already applied the range.
+	w.Header().Set("Accept-Ranges", "bytes")
+	if !object.ModTime.IsZero() {
+		w.Header().Set("Last-Modified", object.ModTime.UTC().Format(http.TimeFormat))
+	}
+	if object.Length >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(object.Length, 10))
+	}
+	status := http.StatusOK
+	if object.ContentRange != "" {
+		w.Header().Set("Content-Range", object.ContentRange)
+		status = http.StatusPartialContent
+	}
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		io.Copy(w, object.Body)
+	}
+}
@@ -0,0 +1,118 @@
+package media
+
+import (
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var ErrNotFound = errors.New("object not found")
+
+// Storage is where the media library keeps file contents. Keys are slash
+// separated paths such as "2024/07/photo-1a2b3c4d.jpg".
+type Storage interface {
+	Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error
+	// Open returns the object. Backends that cannot seek apply byteRange (the
+	// raw Range header, possibly empty) themselves and report it through
+	// Object.ContentRange.
+	Open(ctx context.Context, key string, byteRange string) (*Object, error)
+	Delete(ctx context.Context, key string) error
+}
+
+type Object struct {
+	Body         io.ReadCloser
+	ContentType  string
+	Length       int64 // Length of Body, -1 if unknown
+	ContentRange string
+	ModTime      time.Time
+	ETag         string
+}
+
+// LocalStorage keeps objects as files below Root.
+type LocalStorage struct {
+	Root string
+}
+
+func NewLocalStorage(root string) *LocalStorage {
+	return &LocalStorage{Root: root}
+}
+
+func (s *LocalStorage) filePath(key string) (string, error) {
+	cleaned := path.Clean("/" + key)
+	if cleaned == "/" || cleaned != "/"+key {
+		return "", ErrNotFound
+	}
+	return filepath.Join(s.Root, filepath.FromSlash(cleaned)), nil
+}
+
+func (s *LocalStorage) Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error {
+	fullPath, err := s.filePath(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(fullPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, body); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Open returns the file itself, which is seekable, so byteRange is left to
+// the caller.
+func (s *LocalStorage) Open(ctx context.Context, key string, byteRange string) (*Object, error) {
+	fullPath, err := s.filePath(key)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(fullPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if info.IsDir() {
+		file.Close()
+		return nil, ErrNotFound
+	}
+	return &Object{
+		Body:        file,
+		ContentType: mime.TypeByExtension(path.Ext(key)),
+		Length:      info.Size(),
+		ModTime:     info.ModTime(),
+	}, nil
+}
+
+func (s *LocalStorage) Delete(ctx context.Context, key string) error {
+	fullPath, err := s.filePath(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(fullPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func isPrivateKey(key string) bool {
+	return strings.HasPrefix(key, privatePrefix)
+}
@@ -0,0 +1,172 @@
+package metrics
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Registry holds every Juniper metric plus the Go runtime and process
+// collectors. It is separate from prometheus.DefaultRegisterer so
+// dependencies cannot add metrics behind our back.
+var Registry = prometheus.NewRegistry()
+
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "juniper_http_requests_total",
+		Help: "HTTP requests by method, route pattern and status code.",
+	}, []string{"method", "route", "status"})
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "juniper_http_request_duration_seconds",
+		Help:    "HTTP request latency by method and route pattern.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	dbQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "juniper_db_query_duration_seconds",
+		Help:    "Database query latency by database, operation and table.",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"database", "operation", "table"})
+
+	dbErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "juniper_db_errors_total",
+		Help: "Failed database queries by database and operation, not counting record not found.",
+	}, []string{"database", "operation"})
+
+	loginsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "juniper_logins_total",
+		Help: "Login attempts by result.",
+	}, []string{"result"})
+
+	sessionChecksTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "juniper_session_checks_total",
+		Help: "Session checks on authenticated routes by result.",
+	}, []string{"result"})
+
+	mailsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "juniper_mails_total",
+		Help: "Emails sent by result.",
+	}, []string{"result"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		requestsTotal,
+		requestDuration,
+		dbQueryDuration,
+		dbErrorsTotal,
+		loginsTotal,
+		sessionChecksTotal,
+		mailsTotal,
+	)
+}
+
+// ObserveRequest records a served request. route is the ServeMux pattern
+// that matched, never the raw path, to keep the number of series bounded.
+func ObserveRequest(method string, route string, status int, duration time.Duration) {
+	requestsTotal.WithLabelValues(method, route, strconv.Itoa(status)).Inc()
+	requestDuration.WithLabelValues(method, route).Observe(duration.Seconds())
+}
+
+func result(ok bool) string {
+	if ok {
+		return "success"
+	}
+	return "failure"
+}
+
+func ObserveLogin(ok bool) {
+	loginsTotal.WithLabelValues(result(ok)).Inc()
+}
+
+// ObserveSessionCheck records why auth middleware let a request through or
+// not, e.g. "ok", "unauthenticated" or "unverified".
+func ObserveSessionCheck(outcome string) {
+	sessionChecksTotal.WithLabelValues(outcome).Inc()
+}
+
+func ObserveMail(err error) {
+	mailsTotal.WithLabelValues(result(err == nil)).Inc()
+}
+
+// Handler serves the metrics to clients presenting token as a bearer token
+// or connecting from one of allowedNetworks (CIDRs or single IPs). The
+// remote address is used as is, so behind a proxy rely on the token.
+func Handler(token string, allowedNetworks []string) (http.Handler, error) {
+	networks, err := ParseNetworks(allowedNetworks)
+	if err != nil {
+		return nil, err
+	}
+	metricsHandler := promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !allowed(r, token, networks) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		metricsHandler.ServeHTTP(w, r)
+	}), nil
+}
+
+func allowed(r *http.Request, token string, networks []*net.IPNet) bool {
+	if token != "" {
+		bearer, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if found && subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) == 1 {
+			return true
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseNetworks parses CIDRs, accepting single IPs as /32 or /128 networks.
+func ParseNetworks(values []string) ([]*net.IPNet, error) {
+	networks := []*net.IPNet{}
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", value)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+			value += "/" + strconv.Itoa(bits)
+		}
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q", value)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
@@ -0,0 +1,79 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func Test_InstrumentDB(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	if err := InstrumentDB(db, "test"); err != nil {
+		t.Fatalf("Failed to instrument database: %v", err)
+	}
+
+	type Item struct {
+		ID   uint
+		Name string
+	}
+	db.AutoMigrate(&Item{})
+	db.Create(&Item{Name: "one"})
+	var items []Item
+	db.Find(&items)
+
+	if count := testutil.CollectAndCount(dbQueryDuration, "juniper_db_query_duration_seconds"); count < 2 {
+		t.Errorf("Expected create and query series, got %d", count)
+	}
+	expected := `
+		# HELP juniper_db_errors_total Failed database queries by database and operation, not counting record not found.
+		# TYPE juniper_db_errors_total counter
+	`
+	var item Item
+	db.First(&item, 999) // Not found is not an error
+	if err := testutil.CollectAndCompare(dbErrorsTotal, strings.NewReader(expected)); err != nil {
+		t.Errorf("Unexpected errors: %v", err)
+	}
+}
+
+func Test_HandlerAccess(t *testing.T) {
+	handler, err := Handler("s3cret", []string{"127.0.0.1", "10.0.0.0/8"})
+	if err != nil {
+		t.Fatalf("Failed to create handler: %v", err)
+	}
+
+	tests := []struct {
+		remoteAddr string
+		token      string
+		status     int
+	}{
+		{"127.0.0.1:1234", "", http.StatusOK},
+		{"10.1.2.3:1234", "", http.StatusOK},
+		{"203.0.113.9:1234", "", http.StatusForbidden},
+		{"203.0.113.9:1234", "wrong", http.StatusForbidden},
+		{"203.0.113.9:1234", "s3cret", http.StatusOK},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/metrics", nil)
+		r.RemoteAddr = test.remoteAddr
+		if test.token != "" {
+			r.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("Expected %d for %s with token %q, got %d", test.status, test.remoteAddr, test.token, w.Code)
+		}
+	}
+
+	if _, err := Handler("", []string{"not-an-ip"}); err == nil {
+		t.Errorf("Expected an error for an invalid network")
+	}
+}
@@ -0,0 +1,118 @@
+package models
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// APIVersion is one version of a model's JSON API, mounted by AddVersion at
+// /api/{Name}/{TypeName}/.
+type APIVersion[T any] struct {
+	Name string // "v1", "v2", ...
+
+	// Mapper builds a T from a request body. Nil uses the mapper passed to
+	// NewModelHandler.
+	Mapper func(map[string]interface{}) (T, error)
+
+	// Serializer shapes responses. Nil encodes T as is.
+	Serializer func(T) any
+
+	// Deprecated is when the version was deprecated and Sunset when it goes
+	// away. Either is sent in its header when set.
+	Deprecated time.Time
+	Sunset     time.Time
+}
+
+func (version *APIVersion[T]) serialize(model T) any {
+	if version.Serializer == nil {
+		return model
+	}
+	return version.Serializer(model)
+}
+
+// AddVersion mounts the routes for version. Adding the same version twice
+// panics, like registering a route twice on a ServeMux.
+func (handler *ModelHandler[T]) AddVersion(version APIVersion[T]) {
+	if handler.version(version.Name) != nil {
+		panic(fmt.Sprintf("models: %s already has a version %s", handler.TypeName, version.Name))
+	}
+	if version.Mapper == nil {
+		version.Mapper = handler.jsonMapper
+	}
+	handler.versions = append(handler.versions, &version)
+	handler.registerRoutes(handler.versionBase(version.Name), &version)
+}
+
+// Alias also serves the version called name at the unversioned
+// /api/{TypeName}/ paths.
+func (handler *ModelHandler[T]) Alias(name string) error {
+	version := handler.version(name)
+	if version == nil {
+		return fmt.Errorf("models: %s has no version %s to alias", handler.TypeName, name)
+	}
+	if handler.alias != "" {
+		return fmt.Errorf("models: %s is already aliased to %s", handler.TypeName, handler.alias)
+	}
+	handler.alias = name
+	handler.registerRoutes(handler.versionBase(""), version)
+	return nil
+}
+
+// Deprecate marks the version called name as deprecated since deprecated,
+// to be removed at sunset, which may be zero when no date is set yet.
+func (handler *ModelHandler[T]) Deprecate(name string, deprecated time.Time, sunset time.Time) error {
+	version := handler.version(name)
+	if version == nil {
+		return fmt.Errorf("models: %s has no version %s to deprecate", handler.TypeName, name)
+	}
+	version.Deprecated = deprecated
+	version.Sunset = sunset
+	return nil
+}
+
+func (handler *ModelHandler[T]) version(name string) *APIVersion[T] {
+	for _, version := range handler.versions {
+		if version.Name == name {
+			return version
+		}
+	}
+	return nil
+}
+
+// Path is where the version called name is mounted, e.g. "/api/v1/Posts/",
+// for pages that call the API, such as the dashboard's forms.
+func (handler *ModelHandler[T]) Path(name string) string {
+	return handler.versionBase(name)
+}
+
+// versionBase returns the path the routes of a version are mounted below,
+// or the unversioned path for an empty name.
+func (handler *ModelHandler[T]) versionBase(name string) string {
+	if name == "" {
+		return "/api/" + handler.TypeName + "/"
+	}
+	return "/api/" + name + "/" + handler.TypeName + "/"
+}
+
+// versionHeaders adds the Deprecation (RFC 9745) and Sunset (RFC 8594)
+// headers of a deprecated version, with a link to the newest version that
+// is not deprecated.
+func (handler *ModelHandler[T]) versionHeaders(version *APIVersion[T], next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !version.Deprecated.IsZero() {
+			w.Header().Set("Deprecation", "@"+strconv.FormatInt(version.Deprecated.Unix(), 10))
+			for i := len(handler.versions) - 1; i >= 0; i-- {
+				if successor := handler.versions[i]; successor.Deprecated.IsZero() {
+					w.Header().Add("Link", "<"+handler.versionBase(successor.Name)+`>; rel="successor-version"`)
+					break
+				}
+			}
+		}
+		if !version.Sunset.IsZero() {
+			w.Header().Set("Sunset", version.Sunset.UTC().Format(http.TimeFormat))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,121 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+	"pioneerwebworks.com/juniper/cors"
+)
+
+type postV2 struct {
+	ID    uint     `json:"id"`
+	Title string   `json:"title"`
+	Tags  []string `json:"tags"`
+}
+
+func Test_APIVersions(t *testing.T) {
+	mux := http.NewServeMux()
+	handler := NewModelHandler[Post](
+		&Post{},
+		PostJSONMapper,
+		filepath.Join(t.TempDir(), "post.db"),
+		&gorm.Config{},
+		mux,
+		context.Background(),
+		cors.Options{},
+	)
+	handler.db.Create(&Post{Title: "Hello", Slug: "hello", Content: "hello", UserID: 1, Tags: "go, templ"})
+
+	sunset := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := handler.Deprecate("v1", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), sunset); err != nil {
+		t.Fatalf("Failed to deprecate v1: %v", err)
+	}
+	handler.AddVersion(APIVersion[Post]{
+		Name: "v2",
+		Serializer: func(post Post) any {
+			return postV2{ID: post.ID, Title: post.Title, Tags: post.TagList()}
+		},
+	})
+	if err := handler.Alias("v3"); err == nil {
+		t.Errorf("Expected an error aliasing a missing version")
+	}
+	if err := handler.Alias("v2"); err != nil {
+		t.Fatalf("Failed to alias v2: %v", err)
+	}
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200 for %s, got %d: %s", path, w.Code, w.Body.String())
+		}
+		return w
+	}
+
+	// Deprecation headers are only sent by the deprecated version, which
+	// points at its successor.
+	w := get("/api/v1/Posts/1")
+	if got := w.Header().Get("Deprecation"); got != "@1735689600" {
+		t.Errorf("Unexpected Deprecation header %q", got)
+	}
+	if got := w.Header().Get("Sunset"); got != sunset.Format(http.TimeFormat) {
+		t.Errorf("Unexpected Sunset header %q", got)
+	}
+	if got := w.Header().Get("Link"); got != `</api/v2/Posts/>; rel="successor-version"` {
+		t.Errorf("Unexpected Link header %q", got)
+	}
+	var v1 Post
+	json.NewDecoder(w.Body).Decode(&v1)
+	if v1.Tags != "go, templ" {
+		t.Errorf("Expected v1 to keep tags as a string, got %+v", v1)
+	}
+
+	for _, path := range []string{"/api/v2/Posts/1", "/api/Posts/1"} {
+		w = get(path)
+		if w.Header().Get("Deprecation") != "" || w.Header().Get("Link") != "" {
+			t.Errorf("Expected no deprecation headers for %s", path)
+		}
+		var v2 postV2
+		json.NewDecoder(w.Body).Decode(&v2)
+		if strings.Join(v2.Tags, "|") != "go|templ" {
+			t.Errorf("Expected %s to serialize tags as a list, got %+v", path, v2)
+		}
+	}
+
+	w = get("/api/v2/Posts/")
+	var list []postV2
+	if err := json.NewDecoder(w.Body).Decode(&list); err != nil || len(list) != 1 || len(list[0].Tags) != 2 {
+		t.Errorf("Failed to serialize the list with v2: %v %+v", err, list)
+	}
+}
+
+func Test_Path(t *testing.T) {
+	mux := http.NewServeMux()
+	handler := NewModelHandler[Post](
+		&Post{},
+		PostJSONMapper,
+		filepath.Join(t.TempDir(), "post.db"),
+		&gorm.Config{},
+		mux,
+		context.Background(),
+		cors.Options{},
+	)
+	if path := handler.Path("v1"); path != "/api/v1/Posts/" {
+		t.Errorf("Unexpected path %q", path)
+	}
+
+	// The body the dashboard's new post form sends
+	body := `{"id": 0, "title": "Hello", "slug": "hello", "content": "Hello, world", "userID": 1}`
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("POST", handler.Path("v1"), strings.NewReader(body)))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"slug":"hello"`) {
+		t.Errorf("Expected the dashboard's create URL to create a post, got %d: %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,56 @@
+package models
+
+import "time"
+
+// Identity links a user to their account at a sign-in provider such as
+// Google, so they can log in with it. A user can have several.
+type Identity struct {
+	ID         uint      `gorm:"primarykey" json:"id"`
+	UserID     uint      `gorm:"index;not null" json:"-"`
+	Provider   string    `gorm:"size:64;not null;uniqueIndex:idx_identity_subject" json:"provider"`
+	Subject    string    `gorm:"size:255;not null;uniqueIndex:idx_identity_subject" json:"-"` // The provider's ID for the account, which unlike the email never changes
+	Email      string    `gorm:"size:255" json:"email"`                                       // As the provider last reported it
+	CreatedAt  time.Time `json:"createdAt"`
+	LastUsedAt time.Time `json:"lastUsedAt"`
+}
+
+// FindIdentity returns the identity with subject at provider, or a zero
+// Identity.
+func (udb *UserDB) FindIdentity(provider, subject string) Identity {
+	identity := Identity{}
+	if subject == "" {
+		return identity
+	}
+	udb.DB.Where("provider = ? AND subject = ?", provider, subject).Limit(1).Find(&identity)
+	return identity
+}
+
+// Identities lists the identities of a user, oldest first.
+func (udb *UserDB) Identities(userID uint) ([]Identity, error) {
+	identities := []Identity{}
+	err := udb.DB.Where("user_id = ?", userID).Order("id").Find(&identities).Error
+	return identities, err
+}
+
+func (udb *UserDB) AddIdentity(i *Identity) error {
+	return udb.DB.Create(i).Error
+}
+
+// UseIdentity records a login with i and the email the provider sent.
+func (udb *UserDB) UseIdentity(i *Identity, email string, now time.Time) error {
+	err := udb.DB.Model(i).Updates(map[string]interface{}{
+		"email":        email,
+		"last_used_at": now,
+	}).Error
+	if err == nil {
+		i.Email, i.LastUsedAt = email, now
+	}
+	return err
+}
+
+// DeleteIdentity deletes the identity with id if it belongs to userID, and
+// reports whether there was one.
+func (udb *UserDB) DeleteIdentity(userID uint, id uint) (bool, error) {
+	tx := udb.DB.Where("id = ? AND user_id = ?", id, userID).Delete(&Identity{})
+	return tx.RowsAffected > 0, tx.Error
+}
@@ -0,0 +1,44 @@
+package models
+
+import (
+	"time"
+)
+
+type Media struct {
+	ID           uint           `gorm:"primarykey" json:"id"`
+	CreatedAt    time.Time      `gorm:"default:CURRENT_TIMESTAMP" json:"createdAt"`
+	UpdatedAt    time.Time      `gorm:"default:CURRENT_TIMESTAMP" json:"updatedAt"`
+	DeletedAt    time.Time      `json:"deletedAt"`
+	Path         string         `gorm:"size:255;not null;unique" json:"path"` // Relative to the media root
+	OriginalName string         `gorm:"size:255;not null" json:"originalName"`
+	ContentType  string         `gorm:"size:255;not null" json:"contentType"`
+	Size         int64          `gorm:"not null" json:"size"`
+	Width        int            `json:"width"`
+	Height       int            `json:"height"`
+	AltText      string         `gorm:"size:255" json:"altText"`
+	UserID       uint           `gorm:"not null" json:"userID"`
+	Variants     []MediaVariant `gorm:"serializer:json" json:"variants"`
+}
+
+// MediaVariant is a resized copy of an image generated on upload.
+type MediaVariant struct {
+	Name   string `json:"name"` // "thumbnail" or the width, e.g. "640w"
+	Path   string `json:"path"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+// IsImage reports whether the media has pixel dimensions and variants.
+func (m *Media) IsImage() bool {
+	return m.Width > 0 && m.Height > 0
+}
+
+// Variant returns the named variant, falling back to the original file.
+func (m *Media) Variant(name string) MediaVariant {
+	for _, variant := range m.Variants {
+		if variant.Name == name {
+			return variant
+		}
+	}
+	return MediaVariant{Name: "original", Path: m.Path, Width: m.Width, Height: m.Height}
+}
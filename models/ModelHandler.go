@@ -3,12 +3,19 @@ package models
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"reflect"
+	"strings"
 
 	"github.com/jinzhu/inflection"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
+	"pioneerwebworks.com/juniper/apperr"
+	"pioneerwebworks.com/juniper/cors"
+	"pioneerwebworks.com/juniper/metrics"
+	"pioneerwebworks.com/juniper/openapi"
+	"pioneerwebworks.com/juniper/tracing"
 )
 
 type ModelHandler[T any] struct {
@@ -17,8 +24,24 @@ type ModelHandler[T any] struct {
 	TypeName   string
 	model      *T
 	jsonMapper func(map[string]interface{}) (T, error)
+	versions   []*APIVersion[T]
+	alias      string // Version also served without a version in the path
+	cors       *cors.CORS
+	authorizer Authorizer // Nil lets every request through
 }
 
+// Mapped is implemented by models that list the columns their JSON mapper
+// sets. A PUT only updates those, so columns the API does not expose, e.g.
+// secrets, keep their stored values.
+type Mapped interface {
+	MappedColumns() []string
+}
+
+// Authorizer checks that r may use the permission scope, e.g. "posts:read".
+// The error is written as the response; the authorizer may set headers on
+// w first.
+type Authorizer func(w http.ResponseWriter, r *http.Request, scope string) error
+
 func NewModelHandler[T any](
 	model *T,
 	jsonMapper func(map[string]interface{}) (T, error),
@@ -26,11 +49,9 @@ func NewModelHandler[T any](
 	databaseConnectionConfig *gorm.Config,
 	router *http.ServeMux,
 	context context.Context,
-	allowedOrigins []string,
-	allowedMethods []string,
+	corsOptions cors.Options,
 ) *ModelHandler[T] {
-	name := reflect.TypeOf(*model).Name()
-	name = inflection.Plural(name)
+	name := typeName[T]()
 
 	post_db, err := gorm.Open(
 		sqlite.Open(databaseLocation),
@@ -41,6 +62,14 @@ func NewModelHandler[T any](
 	}
 	post_db.AutoMigrate(model)
 
+	err = errors.Join(
+		metrics.InstrumentDB(post_db, name),
+		tracing.InstrumentDB(post_db, name),
+	)
+	if err != nil {
+		panic("failed to instrument database")
+	}
+
 	// Enable WAL mode for SQLite
 	err = post_db.Exec("PRAGMA journal_mode=WAL;").Error
 	if err != nil {
@@ -53,19 +82,30 @@ func NewModelHandler[T any](
 		name,
 		model,
 		jsonMapper,
+		nil,
+		"",
+		cors.New(corsOptions),
+		nil,
 	}
 
 	modelHandler.RegisterHandlers(context)
 
-	// c := cors.New(cors.Options{
-	// 	AllowedOrigins:   allowedOrigins,
-	// 	AllowCredentials: true,
-	// 	AllowedMethods:   allowedMethods,
-	// })
+	return modelHandler
+}
 
-	// c.Handler(modelHandler.r)
+// DB exposes the underlying connection for queries the generic handler
+// methods do not cover.
+func (handler *ModelHandler[T]) DB() *gorm.DB {
+	return handler.db
+}
 
-	return modelHandler
+// Close closes the database connection.
+func (handler *ModelHandler[T]) Close() error {
+	sqlDB, err := handler.db.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.Close()
 }
 
 func (handler *ModelHandler[T]) Create(model *T) error {
@@ -153,180 +193,345 @@ func (handler *ModelHandler[T]) BatchDelete(ids []int) error {
 	return nil
 }
 
+// Scope is the permission to read, or with write to create, change and
+// delete, the models of handler, e.g. "posts:read" and "posts:write".
+func (handler *ModelHandler[T]) Scope(write bool) string {
+	return scope(handler.TypeName, write)
+}
+
+func scope(typeName string, write bool) string {
+	if write {
+		return strings.ToLower(typeName) + ":write"
+	}
+	return strings.ToLower(typeName) + ":read"
+}
+
+// Scopes describes the two scopes of the ModelHandler of T, for consent
+// pages and docs. They are known before the handler is created, so clients
+// can be registered from the command line.
+func Scopes[T any]() map[string]string {
+	name := typeName[T]()
+	return map[string]string{
+		scope(name, false): "Read " + name,
+		scope(name, true):  "Create, change and delete " + name,
+	}
+}
+
+// typeName is the TypeName of the ModelHandler of T, e.g. "Posts".
+func typeName[T any]() string {
+	var zero T
+	return inflection.Plural(reflect.TypeOf(zero).Name())
+}
+
+// Authorize has every route check its scope with authorizer before
+// handling the request.
+func (handler *ModelHandler[T]) Authorize(authorizer Authorizer) {
+	handler.authorizer = authorizer
+}
+
+// authorize runs the authorizer, if any, for scope before next.
+func (handler *ModelHandler[T]) authorize(scope string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if handler.authorizer != nil {
+			if err := handler.authorizer(w, r, scope); err != nil {
+				apperr.WriteJSON(w, r, err)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 func (handler *ModelHandler[T]) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	handler.Mux.ServeHTTP(w, r)
 }
 
+// RegisterHandlers mounts version v1 of the API, parsing bodies with the
+// handler's jsonMapper and encoding T as is.
 func (handler *ModelHandler[T]) RegisterHandlers(context context.Context) {
-	handler.Mux.HandleFunc(
-		"GET /api/"+handler.TypeName+"/{slug}",
-		handler.Handle_Get_One(handler.TypeName),
-	)
-	handler.Mux.HandleFunc(
-		"GET /api/"+handler.TypeName+"/",
-		handler.Handle_Get_List,
-	)
-	handler.Mux.HandleFunc(
-		"POST /api/"+handler.TypeName+"/",
-		handler.Handle_Post(handler.jsonMapper),
-	)
-	handler.Mux.HandleFunc(
-		"PUT /api/"+handler.TypeName+"/{slug}",
-		handler.Handle_Put(
-			"id",
-			handler.jsonMapper,
-		),
-	)
-	handler.Mux.HandleFunc(
-		"DELETE /api/"+handler.TypeName+"/{slug}",
-		handler.Handle_Delete(
-			"id",
-		),
-	)
+	handler.AddVersion(APIVersion[T]{Name: "v1"})
+}
+
+// registerRoutes mounts the routes for version below base, e.g. "/api/v1/Posts/".
+func (handler *ModelHandler[T]) registerRoutes(base string, version *APIVersion[T]) {
+	routes := []struct {
+		pattern string
+		write   bool
+		handler http.HandlerFunc
+	}{
+		{"GET " + base + "{slug}", false, handler.Handle_Get_One(version)},
+		{"GET " + base, false, handler.Handle_Get_List(version)},
+		{"POST " + base, true, handler.Handle_Post(version)},
+		{"PUT " + base + "{slug}", true, handler.Handle_Put(version)},
+		{"DELETE " + base + "{slug}", true, handler.Handle_Delete(version)},
+	}
+	for _, route := range routes {
+		handler.Mux.Handle(route.pattern, handler.cors.Handler(handler.versionHeaders(version, handler.authorize(handler.Scope(route.write), route.handler))))
+	}
+	// Preflight requests are answered by the CORS handler.
+	handler.Mux.Handle("OPTIONS "+base, handler.cors.Handler(http.HandlerFunc(handler.Handle_Options)))
 
 	notFoundPatterns := []string{
-		"PUT /api/" + handler.TypeName + "/",
-		"DELETE /api/" + handler.TypeName + "/",
-		"GET /api/" + handler.TypeName + "/{slug}/...",
-		"POST /api/" + handler.TypeName + "/{slug}/...",
-		"PUT /api/" + handler.TypeName + "/{slug}/...",
-		"DELETE /api/" + handler.TypeName + "/{slug}/...",
+		"PUT " + base,
+		"DELETE " + base,
+		"GET " + base + "{slug}/...",
+		"POST " + base + "{slug}/...",
+		"PUT " + base + "{slug}/...",
+		"DELETE " + base + "{slug}/...",
 	}
 	for _, pattern := range notFoundPatterns {
 		handler.Mux.HandleFunc(pattern, handler.Handle_NotFound)
 	}
+}
+
+// Describe documents the routes of every version in doc, with the schemas
+// generated from what each version's serializer returns.
+func (handler *ModelHandler[T]) Describe(doc *openapi.Document) {
+	for _, version := range handler.versions {
+		handler.describeVersion(doc, handler.versionBase(version.Name), version.Name+"_", version)
+		if version.Name == handler.alias {
+			handler.describeVersion(doc, handler.versionBase(""), "", version)
+		}
+	}
+}
+
+func (handler *ModelHandler[T]) describeVersion(doc *openapi.Document, base string, idPrefix string, version *APIVersion[T]) {
+	var zero T
+	name := reflect.TypeOf(zero).Name()
+	sample := version.serialize(zero)
+	schemaName := reflect.TypeOf(sample).Name()
+	if schemaName == "" {
+		schemaName = name + "_" + version.Name
+	}
+	model := doc.Model(schemaName, sample)
+	tags := []string{handler.TypeName}
+	deprecated := !version.Deprecated.IsZero()
+	// Every route needs a session or a token granting its scope
+	security := func(write bool) []openapi.SecurityRequirement {
+		if handler.authorizer == nil {
+			return nil
+		}
+		return openapi.Scoped(handler.Scope(write))
+	}
+	responses := func(responses map[string]*openapi.Response) map[string]*openapi.Response {
+		if handler.authorizer != nil {
+			responses["401"] = openapi.Error(http.StatusUnauthorized)
+			responses["403"] = openapi.Error(http.StatusForbidden)
+		}
+		return responses
+	}
+
+	doc.Add("GET", base, &openapi.Operation{
+		OperationID: idPrefix + "list" + handler.TypeName,
+		Summary:     "List all " + handler.TypeName,
+		Tags:        tags,
+		Deprecated:  deprecated,
+		Security:    security(false),
+		Responses: responses(map[string]*openapi.Response{
+			"200": {Description: "OK", Content: openapi.JSON(openapi.ArrayOf(model))},
+			"500": openapi.Error(http.StatusInternalServerError),
+		}),
+	})
+	doc.Add("POST", base, &openapi.Operation{
+		OperationID: idPrefix + "create" + name,
+		Summary:     "Create a " + name,
+		Tags:        tags,
+		Deprecated:  deprecated,
+		Security:    security(true),
+		RequestBody: openapi.Body(model),
+		Responses: responses(map[string]*openapi.Response{
+			"200": {Description: "The created " + name, Content: openapi.JSON(model)},
+			"400": openapi.Error(http.StatusBadRequest),
+			"422": openapi.Error(http.StatusUnprocessableEntity),
+			"500": openapi.Error(http.StatusInternalServerError),
+		}),
+	})
+	doc.Add("GET", base+"{slug}", &openapi.Operation{
+		OperationID: idPrefix + "get" + name,
+		Summary:     "Get a " + name + " by ID",
+		Tags:        tags,
+		Deprecated:  deprecated,
+		Security:    security(false),
+		Responses: responses(map[string]*openapi.Response{
+			"200": {Description: "OK", Content: openapi.JSON(model)},
+			"404": openapi.Error(http.StatusNotFound),
+		}),
+	})
+	doc.Add("PUT", base+"{slug}", &openapi.Operation{
+		OperationID: idPrefix + "update" + name,
+		Summary:     "Replace a " + name,
+		Tags:        tags,
+		Deprecated:  deprecated,
+		Security:    security(true),
+		RequestBody: openapi.Body(model),
+		Responses: responses(map[string]*openapi.Response{
+			"200": {Description: "OK", Content: openapi.JSON(model)},
+			"400": openapi.Error(http.StatusBadRequest),
+			"404": openapi.Error(http.StatusNotFound),
+			"422": openapi.Error(http.StatusUnprocessableEntity),
+			"500": openapi.Error(http.StatusInternalServerError),
+		}),
+	})
+	doc.Add("DELETE", base+"{slug}", &openapi.Operation{
+		OperationID: idPrefix + "delete" + name,
+		Summary:     "Delete a " + name,
+		Tags:        tags,
+		Deprecated:  deprecated,
+		Security:    security(true),
+		Responses: responses(map[string]*openapi.Response{
+			"200": {Description: "The deleted " + name, Content: openapi.JSON(model)},
+			"404": openapi.Error(http.StatusNotFound),
+			"500": openapi.Error(http.StatusInternalServerError),
+		}),
+	})
+}
+
+// writeModel encodes model the way version serializes it.
+func writeModel[T any](w http.ResponseWriter, version *APIVersion[T], model T) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(version.serialize(model))
+}
+
+func writeModels[T any](w http.ResponseWriter, version *APIVersion[T], models []T) {
+	out := make([]any, len(models))
+	for i, model := range models {
+		out[i] = version.serialize(model)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(out)
+}
 
+// readModel decodes the JSON body of r with the mapper of version.
+func readModel[T any](r *http.Request, version *APIVersion[T]) (T, error) {
+	var data map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		var zero T
+		return zero, apperr.BadRequest("Error parsing JSON body").Wrap(err)
+	}
+	model, err := version.Mapper(data)
+	if err != nil {
+		return model, apperr.Unprocessable(err.Error())
+	}
+	return model, nil
 }
 
 func (handler *ModelHandler[T]) Handle_Get_One(
-	pathParamName string,
+	version *APIVersion[T],
 ) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		pathParamValue := r.PathValue(pathParamName)
-		model := handler.model
-		tx := handler.db.First(&model, pathParamValue)
+		var model T
+		tx := handler.db.WithContext(r.Context()).First(&model, r.PathValue("slug"))
 		if tx.Error != nil {
-			http.Error(w, tx.Error.Error(), http.StatusNotFound)
+			apperr.WriteJSON(w, r, apperr.NotFound(handler.TypeName+" not found").Wrap(tx.Error))
 			return
 		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(model)
+		writeModel(w, version, model)
 	}
 }
 
+func (handler *ModelHandler[T]) Handle_Options(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Allow", "GET, POST, PUT, DELETE, OPTIONS")
+	w.WriteHeader(http.StatusNoContent)
+}
+
 func (handler *ModelHandler[T]) Handle_NotFound(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusNotFound)
-	json.NewEncoder(w).Encode(map[string]string{"error": "Endpoint not found."})
+	apperr.WriteJSON(w, r, apperr.NotFound("Endpoint not found"))
 }
 
 func (handler *ModelHandler[T]) Handle_Get_List(
-	w http.ResponseWriter,
-	r *http.Request,
-) {
-	models := make([]T, 0)
-	handler.db.Find(&models)
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(models)
+	version *APIVersion[T],
+) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		models := make([]T, 0)
+		if err := handler.db.WithContext(r.Context()).Find(&models).Error; err != nil {
+			apperr.WriteJSON(w, r, err)
+			return
+		}
+		writeModels(w, version, models)
+	}
 }
 
 func (handler *ModelHandler[T]) Handle_Post(
-	jsonMapper func(map[string]interface{}) (T, error),
+	version *APIVersion[T],
 ) func(w http.ResponseWriter, r *http.Request) {
 	return func(
 		w http.ResponseWriter,
 		r *http.Request,
 	) {
-		var data map[string]interface{}
-		err := json.NewDecoder(r.Body).Decode(&data)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		model, err := jsonMapper(data)
+		model, err := readModel(r, version)
 		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			apperr.WriteJSON(w, r, err)
 			return
 		}
-		err = handler.Create(&model)
+		err = handler.db.WithContext(r.Context()).Create(&model).Error
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			apperr.WriteJSON(w, r, err)
 			return
 		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(model)
+		writeModel(w, version, model)
 	}
 }
 
 func (handler *ModelHandler[T]) Handle_Put(
-	pathParamName string,
-	jsonMapper func(map[string]interface{}) (T, error),
+	version *APIVersion[T],
 ) func(w http.ResponseWriter, r *http.Request) {
 	return func(
 		w http.ResponseWriter,
 		r *http.Request,
 	) {
-		pathParamValue := r.PathValue(pathParamName)
-		model := handler.model
-		tx := handler.db.First(&model, pathParamValue)
+		var existing T
+		tx := handler.db.WithContext(r.Context()).First(&existing, r.PathValue("slug"))
 		if tx.Error != nil {
-			http.Error(w, tx.Error.Error(), http.StatusNotFound)
+			apperr.WriteJSON(w, r, apperr.NotFound(handler.TypeName+" not found").Wrap(tx.Error))
 			return
 		}
 
-		var data map[string]interface{}
-		err := json.NewDecoder(r.Body).Decode(&data)
+		model, err := readModel(r, version)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			apperr.WriteJSON(w, r, err)
 			return
 		}
 
-		modelData, err := jsonMapper(data)
-		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		// Without a list of columns, only the non-zero fields are updated
+		tx = handler.db.WithContext(r.Context()).Model(&existing)
+		if mapped, ok := any(model).(Mapped); ok {
+			tx = tx.Select(mapped.MappedColumns())
+		}
+		if err := tx.Updates(&model).Error; err != nil {
+			apperr.WriteJSON(w, r, err)
 			return
 		}
 
-		err = handler.Update(&modelData)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		var updated T
+		if err := handler.db.WithContext(r.Context()).First(&updated, r.PathValue("slug")).Error; err != nil {
+			apperr.WriteJSON(w, r, err)
 			return
 		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(model)
+		writeModel(w, version, updated)
 	}
 }
 
 func (handler *ModelHandler[T]) Handle_Delete(
-	pathParamName string,
+	version *APIVersion[T],
 ) func(w http.ResponseWriter, r *http.Request) {
 	return func(
 		w http.ResponseWriter,
 		r *http.Request,
 	) {
-		pathParamValue := r.PathValue(pathParamName)
-		model := handler.model
-		tx := handler.db.First(model, pathParamValue)
+		var model T
+		tx := handler.db.WithContext(r.Context()).First(&model, r.PathValue("slug"))
 		if tx.Error != nil {
-			http.Error(w, tx.Error.Error(), http.StatusNotFound)
+			apperr.WriteJSON(w, r, apperr.NotFound(handler.TypeName+" not found").Wrap(tx.Error))
 			return
 		}
 
-		err := handler.Delete(model)
+		err := handler.db.WithContext(r.Context()).Delete(&model).Error
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			apperr.WriteJSON(w, r, err)
 			return
 		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(model)
+		writeModel(w, version, model)
 	}
 }
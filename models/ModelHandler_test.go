@@ -0,0 +1,92 @@
+package models
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gorm.io/gorm"
+	"pioneerwebworks.com/juniper/apperr"
+	"pioneerwebworks.com/juniper/cors"
+)
+
+func Test_Authorize(t *testing.T) {
+	mux := http.NewServeMux()
+	handler := NewModelHandler[Post](
+		&Post{},
+		PostJSONMapper,
+		filepath.Join(t.TempDir(), "post.db"),
+		&gorm.Config{},
+		mux,
+		context.Background(),
+		cors.Options{},
+	)
+	if scopes := Scopes[Post](); len(scopes) != 2 || scopes["posts:read"] == "" || scopes["posts:write"] == "" {
+		t.Errorf("Unexpected scopes %v", scopes)
+	}
+
+	var checked []string
+	handler.Authorize(func(w http.ResponseWriter, r *http.Request, scope string) error {
+		checked = append(checked, scope)
+		if r.Header.Get("Authorization") == "" {
+			return apperr.Forbidden("Forbidden")
+		}
+		return nil
+	})
+	serve := func(method, path string, authorized bool) int {
+		r := httptest.NewRequest(method, path, strings.NewReader(`{}`))
+		if authorized {
+			r.Header.Set("Authorization", "Bearer token")
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	if code := serve("GET", "/api/v1/Posts/", true); code != http.StatusOK {
+		t.Errorf("Expected 200 for an authorized list, got %d", code)
+	}
+	if code := serve("DELETE", "/api/v1/Posts/1", false); code != http.StatusForbidden {
+		t.Errorf("Expected the authorizer's 403, got %d", code)
+	}
+	if strings.Join(checked, " ") != "posts:read posts:write" {
+		t.Errorf("Expected a read and a write scope to be checked, got %v", checked)
+	}
+}
+
+func Test_PutKeepsUnmappedColumns(t *testing.T) {
+	mux := http.NewServeMux()
+	handler := NewModelHandler[User](
+		&User{},
+		UserJSONMapper,
+		filepath.Join(t.TempDir(), "user.db"),
+		&gorm.Config{},
+		mux,
+		context.Background(),
+		cors.Options{},
+	)
+	handler.AddVersion(APIVersion[User]{Name: "v2", Mapper: func(data map[string]interface{}) (User, error) {
+		username, _ := data["username"].(string)
+		return User{Username: username, Email: "alice@example.com", UserRole: "user"}, nil
+	}})
+	user := User{Username: "alice", Email: "alice@example.com", Password: "hash", UserRole: "user", TOTPSecret: "secret", TOTPEnabled: true, PasskeyHandle: []byte("handle")}
+	handler.DB().Create(&user)
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("PUT", "/api/v2/Users/1", strings.NewReader(`{"username": "alicia", "totpEnabled": false}`)))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"username":"alicia"`) {
+		t.Fatalf("Expected the updated user, got %d: %s", w.Code, w.Body.String())
+	}
+	if strings.Contains(w.Body.String(), "password") || strings.Contains(w.Body.String(), "hash") {
+		t.Errorf("Expected the password hash to be left out of the response: %s", w.Body.String())
+	}
+
+	var stored User
+	handler.DB().First(&stored, user.ID)
+	if stored.Username != "alicia" || stored.TOTPSecret != "secret" || !stored.TOTPEnabled || string(stored.PasskeyHandle) != "handle" {
+		t.Errorf("Expected only the mapped columns to change, got %+v", stored)
+	}
+}
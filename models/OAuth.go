@@ -0,0 +1,190 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Kinds of OAuthToken.
+const (
+	OAuthAccessToken  = "access_token"
+	OAuthRefreshToken = "refresh_token"
+)
+
+// OAuthClient is a program registered to call the API with OAuth2 tokens
+// instead of a password. Confidential clients, e.g. servers, authenticate
+// with a secret; public ones, e.g. mobile apps, cannot keep a secret and
+// rely on PKCE alone.
+type OAuthClient struct {
+	ID           uint   `gorm:"primarykey"`
+	ClientID     string `gorm:"size:64;not null;uniqueIndex"`
+	SecretHash   string `gorm:"size:64"`           // Empty for public clients
+	Name         string `gorm:"size:255;not null"` // Shown on the consent page
+	RedirectURIs string `gorm:"size:2048"`         // Space-separated, matched exactly
+	Scopes       string `gorm:"size:1024"`         // Space-separated, the most the client may be granted
+	CreatedAt    time.Time
+}
+
+// Public reports whether c has no secret.
+func (c OAuthClient) Public() bool {
+	return c.SecretHash == ""
+}
+
+// OAuthCode is an authorization code waiting to be exchanged for tokens by
+// the client it was issued to, with the verifier of Challenge.
+type OAuthCode struct {
+	ID          uint   `gorm:"primarykey"`
+	Hash        string `gorm:"size:64;not null;uniqueIndex"`
+	GrantID     string `gorm:"size:64;not null"` // Of the tokens it is exchanged for
+	ClientID    string `gorm:"size:64;not null"`
+	UserID      uint   `gorm:"not null"`
+	RedirectURI string `gorm:"size:2048;not null"`
+	Scopes      string `gorm:"size:1024"`
+	Challenge   string `gorm:"size:128;not null"` // PKCE S256 code challenge
+	CreatedAt   time.Time
+	ExpiresAt   time.Time
+	UsedAt      time.Time
+}
+
+// OAuthToken is an access or refresh token. The tokens issued for one
+// consent, or one client credentials request, share a GrantID, so they can
+// be revoked together.
+type OAuthToken struct {
+	ID        uint   `gorm:"primarykey"`
+	Hash      string `gorm:"size:64;not null;uniqueIndex"`
+	Kind      string `gorm:"size:16;not null"`
+	GrantID   string `gorm:"size:64;not null;index"`
+	ClientID  string `gorm:"size:64;not null;index"`
+	UserID    uint   `gorm:"index"` // 0 for client credentials
+	Scopes    string `gorm:"size:1024"`
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	RevokedAt time.Time
+}
+
+// Active reports whether t can still be used at now.
+func (t OAuthToken) Active(now time.Time) bool {
+	return t.ID != 0 && t.RevokedAt.IsZero() && now.Before(t.ExpiresAt)
+}
+
+// HashOAuthToken hashes a client secret, code or token for storage. They
+// are random enough that SHA-256 is as safe as bcrypt, and it lets them be
+// looked up directly.
+func HashOAuthToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// FindOAuthClient returns the client with clientID, or a zero OAuthClient.
+func (udb *UserDB) FindOAuthClient(clientID string) OAuthClient {
+	client := OAuthClient{}
+	if clientID == "" {
+		return client
+	}
+	udb.DB.Where("client_id = ?", clientID).Limit(1).Find(&client)
+	return client
+}
+
+// OAuthClients lists the registered clients, oldest first.
+func (udb *UserDB) OAuthClients() ([]OAuthClient, error) {
+	clients := []OAuthClient{}
+	err := udb.DB.Order("id").Find(&clients).Error
+	return clients, err
+}
+
+func (udb *UserDB) AddOAuthClient(c *OAuthClient) error {
+	return udb.DB.Create(c).Error
+}
+
+// DeleteOAuthClient deletes the client with clientID with its codes and
+// tokens, and reports whether there was one.
+func (udb *UserDB) DeleteOAuthClient(clientID string) (bool, error) {
+	deleted := false
+	err := udb.DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Where("client_id = ?", clientID).Delete(&OAuthClient{})
+		if result.Error != nil {
+			return result.Error
+		}
+		deleted = result.RowsAffected > 0
+		if err := tx.Where("client_id = ?", clientID).Delete(&OAuthCode{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("client_id = ?", clientID).Delete(&OAuthToken{}).Error
+	})
+	return deleted, err
+}
+
+func (udb *UserDB) AddOAuthCode(c *OAuthCode) error {
+	return udb.DB.Create(c).Error
+}
+
+// FindOAuthCode returns the code with hash, used or not, or a zero
+// OAuthCode.
+func (udb *UserDB) FindOAuthCode(hash string) OAuthCode {
+	code := OAuthCode{}
+	udb.DB.Where("hash = ?", hash).Limit(1).Find(&code)
+	return code
+}
+
+// UseOAuthCode marks c as used and reports false if it was used first.
+func (udb *UserDB) UseOAuthCode(c *OAuthCode, now time.Time) (bool, error) {
+	tx := udb.DB.Model(c).Where("used_at = ?", time.Time{}).Update("used_at", now)
+	if tx.Error != nil || tx.RowsAffected == 0 {
+		return false, tx.Error
+	}
+	c.UsedAt = now
+	return true, nil
+}
+
+// AddOAuthTokens stores tokens together, so a client never gets an access
+// token without its refresh token.
+func (udb *UserDB) AddOAuthTokens(tokens ...*OAuthToken) error {
+	return udb.DB.Transaction(func(tx *gorm.DB) error {
+		for _, token := range tokens {
+			if err := tx.Create(token).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// FindOAuthToken returns the token with hash, active or not, or a zero
+// OAuthToken.
+func (udb *UserDB) FindOAuthToken(hash string) OAuthToken {
+	token := OAuthToken{}
+	udb.DB.Where("hash = ?", hash).Limit(1).Find(&token)
+	return token
+}
+
+// RevokeOAuthToken revokes t and reports false if it was revoked first,
+// e.g. by a concurrent refresh.
+func (udb *UserDB) RevokeOAuthToken(t *OAuthToken, now time.Time) (bool, error) {
+	tx := udb.DB.Model(t).Where("revoked_at = ?", time.Time{}).Update("revoked_at", now)
+	if tx.Error != nil || tx.RowsAffected == 0 {
+		return false, tx.Error
+	}
+	t.RevokedAt = now
+	return true, nil
+}
+
+// RevokeOAuthGrant revokes every token of grantID.
+func (udb *UserDB) RevokeOAuthGrant(grantID string, now time.Time) error {
+	return udb.DB.Model(&OAuthToken{}).
+		Where("grant_id = ? AND revoked_at = ?", grantID, time.Time{}).
+		Update("revoked_at", now).Error
+}
+
+// DeleteExpiredOAuth deletes the codes and tokens that expired before
+// now.
+func (udb *UserDB) DeleteExpiredOAuth(now time.Time) error {
+	return udb.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("expires_at < ?", now).Delete(&OAuthCode{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("expires_at < ?", now).Delete(&OAuthToken{}).Error
+	})
+}
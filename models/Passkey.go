@@ -0,0 +1,94 @@
+package models
+
+import (
+	"crypto/rand"
+	"strings"
+	"time"
+)
+
+// Passkey is a WebAuthn credential a user logs in with instead of a
+// password. Only the public key is stored; the private key never leaves the
+// authenticator.
+type Passkey struct {
+	ID              uint      `gorm:"primarykey" json:"id"`
+	UserID          uint      `gorm:"index;not null" json:"-"`
+	Name            string    `gorm:"size:255" json:"name"`
+	CredentialID    []byte    `gorm:"size:1023;uniqueIndex;not null" json:"-"`
+	PublicKey       []byte    `gorm:"not null" json:"-"` // COSE encoded
+	AttestationType string    `gorm:"size:32" json:"-"`
+	Transports      string    `gorm:"size:255" json:"-"` // Comma separated, e.g. "internal,hybrid"
+	AAGUID          []byte    `gorm:"size:16" json:"-"`
+	SignCount       uint32    `json:"-"`
+	BackupEligible  bool      `json:"backupEligible"`
+	BackupState     bool      `json:"backupState"` // Synced to other devices, e.g. by a password manager
+	CreatedAt       time.Time `json:"createdAt"`
+	LastUsedAt      time.Time `json:"lastUsedAt"`
+}
+
+// TransportList returns Transports split into a list.
+func (p *Passkey) TransportList() []string {
+	if p.Transports == "" {
+		return nil
+	}
+	return strings.Split(p.Transports, ",")
+}
+
+// EnsurePasskeyHandle gives u a random user handle if it has none yet. The
+// handle identifies the user to authenticators without revealing the ID or
+// username.
+func (udb *UserDB) EnsurePasskeyHandle(u *User) error {
+	if len(u.PasskeyHandle) > 0 {
+		return nil
+	}
+	handle := make([]byte, 32)
+	if _, err := rand.Read(handle); err != nil {
+		return err
+	}
+	if err := udb.DB.Model(u).Update("passkey_handle", handle).Error; err != nil {
+		return err
+	}
+	u.PasskeyHandle = handle
+	return nil
+}
+
+// FindByPasskeyHandle returns the user with handle, or a zero User.
+func (udb *UserDB) FindByPasskeyHandle(handle []byte) User {
+	user := User{}
+	if len(handle) == 0 {
+		return user
+	}
+	udb.DB.Where("passkey_handle = ?", handle).Limit(1).Find(&user)
+	return user
+}
+
+// Passkeys lists the passkeys of a user, oldest first.
+func (udb *UserDB) Passkeys(userID uint) ([]Passkey, error) {
+	passkeys := []Passkey{}
+	err := udb.DB.Where("user_id = ?", userID).Order("id").Find(&passkeys).Error
+	return passkeys, err
+}
+
+func (udb *UserDB) AddPasskey(p *Passkey) error {
+	return udb.DB.Create(p).Error
+}
+
+// UsePasskey records a login with p: the new signature counter, whether it
+// is backed up now, and when.
+func (udb *UserDB) UsePasskey(p *Passkey, signCount uint32, backupState bool, now time.Time) error {
+	err := udb.DB.Model(p).Updates(map[string]interface{}{
+		"sign_count":   signCount,
+		"backup_state": backupState,
+		"last_used_at": now,
+	}).Error
+	if err == nil {
+		p.SignCount, p.BackupState, p.LastUsedAt = signCount, backupState, now
+	}
+	return err
+}
+
+// DeletePasskey deletes the passkey with id if it belongs to userID, and
+// reports whether there was one.
+func (udb *UserDB) DeletePasskey(userID uint, id uint) (bool, error) {
+	tx := udb.DB.Where("id = ? AND user_id = ?", id, userID).Delete(&Passkey{})
+	return tx.RowsAffected > 0, tx.Error
+}
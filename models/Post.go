@@ -2,19 +2,120 @@ package models
 
 import (
 	"errors"
-	"fmt"
+	"log/slog"
+	"strings"
 	"time"
+
+	"gorm.io/gorm"
 )
 
 type Post struct {
-	ID        uint      `gorm:"primarykey"`
-	CreatedAt time.Time `gorm:"default:CURRENT_TIMESTAMP" json:"createdAt"`
-	UpdatedAt time.Time `gorm:"default:CURRENT_TIMESTAMP" json:"updatedAt"`
-	DeletedAt time.Time `json:"deletedAt"`
-	Slug      string    `gorm:"size:255;not null" json:"slug"`
-	Title     string    `gorm:"size:255;not null" json:"title"`
-	Content   string    `gorm:"size:255;not null" json:"content"`
-	UserID    uint      `gorm:"not null" json:"userID"`
+	ID          uint      `gorm:"primarykey"`
+	CreatedAt   time.Time `gorm:"default:CURRENT_TIMESTAMP" json:"createdAt"`
+	UpdatedAt   time.Time `gorm:"default:CURRENT_TIMESTAMP" json:"updatedAt"`
+	DeletedAt   time.Time `json:"deletedAt"`
+	Slug        string    `gorm:"size:255;not null" json:"slug"`
+	Title       string    `gorm:"size:255;not null" json:"title"`
+	Content     string    `gorm:"size:255;not null" json:"content"`
+	UserID      uint      `gorm:"not null" json:"userID"`
+	Published   bool      `gorm:"default:false" json:"published"`
+	PublishedAt time.Time `json:"publishedAt"`
+	Category    string    `gorm:"size:255" json:"category"`
+	Tags        string    `gorm:"size:255" json:"tags"` // Comma separated
+}
+
+// TagList splits the comma separated Tags field into trimmed, non-empty tags.
+func (p *Post) TagList() []string {
+	tags := []string{}
+	for _, tag := range strings.Split(p.Tags, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// Excerpt returns the start of the content, cut at a word boundary, for use
+// in summaries and meta descriptions.
+func (p *Post) Excerpt(length int) string {
+	content := []rune(strings.Join(strings.Fields(p.Content), " "))
+	if len(content) <= length {
+		return string(content)
+	}
+	cut := strings.LastIndex(string(content[:length]), " ")
+	if cut <= 0 {
+		return string(content[:length]) + "…"
+	}
+	return string(content[:length])[:cut] + "…"
+}
+
+// PostFilter narrows down the published posts returned by ListPublishedPosts.
+// Empty fields are ignored.
+type PostFilter struct {
+	Tag      string
+	Category string
+	Limit    int
+}
+
+// likeEscaper escapes the wildcards of a LIKE pattern, for ESCAPE '\'.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// ListPublishedPosts returns published posts, newest first.
+func ListPublishedPosts(db *gorm.DB, filter PostFilter) ([]Post, error) {
+	posts := []Post{}
+	tx := db.Where("published = ?", true)
+	if filter.Category != "" {
+		tx = tx.Where("LOWER(category) = LOWER(?)", filter.Category)
+	}
+	if filter.Tag != "" {
+		// Tags are stored comma separated, so pad both sides to match whole tags only.
+		// Wildcards in the tag itself are escaped so they match literally.
+		tag := likeEscaper.Replace(strings.ToLower(strings.ReplaceAll(filter.Tag, " ", "")))
+		tx = tx.Where(
+			`',' || LOWER(REPLACE(tags, ' ', '')) || ',' LIKE ? ESCAPE '\'`,
+			"%,"+tag+",%",
+		)
+	}
+	tx = tx.Order("published_at DESC")
+	if filter.Limit > 0 {
+		tx = tx.Limit(filter.Limit)
+	}
+	tx = tx.Find(&posts)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	return posts, nil
+}
+
+// BeforeCreate dates a post created as published.
+func (p *Post) BeforeCreate(tx *gorm.DB) error {
+	if p.Published && p.PublishedAt.IsZero() {
+		p.PublishedAt = time.Now()
+	}
+	return nil
+}
+
+// BeforeUpdate dates a post when it is first published, and keeps the
+// stored date when an update leaves it out, so feeds keep their order. p
+// holds the stored post and tx the update.
+func (p *Post) BeforeUpdate(tx *gorm.DB) error {
+	update, ok := tx.Statement.Dest.(*Post)
+	if !ok || !update.PublishedAt.IsZero() {
+		return nil
+	}
+	switch {
+	case !p.PublishedAt.IsZero():
+		tx.Statement.SetColumn("PublishedAt", p.PublishedAt)
+	case update.Published:
+		tx.Statement.SetColumn("PublishedAt", time.Now())
+	}
+	return nil
+}
+
+// MappedColumns are the columns PostJSONMapper sets.
+func (Post) MappedColumns() []string {
+	return []string{"slug", "title", "content", "user_id", "published", "published_at", "category", "tags"}
 }
 
 func PostJSONMapper(data map[string]interface{}) (Post, error) {
@@ -27,15 +128,32 @@ func PostJSONMapper(data map[string]interface{}) (Post, error) {
 	oks := []bool{IDOK, TitleOK, SlugOK, ContentOK, UserIDOK}
 
 	if !IDOK || !TitleOK || !SlugOK || !ContentOK || !UserIDOK {
-		fmt.Printf("invalid data: %+v\n", oks)
+		slog.Debug("invalid data", "fields", oks)
 		return Post{}, errors.New("invalid data")
 	}
 
+	// Optional fields
+	parsedPublished, _ := data["published"].(bool)
+	parsedCategory, _ := data["category"].(string)
+	parsedTags, _ := data["tags"].(string)
+	var parsedPublishedAt time.Time
+	if publishedAt, ok := data["publishedAt"].(string); ok && publishedAt != "" {
+		t, err := time.Parse(time.RFC3339, publishedAt)
+		if err != nil {
+			return Post{}, errors.New("invalid publishedAt")
+		}
+		parsedPublishedAt = t
+	}
+
 	return Post{
-		ID:      uint(parsedID),
-		Title:   parsedTitle,
-		Slug:    parsedSlug,
-		Content: parsedContent,
-		UserID:  uint(parsedUserID),
+		ID:          uint(parsedID),
+		Title:       parsedTitle,
+		Slug:        parsedSlug,
+		Content:     parsedContent,
+		UserID:      uint(parsedUserID),
+		Published:   parsedPublished,
+		PublishedAt: parsedPublishedAt,
+		Category:    parsedCategory,
+		Tags:        parsedTags,
 	}, nil
 }
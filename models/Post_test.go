@@ -0,0 +1,101 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"pioneerwebworks.com/juniper/cors"
+)
+
+func Test_ListPublishedPosts(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	db.AutoMigrate(&Post{})
+
+	now := time.Now()
+	db.Create(&Post{Title: "Draft", Slug: "draft", Content: "draft", UserID: 1, Tags: "go"})
+	db.Create(&Post{Title: "Old", Slug: "old", Content: "old", UserID: 1, Published: true, PublishedAt: now.Add(-time.Hour), Category: "News", Tags: "go, templ"})
+	db.Create(&Post{Title: "New", Slug: "new", Content: "new", UserID: 1, Published: true, PublishedAt: now, Tags: "gopher"})
+
+	posts, err := ListPublishedPosts(db, PostFilter{})
+	if err != nil {
+		t.Fatalf("Failed to list posts: %v", err)
+	}
+	if len(posts) != 2 || posts[0].Title != "New" {
+		t.Errorf("Expected 2 published posts, newest first, got %+v", posts)
+	}
+
+	posts, _ = ListPublishedPosts(db, PostFilter{Tag: "go"})
+	if len(posts) != 1 || posts[0].Title != "Old" {
+		t.Errorf("Expected only whole tag matches for 'go', got %+v", posts)
+	}
+
+	db.Create(&Post{Title: "Underscore", Slug: "underscore", Content: "u", UserID: 1, Published: true, PublishedAt: now, Tags: "go_lang"})
+	db.Create(&Post{Title: "Letter", Slug: "letter", Content: "l", UserID: 1, Published: true, PublishedAt: now, Tags: "goxlang"})
+	posts, _ = ListPublishedPosts(db, PostFilter{Tag: "go_lang"})
+	if len(posts) != 1 || posts[0].Title != "Underscore" {
+		t.Errorf("Expected _ in a tag to match literally, got %+v", posts)
+	}
+	if posts, _ = ListPublishedPosts(db, PostFilter{Tag: "%"}); len(posts) != 0 {
+		t.Errorf("Expected %% in a tag to match literally, got %+v", posts)
+	}
+
+	posts, _ = ListPublishedPosts(db, PostFilter{Category: "news"})
+	if len(posts) != 1 || posts[0].Title != "Old" {
+		t.Errorf("Expected category match to be case insensitive, got %+v", posts)
+	}
+}
+
+func Test_PublishedAt(t *testing.T) {
+	mux := http.NewServeMux()
+	NewModelHandler[Post](
+		&Post{},
+		PostJSONMapper,
+		filepath.Join(t.TempDir(), "post.db"),
+		&gorm.Config{},
+		mux,
+		context.Background(),
+		cors.Options{},
+	)
+	send := func(method, path, body string) Post {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200 for %s %s, got %d: %s", method, path, w.Code, w.Body.String())
+		}
+		var post Post
+		json.Unmarshal(w.Body.Bytes(), &post)
+		return post
+	}
+
+	draft := send("POST", "/api/v1/Posts/", `{"id": 0, "title": "Hello", "slug": "hello", "content": "c", "userID": 1}`)
+	if !draft.PublishedAt.IsZero() {
+		t.Errorf("Expected a draft to have no publish date, got %v", draft.PublishedAt)
+	}
+	published := send("PUT", "/api/v1/Posts/1", `{"id": 1, "title": "Hello", "slug": "hello", "content": "c", "userID": 1, "published": true}`)
+	if published.PublishedAt.IsZero() {
+		t.Fatalf("Expected publishing to date the post")
+	}
+	edited := send("PUT", "/api/v1/Posts/1", `{"id": 1, "title": "Hello again", "slug": "hello", "content": "c", "userID": 1, "published": true}`)
+	if !edited.PublishedAt.Equal(published.PublishedAt) {
+		t.Errorf("Expected an edit to keep the publish date %v, got %v", published.PublishedAt, edited.PublishedAt)
+	}
+	dated := send("PUT", "/api/v1/Posts/1", `{"id": 1, "title": "Hello", "slug": "hello", "content": "c", "userID": 1, "published": true, "publishedAt": "2024-01-01T00:00:00Z"}`)
+	if !dated.PublishedAt.Equal(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected an explicit publish date to be kept, got %v", dated.PublishedAt)
+	}
+	created := send("POST", "/api/v1/Posts/", `{"id": 0, "title": "Now", "slug": "now", "content": "c", "userID": 1, "published": true}`)
+	if created.PublishedAt.IsZero() {
+		t.Errorf("Expected a post created as published to be dated")
+	}
+}
@@ -0,0 +1,85 @@
+package models
+
+import (
+	"strings"
+	"time"
+)
+
+// Session is a login kept server side. The cookie only holds the signed ID,
+// so deleting the row logs the device out.
+type Session struct {
+	ID         string    `gorm:"primarykey;size:64" json:"id"`
+	UserID     uint      `gorm:"index" json:"userId"` // 0 until someone logs in
+	Data       []byte    `json:"-"`
+	IPAddress  string    `gorm:"size:64" json:"ipAddress"`
+	UserAgent  string    `gorm:"size:512" json:"userAgent"`
+	CreatedAt  time.Time `json:"createdAt"`
+	LastSeenAt time.Time `json:"lastSeenAt"`
+	ExpiresAt  time.Time `gorm:"index" json:"expiresAt"`
+}
+
+// Device describes the browser and operating system from the user agent,
+// e.g. "Firefox on Linux".
+func (s *Session) Device() string {
+	ua := s.UserAgent
+	browser := "Unknown browser"
+	for _, candidate := range []struct{ token, name string }{
+		// Order matters: Edge and Opera also claim to be Chrome, Chrome
+		// claims to be Safari.
+		{"Edg/", "Edge"},
+		{"OPR/", "Opera"},
+		{"Firefox/", "Firefox"},
+		{"Chrome/", "Chrome"},
+		{"Safari/", "Safari"},
+		{"curl/", "curl"},
+	} {
+		if strings.Contains(ua, candidate.token) {
+			browser = candidate.name
+			break
+		}
+	}
+	for _, candidate := range []struct{ token, name string }{
+		{"Android", "Android"},
+		{"iPhone", "iOS"},
+		{"iPad", "iPadOS"},
+		{"Windows", "Windows"},
+		{"Mac OS X", "macOS"},
+		{"Linux", "Linux"},
+	} {
+		if strings.Contains(ua, candidate.token) {
+			return browser + " on " + candidate.name
+		}
+	}
+	return browser
+}
+
+// ActiveSessions lists the sessions of a user that are still valid at now,
+// most recently used first.
+func (udb *UserDB) ActiveSessions(userID uint, now time.Time, idleTimeout time.Duration) ([]Session, error) {
+	sessions := []Session{}
+	err := udb.DB.
+		Where("user_id = ? AND expires_at > ? AND last_seen_at > ?", userID, now, now.Add(-idleTimeout)).
+		Order("last_seen_at DESC").
+		Find(&sessions).Error
+	return sessions, err
+}
+
+// RevokeSession deletes the session with id if it belongs to userID, and
+// reports whether there was one.
+func (udb *UserDB) RevokeSession(userID uint, id string) (bool, error) {
+	tx := udb.DB.Where("id = ? AND user_id = ?", id, userID).Delete(&Session{})
+	return tx.RowsAffected > 0, tx.Error
+}
+
+// RevokeSessions deletes every session of userID except exceptID, which may
+// be empty, and returns how many were deleted.
+func (udb *UserDB) RevokeSessions(userID uint, exceptID string) (int64, error) {
+	tx := udb.DB.Where("user_id = ? AND id <> ?", userID, exceptID).Delete(&Session{})
+	return tx.RowsAffected, tx.Error
+}
+
+// DeleteExpiredSessions deletes sessions that expired or went idle by now.
+func (udb *UserDB) DeleteExpiredSessions(now time.Time, idleTimeout time.Duration) (int64, error) {
+	tx := udb.DB.Where("expires_at <= ? OR last_seen_at <= ?", now, now.Add(-idleTimeout)).Delete(&Session{})
+	return tx.RowsAffected, tx.Error
+}
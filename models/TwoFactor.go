@@ -0,0 +1,117 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// RecoveryCode is a single-use code that stands in for a TOTP code when the
+// authenticator is lost. Codes are random enough that a SHA-256 hash is as
+// safe to store as bcrypt, and it lets a code be looked up directly.
+type RecoveryCode struct {
+	ID        uint   `gorm:"primarykey"`
+	UserID    uint   `gorm:"index;not null"`
+	Hash      string `gorm:"size:64;not null"`
+	CreatedAt time.Time
+	UsedAt    time.Time
+}
+
+// HashRecoveryCode hashes code, ignoring case, spaces and dashes.
+func HashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
+
+// EnableTOTP turns on two-factor authentication for u with secret, marking
+// step as used, and replaces the recovery codes with codes.
+func (udb *UserDB) EnableTOTP(u *User, secret string, step int64, codes []string) error {
+	err := udb.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(u).Updates(map[string]interface{}{
+			"totp_secret":    secret,
+			"totp_enabled":   true,
+			"totp_last_step": step,
+		}).Error
+		if err != nil {
+			return err
+		}
+		return replaceRecoveryCodes(tx, u.ID, codes)
+	})
+	if err == nil {
+		u.TOTPSecret, u.TOTPEnabled, u.TOTPLastStep = secret, true, step
+	}
+	return err
+}
+
+// DisableTOTP turns off two-factor authentication for u and deletes the
+// recovery codes.
+func (udb *UserDB) DisableTOTP(u *User) error {
+	err := udb.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(u).Updates(map[string]interface{}{
+			"totp_secret":    "",
+			"totp_enabled":   false,
+			"totp_last_step": 0,
+		}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Where("user_id = ?", u.ID).Delete(&RecoveryCode{}).Error
+	})
+	if err == nil {
+		u.TOTPSecret, u.TOTPEnabled, u.TOTPLastStep = "", false, 0
+	}
+	return err
+}
+
+// UseTOTPStep records that a code of step was used, and reports false if a
+// code of that step or a later one was used first.
+func (udb *UserDB) UseTOTPStep(u *User, step int64) (bool, error) {
+	tx := udb.DB.Model(u).Where("totp_last_step < ?", step).Update("totp_last_step", step)
+	if tx.Error != nil || tx.RowsAffected == 0 {
+		return false, tx.Error
+	}
+	u.TOTPLastStep = step
+	return true, nil
+}
+
+// ReplaceRecoveryCodes deletes the recovery codes of a user and stores the
+// hashes of codes instead.
+func (udb *UserDB) ReplaceRecoveryCodes(userID uint, codes []string) error {
+	return udb.DB.Transaction(func(tx *gorm.DB) error {
+		return replaceRecoveryCodes(tx, userID, codes)
+	})
+}
+
+func replaceRecoveryCodes(tx *gorm.DB, userID uint, codes []string) error {
+	if err := tx.Where("user_id = ?", userID).Delete(&RecoveryCode{}).Error; err != nil {
+		return err
+	}
+	if len(codes) == 0 {
+		return nil
+	}
+	rows := make([]RecoveryCode, len(codes))
+	for i, code := range codes {
+		rows[i] = RecoveryCode{UserID: userID, Hash: HashRecoveryCode(code)}
+	}
+	return tx.Create(&rows).Error
+}
+
+// UseRecoveryCode marks code as used and reports whether it was an unused
+// code of the user.
+func (udb *UserDB) UseRecoveryCode(userID uint, code string, now time.Time) (bool, error) {
+	tx := udb.DB.Model(&RecoveryCode{}).
+		Where("user_id = ? AND hash = ? AND used_at = ?", userID, HashRecoveryCode(code), time.Time{}).
+		Update("used_at", now)
+	return tx.RowsAffected > 0, tx.Error
+}
+
+// RemainingRecoveryCodes counts the unused recovery codes of a user.
+func (udb *UserDB) RemainingRecoveryCodes(userID uint) (int64, error) {
+	var count int64
+	err := udb.DB.Model(&RecoveryCode{}).Where("user_id = ? AND used_at = ?", userID, time.Time{}).Count(&count).Error
+	return count, err
+}
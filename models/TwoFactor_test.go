@@ -0,0 +1,53 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func Test_TwoFactor(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	db.AutoMigrate(&User{}, &RecoveryCode{})
+	userDB := UserDB{DB: db}
+	user := User{Username: "alice", Email: "alice@example.com"}
+	userDB.CreateUser(&user)
+
+	if err := userDB.EnableTOTP(&user, "JBSWY3DPEHPK3PXP", 100, []string{"aaaaa-bbbbb", "ccccc-ddddd"}); err != nil {
+		t.Fatalf("Failed to enable TOTP: %v", err)
+	}
+	stored, _ := userDB.GetUser(user.ID)
+	if !stored.TOTPEnabled || stored.TOTPSecret != "JBSWY3DPEHPK3PXP" {
+		t.Errorf("Expected TOTP to be enabled, got %+v", stored)
+	}
+
+	if ok, _ := userDB.UseTOTPStep(&user, 100); ok {
+		t.Errorf("Expected the step used during enrollment to be refused")
+	}
+	if ok, _ := userDB.UseTOTPStep(&user, 101); !ok || user.TOTPLastStep != 101 {
+		t.Errorf("Expected a later step to be accepted")
+	}
+
+	now := time.Now()
+	if ok, _ := userDB.UseRecoveryCode(user.ID, "AAAAA BBBBB", now); !ok {
+		t.Errorf("Expected a recovery code to be accepted regardless of case and spacing")
+	}
+	if ok, _ := userDB.UseRecoveryCode(user.ID, "aaaaa-bbbbb", now); ok {
+		t.Errorf("Expected a used recovery code to be refused")
+	}
+	if remaining, _ := userDB.RemainingRecoveryCodes(user.ID); remaining != 1 {
+		t.Errorf("Expected one recovery code left, got %d", remaining)
+	}
+
+	if err := userDB.DisableTOTP(&user); err != nil {
+		t.Fatalf("Failed to disable TOTP: %v", err)
+	}
+	if ok, _ := userDB.UseRecoveryCode(user.ID, "ccccc-ddddd", now); ok {
+		t.Errorf("Expected recovery codes to be deleted with TOTP")
+	}
+}
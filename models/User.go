@@ -1,13 +1,17 @@
 package models
 
 import (
+	"context"
 	"errors"
-	"fmt"
+	"log/slog"
+	"sync"
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
+	"pioneerwebworks.com/juniper/metrics"
+	"pioneerwebworks.com/juniper/tracing"
 )
 
 type User struct {
@@ -16,17 +20,31 @@ type User struct {
 	UpdatedAt     time.Time `gorm:"default:CURRENT_TIMESTAMP" json:"updatedAt"`
 	DeletedAt     time.Time `json:"deletedAt"`
 	Username      string    `gorm:"size:255;not null" json:"username"`
-	Password      string    `gorm:"size:255;not null" json:"password"`
+	Password      string    `gorm:"size:255;not null" json:"-"`
 	Email         string    `gorm:"size:255;not null;unique" json:"email"`
 	LastLoginAt   time.Time `gorm:"default:CURRENT_TIMESTAMP" json:"lastLoginAt"`
 	Forename      string    `gorm:"size:255;not null" json:"forename"`
 	Surname       string    `gorm:"size:255;not null" json:"surname"`
 	Birthdate     time.Time `gorm:"not null" json:"birthdate"`
-	EmailToken    string    `gorm:"size:255" json:"emailToken"`
+	EmailToken    string    `gorm:"size:255" json:"-"`
 	EmailVerified bool      `gorm:"default:false" json:"emailVerified"`
 	PhoneNumber   string    `gorm:"size:255;not null" json:"phoneNumber"`
 	PhoneVerified bool      `gorm:"default:false" json:"phoneVerified"`
 	UserRole      string    `gorm:"size:255;not null" json:"userRole"`
+	FailedLogins  int       `gorm:"default:0" json:"-"` // In a row, reset by a successful login
+	LockedUntil   time.Time `json:"-"`
+	TOTPSecret    string    `gorm:"size:64" json:"-"`
+	TOTPEnabled   bool      `gorm:"default:false" json:"totpEnabled"`
+	TOTPLastStep  int64     `gorm:"default:0" json:"-"`     // Time step of the last code used, so codes cannot be replayed
+	PasskeyHandle []byte    `gorm:"size:64;index" json:"-"` // Random WebAuthn user handle, set with the first passkey
+}
+
+// MappedColumns are the columns UserJSONMapper sets.
+func (User) MappedColumns() []string {
+	return []string{
+		"username", "password", "email", "last_login_at", "forename", "surname", "birthdate",
+		"email_token", "email_verified", "phone_number", "phone_verified", "user_role",
+	}
 }
 
 func UserJSONMapper(data map[string]interface{}) (User, error) {
@@ -47,7 +65,7 @@ func UserJSONMapper(data map[string]interface{}) (User, error) {
 	oks := []bool{IDOK, UsernameOK, PasswordOK, EmailOK, LastLoginAtOK, ForenameOK, SurnameOK, BirthdateOK, EmailTokenOK, EmailVerifiedOK, PhoneNumberOK, PhoneVerifiedOK, UserRoleOK}
 
 	if !IDOK || !UsernameOK || !PasswordOK || !EmailOK || !LastLoginAtOK || !ForenameOK || !SurnameOK || !BirthdateOK || !EmailTokenOK || !EmailVerifiedOK || !PhoneNumberOK || !PhoneVerifiedOK || !UserRoleOK {
-		fmt.Printf("invalid data: %+v\n", oks)
+		slog.Debug("invalid data", "fields", oks)
 		return User{}, errors.New("invalid data")
 	}
 
@@ -72,12 +90,47 @@ type UserDB struct {
 	DB *gorm.DB
 }
 
+var (
+	userDB     *gorm.DB
+	userDBOnce sync.Once
+)
+
+// ConnectToUserDB returns a handle on the shared user database connection,
+// opening it on first use.
 func ConnectToUserDB() UserDB {
-	user_db, err := gorm.Open(sqlite.Open("database/user.db"), &gorm.Config{})
+	userDBOnce.Do(func() {
+		user_db, err := gorm.Open(sqlite.Open("database/user.db"), &gorm.Config{})
+		if err != nil {
+			panic("failed to connect database")
+		}
+		err = errors.Join(
+			metrics.InstrumentDB(user_db, "user"),
+			tracing.InstrumentDB(user_db, "user"),
+		)
+		if err != nil {
+			panic("failed to instrument database")
+		}
+		userDB = user_db
+	})
+	return UserDB{DB: userDB}
+}
+
+// WithContext returns a UserDB whose queries run with ctx, so they show up
+// in the request trace.
+func (udb UserDB) WithContext(ctx context.Context) UserDB {
+	return UserDB{DB: udb.DB.WithContext(ctx)}
+}
+
+// CloseUserDB closes the shared user database connection, if it was opened.
+func CloseUserDB() error {
+	if userDB == nil {
+		return nil
+	}
+	sqlDB, err := userDB.DB()
 	if err != nil {
-		panic("failed to connect database")
+		return err
 	}
-	return UserDB{DB: user_db}
+	return sqlDB.Close()
 }
 
 func (udb *UserDB) CreateUser(u *User) (uint, error) {
@@ -121,6 +174,62 @@ func (udb *UserDB) FindByUsername(username string) User {
 	return u
 }
 
+// LockoutPolicy decides when failed logins lock an account.
+type LockoutPolicy struct {
+	Threshold int           // Failed logins in a row that lock the account, 0 disables locking
+	Duration  time.Duration // First lock, doubled for every further lock up to a day
+}
+
+func (p LockoutPolicy) lockFor(failures int) time.Duration {
+	duration := p.Duration
+	for locks := failures / p.Threshold; locks > 1 && duration < 24*time.Hour; locks-- {
+		duration *= 2
+	}
+	return min(duration, 24*time.Hour)
+}
+
+// IsLocked reports whether failed logins have locked the account at now.
+func (u *User) IsLocked(now time.Time) bool {
+	return now.Before(u.LockedUntil)
+}
+
+// LoginDelay is how long to hold back the answer to a failed login, growing
+// with the failures in a row: 250ms, 500ms, 1s, 2s, then 4s.
+func LoginDelay(failures int) time.Duration {
+	if failures <= 0 {
+		return 0
+	}
+	return 250 * time.Millisecond << min(failures-1, 4)
+}
+
+// RecordFailedLogin counts a failed login for u and locks the account every
+// policy.Threshold failures in a row.
+func (udb *UserDB) RecordFailedLogin(u *User, policy LockoutPolicy, now time.Time) error {
+	u.FailedLogins++
+	if policy.Threshold > 0 && u.FailedLogins%policy.Threshold == 0 {
+		u.LockedUntil = now.Add(policy.lockFor(u.FailedLogins))
+	}
+	return udb.DB.Model(u).Updates(map[string]interface{}{
+		"failed_logins": u.FailedLogins,
+		"locked_until":  u.LockedUntil,
+	}).Error
+}
+
+// Unlock clears the failed logins and any lock on the user with id.
+func (udb *UserDB) Unlock(id uint) (User, error) {
+	u, err := udb.GetUser(id)
+	if err != nil {
+		return u, err
+	}
+	u.FailedLogins = 0
+	u.LockedUntil = time.Time{}
+	err = udb.DB.Model(&u).Updates(map[string]interface{}{
+		"failed_logins": 0,
+		"locked_until":  time.Time{},
+	}).Error
+	return u, err
+}
+
 func HashPassword(password string) (string, error) {
 	bytes, err := bcrypt.GenerateFromPassword(
 		[]byte(password),
@@ -141,9 +250,10 @@ func (u *User) CheckPassword(password string) bool {
 	) == nil
 }
 
-func HashEmailToken(email string) (string, error) {
+// HashEmailToken hashes the token mailed out for email verification.
+func HashEmailToken(token string) (string, error) {
 	bytes, err := bcrypt.GenerateFromPassword(
-		[]byte(email),
+		[]byte(token),
 		bcrypt.DefaultCost,
 	)
 	if err != nil {
@@ -160,3 +270,20 @@ func (u *User) CheckEmailToken(token string) bool {
 		[]byte(token),
 	) == nil
 }
+
+// VerifyEmail marks the user's email address as verified if token is the
+// one mailed to them. The token is cleared so it cannot be used again.
+func (udb *UserDB) VerifyEmail(u *User, token string) (bool, error) {
+	if u.ID == 0 || !u.CheckEmailToken(token) {
+		return false, nil
+	}
+	tx := udb.DB.Model(u).Updates(map[string]interface{}{
+		"email_verified": true,
+		"email_token":    "",
+	})
+	if tx.Error != nil {
+		return false, tx.Error
+	}
+	u.EmailVerified, u.EmailToken = true, ""
+	return true, nil
+}
@@ -2,8 +2,11 @@ package models
 
 import (
 	"testing"
+	"time"
 
 	"golang.org/x/crypto/bcrypt"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
 )
 
 func Test_Hashpassword(t *testing.T) {
@@ -37,3 +40,82 @@ func Test_Hashpassword(t *testing.T) {
 		t.Errorf("Failed to verify second hashed password: %v", err)
 	}
 }
+
+func Test_Lockout(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	db.AutoMigrate(&User{})
+	userDB := UserDB{DB: db}
+	user := User{Username: "alice", Email: "alice@example.com"}
+	userDB.CreateUser(&user)
+
+	policy := LockoutPolicy{Threshold: 3, Duration: time.Minute}
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		userDB.RecordFailedLogin(&user, policy, now)
+	}
+	if user.IsLocked(now) {
+		t.Errorf("Expected no lock before the threshold")
+	}
+	userDB.RecordFailedLogin(&user, policy, now)
+	if !user.IsLocked(now) || user.LockedUntil != now.Add(time.Minute) {
+		t.Errorf("Expected a one minute lock at the threshold, got %v", user.LockedUntil)
+	}
+
+	// The next lock lasts twice as long.
+	for i := 0; i < 3; i++ {
+		userDB.RecordFailedLogin(&user, policy, now)
+	}
+	if user.LockedUntil != now.Add(2*time.Minute) {
+		t.Errorf("Expected a two minute lock, got %v", user.LockedUntil.Sub(now))
+	}
+
+	stored, _ := userDB.GetUser(user.ID)
+	if stored.FailedLogins != 6 || !stored.IsLocked(now) {
+		t.Errorf("Expected the lockout to be stored, got %d failures until %v", stored.FailedLogins, stored.LockedUntil)
+	}
+
+	unlocked, err := userDB.Unlock(user.ID)
+	if err != nil || unlocked.FailedLogins != 0 || unlocked.IsLocked(now) {
+		t.Errorf("Failed to unlock: %v %+v", err, unlocked)
+	}
+	stored, _ = userDB.GetUser(user.ID)
+	if stored.FailedLogins != 0 || stored.IsLocked(now) {
+		t.Errorf("Expected the unlock to be stored, got %+v", stored)
+	}
+
+	if LoginDelay(1) != 250*time.Millisecond || LoginDelay(3) != time.Second || LoginDelay(20) != 4*time.Second {
+		t.Errorf("Unexpected login delays %v %v %v", LoginDelay(1), LoginDelay(3), LoginDelay(20))
+	}
+}
+
+func Test_VerifyEmail(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	db.AutoMigrate(&User{})
+	userDB := UserDB{DB: db}
+	hashedToken, err := HashEmailToken("mailed-token")
+	if err != nil {
+		t.Fatalf("Failed to hash token: %v", err)
+	}
+	user := User{Username: "alice", Email: "alice@example.com", EmailToken: hashedToken}
+	userDB.CreateUser(&user)
+
+	if ok, _ := userDB.VerifyEmail(&user, "alice@example.com"); ok {
+		t.Errorf("Expected the email address not to verify")
+	}
+	if ok, err := userDB.VerifyEmail(&user, "mailed-token"); !ok || err != nil {
+		t.Fatalf("Failed to verify with the mailed token: %v", err)
+	}
+	stored, _ := userDB.GetUser(user.ID)
+	if !stored.EmailVerified || stored.EmailToken != "" {
+		t.Errorf("Expected a verified email and a cleared token, got %+v", stored)
+	}
+	if ok, _ := userDB.VerifyEmail(&stored, "mailed-token"); ok {
+		t.Errorf("Expected the token to work only once")
+	}
+}
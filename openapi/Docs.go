@@ -0,0 +1,24 @@
+package openapi
+
+import (
+	_ "embed"
+	"html/template"
+	"net/http"
+)
+
+//go:embed docs.html
+var docsHTML string
+
+var docsTemplate = template.Must(template.New("docs").Parse(docsHTML))
+
+// Docs serves a self-contained page that renders the document at specURL.
+// It loads nothing from outside the site, so it also works offline.
+func Docs(title, specURL string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		docsTemplate.Execute(w, struct {
+			Title   string
+			SpecURL string
+		}{title, specURL})
+	})
+}
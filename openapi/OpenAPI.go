@@ -0,0 +1,283 @@
+package openapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Version is the OpenAPI version documents are written against.
+const Version = "3.1.0"
+
+// SessionCookie is the security scheme for routes that need a logged in
+// user, matching the cookie set by the auth package.
+const SessionCookie = "sessionCookie"
+
+// OAuth2 is the security scheme for bearer tokens from the OAuth2 server,
+// added to a document by AddOAuth2.
+const OAuth2 = "oauth2"
+
+// Document is an OpenAPI document. Only the parts Juniper uses are modelled.
+type Document struct {
+	OpenAPI    string               `json:"openapi"`
+	Info       Info                 `json:"info"`
+	Paths      map[string]*PathItem `json:"paths"`
+	Components Components           `json:"components"`
+}
+
+type Info struct {
+	Title       string `json:"title"`
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
+}
+
+// PathItem maps lower case HTTP methods to operations.
+type PathItem map[string]*Operation
+
+type Operation struct {
+	OperationID string                `json:"operationId,omitempty"`
+	Summary     string                `json:"summary,omitempty"`
+	Description string                `json:"description,omitempty"`
+	Tags        []string              `json:"tags,omitempty"`
+	Parameters  []Parameter           `json:"parameters,omitempty"`
+	RequestBody *RequestBody          `json:"requestBody,omitempty"`
+	Responses   map[string]*Response  `json:"responses"`
+	Security    []SecurityRequirement `json:"security,omitempty"`
+	Deprecated  bool                  `json:"deprecated,omitempty"`
+}
+
+type Parameter struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"` // "path", "query", "header" or "cookie"
+	Description string  `json:"description,omitempty"`
+	Required    bool    `json:"required,omitempty"`
+	Schema      *Schema `json:"schema,omitempty"`
+}
+
+type RequestBody struct {
+	Description string               `json:"description,omitempty"`
+	Required    bool                 `json:"required,omitempty"`
+	Content     map[string]MediaType `json:"content"`
+}
+
+type Response struct {
+	Ref         string               `json:"$ref,omitempty"`
+	Description string               `json:"description,omitempty"`
+	Content     map[string]MediaType `json:"content,omitempty"`
+}
+
+type MediaType struct {
+	Schema *Schema `json:"schema,omitempty"`
+}
+
+// SecurityRequirement maps security scheme names to the scopes needed.
+type SecurityRequirement map[string][]string
+
+type SecurityScheme struct {
+	Type        string      `json:"type"`
+	In          string      `json:"in,omitempty"`
+	Name        string      `json:"name,omitempty"`
+	Description string      `json:"description,omitempty"`
+	Flows       *OAuthFlows `json:"flows,omitempty"`
+}
+
+type OAuthFlows struct {
+	AuthorizationCode *OAuthFlow `json:"authorizationCode,omitempty"`
+	ClientCredentials *OAuthFlow `json:"clientCredentials,omitempty"`
+}
+
+type OAuthFlow struct {
+	AuthorizationURL string            `json:"authorizationUrl,omitempty"`
+	TokenURL         string            `json:"tokenUrl"`
+	RefreshURL       string            `json:"refreshUrl,omitempty"`
+	Scopes           map[string]string `json:"scopes"`
+}
+
+type Components struct {
+	Schemas         map[string]*Schema        `json:"schemas"`
+	Responses       map[string]*Response      `json:"responses"`
+	SecuritySchemes map[string]SecurityScheme `json:"securitySchemes"`
+}
+
+// New creates a document with the error format written by apperr.WriteJSON
+// and the session cookie security scheme already in its components.
+func New(title, version string) *Document {
+	doc := &Document{
+		OpenAPI: Version,
+		Info:    Info{Title: title, Version: version},
+		Paths:   map[string]*PathItem{},
+		Components: Components{
+			Schemas:   map[string]*Schema{"Error": errorSchema()},
+			Responses: map[string]*Response{},
+			SecuritySchemes: map[string]SecurityScheme{
+				SessionCookie: {
+					Type:        "apiKey",
+					In:          "cookie",
+					Name:        "juniper-session",
+					Description: "Session cookie set by POST /api/auth/login.",
+				},
+			},
+		},
+	}
+	for _, status := range []int{
+		http.StatusBadRequest,
+		http.StatusUnauthorized,
+		http.StatusForbidden,
+		http.StatusNotFound,
+		http.StatusConflict,
+		http.StatusUnprocessableEntity,
+		http.StatusLocked,
+		http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+	} {
+		doc.Components.Responses[responseName(status)] = &Response{
+			Description: http.StatusText(status),
+			Content:     JSON(Ref("Error")),
+		}
+	}
+	return doc
+}
+
+// errorSchema describes the envelope written by apperr.WriteJSON.
+func errorSchema() *Schema {
+	return &Schema{
+		Type:     "object",
+		Required: []string{"error"},
+		Properties: map[string]*Schema{
+			"error": {
+				Type:     "object",
+				Required: []string{"status", "code", "message"},
+				Properties: map[string]*Schema{
+					"status":    {Type: "integer"},
+					"code":      {Type: "string", Description: `Machine readable, e.g. "not_found".`},
+					"message":   {Type: "string"},
+					"details":   {Type: "object", AdditionalProperties: &Schema{Type: "string"}, Description: "Per-field problems for validation errors."},
+					"requestId": {Type: "string"},
+				},
+			},
+		},
+	}
+}
+
+func responseName(status int) string {
+	return strings.ReplaceAll(http.StatusText(status), " ", "")
+}
+
+// Error returns a reference to the shared response for an error status.
+func Error(status int) *Response {
+	return &Response{Ref: "#/components/responses/" + responseName(status)}
+}
+
+// JSON returns content holding schema as application/json.
+func JSON(schema *Schema) map[string]MediaType {
+	return map[string]MediaType{"application/json": {Schema: schema}}
+}
+
+// Body returns a required JSON request body.
+func Body(schema *Schema) *RequestBody {
+	return &RequestBody{Required: true, Content: JSON(schema)}
+}
+
+// Session is the security requirement for routes behind the session cookie.
+func Session() []SecurityRequirement {
+	return []SecurityRequirement{{SessionCookie: {}}}
+}
+
+// Scoped is the security requirement for routes that take a bearer token
+// granting scope, or else the session cookie.
+func Scoped(scope string) []SecurityRequirement {
+	return []SecurityRequirement{{SessionCookie: {}}, {OAuth2: {scope}}}
+}
+
+// AddOAuth2 adds the OAuth2 security scheme, with the authorization code
+// and client credentials flows of the endpoints at authorizationURL and
+// tokenURL, and scopes with their descriptions.
+func (doc *Document) AddOAuth2(authorizationURL, tokenURL string, scopes map[string]string) {
+	doc.Components.SecuritySchemes[OAuth2] = SecurityScheme{
+		Type:        "oauth2",
+		Description: "Access tokens of registered clients, sent as Authorization: Bearer.",
+		Flows: &OAuthFlows{
+			AuthorizationCode: &OAuthFlow{
+				AuthorizationURL: authorizationURL,
+				TokenURL:         tokenURL,
+				RefreshURL:       tokenURL,
+				Scopes:           scopes,
+			},
+			ClientCredentials: &OAuthFlow{
+				TokenURL: tokenURL,
+				Scopes:   scopes,
+			},
+		},
+	}
+}
+
+// Model registers the schema for v under components, named name, and returns
+// a reference to it.
+func (doc *Document) Model(name string, v any) *Schema {
+	if _, ok := doc.Components.Schemas[name]; !ok {
+		doc.Components.Schemas[name] = SchemaOf(v)
+	}
+	return Ref(name)
+}
+
+var pathParam = regexp.MustCompile(`\{([^}.]+)(\.\.\.)?\}`)
+
+// Add documents op at path, which may be a ServeMux pattern like
+// "/api/Posts/{slug}". Path parameters that op does not declare are added
+// as required strings.
+func (doc *Document) Add(method, path string, op *Operation) {
+	for _, match := range pathParam.FindAllStringSubmatch(path, -1) {
+		declared := false
+		for _, param := range op.Parameters {
+			if param.In == "path" && param.Name == match[1] {
+				declared = true
+			}
+		}
+		if !declared {
+			op.Parameters = append(op.Parameters, Parameter{
+				Name:     match[1],
+				In:       "path",
+				Required: true,
+				Schema:   &Schema{Type: "string"},
+			})
+		}
+	}
+	path = pathParam.ReplaceAllString(path, "{$1}")
+
+	if op.Responses == nil {
+		op.Responses = map[string]*Response{}
+	}
+	item, ok := doc.Paths[path]
+	if !ok {
+		item = &PathItem{}
+		doc.Paths[path] = item
+	}
+	(*item)[strings.ToLower(method)] = op
+}
+
+// Operations returns the documented "METHOD path" pairs, sorted.
+func (doc *Document) Operations() []string {
+	operations := []string{}
+	for path, item := range doc.Paths {
+		for method := range *item {
+			operations = append(operations, strings.ToUpper(method)+" "+path)
+		}
+	}
+	sort.Strings(operations)
+	return operations
+}
+
+// ServeHTTP serves the document as JSON.
+func (doc *Document) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	out, err := json.Marshal(doc)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(out)))
+	w.Write(out)
+}
@@ -0,0 +1,104 @@
+package openapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testModel struct {
+	ID        uint      `gorm:"primarykey"`
+	CreatedAt time.Time `json:"createdAt"`
+	Title     string    `json:"title"`
+	Tags      []string  `json:"tags,omitempty"`
+	Secret    string    `json:"-"`
+	Parent    *testModel
+	internal  int
+}
+
+func Test_SchemaOf(t *testing.T) {
+	schema := SchemaOf(testModel{})
+	if schema.Type != "object" {
+		t.Fatalf("Expected an object, got %q", schema.Type)
+	}
+
+	names := []string{}
+	for name := range schema.Properties {
+		names = append(names, name)
+	}
+	for _, name := range []string{"ID", "createdAt", "title", "tags", "Parent"} {
+		if schema.Properties[name] == nil {
+			t.Errorf("Missing property %q in %v", name, names)
+		}
+	}
+	if len(schema.Properties) != 5 {
+		t.Errorf("Expected 5 properties, got %v", names)
+	}
+
+	if created := schema.Properties["createdAt"]; created.Type != "string" || created.Format != "date-time" {
+		t.Errorf("Failed to describe time.Time: %+v", created)
+	}
+	if tags := schema.Properties["tags"]; tags.Type != "array" || tags.Items.Type != "string" {
+		t.Errorf("Failed to describe []string: %+v", tags)
+	}
+	if parent := schema.Properties["Parent"]; parent.Type != "object" || parent.Properties != nil {
+		t.Errorf("Expected the recursive field to be left open, got %+v", parent)
+	}
+	if want := []string{"ID", "createdAt", "title"}; !reflect.DeepEqual(schema.Required, want) {
+		t.Errorf("Expected required %v, got %v", want, schema.Required)
+	}
+}
+
+func Test_Document(t *testing.T) {
+	doc := New("Test", "1.0.0")
+	model := doc.Model("TestModel", testModel{})
+	doc.Add("GET", "/api/tests/{slug}", &Operation{
+		Security: Session(),
+		Responses: map[string]*Response{
+			"200": {Description: "OK", Content: JSON(model)},
+			"404": Error(http.StatusNotFound),
+		},
+	})
+	doc.Add("GET", "/api/files/{path...}", &Operation{})
+
+	if want := []string{"GET /api/files/{path}", "GET /api/tests/{slug}"}; !reflect.DeepEqual(doc.Operations(), want) {
+		t.Errorf("Expected operations %v, got %v", want, doc.Operations())
+	}
+	op := (*doc.Paths["/api/tests/{slug}"])["get"]
+	if len(op.Parameters) != 1 || op.Parameters[0].Name != "slug" || !op.Parameters[0].Required {
+		t.Errorf("Failed to add the path parameter: %+v", op.Parameters)
+	}
+
+	w := httptest.NewRecorder()
+	doc.ServeHTTP(w, httptest.NewRequest("GET", "/api/openapi.json", nil))
+	var served map[string]any
+	if err := json.NewDecoder(w.Body).Decode(&served); err != nil {
+		t.Fatalf("Failed to decode document: %v", err)
+	}
+	if served["openapi"] != Version {
+		t.Errorf("Expected openapi %q, got %v", Version, served["openapi"])
+	}
+
+	// Every reference must resolve within the document.
+	out, _ := json.Marshal(doc)
+	for _, ref := range strings.Split(string(out), `"$ref":"#/components/`)[1:] {
+		kind, rest, _ := strings.Cut(ref, "/")
+		name, _, _ := strings.Cut(rest, `"`)
+		components := served["components"].(map[string]any)[kind].(map[string]any)
+		if components[name] == nil {
+			t.Errorf("Unresolved reference to %s/%s", kind, name)
+		}
+	}
+}
+
+func Test_Docs(t *testing.T) {
+	w := httptest.NewRecorder()
+	Docs("Test API", "/api/openapi.json").ServeHTTP(w, httptest.NewRequest("GET", "/api/docs", nil))
+	if !strings.Contains(w.Body.String(), `const specURL = "/api/openapi.json"`) {
+		t.Errorf("Failed to render the spec URL into the docs page")
+	}
+}
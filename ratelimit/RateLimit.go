@@ -0,0 +1,161 @@
+package ratelimit
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"pioneerwebworks.com/juniper/apperr"
+)
+
+// Limit is a token bucket holding Burst tokens that refills completely over
+// Period. A zero Burst or Period disables the limit.
+type Limit struct {
+	Burst  int
+	Period time.Duration
+}
+
+func (l Limit) disabled() bool {
+	return l.Burst <= 0 || l.Period <= 0
+}
+
+type Result struct {
+	Allowed    bool
+	Remaining  int
+	RetryAfter time.Duration // Until the next token, when not allowed
+}
+
+// Store keeps the buckets. MemoryStore is enough for a single instance;
+// instances behind a load balancer need a Store on shared storage so they
+// count together.
+type Store interface {
+	// Take removes a token from the bucket for key, if there is one.
+	Take(ctx context.Context, key string, limit Limit) (Result, error)
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	limit   Limit
+}
+
+// MemoryStore keeps buckets in memory. Full buckets are dropped now and then
+// so the map does not grow with every client ever seen.
+type MemoryStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		buckets: map[string]*bucket{},
+		now:     time.Now,
+	}
+}
+
+func (s *MemoryStore) Take(ctx context.Context, key string, limit Limit) (Result, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	if now.Sub(s.lastSweep) > time.Minute {
+		s.sweep(now)
+	}
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Burst), updated: now}
+		s.buckets[key] = b
+	}
+	b.limit = limit
+	b.refill(now)
+
+	if b.tokens < 1 {
+		perToken := limit.Period / time.Duration(limit.Burst)
+		wait := time.Duration((1 - b.tokens) * float64(perToken))
+		return Result{Allowed: false, RetryAfter: wait}, nil
+	}
+	b.tokens--
+	return Result{Allowed: true, Remaining: int(b.tokens)}, nil
+}
+
+func (b *bucket) refill(now time.Time) {
+	elapsed := now.Sub(b.updated)
+	b.updated = now
+	b.tokens = math.Min(
+		float64(b.limit.Burst),
+		b.tokens+elapsed.Seconds()*float64(b.limit.Burst)/b.limit.Period.Seconds(),
+	)
+}
+
+func (s *MemoryStore) sweep(now time.Time) {
+	s.lastSweep = now
+	for key, b := range s.buckets {
+		b.refill(now)
+		if b.tokens >= float64(b.limit.Burst) {
+			delete(s.buckets, key)
+		}
+	}
+}
+
+// Limiter applies one limit to keys in its own namespace of a Store.
+type Limiter struct {
+	store  Store
+	prefix string
+	limit  Limit
+}
+
+func New(store Store, prefix string, limit Limit) *Limiter {
+	return &Limiter{store: store, prefix: prefix, limit: limit}
+}
+
+// Allow takes a token for key. When the store fails the request is allowed,
+// so an outage of a shared store does not lock everyone out.
+func (l *Limiter) Allow(ctx context.Context, key string) Result {
+	if l.limit.disabled() {
+		return Result{Allowed: true, Remaining: math.MaxInt}
+	}
+	result, err := l.store.Take(ctx, l.prefix+":"+key, l.limit)
+	if err != nil {
+		slog.ErrorContext(ctx, "rate limit store failed", "limiter", l.prefix, "error", err)
+		return Result{Allowed: true}
+	}
+	return result
+}
+
+// Error returns the 429 error for a refused request and sets Retry-After.
+func Error(w http.ResponseWriter, result Result) *apperr.AppError {
+	seconds := int(math.Ceil(result.RetryAfter.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(max(seconds, 1)))
+	return apperr.New(http.StatusTooManyRequests, "Too many requests, please try again later")
+}
+
+// Middleware refuses requests once the bucket for key(r) is empty.
+func Middleware(limiter *Limiter, key func(*http.Request) string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			result := limiter.Allow(r.Context(), key(r))
+			if !result.Allowed {
+				apperr.WriteJSON(w, r, Error(w, result))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// ClientIP returns the IP address the request came from.
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,73 @@
+package ratelimit
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_MemoryStore(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	store := NewMemoryStore()
+	store.now = func() time.Time { return now }
+	limiter := New(store, "login", Limit{Burst: 3, Period: 3 * time.Minute})
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		if result := limiter.Allow(ctx, "alice"); !result.Allowed || result.Remaining != 2-i {
+			t.Errorf("Expected request %d to be allowed, got %+v", i+1, result)
+		}
+	}
+	result := limiter.Allow(ctx, "alice")
+	if result.Allowed || result.RetryAfter != time.Minute {
+		t.Errorf("Expected the fourth request to wait a minute, got %+v", result)
+	}
+	if !limiter.Allow(ctx, "bob").Allowed {
+		t.Errorf("Expected keys to have separate buckets")
+	}
+
+	now = now.Add(time.Minute)
+	if !limiter.Allow(ctx, "alice").Allowed {
+		t.Errorf("Expected a token to be back after a minute")
+	}
+	if limiter.Allow(ctx, "alice").Allowed {
+		t.Errorf("Expected only one token to be back after a minute")
+	}
+
+	// Full buckets are swept.
+	now = now.Add(time.Hour)
+	limiter.Allow(ctx, "carol")
+	if len(store.buckets) != 1 {
+		t.Errorf("Expected full buckets to be dropped, got %d buckets", len(store.buckets))
+	}
+
+	if disabled := New(store, "off", Limit{}); !disabled.Allow(ctx, "alice").Allowed {
+		t.Errorf("Expected a zero limit to allow everything")
+	}
+}
+
+func Test_Middleware(t *testing.T) {
+	limiter := New(NewMemoryStore(), "test", Limit{Burst: 1, Period: time.Minute})
+	handler := Middleware(limiter, ClientIP)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	serve := func(remoteAddr string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/api/auth/login", nil)
+		r.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := serve("192.0.2.1:1234"); w.Code != http.StatusOK {
+		t.Errorf("Expected the first request to pass, got %d", w.Code)
+	}
+	w := serve("192.0.2.1:5678")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "60" {
+		t.Errorf("Expected 429 with Retry-After for the same IP, got %d %v", w.Code, w.Header())
+	}
+	if w := serve("192.0.2.2:1234"); w.Code != http.StatusOK {
+		t.Errorf("Expected another IP to pass, got %d", w.Code)
+	}
+}
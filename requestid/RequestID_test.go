@@ -0,0 +1,38 @@
+package requestid
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_Middleware(t *testing.T) {
+	var seen string
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = FromContext(r.Context())
+	}))
+
+	tests := []struct {
+		incoming string
+		keep     bool
+	}{
+		{"", false},
+		{"edge-1234.abc_DEF", true},
+		{"bad id\nwith newline", false},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		if test.incoming != "" {
+			r.Header.Set(Header, test.incoming)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if seen == "" || w.Header().Get(Header) != seen {
+			t.Errorf("Expected the response header to match the context ID %q, got %q", seen, w.Header().Get(Header))
+		}
+		if test.keep != (seen == test.incoming) {
+			t.Errorf("Unexpected ID %q for incoming %q", seen, test.incoming)
+		}
+	}
+}
@@ -1,8 +1,16 @@
 package main
 
 import (
+	"context"
+	"net"
 	"net/smtp"
 	"strconv"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"pioneerwebworks.com/juniper/metrics"
+	"pioneerwebworks.com/juniper/tracing"
 )
 
 type Email struct {
@@ -13,7 +21,7 @@ type Email struct {
 }
 
 type Emailer interface {
-	Send(email Email) error
+	Send(ctx context.Context, email Email) error
 	Initialize(username, password string, host string) error
 }
 
@@ -29,7 +37,40 @@ func (m *Mailer) Initialize(username, password, host string) {
 	m.Auth = smtp.PlainAuth("", username, password, host)
 }
 
-func (m *Mailer) Send(email Email) error {
+// Ping connects to the SMTP server and checks that it answers a NOOP,
+// without sending mail.
+func (m *Mailer) Ping(ctx context.Context) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(m.Host, strconv.Itoa(m.Port)))
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	client, err := smtp.NewClient(conn, m.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+	if err := client.Noop(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+func (m *Mailer) Send(ctx context.Context, email Email) error {
+	_, span := tracing.Tracer().Start(ctx, "smtp.send",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("server.address", m.Host),
+			attribute.Int("server.port", m.Port),
+			attribute.Int("mail.recipients", len(email.To)),
+		),
+	)
+	defer span.End()
+
 	err := smtp.SendMail(
 		m.Host+":"+strconv.Itoa(m.Port),
 		m.Auth,
@@ -37,7 +78,10 @@ func (m *Mailer) Send(email Email) error {
 		email.To,
 		[]byte(email.Body),
 	)
+	metrics.ObserveMail(err)
 	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "send failed")
 		return err
 	}
 
@@ -0,0 +1,63 @@
+package totp
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_Code(t *testing.T) {
+	// RFC 6238 appendix B, SHA1, truncated to six digits.
+	secret := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+	for _, test := range []struct {
+		unix     int64
+		expected string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	} {
+		code, err := Code(secret, Step(time.Unix(test.unix, 0)))
+		if err != nil || code != test.expected {
+			t.Errorf("Code at %d = %q, %v, expected %q", test.unix, code, err, test.expected)
+		}
+	}
+}
+
+func Test_Validate(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatalf("Failed to generate a secret: %v", err)
+	}
+	now := time.Unix(1700000000, 0)
+	previous, _ := Code(secret, Step(now)-1)
+	current, _ := Code(secret, Step(now))
+
+	step, ok := Validate(secret, previous, now, 0)
+	if !ok || step != Step(now)-1 {
+		t.Errorf("Expected the code of the previous step to be accepted")
+	}
+	if _, ok := Validate(secret, previous, now, step); ok {
+		t.Errorf("Expected a used code to be refused")
+	}
+	if _, ok := Validate(secret, current[:3]+" "+current[3:], now, step); !ok {
+		t.Errorf("Expected a code with a space to be accepted")
+	}
+	if _, ok := Validate(secret, current, now.Add(2*Period), 0); ok {
+		t.Errorf("Expected a code two steps old to be refused")
+	}
+}
+
+func Test_QRCode(t *testing.T) {
+	uri := URI("Juniper", "alice@example.com", "JBSWY3DPEHPK3PXP")
+	if uri != "otpauth://totp/Juniper:alice@example.com?issuer=Juniper&secret=JBSWY3DPEHPK3PXP" {
+		t.Errorf("Unexpected URI %q", uri)
+	}
+	image, err := QRCode(uri)
+	if err != nil || !strings.HasPrefix(image, "data:image/png;base64,") {
+		t.Errorf("Failed to render the QR code: %v", err)
+	}
+}
@@ -0,0 +1,56 @@
+package tracing
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func Test_RequestAndQuerySpans(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	Install(exporter)
+
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	if err := InstrumentDB(db, "test"); err != nil {
+		t.Fatalf("Failed to instrument database: %v", err)
+	}
+	type Item struct {
+		ID uint
+	}
+	db.AutoMigrate(&Item{})
+	exporter.Reset()
+
+	handler := Middleware(func(r *http.Request) string {
+		return "GET /items/{id}"
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var item Item
+		db.WithContext(r.Context()).First(&item, 1)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+
+	r := httptest.NewRequest("GET", "/items/1", nil)
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	spans := exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("Expected a query and a request span, got %d", len(spans))
+	}
+	query, request := spans[0], spans[1]
+	if request.Name != "GET /items/{id}" || query.Name != "db.query" {
+		t.Errorf("Unexpected span names %q and %q", request.Name, query.Name)
+	}
+	if request.SpanContext.TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("Expected the incoming trace to be continued, got %s", request.SpanContext.TraceID())
+	}
+	if query.Parent.SpanID() != request.SpanContext.SpanID() {
+		t.Errorf("Expected the query span to be a child of the request span")
+	}
+}